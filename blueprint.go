@@ -69,7 +69,8 @@ var (
 
 // DBModuleListItem is a single module that is locally scoped to a blueprint
 type DBModuleListItem struct {
-	ModuleID uuid.UUID   `json:"id"`
-	Name     string      `json:"name"`
-	Graph    GraphModule `json:"graph"`
+	ModuleID uuid.UUID     `json:"id"`
+	Name     string        `json:"name"`
+	Graph    GraphModule   `json:"graph"`
+	Source   *ModuleSource `json:"source,omitempty"` // Set if the module was imported from a package
 }
@@ -0,0 +1,556 @@
+package ctypes
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Names of the parts of a node or link that are diffed and merged separately
+const (
+	DiffFieldDefinition = "definition" // Everything except the layout and the config
+	DiffFieldLayout     = "layout"
+	DiffFieldConfig     = "config"
+	DiffFieldName       = "name" // Modules only
+)
+
+// NodeChange is a node that exists on both sides of a diff but differs
+type NodeChange struct {
+	ID     uuid.UUID `json:"id"`
+	From   GraphNode `json:"from"`
+	To     GraphNode `json:"to"`
+	Fields []string  `json:"fields"` // One or more of the DiffField constants
+}
+
+// LinkChange is a link that exists on both sides of a diff but differs
+type LinkChange struct {
+	ID     uuid.UUID `json:"id"`
+	From   GraphLink `json:"from"`
+	To     GraphLink `json:"to"`
+	Fields []string  `json:"fields"`
+}
+
+// ModuleDiff describes how a module present on both sides of a diff changed
+type ModuleDiff struct {
+	ModuleID uuid.UUID `json:"module_id"`
+	Renamed  bool      `json:"renamed"`
+
+	AddedNodes   []GraphNode  `json:"added_nodes"`
+	RemovedNodes []uuid.UUID  `json:"removed_nodes"`
+	ChangedNodes []NodeChange `json:"changed_nodes"`
+
+	AddedLinks   []GraphLink  `json:"added_links"`
+	RemovedLinks []uuid.UUID  `json:"removed_links"`
+	ChangedLinks []LinkChange `json:"changed_links"`
+}
+
+// Empty is true if the module did not change
+func (d *ModuleDiff) Empty() bool {
+	return !d.Renamed &&
+		len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.ChangedNodes) == 0 &&
+		len(d.AddedLinks) == 0 && len(d.RemovedLinks) == 0 && len(d.ChangedLinks) == 0
+}
+
+// ModuleListDiff is the structural difference between two versions of a blueprint's modules
+// Operations turns the first version into the second when applied with ApplyDeltaToModuleList
+// The Source of imported modules is not part of the diff, as there is no operation that changes it
+type ModuleListDiff struct {
+	AddedModules   []uuid.UUID     `json:"added_modules"`
+	RemovedModules []uuid.UUID     `json:"removed_modules"`
+	ChangedModules []ModuleDiff    `json:"changed_modules"`
+	Operations     DeltaOperations `json:"operations"`
+}
+
+// Empty is true if both module lists are equivalent
+func (d *ModuleListDiff) Empty() bool {
+	return len(d.AddedModules) == 0 && len(d.RemovedModules) == 0 && len(d.ChangedModules) == 0
+}
+
+// DiffModuleLists compares two module lists
+// Operations are ordered so they can be applied one by one: new modules first, then for every changed module
+// link and node deletions, creations and updates, and deleted modules last
+func DiffModuleLists(from, to DBModuleList) *ModuleListDiff {
+	diff := &ModuleListDiff{
+		AddedModules:   []uuid.UUID{},
+		RemovedModules: []uuid.UUID{},
+		ChangedModules: []ModuleDiff{},
+		Operations:     DeltaOperations{},
+	}
+
+	for _, id := range sortedModuleIDs(to) {
+		if _, ok := from[id]; ok {
+			continue
+		}
+
+		item := to[id]
+		diff.AddedModules = append(diff.AddedModules, id)
+		diff.Operations = append(diff.Operations, createModuleOperations(&item)...)
+	}
+
+	for _, id := range sortedModuleIDs(from) {
+		toItem, ok := to[id]
+		if !ok {
+			continue
+		}
+
+		fromItem := from[id]
+
+		md, ops := diffModule(&fromItem, &toItem)
+		if md.Empty() {
+			continue
+		}
+
+		diff.ChangedModules = append(diff.ChangedModules, *md)
+		diff.Operations = append(diff.Operations, ops...)
+	}
+
+	for _, id := range sortedModuleIDs(from) {
+		if _, ok := to[id]; ok {
+			continue
+		}
+
+		diff.RemovedModules = append(diff.RemovedModules, id)
+		diff.Operations = append(diff.Operations, DeltaOperation{
+			Type:         DODeleteModule,
+			DeleteModule: &DeltaDeleteModule{ID: id},
+		})
+	}
+
+	return diff
+}
+
+func createModuleOperations(item *DBModuleListItem) []DeltaOperation {
+	moduleID := item.ModuleID
+
+	ops := []DeltaOperation{{
+		Type:         DOCreateModule,
+		CreateModule: &DeltaCreateModule{ID: moduleID, Name: item.Name},
+	}}
+
+	for _, id := range sortedNodeIDs(item.Graph.Nodes) {
+		node := DeltaCreateNode(item.Graph.Nodes[id])
+		ops = append(ops, DeltaOperation{ModuleID: &moduleID, Type: DOCreateNode, CreateNode: &node})
+	}
+
+	for _, l := range sortedLinks(item.Graph.Links) {
+		link := DeltaCreateLink(l)
+		ops = append(ops, DeltaOperation{ModuleID: &moduleID, Type: DOCreateLink, CreateLink: &link})
+	}
+
+	return ops
+}
+
+func diffModule(from, to *DBModuleListItem) (*ModuleDiff, []DeltaOperation) {
+	moduleID := to.ModuleID
+
+	md := &ModuleDiff{
+		ModuleID:     moduleID,
+		Renamed:      from.Name != to.Name,
+		AddedNodes:   []GraphNode{},
+		RemovedNodes: []uuid.UUID{},
+		ChangedNodes: []NodeChange{},
+		AddedLinks:   []GraphLink{},
+		RemovedLinks: []uuid.UUID{},
+		ChangedLinks: []LinkChange{},
+	}
+
+	var deletes, creates, updates []DeltaOperation
+
+	op := func(o DeltaOperation) DeltaOperation {
+		o.ModuleID = &moduleID
+		return o
+	}
+
+	if md.Renamed {
+		updates = append(updates, op(DeltaOperation{Type: DOUpdateModule, UpdateModule: &DeltaUpdateModule{Name: to.Name}}))
+	}
+
+	fromLinks := linksByID(from.Graph.Links)
+	toLinks := linksByID(to.Graph.Links)
+
+	for _, l := range sortedLinks(from.Graph.Links) {
+		if _, ok := toLinks[l.ID]; !ok {
+			md.RemovedLinks = append(md.RemovedLinks, l.ID)
+			deletes = append(deletes, op(DeltaOperation{Type: DODeleteLink, DeleteLink: &DeltaDeleteLink{ID: l.ID}}))
+		}
+	}
+
+	for _, id := range sortedNodeIDs(from.Graph.Nodes) {
+		if _, ok := to.Graph.Nodes[id]; !ok {
+			md.RemovedNodes = append(md.RemovedNodes, id)
+			deletes = append(deletes, op(DeltaOperation{Type: DODeleteNode, DeleteNode: &DeltaDeleteNode{ID: id}}))
+		}
+	}
+
+	for _, id := range sortedNodeIDs(to.Graph.Nodes) {
+		toNode := to.Graph.Nodes[id]
+
+		fromNode, ok := from.Graph.Nodes[id]
+		if !ok {
+			node := DeltaCreateNode(toNode)
+			md.AddedNodes = append(md.AddedNodes, toNode)
+			creates = append(creates, op(DeltaOperation{Type: DOCreateNode, CreateNode: &node}))
+
+			continue
+		}
+
+		fields := nodeChangedFields(&fromNode, &toNode)
+		if len(fields) == 0 {
+			continue
+		}
+
+		md.ChangedNodes = append(md.ChangedNodes, NodeChange{ID: id, From: fromNode, To: toNode, Fields: fields})
+
+		// Fields that are removed cannot be expressed as an update, so the node is replaced instead.
+		// Links refer to nodes by id, so they are unaffected
+		if nodeNeedsReplacing(&fromNode, &toNode) {
+			node := DeltaCreateNode(toNode)
+			deletes = append(deletes, op(DeltaOperation{Type: DODeleteNode, DeleteNode: &DeltaDeleteNode{ID: id}}))
+			creates = append(creates, op(DeltaOperation{Type: DOCreateNode, CreateNode: &node}))
+
+			continue
+		}
+
+		for _, o := range nodeUpdateOperations(&fromNode, &toNode, fields) {
+			updates = append(updates, op(o))
+		}
+	}
+
+	for _, toLink := range sortedLinks(to.Graph.Links) {
+		fromLink, ok := fromLinks[toLink.ID]
+		if !ok {
+			link := DeltaCreateLink(toLink)
+			md.AddedLinks = append(md.AddedLinks, toLink)
+			creates = append(creates, op(DeltaOperation{Type: DOCreateLink, CreateLink: &link}))
+
+			continue
+		}
+
+		fields := linkChangedFields(&fromLink, &toLink)
+		if len(fields) == 0 {
+			continue
+		}
+
+		md.ChangedLinks = append(md.ChangedLinks, LinkChange{ID: toLink.ID, From: fromLink, To: toLink, Fields: fields})
+
+		for _, o := range linkUpdateOperations(&fromLink, &toLink, fields) {
+			updates = append(updates, op(o))
+		}
+	}
+
+	ops := append(deletes, creates...)
+
+	return md, append(ops, updates...)
+}
+
+func nodeDefinition(n GraphNode) GraphNode {
+	n.Layout = Point{}
+	n.ConfigJSON = nil
+
+	return n
+}
+
+func linkDefinition(l GraphLink) GraphLink {
+	l.A.Position = Point{}
+	l.B.Position = Point{}
+	l.ConfigJSON = ""
+
+	return l
+}
+
+func nodeChangedFields(from, to *GraphNode) []string {
+	var fields []string
+
+	if !reflect.DeepEqual(nodeDefinition(*from), nodeDefinition(*to)) {
+		fields = append(fields, DiffFieldDefinition)
+	}
+
+	if from.Layout != to.Layout {
+		fields = append(fields, DiffFieldLayout)
+	}
+
+	if !reflect.DeepEqual(from.ConfigJSON, to.ConfigJSON) {
+		fields = append(fields, DiffFieldConfig)
+	}
+
+	return fields
+}
+
+func linkChangedFields(from, to *GraphLink) []string {
+	var fields []string
+
+	if !reflect.DeepEqual(linkDefinition(*from), linkDefinition(*to)) {
+		fields = append(fields, DiffFieldDefinition)
+	}
+
+	if from.A.Position != to.A.Position || from.B.Position != to.B.Position {
+		fields = append(fields, DiffFieldLayout)
+	}
+
+	if from.ConfigJSON != to.ConfigJSON {
+		fields = append(fields, DiffFieldConfig)
+	}
+
+	return fields
+}
+
+// nodeNeedsReplacing is true if a pointer field of the node is cleared, which DOUpdateNode cannot do
+func nodeNeedsReplacing(from, to *GraphNode) bool {
+	return from.TypeID != nil && to.TypeID == nil ||
+		from.Version != nil && to.Version == nil ||
+		from.ConfigJSON != nil && to.ConfigJSON == nil ||
+		from.ModuleID != nil && to.ModuleID == nil ||
+		from.ModuleVersion != nil && to.ModuleVersion == nil ||
+		from.EventTypeID != nil && to.EventTypeID == nil
+}
+
+func nodeUpdateOperations(from, to *GraphNode, fields []string) []DeltaOperation {
+	var ops []DeltaOperation
+
+	if StringSliceContains(fields, DiffFieldDefinition) {
+		update := &DeltaUpdateNode{ID: to.ID}
+
+		if from.Label != to.Label {
+			update.Label = &to.Label
+		}
+
+		if from.PackageID != to.PackageID {
+			update.PackageID = &to.PackageID
+		}
+
+		if !reflect.DeepEqual(from.TypeID, to.TypeID) {
+			update.TypeID = to.TypeID
+		}
+
+		if !reflect.DeepEqual(from.Version, to.Version) {
+			update.Version = to.Version
+		}
+
+		if !reflect.DeepEqual(from.ModuleID, to.ModuleID) {
+			update.ModuleID = to.ModuleID
+		}
+
+		if !reflect.DeepEqual(from.ModuleVersion, to.ModuleVersion) {
+			update.ModuleVersion = to.ModuleVersion
+		}
+
+		if !reflect.DeepEqual(from.EventTypeID, to.EventTypeID) {
+			update.EventTypeID = to.EventTypeID
+		}
+
+		ops = append(ops, DeltaOperation{Type: DOUpdateNode, UpdateNode: update})
+	}
+
+	if StringSliceContains(fields, DiffFieldLayout) {
+		ops = append(ops, DeltaOperation{Type: DOMoveNode, MoveNode: &DeltaMoveNode{ID: to.ID, Pos: to.Layout}})
+	}
+
+	if StringSliceContains(fields, DiffFieldConfig) {
+		ops = append(ops, DeltaOperation{
+			Type:                    DOUpdateNodePackageConfig,
+			UpdateNodePackageConfig: &DeltaUpdateNodePackageConfig{ID: to.ID, Config: *to.ConfigJSON},
+		})
+	}
+
+	return ops
+}
+
+func linkUpdateOperations(from, to *GraphLink, fields []string) []DeltaOperation {
+	var ops []DeltaOperation
+
+	// Endpoints are updated as a whole, which also moves them
+	endpointsChanged := false
+
+	if StringSliceContains(fields, DiffFieldDefinition) {
+		update := &DeltaUpdateLink{ID: to.ID}
+
+		if from.Label != to.Label {
+			update.Label = &to.Label
+		}
+
+		if from.PackageID != to.PackageID {
+			update.PackageID = &to.PackageID
+		}
+
+		if from.TypeID != to.TypeID {
+			update.TypeID = &to.TypeID
+		}
+
+		if from.Version != to.Version {
+			update.Version = &to.Version
+		}
+
+		if from.Priority != to.Priority {
+			update.Priority = &to.Priority
+		}
+
+		if !reflect.DeepEqual(from.A, to.A) {
+			update.A = &to.A
+		}
+
+		if !reflect.DeepEqual(from.B, to.B) {
+			update.B = &to.B
+		}
+
+		endpointsChanged = update.A != nil || update.B != nil
+
+		ops = append(ops, DeltaOperation{Type: DOUpdateLink, UpdateLink: update})
+	}
+
+	if StringSliceContains(fields, DiffFieldLayout) && !endpointsChanged {
+		ops = append(ops, DeltaOperation{
+			Type:     DOMoveLink,
+			MoveLink: &DeltaMoveLink{ID: to.ID, A: to.A.Position, B: to.B.Position},
+		})
+	}
+
+	if StringSliceContains(fields, DiffFieldConfig) {
+		ops = append(ops, DeltaOperation{
+			Type:                    DOUpdateLinkPackageConfig,
+			UpdateLinkPackageConfig: &DeltaUpdateLinkPackageConfig{ID: to.ID, Config: to.ConfigJSON},
+		})
+	}
+
+	return ops
+}
+
+func sortedModuleIDs(modules DBModuleList) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(modules))
+	for id := range modules {
+		ids = append(ids, id)
+	}
+
+	sortUUIDs(ids)
+
+	return ids
+}
+
+func sortedNodeIDs(nodes map[uuid.UUID]GraphNode) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+
+	sortUUIDs(ids)
+
+	return ids
+}
+
+func sortUUIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+}
+
+func sortedLinks(links []GraphLink) []GraphLink {
+	sorted := append([]GraphLink{}, links...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID.String() < sorted[j].ID.String() })
+
+	return sorted
+}
+
+func linksByID(links []GraphLink) map[uuid.UUID]GraphLink {
+	byID := make(map[uuid.UUID]GraphLink, len(links))
+	for _, l := range links {
+		byID[l.ID] = l
+	}
+
+	return byID
+}
+
+var ErrModuleNotFound = errors.New("module does not exist")
+
+// ApplyDeltaToModuleList applies operations that may create, delete or change modules
+func ApplyDeltaToModuleList(modules *DBModuleList, operations DeltaOperations) error {
+	for _, op := range operations {
+		err := ApplyOperationToModuleList(modules, &op)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyOperationToModuleList applies a single operation to a module list
+// Module operations are handled here, node and link operations are passed on to ApplyOperationToModule
+// Operations that do not concern modules are ignored
+func ApplyOperationToModuleList(modules *DBModuleList, operation *DeltaOperation) error {
+	if *modules == nil {
+		*modules = DBModuleList{}
+	}
+
+	switch operation.Type {
+	case DOCreateModule:
+		id := operation.CreateModule.ID
+
+		if _, exists := (*modules)[id]; exists {
+			return fmt.Errorf("could not create module %s because it already exists", id)
+		}
+
+		(*modules)[id] = DBModuleListItem{
+			ModuleID: id,
+			Name:     operation.CreateModule.Name,
+			Graph: GraphModule{
+				ID:    id,
+				Label: operation.CreateModule.Name,
+				Nodes: map[uuid.UUID]GraphNode{},
+				Links: []GraphLink{},
+			},
+		}
+
+	case DODeleteModule:
+		if _, exists := (*modules)[operation.DeleteModule.ID]; !exists {
+			return fmt.Errorf("%w: %s", ErrModuleNotFound, operation.DeleteModule.ID)
+		}
+
+		delete(*modules, operation.DeleteModule.ID)
+
+	case DOUpdateModule:
+		item, ok := (*modules)[*operation.ModuleID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrModuleNotFound, *operation.ModuleID)
+		}
+
+		item.Name = operation.UpdateModule.Name
+		(*modules)[item.ModuleID] = item
+
+	case DOMoveNode, DOMoveLink, DOCreateNode, DOCreateLink, DODeleteNode, DODeleteLink,
+		DOUpdateNode, DOUpdateLink, DOUpdateNodePackageConfig, DOUpdateLinkPackageConfig:
+		item, ok := (*modules)[*operation.ModuleID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrModuleNotFound, *operation.ModuleID)
+		}
+
+		if err := ApplyOperationToModule(&item.Graph, operation); err != nil {
+			return err
+		}
+
+		(*modules)[item.ModuleID] = item
+	}
+
+	return nil
+}
+
+// Copy returns a copy of the module list whose graphs can be changed without affecting the original
+func (l DBModuleList) Copy() DBModuleList {
+	if l == nil {
+		return nil
+	}
+
+	c := make(DBModuleList, len(l))
+
+	for id, item := range l {
+		nodes := make(map[uuid.UUID]GraphNode, len(item.Graph.Nodes))
+		for nid, n := range item.Graph.Nodes {
+			nodes[nid] = n
+		}
+
+		item.Graph.Nodes = nodes
+		item.Graph.Links = append([]GraphLink{}, item.Graph.Links...)
+		c[id] = item
+	}
+
+	return c
+}
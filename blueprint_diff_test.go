@@ -0,0 +1,265 @@
+package ctypes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDiffModuleLists(t *testing.T) {
+	moduleID, a, b, linkID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	typeID, version, sendConfig := "send", "1.0.0", `{"text":"hi"}`
+
+	from := DBModuleList{moduleID: {
+		ModuleID: moduleID,
+		Name:     "main",
+		Graph: GraphModule{
+			ID:    moduleID,
+			Label: "main",
+			Nodes: map[uuid.UUID]GraphNode{
+				a: {ID: a, Label: "a", TypeID: &typeID, Version: &version, ConfigJSON: &sendConfig},
+				b: {ID: b, Label: "b", TypeID: &typeID, Version: &version, Layout: Point{X: 100}},
+			},
+			Links: []GraphLink{{
+				ID:         linkID,
+				TypeID:     "always",
+				Version:    "0.1.0",
+				ConfigJSON: "{}",
+				A:          LinkPoint{NodeID: &a, IsOutput: true},
+				B:          LinkPoint{NodeID: &b, Position: Point{X: 100}},
+			}},
+		},
+	}}
+	to := from.Copy()
+
+	item := to[moduleID]
+	item.Name = "renamed"
+
+	nodeA := item.Graph.Nodes[a]
+	label, config := "changed", `{"text":"bye"}`
+	nodeA.Label, nodeA.ConfigJSON, nodeA.Layout = label, &config, Point{X: 5, Y: 5}
+	item.Graph.Nodes[a] = nodeA
+
+	nodeB := item.Graph.Nodes[b]
+	nodeB.Version = nil
+	item.Graph.Nodes[b] = nodeB
+
+	c := uuid.Must(uuid.NewRandom())
+	item.Graph.Nodes[c] = GraphNode{ID: c, Label: "c"}
+
+	item.Graph.Links[0].A.Position = Point{X: 10}
+	item.Graph.Links[0].Priority = 2
+	to[moduleID] = item
+
+	addedID := uuid.Must(uuid.NewRandom())
+	to[addedID] = DBModuleListItem{ModuleID: addedID, Name: "added", Graph: GraphModule{ID: addedID, Label: "added", Nodes: map[uuid.UUID]GraphNode{}}}
+
+	diff := DiffModuleLists(from, to)
+
+	if len(diff.AddedModules) != 1 || len(diff.RemovedModules) != 0 || len(diff.ChangedModules) != 1 {
+		t.Fatalf("unexpected diff %+v", diff)
+	}
+
+	md := diff.ChangedModules[0]
+	if !md.Renamed || len(md.AddedNodes) != 1 || len(md.ChangedNodes) != 2 || len(md.ChangedLinks) != 1 {
+		t.Fatalf("unexpected module diff %+v", md)
+	}
+
+	for _, change := range md.ChangedNodes {
+		if change.ID == a && !reflect.DeepEqual(change.Fields, []string{DiffFieldDefinition, DiffFieldLayout, DiffFieldConfig}) {
+			t.Errorf("unexpected fields for node a %v", change.Fields)
+		}
+	}
+
+	if err := diff.Operations.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := from.Copy()
+	if err := ApplyDeltaToModuleList(&applied, diff.Operations); err != nil {
+		t.Fatal(err)
+	}
+
+	if !DiffModuleLists(applied, to).Empty() {
+		t.Errorf("applying the diff did not produce the target, remaining %+v", DiffModuleLists(applied, to))
+	}
+
+	// The original must not be touched by applying operations to a copy
+	if from[moduleID].Graph.Nodes[a].Label != "a" || from[moduleID].Graph.Links[0].ID != linkID {
+		t.Error("original module list was modified")
+	}
+
+	removed := DiffModuleLists(to, from)
+	if len(removed.RemovedModules) != 1 || removed.Operations[len(removed.Operations)-1].Type != DODeleteModule {
+		t.Errorf("expected the added module to be deleted last, got %+v", removed)
+	}
+
+	if !DiffModuleLists(from, from.Copy()).Empty() {
+		t.Error("expected identical module lists to have an empty diff")
+	}
+}
+
+func TestMergeModuleLists(t *testing.T) {
+	moduleID, a, b, linkID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	typeID, version, sendConfig := "send", "1.0.0", `{"text":"hi"}`
+
+	base := DBModuleList{moduleID: {
+		ModuleID: moduleID,
+		Name:     "main",
+		Graph: GraphModule{
+			ID:    moduleID,
+			Label: "main",
+			Nodes: map[uuid.UUID]GraphNode{
+				a: {ID: a, Label: "a", TypeID: &typeID, Version: &version, ConfigJSON: &sendConfig},
+				b: {ID: b, Label: "b", TypeID: &typeID, Version: &version, Layout: Point{X: 100}},
+			},
+			Links: []GraphLink{{
+				ID:         linkID,
+				TypeID:     "always",
+				Version:    "0.1.0",
+				ConfigJSON: "{}",
+				A:          LinkPoint{NodeID: &a, IsOutput: true},
+				B:          LinkPoint{NodeID: &b, Position: Point{X: 100}},
+			}},
+		},
+	}}
+
+	// The hotfix moves node a and changes its config, and removes node b
+	theirs := base.Copy()
+	hotfix := theirs[moduleID]
+	nodeA := hotfix.Graph.Nodes[a]
+	config := `{"text":"fixed"}`
+	nodeA.ConfigJSON, nodeA.Layout = &config, Point{X: 50}
+	hotfix.Graph.Nodes[a] = nodeA
+	delete(hotfix.Graph.Nodes, b)
+	hotfix.Graph.Links[0].ConfigJSON = `{"fixed":true}`
+	theirs[moduleID] = hotfix
+
+	// The main line renames node a and moves node b
+	ours := base.Copy()
+	main := ours[moduleID]
+	nodeA = main.Graph.Nodes[a]
+	nodeA.Label = "renamed"
+	main.Graph.Nodes[a] = nodeA
+	nodeB := main.Graph.Nodes[b]
+	nodeB.Layout = Point{X: 200}
+	main.Graph.Nodes[b] = nodeB
+	ours[moduleID] = main
+
+	result := MergeModuleLists(base, ours, theirs)
+
+	if len(result.Conflicts) != 1 || result.Conflicts[0].NodeID == nil || *result.Conflicts[0].NodeID != b ||
+		result.Conflicts[0].Reason != MergeConflictChangedAndDeleted {
+		t.Fatalf("expected a conflict on node b, got %+v", result.Conflicts)
+	}
+
+	merged := result.Modules[moduleID]
+	mergedA := merged.Graph.Nodes[a]
+
+	if mergedA.Label != "renamed" || *mergedA.ConfigJSON != config || mergedA.Layout.X != 50 {
+		t.Errorf("expected both changes to node a to be merged, got %+v", mergedA)
+	}
+
+	if _, ok := merged.Graph.Nodes[b]; !ok {
+		t.Error("expected the conflicting node to keep our side")
+	}
+
+	if link, _ := merged.Graph.GetLink(linkID); link == nil || link.ConfigJSON != `{"fixed":true}` {
+		t.Errorf("expected the link config to be merged, got %+v", link)
+	}
+
+	applied := ours.Copy()
+	if err := ApplyDeltaToModuleList(&applied, result.Operations); err != nil {
+		t.Fatal(err)
+	}
+
+	if !DiffModuleLists(applied, result.Modules).Empty() {
+		t.Error("expected the merge operations to turn our side into the merge result")
+	}
+
+	// Both sides changing the same part conflicts
+	other := `{"text":"other"}`
+	nodeA = main.Graph.Nodes[a]
+	nodeA.ConfigJSON = &other
+	main.Graph.Nodes[a] = nodeA
+
+	result = MergeModuleLists(base, ours, theirs)
+
+	found := false
+	for _, c := range result.Conflicts {
+		if c.NodeID != nil && *c.NodeID == a && reflect.DeepEqual(c.Fields, []string{DiffFieldConfig}) {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("expected a config conflict on node a, got %+v", result.Conflicts)
+	}
+}
+
+func TestMergeModuleLists_DanglingLinks(t *testing.T) {
+	moduleID, a, b, linkID, addedID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	typeID, version := "send", "1.0.0"
+
+	base := DBModuleList{moduleID: {
+		ModuleID: moduleID,
+		Name:     "main",
+		Graph: GraphModule{
+			ID: moduleID,
+			Nodes: map[uuid.UUID]GraphNode{
+				a: {ID: a, Label: "a", TypeID: &typeID, Version: &version},
+				b: {ID: b, Label: "b", TypeID: &typeID, Version: &version},
+			},
+			Links: []GraphLink{{ID: linkID, TypeID: "always", Version: "0.1.0", A: LinkPoint{NodeID: &a, IsOutput: true}, B: LinkPoint{NodeID: &b}}},
+		},
+	}}
+
+	// They delete node b but leave the link to it alone
+	theirs := base.Copy()
+	delete(theirs[moduleID].Graph.Nodes, b)
+
+	// We leave node b alone and add another link to it
+	ours := base.Copy()
+	main := ours[moduleID]
+	main.Graph.Links = append(main.Graph.Links, GraphLink{ID: addedID, TypeID: "always", Version: "0.1.0", A: LinkPoint{NodeID: &b, IsOutput: true}, B: LinkPoint{NodeID: &a}})
+	ours[moduleID] = main
+
+	result := MergeModuleLists(base, ours, theirs)
+
+	if _, ok := result.Modules[moduleID].Graph.Nodes[b]; ok {
+		t.Error("expected node b to be deleted")
+	}
+
+	if len(result.Conflicts) != 2 {
+		t.Fatalf("expected a conflict on each link to node b, got %+v", result.Conflicts)
+	}
+
+	for i, id := range []uuid.UUID{linkID, addedID} {
+		c := result.Conflicts[i]
+
+		if c.LinkID == nil || *c.LinkID != id || c.NodeID != nil || c.Reason != MergeConflictChangedAndDeleted {
+			t.Errorf("expected a changed and deleted conflict on link %s, got %+v", id, c)
+		}
+	}
+}
+
+func TestMergeBlueprints(t *testing.T) {
+	moduleID := uuid.Must(uuid.NewRandom())
+	base := DBModuleList{moduleID: {ModuleID: moduleID, Name: "main", Graph: GraphModule{ID: moduleID, Label: "main", Nodes: map[uuid.UUID]GraphNode{}}}}
+	botID := uuid.Must(uuid.NewRandom())
+
+	baseBP := &DBBlueprint{BotID: botID, Version: sv("0.0.3"), Modules: base}
+	ours := &DBBlueprint{BotID: botID, Version: sv("0.0.5"), Modules: base.Copy()}
+	theirs := &DBBlueprint{BotID: botID, Version: sv("0.0.4-hotfix"), ContinuedFromVersion: svp("0.0.3"), Modules: base.Copy()}
+
+	if result, err := MergeBlueprints(baseBP, ours, theirs); err != nil || result.Conflicted() || len(result.Operations) != 0 {
+		t.Errorf("expected a clean empty merge, got %+v %v", result, err)
+	}
+
+	theirs.ContinuedFromVersion = svp("0.0.2")
+
+	if _, err := MergeBlueprints(baseBP, ours, theirs); err == nil {
+		t.Error("expected blueprints that did not continue from base to be rejected")
+	}
+}
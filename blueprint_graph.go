@@ -0,0 +1,309 @@
+package ctypes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrInvalidBlueprintGraph     = errors.New("invalid blueprint version graph")
+	ErrBlueprintVersionNotFound  = errors.New("blueprint version does not exist")
+	ErrBlueprintVersionExists    = errors.New("blueprint version already exists")
+	ErrBlueprintAlreadyPublished = errors.New("blueprint version is already published")
+	ErrNewVersionRequired        = errors.New("a new version is required when publishing the latest version")
+	ErrNewVersionTooLow          = errors.New("new version must be above the version being published")
+	ErrNewVersionAboveLatest     = errors.New("new version must be below the latest version when branching from an old version")
+	ErrNoCommonAncestor          = errors.New("blueprint versions do not share an ancestor")
+)
+
+// BlueprintVersionTree indexes the versions of a blueprint by their parent relationships
+type BlueprintVersionTree struct {
+	items    map[string]DBBlueprintGraphItem
+	children map[string][]Semver
+	roots    []Semver
+	latest   Semver
+}
+
+// BuildBlueprintVersionTree builds the version tree from a flat list of versions, such as a database query result
+// Children of the given items are ignored, relationships come from Parent alone
+func BuildBlueprintVersionTree(items []DBBlueprintGraphItem) (*BlueprintVersionTree, error) {
+	t := &BlueprintVersionTree{
+		items:    map[string]DBBlueprintGraphItem{},
+		children: map[string][]Semver{},
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: no versions", ErrInvalidBlueprintGraph)
+	}
+
+	for _, item := range items {
+		key := item.Version.String()
+
+		if _, exists := t.items[key]; exists {
+			return nil, fmt.Errorf("%w: version %s appears twice", ErrInvalidBlueprintGraph, key)
+		}
+
+		item.Children = nil
+		t.items[key] = item
+
+		if item.Version.GT(t.latest.Version) {
+			t.latest = item.Version
+		}
+	}
+
+	for _, item := range t.items {
+		if item.Parent == nil {
+			t.roots = append(t.roots, item.Version)
+			continue
+		}
+
+		parent := item.Parent.String()
+
+		if _, ok := t.items[parent]; !ok {
+			return nil, fmt.Errorf("%w: parent %s of %s does not exist", ErrInvalidBlueprintGraph, parent, item.Version)
+		}
+
+		t.children[parent] = append(t.children[parent], item.Version)
+	}
+
+	// Every version must lead back to a root, otherwise there is a cycle
+	for key := range t.items {
+		seen := map[string]bool{}
+
+		for v := key; ; {
+			if seen[v] {
+				return nil, fmt.Errorf("%w: cycle through %s", ErrInvalidBlueprintGraph, v)
+			}
+
+			seen[v] = true
+
+			parent := t.items[v].Parent
+			if parent == nil {
+				break
+			}
+
+			v = parent.String()
+		}
+	}
+
+	sortSemvers(t.roots)
+
+	for _, c := range t.children {
+		sortSemvers(c)
+	}
+
+	return t, nil
+}
+
+func sortSemvers(versions []Semver) {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].LT(versions[j].Version) })
+}
+
+// Latest is the highest version in the tree
+func (t *BlueprintVersionTree) Latest() Semver {
+	return t.latest
+}
+
+// Get returns a single version, without its children
+func (t *BlueprintVersionTree) Get(version Semver) (*DBBlueprintGraphItem, bool) {
+	item, ok := t.items[version.String()]
+	if !ok {
+		return nil, false
+	}
+
+	return &item, true
+}
+
+// Roots returns the versions without a parent, with Children filled in recursively and sorted by version
+func (t *BlueprintVersionTree) Roots() []DBBlueprintGraphItem {
+	roots := make([]DBBlueprintGraphItem, len(t.roots))
+
+	for i, r := range t.roots {
+		roots[i] = t.nested(r)
+	}
+
+	return roots
+}
+
+func (t *BlueprintVersionTree) nested(version Semver) DBBlueprintGraphItem {
+	item := t.items[version.String()]
+	item.Children = []DBBlueprintGraphItem{}
+
+	for _, c := range t.children[version.String()] {
+		item.Children = append(item.Children, t.nested(c))
+	}
+
+	return item
+}
+
+// Ancestors returns the parent chain of version, starting with its parent and ending at the root
+func (t *BlueprintVersionTree) Ancestors(version Semver) ([]Semver, error) {
+	item, ok := t.items[version.String()]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlueprintVersionNotFound, version)
+	}
+
+	var ancestors []Semver
+
+	for item.Parent != nil {
+		ancestors = append(ancestors, *item.Parent)
+		item = t.items[item.Parent.String()]
+	}
+
+	return ancestors, nil
+}
+
+// IsAncestor reports whether ancestor is on the parent chain of version
+func (t *BlueprintVersionTree) IsAncestor(ancestor, version Semver) bool {
+	ancestors, err := t.Ancestors(version)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range ancestors {
+		if a.EQ(ancestor.Version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BlueprintLineage describes how two versions of a blueprint are related
+type BlueprintLineage struct {
+	From           Semver   `json:"from"`
+	To             Semver   `json:"to"`
+	CommonAncestor Semver   `json:"common_ancestor"`
+	Path           []Semver `json:"path"`   // Every version from From to To, through the common ancestor
+	Direct         bool     `json:"direct"` // One version descends from the other
+}
+
+// Lineage finds the path between two versions through their closest common ancestor
+func (t *BlueprintVersionTree) Lineage(from, to Semver) (*BlueprintLineage, error) {
+	fromChain, err := t.Ancestors(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toChain, err := t.Ancestors(to)
+	if err != nil {
+		return nil, err
+	}
+
+	fromChain = append([]Semver{from}, fromChain...)
+	toChain = append([]Semver{to}, toChain...)
+
+	position := map[string]int{}
+	for i, v := range toChain {
+		position[v.String()] = i
+	}
+
+	for i, v := range fromChain {
+		j, ok := position[v.String()]
+		if !ok {
+			continue
+		}
+
+		path := append([]Semver{}, fromChain[:i+1]...)
+
+		for k := j - 1; k >= 0; k-- {
+			path = append(path, toChain[k])
+		}
+
+		return &BlueprintLineage{
+			From:           from,
+			To:             to,
+			CommonAncestor: v,
+			Path:           path,
+			Direct:         i == 0 || j == 0,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s and %s", ErrNoCommonAncestor, from, to)
+}
+
+// LatestUnlockedDescendant finds the highest unlocked version that descends from version, including version itself
+func (t *BlueprintVersionTree) LatestUnlockedDescendant(version Semver) (*DBBlueprintGraphItem, bool) {
+	if _, ok := t.items[version.String()]; !ok {
+		return nil, false
+	}
+
+	var best *DBBlueprintGraphItem
+
+	queue := []Semver{version}
+
+	for len(queue) > 0 {
+		item := t.items[queue[0].String()]
+		queue = append(queue[1:], t.children[item.Version.String()]...)
+
+		if !item.Locked && (best == nil || item.Version.GT(best.Version.Version)) {
+			i := item
+			best = &i
+		}
+	}
+
+	return best, best != nil
+}
+
+// ValidatePublish checks a publish request against the tree, returning the version that will be published
+func (t *BlueprintVersionTree) ValidatePublish(req *PublishBlueprintRequest) (Semver, error) {
+	version := t.latest
+	if req.Version != nil {
+		version = *req.Version
+	}
+
+	item, ok := t.items[version.String()]
+	if !ok {
+		return version, fmt.Errorf("%w: %s", ErrBlueprintVersionNotFound, version)
+	}
+
+	isLatest := version.EQ(t.latest.Version)
+
+	if req.NewVersion == nil {
+		if isLatest {
+			return version, ErrNewVersionRequired
+		}
+
+		if item.Locked {
+			return version, fmt.Errorf("%w: %s", ErrBlueprintAlreadyPublished, version)
+		}
+
+		return version, nil
+	}
+
+	newVersion := *req.NewVersion
+
+	if _, exists := t.items[newVersion.String()]; exists {
+		return version, fmt.Errorf("%w: %s", ErrBlueprintVersionExists, newVersion)
+	}
+
+	if !newVersion.GT(version.Version) {
+		return version, fmt.Errorf("%w: %s is not above %s", ErrNewVersionTooLow, newVersion, version)
+	}
+
+	if !isLatest && !newVersion.LT(t.latest.Version) {
+		return version, fmt.Errorf("%w: %s is not below %s", ErrNewVersionAboveLatest, newVersion, t.latest)
+	}
+
+	return version, nil
+}
+
+// PublishedGraphItems returns the graph items that result from a valid publish request
+// The published version is locked, and the new version (if any) is added as an unlocked child of it
+func (t *BlueprintVersionTree) PublishedGraphItems(req *PublishBlueprintRequest) (published DBBlueprintGraphItem, created *DBBlueprintGraphItem, err error) {
+	version, err := t.ValidatePublish(req)
+	if err != nil {
+		return published, nil, err
+	}
+
+	published = t.items[version.String()]
+	published.Locked = true
+
+	if req.NewVersion != nil {
+		parent := version
+		created = &DBBlueprintGraphItem{Version: *req.NewVersion, Parent: &parent}
+	}
+
+	return published, created, nil
+}
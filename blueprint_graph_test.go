@@ -0,0 +1,171 @@
+package ctypes
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func sv(s string) Semver {
+	return Semver{semver.MustParse(s)}
+}
+
+func svp(s string) *Semver {
+	v := sv(s)
+	return &v
+}
+
+func TestBuildBlueprintVersionTree(t *testing.T) {
+	// 0.0.1 -> 0.0.2 -> 0.0.5
+	//                -> 0.0.3 -> 0.0.4
+	tree, err := BuildBlueprintVersionTree([]DBBlueprintGraphItem{
+		{Version: sv("0.0.4"), Parent: svp("0.0.3")},
+		{Version: sv("0.0.1"), Locked: true},
+		{Version: sv("0.0.5"), Parent: svp("0.0.2")},
+		{Version: sv("0.0.2"), Parent: svp("0.0.1"), Locked: true},
+		{Version: sv("0.0.3"), Parent: svp("0.0.2"), Locked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tree.Latest().EQ(sv("0.0.5").Version) {
+		t.Errorf("expected latest to be 0.0.5, got %s", tree.Latest())
+	}
+
+	roots := tree.Roots()
+	if len(roots) != 1 || len(roots[0].Children) != 1 {
+		t.Fatalf("unexpected roots %+v", roots)
+	}
+
+	branches := roots[0].Children[0].Children
+	if len(branches) != 2 || branches[0].Version.String() != "0.0.3" || branches[1].Version.String() != "0.0.5" {
+		t.Errorf("expected children of 0.0.2 to be sorted, got %+v", branches)
+	}
+
+	invalid := [][]DBBlueprintGraphItem{
+		nil,
+		{{Version: sv("0.0.1")}, {Version: sv("0.0.1")}},
+		{{Version: sv("0.0.2"), Parent: svp("0.0.1")}},
+		{{Version: sv("0.0.1"), Parent: svp("0.0.2")}, {Version: sv("0.0.2"), Parent: svp("0.0.1")}},
+	}
+
+	for _, items := range invalid {
+		if _, err := BuildBlueprintVersionTree(items); !errors.Is(err, ErrInvalidBlueprintGraph) {
+			t.Errorf("expected %+v to be invalid, got %v", items, err)
+		}
+	}
+}
+
+func TestBlueprintVersionTree_Lineage(t *testing.T) {
+	tree, err := BuildBlueprintVersionTree([]DBBlueprintGraphItem{
+		{Version: sv("0.0.4"), Parent: svp("0.0.3")},
+		{Version: sv("0.0.1"), Locked: true},
+		{Version: sv("0.0.5"), Parent: svp("0.0.2")},
+		{Version: sv("0.0.2"), Parent: svp("0.0.1"), Locked: true},
+		{Version: sv("0.0.3"), Parent: svp("0.0.2"), Locked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lineage, err := tree.Lineage(sv("0.0.4"), sv("0.0.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"0.0.4", "0.0.3", "0.0.2", "0.0.5"}
+
+	if lineage.CommonAncestor.String() != "0.0.2" || lineage.Direct || len(lineage.Path) != len(want) {
+		t.Fatalf("unexpected lineage %+v", lineage)
+	}
+
+	for i, v := range want {
+		if lineage.Path[i].String() != v {
+			t.Errorf("expected path %v, got %v", want, lineage.Path)
+		}
+	}
+
+	direct, err := tree.Lineage(sv("0.0.1"), sv("0.0.4"))
+	if err != nil || !direct.Direct || len(direct.Path) != 4 || !tree.IsAncestor(sv("0.0.1"), sv("0.0.4")) {
+		t.Errorf("expected direct lineage, got %+v %v", direct, err)
+	}
+
+	if _, err := tree.Lineage(sv("0.0.1"), sv("1.0.0")); !errors.Is(err, ErrBlueprintVersionNotFound) {
+		t.Errorf("expected ErrBlueprintVersionNotFound, got %v", err)
+	}
+}
+
+func TestBlueprintVersionTree_LatestUnlockedDescendant(t *testing.T) {
+	tree, err := BuildBlueprintVersionTree([]DBBlueprintGraphItem{
+		{Version: sv("0.0.4"), Parent: svp("0.0.3")},
+		{Version: sv("0.0.1"), Locked: true},
+		{Version: sv("0.0.5"), Parent: svp("0.0.2")},
+		{Version: sv("0.0.2"), Parent: svp("0.0.1"), Locked: true},
+		{Version: sv("0.0.3"), Parent: svp("0.0.2"), Locked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, ok := tree.LatestUnlockedDescendant(sv("0.0.1")); !ok || d.Version.String() != "0.0.5" {
+		t.Errorf("expected 0.0.5, got %+v", d)
+	}
+
+	if d, ok := tree.LatestUnlockedDescendant(sv("0.0.3")); !ok || d.Version.String() != "0.0.4" {
+		t.Errorf("expected 0.0.4, got %+v", d)
+	}
+
+	locked, _ := BuildBlueprintVersionTree([]DBBlueprintGraphItem{{Version: sv("0.0.1"), Locked: true}})
+
+	if _, ok := locked.LatestUnlockedDescendant(sv("0.0.1")); ok {
+		t.Error("expected no unlocked descendant")
+	}
+}
+
+func TestBlueprintVersionTree_ValidatePublish(t *testing.T) {
+	tree, err := BuildBlueprintVersionTree([]DBBlueprintGraphItem{
+		{Version: sv("0.0.4"), Parent: svp("0.0.3")},
+		{Version: sv("0.0.1"), Locked: true},
+		{Version: sv("0.0.5"), Parent: svp("0.0.2")},
+		{Version: sv("0.0.2"), Parent: svp("0.0.1"), Locked: true},
+		{Version: sv("0.0.3"), Parent: svp("0.0.2"), Locked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		req     PublishBlueprintRequest
+		wantErr error
+	}{
+		{"latest without new version", PublishBlueprintRequest{}, ErrNewVersionRequired},
+		{"latest with new version", PublishBlueprintRequest{NewVersion: svp("0.1.0")}, nil},
+		{"latest with lower version", PublishBlueprintRequest{NewVersion: svp("0.0.4")}, ErrBlueprintVersionExists},
+		{"latest with version below", PublishBlueprintRequest{NewVersion: svp("0.0.4-rc.1")}, ErrNewVersionTooLow},
+		{"old unlocked version", PublishBlueprintRequest{Version: svp("0.0.4")}, nil},
+		{"old locked version", PublishBlueprintRequest{Version: svp("0.0.3")}, ErrBlueprintAlreadyPublished},
+		{"branch below latest", PublishBlueprintRequest{Version: svp("0.0.3"), NewVersion: svp("0.0.4-hotfix")}, nil},
+		{"branch above latest", PublishBlueprintRequest{Version: svp("0.0.3"), NewVersion: svp("0.0.6")}, ErrNewVersionAboveLatest},
+		{"missing version", PublishBlueprintRequest{Version: svp("1.0.0")}, ErrBlueprintVersionNotFound},
+	}
+
+	for _, tt := range tests {
+		_, err := tree.ValidatePublish(&tt.req)
+
+		if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+
+	published, created, err := tree.PublishedGraphItems(&PublishBlueprintRequest{NewVersion: svp("0.1.0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !published.Locked || published.Version.String() != "0.0.5" || created == nil || created.Parent.String() != "0.0.5" || created.Locked {
+		t.Errorf("unexpected publish result %+v %+v", published, created)
+	}
+}
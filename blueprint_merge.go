@@ -0,0 +1,345 @@
+package ctypes
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/google/uuid"
+)
+
+var ErrUnrelatedBlueprints = errors.New("blueprint versions cannot be merged")
+
+// Reasons a merge conflict can have
+const (
+	MergeConflictBothChanged       = "both_changed"        // Both sides changed the same part differently
+	MergeConflictChangedAndDeleted = "changed_and_deleted" // One side changed what the other side deleted
+	MergeConflictBothAdded         = "both_added"          // Both sides added the same id with different contents
+)
+
+// MergeConflict is a module, node or link that could not be merged. The merge keeps our side of it
+type MergeConflict struct {
+	ModuleID uuid.UUID  `json:"module_id"`
+	NodeID   *uuid.UUID `json:"node_id,omitempty"`
+	LinkID   *uuid.UUID `json:"link_id,omitempty"`
+	Reason   string     `json:"reason"`
+	Fields   []string   `json:"fields,omitempty"` // The conflicting DiffField constants, for MergeConflictBothChanged
+}
+
+func (c *MergeConflict) Error() string {
+	switch {
+	case c.NodeID != nil:
+		return fmt.Sprintf("node %s of module %s: %s %v", c.NodeID, c.ModuleID, c.Reason, c.Fields)
+	case c.LinkID != nil:
+		return fmt.Sprintf("link %s of module %s: %s %v", c.LinkID, c.ModuleID, c.Reason, c.Fields)
+	}
+
+	return fmt.Sprintf("module %s: %s %v", c.ModuleID, c.Reason, c.Fields)
+}
+
+// MergeResult is the outcome of a three-way merge
+type MergeResult struct {
+	Modules    DBModuleList    `json:"modules"`
+	Operations DeltaOperations `json:"operations"` // Turns our side into Modules
+	Conflicts  []MergeConflict `json:"conflicts"`
+}
+
+// Conflicted is true if some changes of their side could not be merged
+func (r *MergeResult) Conflicted() bool {
+	return len(r.Conflicts) > 0
+}
+
+// MergeBlueprints merges theirs into ours, for instance a hotfix branch back into the main line
+// base must be the version theirs continued from, and all three must be versions of the same bot
+func MergeBlueprints(base, ours, theirs *DBBlueprint) (*MergeResult, error) {
+	if base.BotID != ours.BotID || base.BotID != theirs.BotID {
+		return nil, fmt.Errorf("%w: blueprints belong to different bots", ErrUnrelatedBlueprints)
+	}
+
+	if theirs.ContinuedFromVersion == nil || !theirs.ContinuedFromVersion.EQ(base.Version.Version) {
+		return nil, fmt.Errorf("%w: %s did not continue from %s", ErrUnrelatedBlueprints, theirs.Version, base.Version)
+	}
+
+	return MergeModuleLists(base.Modules, ours.Modules, theirs.Modules), nil
+}
+
+// MergeModuleLists applies the changes made between base and theirs to ours
+// Nodes and links are merged by part, so a layout change on one side and a config change on the other do not conflict
+func MergeModuleLists(base, ours, theirs DBModuleList) *MergeResult {
+	merged := ours.Copy()
+	if merged == nil {
+		merged = DBModuleList{}
+	}
+
+	result := &MergeResult{Conflicts: []MergeConflict{}}
+
+	ids := map[uuid.UUID]bool{}
+	for _, l := range []DBModuleList{base, ours, theirs} {
+		for id := range l {
+			ids[id] = true
+		}
+	}
+
+	for _, id := range sortedIDSet(ids) {
+		b, inBase := base[id]
+		o, inOurs := ours[id]
+		t, inTheirs := theirs[id]
+
+		switch {
+		case inTheirs == inBase && (!inBase || modulesEqual(&b, &t)):
+			// Unchanged on their side
+		case inOurs == inBase && (!inBase || modulesEqual(&b, &o)):
+			if inTheirs {
+				merged[id] = t.copy()
+			} else {
+				delete(merged, id)
+			}
+		case inOurs == inTheirs && (!inOurs || modulesEqual(&o, &t)):
+			// Same change on both sides
+		case !inBase:
+			result.Conflicts = append(result.Conflicts, MergeConflict{ModuleID: id, Reason: MergeConflictBothAdded})
+		case !inOurs || !inTheirs:
+			result.Conflicts = append(result.Conflicts, MergeConflict{ModuleID: id, Reason: MergeConflictChangedAndDeleted})
+		default:
+			item := merged[id]
+			result.Conflicts = append(result.Conflicts, mergeModule(&b, &o, &t, &item)...)
+			merged[id] = item
+		}
+	}
+
+	result.Modules = merged
+	result.Operations = DiffModuleLists(ours, merged).Operations
+
+	return result
+}
+
+func (i DBModuleListItem) copy() DBModuleListItem {
+	return DBModuleList{i.ModuleID: i}.Copy()[i.ModuleID]
+}
+
+func modulesEqual(a, b *DBModuleListItem) bool {
+	return DiffModuleLists(DBModuleList{a.ModuleID: *a}, DBModuleList{b.ModuleID: *b}).Empty()
+}
+
+// mergeModule merges a module both sides changed into merged, which starts out as our side
+func mergeModule(base, ours, theirs, merged *DBModuleListItem) []MergeConflict {
+	var conflicts []MergeConflict
+
+	moduleID := base.ModuleID
+
+	switch {
+	case ours.Name == base.Name:
+		merged.Name = theirs.Name
+	case theirs.Name != base.Name && theirs.Name != ours.Name:
+		conflicts = append(conflicts, MergeConflict{ModuleID: moduleID, Reason: MergeConflictBothChanged, Fields: []string{DiffFieldName}})
+	}
+
+	nodeIDs := map[uuid.UUID]bool{}
+	for _, g := range []*GraphModule{&base.Graph, &ours.Graph, &theirs.Graph} {
+		for id := range g.Nodes {
+			nodeIDs[id] = true
+		}
+	}
+
+	for _, id := range sortedIDSet(nodeIDs) {
+		b, inBase := base.Graph.Nodes[id]
+		o, inOurs := ours.Graph.Nodes[id]
+		t, inTheirs := theirs.Graph.Nodes[id]
+
+		nodeID := id
+		conflict := MergeConflict{ModuleID: moduleID, NodeID: &nodeID}
+
+		switch {
+		case inTheirs == inBase && (!inBase || reflect.DeepEqual(b, t)):
+			// Unchanged on their side
+		case inOurs == inBase && (!inBase || reflect.DeepEqual(b, o)):
+			if inTheirs {
+				merged.Graph.Nodes[id] = t
+			} else {
+				delete(merged.Graph.Nodes, id)
+			}
+		case inOurs == inTheirs && (!inOurs || reflect.DeepEqual(o, t)):
+			// Same change on both sides
+		case !inBase:
+			conflict.Reason = MergeConflictBothAdded
+			conflicts = append(conflicts, conflict)
+		case !inOurs || !inTheirs:
+			conflict.Reason = MergeConflictChangedAndDeleted
+			conflicts = append(conflicts, conflict)
+		default:
+			node, fields := mergeNode(&b, &o, &t)
+			merged.Graph.Nodes[id] = node
+
+			if len(fields) > 0 {
+				conflict.Reason = MergeConflictBothChanged
+				conflict.Fields = fields
+				conflicts = append(conflicts, conflict)
+			}
+		}
+	}
+
+	baseLinks := linksByID(base.Graph.Links)
+	ourLinks := linksByID(ours.Graph.Links)
+	theirLinks := linksByID(theirs.Graph.Links)
+
+	linkIDs := map[uuid.UUID]bool{}
+	for _, links := range []map[uuid.UUID]GraphLink{baseLinks, ourLinks, theirLinks} {
+		for id := range links {
+			linkIDs[id] = true
+		}
+	}
+
+	for _, id := range sortedIDSet(linkIDs) {
+		b, inBase := baseLinks[id]
+		o, inOurs := ourLinks[id]
+		t, inTheirs := theirLinks[id]
+
+		linkID := id
+		conflict := MergeConflict{ModuleID: moduleID, LinkID: &linkID}
+
+		switch {
+		case inTheirs == inBase && (!inBase || reflect.DeepEqual(b, t)):
+			// Unchanged on their side
+		case inOurs == inBase && (!inBase || reflect.DeepEqual(b, o)):
+			merged.Graph.DeleteLink(id)
+
+			if inTheirs {
+				merged.Graph.Links = append(merged.Graph.Links, t)
+			}
+		case inOurs == inTheirs && (!inOurs || reflect.DeepEqual(o, t)):
+			// Same change on both sides
+		case !inBase:
+			conflict.Reason = MergeConflictBothAdded
+			conflicts = append(conflicts, conflict)
+		case !inOurs || !inTheirs:
+			conflict.Reason = MergeConflictChangedAndDeleted
+			conflicts = append(conflicts, conflict)
+		default:
+			link, fields := mergeLink(&b, &o, &t)
+
+			_, i := merged.Graph.GetLink(id)
+			merged.Graph.Links[i] = link
+
+			if len(fields) > 0 {
+				conflict.Reason = MergeConflictBothChanged
+				conflict.Fields = fields
+				conflicts = append(conflicts, conflict)
+			}
+		}
+	}
+
+	// A link can survive the merge while the node it connects to was deleted on the other side
+	conflicted := map[uuid.UUID]bool{}
+	for _, c := range conflicts {
+		if c.LinkID != nil {
+			conflicted[*c.LinkID] = true
+		}
+	}
+
+	for _, l := range merged.Graph.Links {
+		if conflicted[l.ID] {
+			continue
+		}
+
+		for _, point := range []LinkPoint{l.A, l.B} {
+			if point.NodeID == nil {
+				continue
+			}
+
+			if _, ok := merged.Graph.Nodes[*point.NodeID]; !ok {
+				linkID := l.ID
+				conflicts = append(conflicts, MergeConflict{ModuleID: moduleID, LinkID: &linkID, Reason: MergeConflictChangedAndDeleted})
+				break
+			}
+		}
+	}
+
+	return conflicts
+}
+
+func sortedIDSet(set map[uuid.UUID]bool) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+
+	sortUUIDs(ids)
+
+	return ids
+}
+
+// mergePart decides which side of a single part of a node or link to keep
+func mergePart(base, ours, theirs interface{}) (useTheirs, conflict bool) {
+	switch {
+	case reflect.DeepEqual(base, theirs), reflect.DeepEqual(ours, theirs):
+		return false, false
+	case reflect.DeepEqual(base, ours):
+		return true, false
+	}
+
+	return false, true
+}
+
+// mergeNode merges a node both sides changed, returning the parts that conflicted
+func mergeNode(base, ours, theirs *GraphNode) (GraphNode, []string) {
+	merged := *ours
+
+	var conflicts []string
+
+	if useTheirs, conflict := mergePart(nodeDefinition(*base), nodeDefinition(*ours), nodeDefinition(*theirs)); conflict {
+		conflicts = append(conflicts, DiffFieldDefinition)
+	} else if useTheirs {
+		merged = nodeDefinition(*theirs)
+		merged.Layout = ours.Layout
+		merged.ConfigJSON = ours.ConfigJSON
+	}
+
+	if useTheirs, conflict := mergePart(base.Layout, ours.Layout, theirs.Layout); conflict {
+		conflicts = append(conflicts, DiffFieldLayout)
+	} else if useTheirs {
+		merged.Layout = theirs.Layout
+	}
+
+	if useTheirs, conflict := mergePart(base.ConfigJSON, ours.ConfigJSON, theirs.ConfigJSON); conflict {
+		conflicts = append(conflicts, DiffFieldConfig)
+	} else if useTheirs {
+		merged.ConfigJSON = theirs.ConfigJSON
+	}
+
+	return merged, conflicts
+}
+
+// mergeLink merges a link both sides changed, returning the parts that conflicted
+func mergeLink(base, ours, theirs *GraphLink) (GraphLink, []string) {
+	merged := *ours
+
+	var conflicts []string
+
+	if useTheirs, conflict := mergePart(linkDefinition(*base), linkDefinition(*ours), linkDefinition(*theirs)); conflict {
+		conflicts = append(conflicts, DiffFieldDefinition)
+	} else if useTheirs {
+		merged = linkDefinition(*theirs)
+		merged.A.Position = ours.A.Position
+		merged.B.Position = ours.B.Position
+		merged.ConfigJSON = ours.ConfigJSON
+	}
+
+	basePos := [2]Point{base.A.Position, base.B.Position}
+	ourPos := [2]Point{ours.A.Position, ours.B.Position}
+	theirPos := [2]Point{theirs.A.Position, theirs.B.Position}
+
+	if useTheirs, conflict := mergePart(basePos, ourPos, theirPos); conflict {
+		conflicts = append(conflicts, DiffFieldLayout)
+	} else if useTheirs {
+		merged.A.Position = theirs.A.Position
+		merged.B.Position = theirs.B.Position
+	}
+
+	if useTheirs, conflict := mergePart(base.ConfigJSON, ours.ConfigJSON, theirs.ConfigJSON); conflict {
+		conflicts = append(conflicts, DiffFieldConfig)
+	} else if useTheirs {
+		merged.ConfigJSON = theirs.ConfigJSON
+	}
+
+	return merged, conflicts
+}
@@ -13,6 +13,7 @@ type DBBot struct {
 	Name              string            `db:"name" json:"name"`
 	OrganizationID    uuid.UUID         `db:"organization_id" json:"organization_id"`
 	InstalledPackages InstalledPackages `db:"installed_packages" json:"installed_packages"`
+	Lockfile          *BotLockfile      `db:"lockfile,omitempty" json:"lockfile,omitempty"`
 	CreatedAt         *CustomTime       `db:"created_at,omitempty" json:"created_at"`
 	UpdatedAt         *CustomTime       `db:"updated_at,omitempty" json:"updated_at"`
 }
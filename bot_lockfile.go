@@ -0,0 +1,317 @@
+package ctypes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"upper.io/db.v3/postgresql"
+)
+
+// BotLockfile records the exact versions a bot's version constraints resolved to, so compiling the same
+// blueprint again gives the same result even after packages publish new versions
+type BotLockfile struct {
+	BlueprintID      uuid.UUID       `json:"blueprint_id"`
+	BlueprintVersion Semver          `json:"blueprint_version"`
+	Packages         []LockedPackage `json:"packages"`
+	Modules          []LockedModule  `json:"modules"`
+	LockedAt         *CustomTime     `json:"locked_at,omitempty"`
+}
+
+func (l BotLockfile) Value() (driver.Value, error) {
+	return postgresql.EncodeJSONB(l)
+}
+
+func (l *BotLockfile) Scan(src interface{}) error {
+	return postgresql.DecodeJSONB(l, src)
+}
+
+var (
+	_ driver.Valuer = &BotLockfile{}
+	_ sql.Scanner   = &BotLockfile{}
+)
+
+// LockedPackage holds the resolved versions of every node and link type a bot uses from an installed package
+type LockedPackage struct {
+	PackageID uuid.UUID       `json:"package_id"`
+	Nodes     []LockedVersion `json:"nodes"`
+	Links     []LockedVersion `json:"links"`
+}
+
+// LockedVersion is a single resolved constraint
+type LockedVersion struct {
+	ID         string `json:"id"` // Type id of nodes and links, module id of package modules
+	Constraint string `json:"constraint"`
+	Version    string `json:"version"`
+}
+
+// LockedModule is a blueprint module that was imported from a package
+type LockedModule struct {
+	ModuleID  uuid.UUID     `json:"module_id"` // Id of the module in the blueprint
+	PackageID uuid.UUID     `json:"package_id"`
+	Locked    LockedVersion `json:"locked"`
+}
+
+// NewBotLockfile resolves every node, link and package module version constraint of blueprint against packages
+// Versions locked in previous are kept while they still exist and satisfy their constraint
+func NewBotLockfile(blueprint *DBBlueprint, packages []Package, previous *BotLockfile) (*BotLockfile, error) {
+	byID := map[uuid.UUID]*Package{}
+	for i := range packages {
+		byID[packages[i].ID] = &packages[i]
+	}
+
+	type lockKey struct {
+		packageID  uuid.UUID
+		item       string
+		id         string
+		constraint string
+	}
+
+	locked := map[lockKey]string{}
+
+	resolve := func(packageID uuid.UUID, item, id, constraint string) (string, error) {
+		key := lockKey{packageID, item, id, constraint}
+
+		if version, ok := locked[key]; ok {
+			return version, nil
+		}
+
+		pkg, ok := byID[packageID]
+		if !ok {
+			return "", fmt.Errorf("package %s is not installed", packageID)
+		}
+
+		c, err := ParseSemverConstraint(constraint)
+		if err != nil {
+			return "", err
+		}
+
+		var version string
+
+		if prev, ok := previous.lookup(packageID, item, id, constraint); ok && c.CheckString(prev) && pkg.hasVersion(item, id, prev) {
+			version = prev
+		} else {
+			switch item {
+			case PackageItemNode:
+				var n *DBNode
+				if n, err = pkg.ResolveNode(id, constraint); err == nil {
+					version = n.Version
+				}
+			case PackageItemLink:
+				var l *DBLink
+				if l, err = pkg.ResolveLink(id, constraint); err == nil {
+					version = l.Version
+				}
+			case PackageItemModule:
+				var m *PackageModule
+				if m, err = pkg.ResolveModule(id, constraint); err == nil {
+					version = m.Version
+				}
+			}
+
+			if err != nil {
+				return "", fmt.Errorf("package %s: %w", packageID, err)
+			}
+		}
+
+		locked[key] = version
+
+		return version, nil
+	}
+
+	lockfile := &BotLockfile{
+		BlueprintID:      blueprint.ID,
+		BlueprintVersion: blueprint.Version,
+		LockedAt:         TimePtr(time.Now()),
+	}
+
+	// Constraints on module references, keyed by the referenced module
+	moduleConstraints := map[uuid.UUID]string{}
+
+	// Stock nodes and links (uuid.Nil) ship with convai, so there is nothing to lock for them
+	for _, item := range blueprint.Modules {
+		for _, n := range item.Graph.Nodes {
+			switch {
+			case n.PackageID == uuid.Nil && n.TypeID != nil:
+				continue
+			case n.TypeID != nil && n.Version != nil:
+				if _, err := resolve(n.PackageID, PackageItemNode, *n.TypeID, *n.Version); err != nil {
+					return nil, err
+				}
+			case n.ModuleID != nil && n.ModuleVersion != nil:
+				moduleConstraints[*n.ModuleID] = *n.ModuleVersion
+			}
+		}
+
+		for _, l := range item.Graph.Links {
+			if l.PackageID == uuid.Nil || l.TypeID == "" {
+				continue
+			}
+
+			if _, err := resolve(l.PackageID, PackageItemLink, l.TypeID, l.Version); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for moduleID, item := range blueprint.Modules {
+		if item.Source == nil {
+			continue
+		}
+
+		// Modules nobody constrains stay at the version they were imported at
+		constraint, ok := moduleConstraints[moduleID]
+		if !ok {
+			constraint = item.Source.Version
+		}
+
+		version, err := resolve(item.Source.PackageID, PackageItemModule, item.Source.ModuleID, constraint)
+		if err != nil {
+			return nil, err
+		}
+
+		lockfile.Modules = append(lockfile.Modules, LockedModule{
+			ModuleID:  moduleID,
+			PackageID: item.Source.PackageID,
+			Locked:    LockedVersion{ID: item.Source.ModuleID, Constraint: constraint, Version: version},
+		})
+	}
+
+	lockedPackages := map[uuid.UUID]*LockedPackage{}
+
+	for key, version := range locked {
+		if key.item == PackageItemModule {
+			continue
+		}
+
+		lp, ok := lockedPackages[key.packageID]
+		if !ok {
+			lp = &LockedPackage{PackageID: key.packageID, Nodes: []LockedVersion{}, Links: []LockedVersion{}}
+			lockedPackages[key.packageID] = lp
+		}
+
+		lv := LockedVersion{ID: key.id, Constraint: key.constraint, Version: version}
+
+		if key.item == PackageItemNode {
+			lp.Nodes = append(lp.Nodes, lv)
+		} else {
+			lp.Links = append(lp.Links, lv)
+		}
+	}
+
+	for _, lp := range lockedPackages {
+		sortLockedVersions(lp.Nodes)
+		sortLockedVersions(lp.Links)
+		lockfile.Packages = append(lockfile.Packages, *lp)
+	}
+
+	sort.Slice(lockfile.Packages, func(i, j int) bool {
+		return lockfile.Packages[i].PackageID.String() < lockfile.Packages[j].PackageID.String()
+	})
+
+	sort.Slice(lockfile.Modules, func(i, j int) bool {
+		return lockfile.Modules[i].ModuleID.String() < lockfile.Modules[j].ModuleID.String()
+	})
+
+	return lockfile, nil
+}
+
+func sortLockedVersions(versions []LockedVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].ID != versions[j].ID {
+			return versions[i].ID < versions[j].ID
+		}
+
+		return versions[i].Constraint < versions[j].Constraint
+	})
+}
+
+// lookup finds a previously locked version. It is safe to call on a nil lockfile
+func (l *BotLockfile) lookup(packageID uuid.UUID, item, id, constraint string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+
+	if item == PackageItemModule {
+		for _, m := range l.Modules {
+			if m.PackageID == packageID && m.Locked.ID == id && m.Locked.Constraint == constraint {
+				return m.Locked.Version, true
+			}
+		}
+
+		return "", false
+	}
+
+	for _, p := range l.Packages {
+		if p.PackageID != packageID {
+			continue
+		}
+
+		versions := p.Nodes
+		if item == PackageItemLink {
+			versions = p.Links
+		}
+
+		for _, v := range versions {
+			if v.ID == id && v.Constraint == constraint {
+				return v.Version, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// NodeVersion returns the version a node constraint is locked to
+func (l *BotLockfile) NodeVersion(packageID uuid.UUID, typeID, constraint string) (string, bool) {
+	return l.lookup(packageID, PackageItemNode, typeID, constraint)
+}
+
+// LinkVersion returns the version a link constraint is locked to
+func (l *BotLockfile) LinkVersion(packageID uuid.UUID, typeID, constraint string) (string, bool) {
+	return l.lookup(packageID, PackageItemLink, typeID, constraint)
+}
+
+// ModuleVersion returns the version an imported module is locked to
+func (l *BotLockfile) ModuleVersion(moduleID uuid.UUID) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+
+	for _, m := range l.Modules {
+		if m.ModuleID == moduleID {
+			return m.Locked.Version, true
+		}
+	}
+
+	return "", false
+}
+
+// hasVersion reports whether the package still provides a version of a node, link or module
+func (p *Package) hasVersion(item, id, version string) bool {
+	switch item {
+	case PackageItemNode:
+		for _, n := range p.Nodes {
+			if n.TypeID == id && n.Version == version {
+				return true
+			}
+		}
+	case PackageItemLink:
+		for _, l := range p.Links {
+			if l.TypeID == id && l.Version == version {
+				return true
+			}
+		}
+	case PackageItemModule:
+		for _, m := range p.Modules {
+			if m.ID == id && m.Version == version {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -22,6 +22,10 @@ const (
 	ErrFailedToParseArgument    = 480
 	ErrFailedToCallPackage      = 481
 	ErrPackageMissingLink       = 482
+	ErrInvalidSignature         = 483
+	ErrPackageMissingNode       = 484
+	ErrPromotionFailed          = 485
+	ErrUnresolvedVariable       = 486
 	ErrInsufficientPermissions  = 855
 	ErrMissingOrgHeader         = 901
 	ErrMissingBotHeader         = 902
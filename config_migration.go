@@ -0,0 +1,522 @@
+package ctypes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/google/uuid"
+	"upper.io/db.v3/postgresql"
+)
+
+// Config migration operations
+const (
+	MigrateSet     = "set"     // Set path to value
+	MigrateDefault = "default" // Set path to value if nothing is there yet
+	MigrateRename  = "rename"  // Move the value at from to path
+	MigrateCopy    = "copy"    // Copy the value at from to path
+	MigrateDelete  = "delete"  // Remove path
+)
+
+var (
+	ErrNoMigrationPath       = errors.New("no config migration path between versions")
+	ErrRemoteMigration       = errors.New("migration must be run by the package, but no migrator was given")
+	ErrInvalidMigrationPath  = errors.New("invalid config migration path")
+	ErrUnknownMigrationOp    = errors.New("unknown config migration operation")
+	ErrConfigMigrationFailed = errors.New("package failed to migrate config")
+)
+
+// ConfigMigrationOp is a single declarative change to a config. Paths are dotted keys, such as "auth.token"
+type ConfigMigrationOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ConfigMigration upgrades configs from one version of a node or link type to another
+// Either Operations are applied, or if Remote is set, the package migrates the config through POST /migrate
+type ConfigMigration struct {
+	From       string              `json:"from"`
+	To         string              `json:"to"`
+	Operations []ConfigMigrationOp `json:"operations,omitempty"`
+	Remote     bool                `json:"remote,omitempty"`
+}
+
+type ConfigMigrations []ConfigMigration
+
+func (m ConfigMigrations) Value() (driver.Value, error) {
+	return postgresql.EncodeJSONB(m)
+}
+
+func (m *ConfigMigrations) Scan(src interface{}) error {
+	return postgresql.DecodeJSONB(m, src)
+}
+
+var (
+	_ driver.Valuer = &ConfigMigrations{}
+	_ sql.Scanner   = &ConfigMigrations{}
+)
+
+// ConfigMigrationCall asks a package to migrate a single config by one step
+type ConfigMigrationCall struct {
+	RequestID uuid.UUID `json:"request_id"`
+	Item      string    `json:"item"` // PackageItemNode or PackageItemLink
+	TypeID    string    `json:"type_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Config    string    `json:"config"`
+}
+
+type ConfigMigrationResult struct {
+	RequestID uuid.UUID `json:"request_id"`
+	Config    string    `json:"config"`
+	Errors    []Error   `json:"errors"`
+}
+
+type ConfigMigrationRequest struct {
+	Calls []ConfigMigrationCall `json:"calls"`
+}
+
+type ConfigMigrationResponse struct {
+	Results []ConfigMigrationResult `json:"results"`
+}
+
+// ConfigMigrator runs migrations that packages implement themselves. PackageClient implements it
+type ConfigMigrator interface {
+	MigrateConfigs(calls []ConfigMigrationCall) ([]ConfigMigrationResult, error)
+}
+
+// ValidateConfigMigrationResponse checks that migration results match the calls that were sent
+func ValidateConfigMigrationResponse(calls []ConfigMigrationCall, results []ConfigMigrationResult) error {
+	if len(calls) != len(results) {
+		return resultCountError(len(calls), len(results))
+	}
+
+	for i := range calls {
+		if calls[i].RequestID != results[i].RequestID {
+			return requestIDError(i, results[i].RequestID.String(), calls[i].RequestID.String())
+		}
+
+		if len(results[i].Errors) == 0 && !json.Valid([]byte(results[i].Config)) {
+			return &PackageProtocolError{Kind: PPEMalformedResponse, Index: i, Message: "migrated config is not valid json"}
+		}
+	}
+
+	return nil
+}
+
+// MigrateConfig applies declarative migration operations to a JSON config
+func MigrateConfig(configJSON string, ops []ConfigMigrationOp) (string, error) {
+	value, err := decodeConfig(configJSON)
+	if err != nil {
+		return "", err
+	}
+
+	config, ok := value.(map[string]interface{})
+	if !ok {
+		return "", errors.New("only object configs can be migrated")
+	}
+
+	for _, op := range ops {
+		if err := op.Apply(config); err != nil {
+			return "", err
+		}
+	}
+
+	jsb, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsb), nil
+}
+
+// Apply performs the operation on a decoded config
+func (o *ConfigMigrationOp) Apply(config map[string]interface{}) error {
+	if o.Path == "" {
+		return fmt.Errorf("%w: empty path", ErrInvalidMigrationPath)
+	}
+
+	switch o.Op {
+	case MigrateSet:
+		return setConfigPath(config, o.Path, normalizeJSONValue(o.Value))
+	case MigrateDefault:
+		if _, ok := getConfigPath(config, o.Path); ok {
+			return nil
+		}
+
+		return setConfigPath(config, o.Path, normalizeJSONValue(o.Value))
+	case MigrateRename, MigrateCopy:
+		value, ok := getConfigPath(config, o.From)
+		if !ok {
+			return nil
+		}
+
+		if o.Op == MigrateRename {
+			deleteConfigPath(config, o.From)
+		}
+
+		return setConfigPath(config, o.Path, value)
+	case MigrateDelete:
+		deleteConfigPath(config, o.Path)
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrUnknownMigrationOp, o.Op)
+}
+
+func getConfigPath(config map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	current := config
+
+	for i, part := range parts {
+		value, ok := current[part]
+		if !ok {
+			return nil, false
+		}
+
+		if i == len(parts)-1 {
+			return value, true
+		}
+
+		if current, ok = value.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+func setConfigPath(config map[string]interface{}, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	current := config
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part]
+		if !ok {
+			next = map[string]interface{}{}
+			current[part] = next
+		}
+
+		if current, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("%w: %s is not an object", ErrInvalidMigrationPath, part)
+		}
+	}
+
+	current[parts[len(parts)-1]] = value
+
+	return nil
+}
+
+func deleteConfigPath(config map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	current := config
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		current = next
+	}
+
+	delete(current, parts[len(parts)-1])
+}
+
+// migrations collects the migrations declared by every version of a node or link type
+func (p *Package) migrations(item, typeID string) []ConfigMigration {
+	var all []ConfigMigration
+
+	switch item {
+	case PackageItemNode:
+		for _, n := range p.Nodes {
+			if n.TypeID == typeID {
+				all = append(all, n.Migrations...)
+			}
+		}
+	case PackageItemLink:
+		for _, l := range p.Links {
+			if l.TypeID == typeID {
+				all = append(all, l.Migrations...)
+			}
+		}
+	}
+
+	return all
+}
+
+// MigrationPath finds the shortest chain of migrations that upgrades a config from one version to another
+func (p *Package) MigrationPath(item, typeID, from, to string) ([]ConfigMigration, error) {
+	if from == to {
+		return nil, nil
+	}
+
+	migrations := p.migrations(item, typeID)
+
+	// Breadth first search over versions, remembering the migration used to reach each one
+	via := map[string]ConfigMigration{}
+	queue := []string{from}
+	visited := map[string]bool{from: true}
+
+	for len(queue) > 0 && !visited[to] {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, m := range migrations {
+			if m.From != current || visited[m.To] {
+				continue
+			}
+
+			visited[m.To] = true
+			via[m.To] = m
+			queue = append(queue, m.To)
+		}
+	}
+
+	if !visited[to] {
+		return nil, fmt.Errorf("%w: %s %s %s -> %s", ErrNoMigrationPath, item, typeID, from, to)
+	}
+
+	var path []ConfigMigration
+
+	for v := to; v != from; v = via[v].From {
+		path = append([]ConfigMigration{via[v]}, path...)
+	}
+
+	return path, nil
+}
+
+// UpgradeTargets maps type ids to the version they should be upgraded to
+type UpgradeTargets struct {
+	Nodes map[string]string `json:"nodes"`
+	Links map[string]string `json:"links"`
+}
+
+// LatestVersions targets the highest version of every node and link type in the package
+func (p *Package) LatestVersions() UpgradeTargets {
+	targets := UpgradeTargets{Nodes: map[string]string{}, Links: map[string]string{}}
+
+	latest := func(versions map[string]string, typeID, version string) {
+		v, err := semver.Parse(version)
+		if err != nil {
+			return
+		}
+
+		if current, ok := versions[typeID]; ok {
+			if cv, err := semver.Parse(current); err == nil && cv.GTE(v) {
+				return
+			}
+		}
+
+		versions[typeID] = version
+	}
+
+	for _, n := range p.Nodes {
+		latest(targets.Nodes, n.TypeID, n.Version)
+	}
+
+	for _, l := range p.Links {
+		latest(targets.Links, l.TypeID, l.Version)
+	}
+
+	return targets
+}
+
+// ConfigUpgrade holds the operations that upgrade the nodes and links of a module, and the operations that undo them
+type ConfigUpgrade struct {
+	Operations DeltaOperations `json:"operations"`
+	Undo       DeltaOperations `json:"undo"`
+}
+
+// pendingUpgrade is a node or link config working its way along a migration path
+type pendingUpgrade struct {
+	item   string
+	id     uuid.UUID
+	typeID string
+	from   string
+	to     string
+	old    string
+	config string
+	steps  []ConfigMigration
+}
+
+// UpgradeGraphModule upgrades every node and link of module that belongs to the package to the target version of its type
+// Configs are migrated along the migration path and checked against the schema of the target version
+// Nothing is applied to module, the returned operations should be applied (and stored) as a regular delta
+func (p *Package) UpgradeGraphModule(module *GraphModule, targets UpgradeTargets, migrator ConfigMigrator) (*ConfigUpgrade, error) {
+	var pending []*pendingUpgrade
+
+	nodeIDs := make([]uuid.UUID, 0, len(module.Nodes))
+	for id := range module.Nodes {
+		nodeIDs = append(nodeIDs, id)
+	}
+
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i].String() < nodeIDs[j].String() })
+
+	for _, id := range nodeIDs {
+		n := module.Nodes[id]
+
+		if n.PackageID != p.ID || n.TypeID == nil || n.Version == nil {
+			continue
+		}
+
+		to, ok := targets.Nodes[*n.TypeID]
+		if !ok || to == *n.Version {
+			continue
+		}
+
+		// Nodes without a config are migrated from {}, and go back to having none when undone
+		old, config := "", "{}"
+		if n.ConfigJSON != nil {
+			old, config = *n.ConfigJSON, *n.ConfigJSON
+		}
+
+		pending = append(pending, &pendingUpgrade{item: PackageItemNode, id: id, typeID: *n.TypeID, from: *n.Version, to: to, old: old, config: config})
+	}
+
+	for _, l := range module.Links {
+		if l.PackageID != p.ID {
+			continue
+		}
+
+		to, ok := targets.Links[l.TypeID]
+		if !ok || to == l.Version {
+			continue
+		}
+
+		pending = append(pending, &pendingUpgrade{item: PackageItemLink, id: l.ID, typeID: l.TypeID, from: l.Version, to: to, old: l.ConfigJSON, config: l.ConfigJSON})
+	}
+
+	for _, u := range pending {
+		steps, err := p.MigrationPath(u.item, u.typeID, u.from, u.to)
+		if err != nil {
+			return nil, err
+		}
+
+		u.steps = steps
+	}
+
+	if err := runMigrations(pending, migrator); err != nil {
+		return nil, err
+	}
+
+	schemas := NewConfigSchemas([]Package{*p})
+	upgrade := &ConfigUpgrade{}
+	moduleID := module.ID
+
+	for _, u := range pending {
+		id, from, to, old, config := u.id, u.from, u.to, u.old, u.config
+
+		if u.item == PackageItemNode {
+			if schema := schemas.Node(p.ID, u.typeID, to); schema != nil {
+				if err := schema.ValidateJSON(config); err != nil {
+					return nil, fmt.Errorf("node %s: %w", id, err)
+				}
+			}
+
+			upgrade.Operations = append(upgrade.Operations,
+				DeltaOperation{ModuleID: &moduleID, Type: DOUpdateNode, UpdateNode: &DeltaUpdateNode{ID: id, Version: &to}},
+				DeltaOperation{ModuleID: &moduleID, Type: DOUpdateNodePackageConfig, UpdateNodePackageConfig: &DeltaUpdateNodePackageConfig{ID: id, Config: config}},
+			)
+
+			upgrade.Undo = append(upgrade.Undo,
+				DeltaOperation{ModuleID: &moduleID, Type: DOUpdateNodePackageConfig, UpdateNodePackageConfig: &DeltaUpdateNodePackageConfig{ID: id, Config: old}},
+				DeltaOperation{ModuleID: &moduleID, Type: DOUpdateNode, UpdateNode: &DeltaUpdateNode{ID: id, Version: &from}},
+			)
+
+			continue
+		}
+
+		if schema := schemas.Link(p.ID, u.typeID, to); schema != nil {
+			if err := schema.ValidateJSON(config); err != nil {
+				return nil, fmt.Errorf("link %s: %w", id, err)
+			}
+		}
+
+		upgrade.Operations = append(upgrade.Operations,
+			DeltaOperation{ModuleID: &moduleID, Type: DOUpdateLink, UpdateLink: &DeltaUpdateLink{ID: id, Version: &to}},
+			DeltaOperation{ModuleID: &moduleID, Type: DOUpdateLinkPackageConfig, UpdateLinkPackageConfig: &DeltaUpdateLinkPackageConfig{ID: id, Config: config}},
+		)
+
+		upgrade.Undo = append(upgrade.Undo,
+			DeltaOperation{ModuleID: &moduleID, Type: DOUpdateLinkPackageConfig, UpdateLinkPackageConfig: &DeltaUpdateLinkPackageConfig{ID: id, Config: old}},
+			DeltaOperation{ModuleID: &moduleID, Type: DOUpdateLink, UpdateLink: &DeltaUpdateLink{ID: id, Version: &from}},
+		)
+	}
+
+	// Undo in reverse order of the upgrade, two operations at a time
+	for i, j := 0, len(upgrade.Undo)-2; i < j; i, j = i+2, j-2 {
+		upgrade.Undo[i], upgrade.Undo[j] = upgrade.Undo[j], upgrade.Undo[i]
+		upgrade.Undo[i+1], upgrade.Undo[j+1] = upgrade.Undo[j+1], upgrade.Undo[i+1]
+	}
+
+	return upgrade, nil
+}
+
+// runMigrations walks every pending upgrade along its steps. Declarative steps are applied locally,
+// remote steps are sent to the migrator in one batch per round
+func runMigrations(pending []*pendingUpgrade, migrator ConfigMigrator) error {
+	for {
+		var calls []ConfigMigrationCall
+		var waiting []*pendingUpgrade
+
+		for _, u := range pending {
+			for len(u.steps) > 0 && !u.steps[0].Remote {
+				config, err := MigrateConfig(u.config, u.steps[0].Operations)
+				if err != nil {
+					return fmt.Errorf("%s %s: %w", u.item, u.id, err)
+				}
+
+				u.config = config
+				u.steps = u.steps[1:]
+			}
+
+			if len(u.steps) == 0 {
+				continue
+			}
+
+			calls = append(calls, ConfigMigrationCall{
+				RequestID: uuid.Must(uuid.NewRandom()),
+				Item:      u.item,
+				TypeID:    u.typeID,
+				From:      u.steps[0].From,
+				To:        u.steps[0].To,
+				Config:    u.config,
+			})
+			waiting = append(waiting, u)
+		}
+
+		if len(calls) == 0 {
+			return nil
+		}
+
+		if migrator == nil {
+			return ErrRemoteMigration
+		}
+
+		results, err := migrator.MigrateConfigs(calls)
+		if err != nil {
+			return err
+		}
+
+		if len(results) != len(calls) {
+			return resultCountError(len(calls), len(results))
+		}
+
+		for i, r := range results {
+			if len(r.Errors) > 0 {
+				return fmt.Errorf("%w: %s %s: %s", ErrConfigMigrationFailed, waiting[i].item, waiting[i].id, r.Errors[0].Message)
+			}
+
+			waiting[i].config = r.Config
+			waiting[i].steps = waiting[i].steps[1:]
+		}
+	}
+}
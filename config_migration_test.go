@@ -0,0 +1,184 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	ops := []ConfigMigrationOp{
+		{Op: MigrateRename, From: "token", Path: "auth.token"},
+		{Op: MigrateCopy, From: "url", Path: "backup_url"},
+		{Op: MigrateSet, Path: "auth.type", Value: "bearer"},
+		{Op: MigrateDefault, Path: "url", Value: "ignored"},
+		{Op: MigrateDefault, Path: "timeout", Value: 30},
+		{Op: MigrateDelete, Path: "legacy"},
+	}
+
+	migrated, err := MigrateConfig(`{"token":"abc","url":"https://example.com","legacy":true}`, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, want interface{}
+	_ = json.Unmarshal([]byte(migrated), &got)
+	_ = json.Unmarshal([]byte(`{"auth":{"token":"abc","type":"bearer"},"url":"https://example.com","backup_url":"https://example.com","timeout":30}`), &want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected migrated config %s", migrated)
+	}
+
+	// Ids larger than a float64 can hold are moved without being rounded
+	migrated, err = MigrateConfig(`{"chat_id":12345678901234567891}`, []ConfigMigrationOp{{Op: MigrateRename, From: "chat_id", Path: "chat.id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migrated != `{"chat":{"id":12345678901234567891}}` {
+		t.Errorf("expected the large integer to be kept, got %s", migrated)
+	}
+
+	if _, err := MigrateConfig(`{}`, []ConfigMigrationOp{{Op: "explode", Path: "a"}}); !errors.Is(err, ErrUnknownMigrationOp) {
+		t.Errorf("expected ErrUnknownMigrationOp, got %v", err)
+	}
+
+	if _, err := MigrateConfig(`{"a":1}`, []ConfigMigrationOp{{Op: MigrateSet, Path: "a.b", Value: 1}}); !errors.Is(err, ErrInvalidMigrationPath) {
+		t.Errorf("expected ErrInvalidMigrationPath, got %v", err)
+	}
+}
+
+func TestPackage_UpgradeGraphModule(t *testing.T) {
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+	srv := NewPackageServer(info)
+
+	srv.RegisterNode(DBNode{TypeID: "wait", Version: "1.1.0", Migrations: ConfigMigrations{
+		{From: "1.0.0", To: "1.1.0", Operations: []ConfigMigrationOp{{Op: MigrateDefault, Path: "seconds", Value: 5}}},
+	}}, nil, nil)
+
+	// 1.0.0 -> 1.1.0 is declarative, 1.1.0 -> 2.0.0 needs the package
+	srv.RegisterNode(DBNode{TypeID: "send", Version: "1.0.0"}, nil, nil)
+	srv.RegisterNode(DBNode{TypeID: "send", Version: "1.1.0", Migrations: ConfigMigrations{
+		{From: "1.0.0", To: "1.1.0", Operations: []ConfigMigrationOp{{Op: MigrateRename, From: "msg", Path: "text"}}},
+	}}, nil, nil)
+	srv.RegisterNode(DBNode{TypeID: "send", Version: "2.0.0", ConfigSchema: &ConfigSchema{
+		Type:       SchemaObject,
+		Required:   []string{"text"},
+		Properties: map[string]*ConfigSchema{"text": {Type: SchemaString, Pattern: "^[A-Z]"}},
+	}}, nil, nil)
+	srv.RegisterNodeMigration("send", "1.1.0", "2.0.0", func(call *ConfigMigrationCall) (string, error) {
+		var config map[string]string
+		if err := json.Unmarshal([]byte(call.Config), &config); err != nil {
+			return "", err
+		}
+
+		config["text"] = strings.ToUpper(config["text"])
+
+		jsb, err := json.Marshal(config)
+		return string(jsb), err
+	})
+	srv.RegisterLink(DBLink{TypeID: "always", Version: "0.1.0", Migrations: ConfigMigrations{
+		{From: "0.0.1", To: "0.1.0", Operations: []ConfigMigrationOp{{Op: MigrateDefault, Path: "enabled", Value: true}}},
+	}}, nil, nil)
+
+	hs := httptest.NewServer(srv.Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	pkg := srv.Manifest()
+
+	if remote := pkg.Nodes[len(pkg.Nodes)-1].Migrations; len(remote) != 1 || !remote[0].Remote || remote[0].From != "1.1.0" {
+		t.Fatalf("expected remote migration in manifest, got %+v", remote)
+	}
+
+	targets := pkg.LatestVersions()
+	if targets.Nodes["send"] != "2.0.0" || targets.Nodes["wait"] != "1.1.0" || targets.Links["always"] != "0.1.0" {
+		t.Fatalf("unexpected targets %+v", targets)
+	}
+
+	typeID, waitTypeID, version, config := "send", "wait", "1.0.0", `{"msg":"hello"}`
+	nodeID, waitID, linkID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+
+	// The wait node and the link have never been configured
+	module := &GraphModule{
+		ID: uuid.Must(uuid.NewRandom()),
+		Nodes: map[uuid.UUID]GraphNode{
+			nodeID: {ID: nodeID, PackageID: info.ID, TypeID: &typeID, Version: &version, ConfigJSON: &config},
+			waitID: {ID: waitID, PackageID: info.ID, TypeID: &waitTypeID, Version: &version},
+		},
+		Links: []GraphLink{{ID: linkID, PackageID: info.ID, TypeID: "always", Version: "0.0.1"}},
+	}
+
+	if _, err := pkg.UpgradeGraphModule(module, targets, nil); !errors.Is(err, ErrRemoteMigration) {
+		t.Fatalf("expected ErrRemoteMigration without a migrator, got %v", err)
+	}
+
+	upgrade, err := pkg.UpgradeGraphModule(module, targets, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(upgrade.Operations) != 6 || len(upgrade.Undo) != 6 {
+		t.Fatalf("unexpected operations %+v", upgrade)
+	}
+
+	for _, op := range append(append(DeltaOperations{}, upgrade.Operations...), upgrade.Undo...) {
+		if err := op.Validate(); err != nil {
+			t.Fatalf("operation %+v is invalid: %s", op, err)
+		}
+	}
+
+	original := deepCopyTestModule(t, module)
+
+	if err := ApplyDeltaToModule(module, &DBDelta{Operations: upgrade.Operations}); err != nil {
+		t.Fatal(err)
+	}
+
+	node := module.Nodes[nodeID]
+	if *node.Version != "2.0.0" || *node.ConfigJSON != `{"text":"HELLO"}` {
+		t.Errorf("node was not upgraded: %s %s", *node.Version, *node.ConfigJSON)
+	}
+
+	if wait := module.Nodes[waitID]; *wait.Version != "1.1.0" || wait.ConfigJSON == nil || *wait.ConfigJSON != `{"seconds":5}` {
+		t.Errorf("wait node was not upgraded: %+v", wait)
+	}
+
+	if module.Links[0].Version != "0.1.0" || module.Links[0].ConfigJSON != `{"enabled":true}` {
+		t.Errorf("link was not upgraded: %+v", module.Links[0])
+	}
+
+	if err := ApplyDeltaToModule(module, &DBDelta{Operations: upgrade.Undo}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(module, original) {
+		t.Errorf("undo did not restore the module\n%+v\n%+v", module, original)
+	}
+
+	targets.Nodes["send"] = "3.0.0"
+
+	if _, err := pkg.UpgradeGraphModule(module, targets, pc); !errors.Is(err, ErrNoMigrationPath) {
+		t.Errorf("expected ErrNoMigrationPath, got %v", err)
+	}
+}
+
+func deepCopyTestModule(t *testing.T, m *GraphModule) *GraphModule {
+	jsb, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c GraphModule
+	if err := json.Unmarshal(jsb, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	return &c
+}
@@ -0,0 +1,661 @@
+package ctypes
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"upper.io/db.v3/postgresql"
+)
+
+// Config schema types
+const (
+	SchemaObject  = "object"
+	SchemaArray   = "array"
+	SchemaString  = "string"
+	SchemaNumber  = "number"
+	SchemaInteger = "integer"
+	SchemaBoolean = "boolean"
+	SchemaNull    = "null"
+)
+
+// Config schema string formats
+const (
+	SchemaFormatEmail    = "email"
+	SchemaFormatURI      = "uri"
+	SchemaFormatDateTime = "date-time"
+	SchemaFormatUUID     = "uuid"
+)
+
+// ConfigSchema describes the configuration of a node, link, dispatch or the settings of a package
+// It is the subset of JSON Schema (draft 7) that is useful for describing configuration
+type ConfigSchema struct {
+	Type        string        `json:"type,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Default     interface{}   `json:"default,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+
+	// Objects
+	Properties           map[string]*ConfigSchema `json:"properties,omitempty"`
+	Required             []string                 `json:"required,omitempty"`
+	AdditionalProperties *bool                    `json:"additionalProperties,omitempty"`
+	PropertyOrder        []string                 `json:"propertyOrder,omitempty"` // Order of fields in forms, unlisted properties follow alphabetically
+
+	// Arrays
+	Items    *ConfigSchema `json:"items,omitempty"`
+	MinItems *int          `json:"minItems,omitempty"`
+	MaxItems *int          `json:"maxItems,omitempty"`
+
+	// Strings
+	MinLength *int   `json:"minLength,omitempty"`
+	MaxLength *int   `json:"maxLength,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	Format    string `json:"format,omitempty"`
+
+	// Secret values must be given as secret references, and are redacted whenever they are serialized
+	Secret bool `json:"secret,omitempty"`
+
+	// Numbers
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+}
+
+func (s ConfigSchema) Value() (driver.Value, error) {
+	return postgresql.EncodeJSONB(s)
+}
+
+func (s *ConfigSchema) Scan(src interface{}) error {
+	return postgresql.DecodeJSONB(s, src)
+}
+
+var (
+	_ driver.Valuer = &ConfigSchema{}
+	_ sql.Scanner   = &ConfigSchema{}
+)
+
+var validSchemaTypes = []string{SchemaObject, SchemaArray, SchemaString, SchemaNumber, SchemaInteger, SchemaBoolean, SchemaNull}
+
+// ConfigFieldError is a single validation failure at a path within a config
+type ConfigFieldError struct {
+	Path    string `json:"path"` // Dotted path to the value, such as "headers[0].name". Empty for the root value
+	Message string `json:"message"`
+}
+
+func (e ConfigFieldError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ConfigValidationError holds every problem found while validating a config
+type ConfigValidationError struct {
+	Errors []ConfigFieldError `json:"errors"`
+}
+
+func (e *ConfigValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+
+	return fmt.Sprintf("invalid config: %s", strings.Join(msgs, "; "))
+}
+
+// ConfigError converts a config validation failure into an API error, including the failing paths
+func ConfigError(err error) *APIError {
+	apiErr := &APIError{
+		statusCode: http.StatusBadRequest,
+		Code:       ErrInvalidConfig,
+		Message:    err.Error(),
+	}
+
+	var cvErr *ConfigValidationError
+	if errors.As(err, &cvErr) {
+		apiErr.Data = cvErr.Errors
+	}
+
+	return apiErr
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// Check validates the schema itself
+func (s *ConfigSchema) Check() error {
+	return s.check("")
+}
+
+func (s *ConfigSchema) check(path string) error {
+	if s.Type != "" && !StringSliceContains(validSchemaTypes, s.Type) {
+		return ConfigFieldError{Path: path, Message: fmt.Sprintf("unknown schema type %q", s.Type)}
+	}
+
+	if s.Pattern != "" {
+		if _, err := regexp.Compile(s.Pattern); err != nil {
+			return ConfigFieldError{Path: path, Message: fmt.Sprintf("invalid pattern: %s", err)}
+		}
+	}
+
+	for _, r := range s.Required {
+		if _, ok := s.Properties[r]; !ok {
+			return ConfigFieldError{Path: path, Message: fmt.Sprintf("required property %q is not defined", r)}
+		}
+	}
+
+	for key, prop := range s.Properties {
+		if prop == nil {
+			return ConfigFieldError{Path: joinPath(path, key), Message: "property schema is null"}
+		}
+
+		if err := prop.check(joinPath(path, key)); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		if err := s.Items.check(path + "[]"); err != nil {
+			return err
+		}
+	}
+
+	if s.Default != nil {
+		if errs := s.validate(path, normalizeJSONValue(s.Default), nil); len(errs) > 0 {
+			return ConfigFieldError{Path: path, Message: fmt.Sprintf("default does not match schema: %s", errs[0].Message)}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks a decoded JSON value against the schema, returning a *ConfigValidationError listing every problem
+func (s *ConfigSchema) Validate(value interface{}) error {
+	errs := s.validate("", value, nil)
+	if len(errs) > 0 {
+		return &ConfigValidationError{Errors: errs}
+	}
+
+	return nil
+}
+
+// ValidateJSON checks a JSON encoded config against the schema
+func (s *ConfigSchema) ValidateJSON(configJSON string) error {
+	value, err := decodeConfig(configJSON)
+	if err != nil {
+		return err
+	}
+
+	return s.Validate(value)
+}
+
+// emptyConfig is true for configs that were never set, which are treated as {}
+func emptyConfig(configJSON string) bool {
+	return strings.TrimSpace(configJSON) == ""
+}
+
+// decodeConfig decodes a JSON config. An empty config is treated as an empty object
+func decodeConfig(configJSON string) (interface{}, error) {
+	if emptyConfig(configJSON) {
+		return map[string]interface{}{}, nil
+	}
+
+	var value interface{}
+
+	if err := decodeJSON([]byte(configJSON), &value); err != nil {
+		return nil, &ConfigValidationError{Errors: []ConfigFieldError{{Message: fmt.Sprintf("config is not valid json: %s", err)}}}
+	}
+
+	return value, nil
+}
+
+// decodeJSON is json.Unmarshal keeping numbers as json.Number, so large integers such as ids are not rounded when
+// a config is decoded and encoded again
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+
+	return nil
+}
+
+// jsonNumber is the value of a decoded number, which is a json.Number for configs and a float64 otherwise
+func jsonNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return SchemaNull
+	case map[string]interface{}:
+		return SchemaObject
+	case []interface{}:
+		return SchemaArray
+	case string:
+		return SchemaString
+	case bool:
+		return SchemaBoolean
+	case float64, json.Number:
+		if f, ok := jsonNumber(v); ok && f == math.Trunc(f) {
+			return SchemaInteger
+		}
+
+		return SchemaNumber
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+func (s *ConfigSchema) validate(path string, value interface{}, errs []ConfigFieldError) []ConfigFieldError {
+	fail := func(format string, args ...interface{}) []ConfigFieldError {
+		return append(errs, ConfigFieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if name, ok := SecretRefName(value); ok {
+		switch {
+		case name == "":
+			return fail("secret reference has no name")
+		case s.Type != "" && s.Type != SchemaString:
+			return fail("secret references can only be used for strings")
+		}
+
+		return errs
+	}
+
+	if s.Secret && value != nil {
+		return fail("must be a secret reference")
+	}
+
+	actual := jsonTypeOf(value)
+
+	if s.Type != "" && s.Type != actual && !(s.Type == SchemaNumber && actual == SchemaInteger) {
+		return fail("expected %s, got %s", s.Type, actual)
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(normalizeJSONValue(e), value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fail("must be one of %v", s.Enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := v[r]; !ok {
+				errs = append(errs, ConfigFieldError{Path: joinPath(path, r), Message: "is required"})
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		// Sorted so errors are reported in a stable order
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			prop, ok := s.Properties[k]
+
+			switch {
+			case ok:
+				errs = prop.validate(joinPath(path, k), v[k], errs)
+			case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				errs = append(errs, ConfigFieldError{Path: joinPath(path, k), Message: "is not allowed"})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errs = fail("must have at least %d items", *s.MinItems)
+		}
+
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errs = fail("must have at most %d items", *s.MaxItems)
+		}
+
+		if s.Items != nil {
+			for i, item := range v {
+				errs = s.Items.validate(indexPath(path, i), item, errs)
+			}
+		}
+	case string:
+		length := len([]rune(v))
+
+		if s.MinLength != nil && length < *s.MinLength {
+			errs = fail("must be at least %d characters", *s.MinLength)
+		}
+
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs = fail("must be at most %d characters", *s.MaxLength)
+		}
+
+		if s.Pattern != "" {
+			if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(v) {
+				errs = fail("must match pattern %s", s.Pattern)
+			}
+		}
+
+		if msg := checkFormat(s.Format, v); msg != "" {
+			errs = fail(msg)
+		}
+	case float64, json.Number:
+		f, _ := jsonNumber(v)
+
+		if s.Minimum != nil && f < *s.Minimum {
+			errs = fail("must be at least %v", *s.Minimum)
+		}
+
+		if s.Maximum != nil && f > *s.Maximum {
+			errs = fail("must be at most %v", *s.Maximum)
+		}
+	}
+
+	return errs
+}
+
+// checkFormat returns a message if value does not match format. Unknown formats are not checked
+func checkFormat(format, value string) string {
+	switch format {
+	case SchemaFormatEmail:
+		if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+			return "must be an email address"
+		}
+	case SchemaFormatURI:
+		if u, err := url.ParseRequestURI(value); err != nil || u.Scheme == "" {
+			return "must be a uri"
+		}
+	case SchemaFormatDateTime:
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return "must be an RFC 3339 date-time"
+		}
+	case SchemaFormatUUID:
+		if _, err := uuid.Parse(value); err != nil {
+			return "must be a uuid"
+		}
+	}
+
+	return ""
+}
+
+// normalizeJSONValue converts a value to what it would decode to from JSON, so it can be compared with decoded configs
+// Numbers become json.Number like they do in decodeConfig, so they keep their precision
+func normalizeJSONValue(value interface{}) interface{} {
+	jsb, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var normalized interface{}
+	if err := decodeJSON(jsb, &normalized); err != nil {
+		return value
+	}
+
+	return normalized
+}
+
+// ApplyDefaults returns value with defaults filled in for every missing property that has one
+// A nil value is replaced by the default of the schema. value itself is not modified
+func (s *ConfigSchema) ApplyDefaults(value interface{}) interface{} {
+	if value == nil {
+		if s.Default == nil {
+			return nil
+		}
+
+		value = normalizeJSONValue(s.Default)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		filled := make(map[string]interface{}, len(v))
+
+		for k, item := range v {
+			filled[k] = item
+		}
+
+		for k, prop := range s.Properties {
+			if item, ok := filled[k]; ok {
+				filled[k] = prop.ApplyDefaults(item)
+			} else if prop.Default != nil {
+				filled[k] = prop.ApplyDefaults(nil)
+			}
+		}
+
+		return filled
+	case []interface{}:
+		if s.Items == nil {
+			return v
+		}
+
+		filled := make([]interface{}, len(v))
+
+		for i, item := range v {
+			filled[i] = s.Items.ApplyDefaults(item)
+		}
+
+		return filled
+	}
+
+	return value
+}
+
+// PrepareConfig fills in defaults and validates a JSON encoded config, returning the config that should be sent to the package
+func (s *ConfigSchema) PrepareConfig(configJSON string) (string, error) {
+	value, err := decodeConfig(configJSON)
+	if err != nil {
+		return "", err
+	}
+
+	value = s.ApplyDefaults(value)
+
+	if err := s.Validate(value); err != nil {
+		return "", err
+	}
+
+	jsb, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsb), nil
+}
+
+// Form widgets
+const (
+	WidgetText     = "text"
+	WidgetEmail    = "email"
+	WidgetURL      = "url"
+	WidgetDateTime = "datetime"
+	WidgetNumber   = "number"
+	WidgetCheckbox = "checkbox"
+	WidgetSelect   = "select"
+	WidgetGroup    = "group"
+	WidgetList     = "list"
+	WidgetSecret   = "secret"
+)
+
+// FormField describes how the editor should render a single config value
+type FormField struct {
+	Key         string       `json:"key"` // Path of the value in the config
+	Label       string       `json:"label"`
+	Description string       `json:"description,omitempty"`
+	Widget      string       `json:"widget"`
+	Required    bool         `json:"required"`
+	Default     interface{}  `json:"default,omitempty"`
+	Options     []FormOption `json:"options,omitempty"`
+	Min         *float64     `json:"min,omitempty"`
+	Max         *float64     `json:"max,omitempty"`
+	MinLength   *int         `json:"min_length,omitempty"`
+	MaxLength   *int         `json:"max_length,omitempty"`
+	Pattern     string       `json:"pattern,omitempty"`
+	Fields      []FormField  `json:"fields,omitempty"` // Fields of a group
+	Item        *FormField   `json:"item,omitempty"`   // Field used for each item of a list
+}
+
+type FormOption struct {
+	Label string      `json:"label"`
+	Value interface{} `json:"value"`
+}
+
+// Form describes the editor form for a config
+type Form struct {
+	Fields []FormField `json:"fields"`
+}
+
+// Form generates the description of an editor form from the schema
+// Object schemas produce one field per property, any other schema produces a single field
+func (s *ConfigSchema) Form() *Form {
+	root := s.formField("", "", false)
+
+	if root.Widget == WidgetGroup {
+		return &Form{Fields: root.Fields}
+	}
+
+	return &Form{Fields: []FormField{root}}
+}
+
+func (s *ConfigSchema) formField(key, name string, required bool) FormField {
+	field := FormField{
+		Key:         key,
+		Label:       s.Title,
+		Description: s.Description,
+		Required:    required,
+		Default:     s.Default,
+		Min:         s.Minimum,
+		Max:         s.Maximum,
+		MinLength:   s.MinLength,
+		MaxLength:   s.MaxLength,
+		Pattern:     s.Pattern,
+	}
+
+	if field.Label == "" {
+		field.Label = humanizeKey(name)
+	}
+
+	switch {
+	case s.Secret:
+		field.Widget = WidgetSecret
+	case len(s.Enum) > 0:
+		field.Widget = WidgetSelect
+
+		for _, e := range s.Enum {
+			field.Options = append(field.Options, FormOption{Label: fmt.Sprint(e), Value: e})
+		}
+	case s.Type == SchemaObject || (s.Type == "" && s.Properties != nil):
+		field.Widget = WidgetGroup
+
+		for _, k := range s.propertyOrder() {
+			field.Fields = append(field.Fields, s.Properties[k].formField(joinPath(key, k), k, StringSliceContains(s.Required, k)))
+		}
+	case s.Type == SchemaArray:
+		field.Widget = WidgetList
+
+		if s.Items != nil {
+			item := s.Items.formField(key+"[]", name, false)
+			field.Item = &item
+		}
+	case s.Type == SchemaNumber || s.Type == SchemaInteger:
+		field.Widget = WidgetNumber
+	case s.Type == SchemaBoolean:
+		field.Widget = WidgetCheckbox
+	case s.Format == SchemaFormatEmail:
+		field.Widget = WidgetEmail
+	case s.Format == SchemaFormatURI:
+		field.Widget = WidgetURL
+	case s.Format == SchemaFormatDateTime:
+		field.Widget = WidgetDateTime
+	default:
+		field.Widget = WidgetText
+	}
+
+	return field
+}
+
+// propertyOrder lists properties in PropertyOrder first, then the rest alphabetically
+func (s *ConfigSchema) propertyOrder() []string {
+	var keys []string
+
+	for _, k := range s.PropertyOrder {
+		if _, ok := s.Properties[k]; ok && !StringSliceContains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+
+	var rest []string
+
+	for k := range s.Properties {
+		if !StringSliceContains(keys, k) {
+			rest = append(rest, k)
+		}
+	}
+
+	sort.Strings(rest)
+
+	return append(keys, rest...)
+}
+
+var keySeparators = regexp.MustCompile(`[_\-]+`)
+var camelBoundary = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+// humanizeKey turns a property name such as "max_retries" or "maxRetries" into "Max retries"
+func humanizeKey(key string) string {
+	s := camelBoundary.ReplaceAllString(key, "$1 $2")
+	s = strings.TrimSpace(keySeparators.ReplaceAllString(s, " "))
+
+	if s == "" {
+		return ""
+	}
+
+	s = strings.ToLower(s)
+
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,304 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestConfigSchema_Validate(t *testing.T) {
+	three, zero := 3, 0.0
+	no := false
+
+	schema := &ConfigSchema{
+		Type:                 SchemaObject,
+		Required:             []string{"url"},
+		AdditionalProperties: &no,
+		Properties: map[string]*ConfigSchema{
+			"url":     {Type: SchemaString, Format: SchemaFormatURI},
+			"method":  {Type: SchemaString, Enum: []interface{}{"GET", "POST"}},
+			"retries": {Type: SchemaInteger, Minimum: &zero},
+			"headers": {Type: SchemaArray, MaxItems: &three, Items: &ConfigSchema{
+				Type:       SchemaObject,
+				Required:   []string{"name"},
+				Properties: map[string]*ConfigSchema{"name": {Type: SchemaString, MinLength: &three}},
+			}},
+			"notify_email": {Type: SchemaString, Format: SchemaFormatEmail},
+		},
+	}
+
+	if err := schema.Check(); err != nil {
+		t.Fatalf("expected schema to be valid, got %s", err)
+	}
+
+	if err := schema.ValidateJSON(`{"url":"https://example.com","retries":3,"headers":[{"name":"Accept"}]}`); err != nil {
+		t.Errorf("expected config to be valid, got %s", err)
+	}
+
+	err := schema.ValidateJSON(`{"method":"PUT","retries":1.5,"headers":[{"name":"X"},{}],"notify_email":"nope","extra":true}`)
+
+	var cvErr *ConfigValidationError
+	if !errors.As(err, &cvErr) {
+		t.Fatalf("expected a config validation error, got %v", err)
+	}
+
+	got := map[string]string{}
+	for _, fe := range cvErr.Errors {
+		got[fe.Path] = fe.Message
+	}
+
+	want := []string{"url", "method", "retries", "headers[0].name", "headers[1].name", "notify_email", "extra"}
+
+	for _, path := range want {
+		if _, ok := got[path]; !ok {
+			t.Errorf("expected an error at %s, got %+v", path, cvErr.Errors)
+		}
+	}
+
+	if len(cvErr.Errors) != len(want) {
+		t.Errorf("expected %d errors, got %+v", len(want), cvErr.Errors)
+	}
+
+	if err := schema.ValidateJSON(`not json`); err == nil {
+		t.Error("expected invalid json to fail")
+	}
+
+	apiErr := ConfigError(err)
+	if apiErr.Code != ErrInvalidConfig || apiErr.HTTPStatusCode() != 400 || !reflect.DeepEqual(apiErr.Data, cvErr.Errors) {
+		t.Errorf("unexpected api error %+v", apiErr)
+	}
+}
+
+func TestConfigSchema_Check(t *testing.T) {
+	bad := []*ConfigSchema{
+		{Type: "map"},
+		{Type: SchemaString, Pattern: "("},
+		{Type: SchemaObject, Required: []string{"missing"}},
+		{Type: SchemaInteger, Default: "one"},
+	}
+
+	for _, s := range bad {
+		if err := s.Check(); err == nil {
+			t.Errorf("expected %+v to be invalid", s)
+		}
+	}
+}
+
+func TestConfigSchema_PrepareConfig(t *testing.T) {
+	schema := &ConfigSchema{
+		Type:     SchemaObject,
+		Required: []string{"url"},
+		Properties: map[string]*ConfigSchema{
+			"url":     {Type: SchemaString, Format: SchemaFormatURI},
+			"method":  {Type: SchemaString, Enum: []interface{}{"GET", "POST"}, Default: "GET"},
+			"retries": {Type: SchemaInteger, Default: 2},
+			"headers": {Type: SchemaArray, Items: &ConfigSchema{
+				Type: SchemaObject,
+				Properties: map[string]*ConfigSchema{
+					"name":  {Type: SchemaString},
+					"value": {Type: SchemaString, Default: ""},
+				},
+			}},
+		},
+	}
+
+	prepared, err := schema.PrepareConfig(`{"url":"https://example.com","headers":[{"name":"Accept"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, want interface{}
+	_ = json.Unmarshal([]byte(prepared), &got)
+	_ = json.Unmarshal([]byte(`{"url":"https://example.com","method":"GET","retries":2,"headers":[{"name":"Accept","value":""}]}`), &want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected defaults to be filled, got %s", prepared)
+	}
+
+	if _, err := schema.PrepareConfig(`{}`); err == nil {
+		t.Error("expected missing required url to fail after filling defaults")
+	}
+
+	// Large integers such as chat ids are kept exactly
+	prepared, err = schema.PrepareConfig(`{"url":"https://example.com","retries":12345678901234567891,"chat_id":12345678901234567891}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prepared != `{"chat_id":12345678901234567891,"method":"GET","retries":12345678901234567891,"url":"https://example.com"}` {
+		t.Errorf("expected large integers to be kept, got %s", prepared)
+	}
+
+	if err := schema.ValidateJSON(`{"url":"https://example.com","retries":2.5}`); err == nil {
+		t.Error("expected a fractional number to fail an integer field")
+	}
+}
+
+func TestConfigSchema_Form(t *testing.T) {
+	three, zero := 3, 0.0
+
+	schema := &ConfigSchema{
+		Type:          SchemaObject,
+		Required:      []string{"url"},
+		PropertyOrder: []string{"url", "method"},
+		Properties: map[string]*ConfigSchema{
+			"url":     {Type: SchemaString, Format: SchemaFormatURI, Title: "Endpoint"},
+			"method":  {Type: SchemaString, Enum: []interface{}{"GET", "POST"}, Default: "GET"},
+			"retries": {Type: SchemaInteger, Minimum: &zero},
+			"headers": {Type: SchemaArray, MaxItems: &three, Items: &ConfigSchema{
+				Type:       SchemaObject,
+				Properties: map[string]*ConfigSchema{"name": {Type: SchemaString}},
+			}},
+			"notify_email": {Type: SchemaString, Format: SchemaFormatEmail},
+		},
+	}
+
+	form := schema.Form()
+
+	keys := make([]string, len(form.Fields))
+	for i, f := range form.Fields {
+		keys[i] = f.Key
+	}
+
+	if !reflect.DeepEqual(keys, []string{"url", "method", "headers", "notify_email", "retries"}) {
+		t.Fatalf("unexpected field order %v", keys)
+	}
+
+	url, method, headers, email, retries := form.Fields[0], form.Fields[1], form.Fields[2], form.Fields[3], form.Fields[4]
+
+	if url.Widget != WidgetURL || url.Label != "Endpoint" || !url.Required {
+		t.Errorf("unexpected url field %+v", url)
+	}
+
+	if method.Widget != WidgetSelect || len(method.Options) != 2 || method.Default != "GET" {
+		t.Errorf("unexpected method field %+v", method)
+	}
+
+	if headers.Widget != WidgetList || headers.Item == nil || headers.Item.Widget != WidgetGroup || headers.Item.Fields[0].Key != "headers[].name" {
+		t.Errorf("unexpected headers field %+v", headers)
+	}
+
+	if email.Widget != WidgetEmail || email.Label != "Notify email" {
+		t.Errorf("unexpected email field %+v", email)
+	}
+
+	if retries.Widget != WidgetNumber || retries.Min == nil || *retries.Min != 0 {
+		t.Errorf("unexpected retries field %+v", retries)
+	}
+}
+
+func TestConfigSchemas_Validation(t *testing.T) {
+	packageID := uuid.Must(uuid.NewRandom())
+	no := false
+
+	pkg := Package{
+		DBPackage: DBPackage{ID: packageID},
+		Nodes: []DBNode{{TypeID: "http", Version: "1.0.0", ConfigSchema: &ConfigSchema{
+			Type:     SchemaObject,
+			Required: []string{"url"},
+			Properties: map[string]*ConfigSchema{
+				"url":     {Type: SchemaString, Format: SchemaFormatURI},
+				"method":  {Type: SchemaString, Enum: []interface{}{"GET", "POST"}, Default: "GET"},
+				"retries": {Type: SchemaInteger, Default: 2},
+			},
+		}}},
+		Links: []DBLink{{TypeID: "always", Version: "1.0.0", ConfigSchema: &ConfigSchema{Type: SchemaObject, AdditionalProperties: &no}}},
+		SettingsSchema: &ConfigSchema{
+			Type:       SchemaObject,
+			Required:   []string{"token"},
+			Properties: map[string]*ConfigSchema{"token": {Type: SchemaString}},
+		},
+	}
+
+	schemas := NewConfigSchemas([]Package{pkg})
+
+	typeID, version := "http", "1.0.0"
+	nodeID, linkID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	valid := `{"url":"https://example.com"}`
+
+	module := &GraphModule{ID: uuid.Must(uuid.NewRandom())}
+
+	delta := &DBDelta{Operations: DeltaOperations{
+		{Type: DOCreateNode, CreateNode: &DeltaCreateNode{ID: nodeID, PackageID: packageID, TypeID: &typeID, Version: &version, ConfigJSON: &valid}},
+		{Type: DOCreateLink, CreateLink: &DeltaCreateLink{ID: linkID, PackageID: packageID, TypeID: "always", Version: "1.0.0", ConfigJSON: "{}"}},
+	}}
+
+	if err := schemas.ApplyDeltaToModule(module, delta); err != nil {
+		t.Fatal(err)
+	}
+
+	invalidNode := &DeltaOperation{Type: DOUpdateNodePackageConfig, UpdateNodePackageConfig: &DeltaUpdateNodePackageConfig{ID: nodeID, Config: `{"url":1}`}}
+
+	if err := schemas.ApplyOperationToModule(module, invalidNode); err == nil {
+		t.Error("expected invalid node config to be rejected")
+	}
+
+	if *module.Nodes[nodeID].ConfigJSON != valid {
+		t.Error("rejected operation was applied")
+	}
+
+	invalidLink := &DeltaOperation{Type: DOUpdateLinkPackageConfig, UpdateLinkPackageConfig: &DeltaUpdateLinkPackageConfig{ID: linkID, Config: `{"a":1}`}}
+
+	if err := schemas.ApplyOperationToModule(module, invalidLink); err == nil {
+		t.Error("expected invalid link config to be rejected")
+	}
+
+	// Configs that were never set count as {}, as they do everywhere else
+	emptyLink := &DeltaOperation{Type: DOUpdateLinkPackageConfig, UpdateLinkPackageConfig: &DeltaUpdateLinkPackageConfig{ID: linkID, Config: ""}}
+
+	if err := schemas.ApplyOperationToModule(module, emptyLink); err != nil {
+		t.Errorf("expected empty link config to be accepted, got %s", err)
+	}
+
+	if err := (&DeltaUpdateNodePackageConfig{ID: nodeID, Config: " "}).Validate(); err != nil {
+		t.Errorf("expected empty node config to be valid json, got %s", err)
+	}
+
+	settings := &DeltaOperation{Type: DOUpdateEnvironmentPackageConfig, UpdateEnvironmentPackageConfig: &DeltaUpdateEnvironmentPackageConfig{PackageID: packageID, Data: map[string]int{"other": 1}}}
+
+	if err := schemas.ValidateOperation(module, settings); err == nil {
+		t.Error("expected settings without a token to be rejected")
+	}
+
+	// Configs written before the schema existed are reported by the compiler
+	bad := `{"method":"DELETE"}`
+	node := module.Nodes[nodeID]
+	node.ConfigJSON = &bad
+	module.Nodes[nodeID] = node
+
+	notes := schemas.ValidateModule(module)
+	if len(notes) != 2 {
+		t.Fatalf("expected 2 notes, got %+v", notes)
+	}
+
+	for _, n := range notes {
+		if n.Code != ErrInvalidConfig || len(n.GLR) != 1 || *n.GLR[0].NodeID != nodeID || n.GLR[0].Type != LRTypeConfig {
+			t.Errorf("unexpected note %+v", n)
+		}
+	}
+
+	node.ConfigJSON = &valid
+	module.Nodes[nodeID] = node
+
+	if err := schemas.FillDefaults(module); err != nil {
+		t.Fatal(err)
+	}
+
+	var filled map[string]interface{}
+	_ = json.Unmarshal([]byte(*module.Nodes[nodeID].ConfigJSON), &filled)
+
+	if filled["method"] != "GET" || filled["retries"] != 2.0 {
+		t.Errorf("expected defaults to be filled, got %v", filled)
+	}
+
+	large := `{"method":"POST","retries":12345678901234567891}`
+	node.ConfigJSON = &large
+	module.Nodes[nodeID] = node
+
+	if err := schemas.FillDefaults(module); err != nil || *module.Nodes[nodeID].ConfigJSON != large {
+		t.Errorf("expected filling defaults to keep large integers, got %s %v", *module.Nodes[nodeID].ConfigJSON, err)
+	}
+}
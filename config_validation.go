@@ -0,0 +1,323 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// ConfigSchemas looks up the config schemas declared in package manifests
+type ConfigSchemas struct {
+	nodes      map[string]*ConfigSchema
+	links      map[string]*ConfigSchema
+	dispatches map[string]*ConfigSchema
+	settings   map[uuid.UUID]*ConfigSchema
+}
+
+// NewConfigSchemas indexes the schemas of every node, link, dispatch and package settings in packages
+func NewConfigSchemas(packages []Package) *ConfigSchemas {
+	c := &ConfigSchemas{
+		nodes:      map[string]*ConfigSchema{},
+		links:      map[string]*ConfigSchema{},
+		dispatches: map[string]*ConfigSchema{},
+		settings:   map[uuid.UUID]*ConfigSchema{},
+	}
+
+	for _, pkg := range packages {
+		for _, n := range pkg.Nodes {
+			if n.ConfigSchema != nil {
+				c.nodes[schemaKey(pkg.ID, handlerKey(n.TypeID, n.Version))] = n.ConfigSchema
+			}
+		}
+
+		for _, l := range pkg.Links {
+			if l.ConfigSchema != nil {
+				c.links[schemaKey(pkg.ID, handlerKey(l.TypeID, l.Version))] = l.ConfigSchema
+			}
+		}
+
+		for _, d := range pkg.Dispatches {
+			if d.ConfigSchema != nil {
+				c.dispatches[schemaKey(pkg.ID, d.ID)] = d.ConfigSchema
+			}
+		}
+
+		if pkg.SettingsSchema != nil {
+			c.settings[pkg.ID] = pkg.SettingsSchema
+		}
+	}
+
+	return c
+}
+
+func schemaKey(packageID uuid.UUID, key string) string {
+	return fmt.Sprintf("%s/%s", packageID, key)
+}
+
+// Node returns the config schema of a node type, or nil if it does not have one
+func (c *ConfigSchemas) Node(packageID uuid.UUID, typeID, version string) *ConfigSchema {
+	if c == nil {
+		return nil
+	}
+
+	return c.nodes[schemaKey(packageID, handlerKey(typeID, version))]
+}
+
+// Link returns the config schema of a link type, or nil if it does not have one
+func (c *ConfigSchemas) Link(packageID uuid.UUID, typeID, version string) *ConfigSchema {
+	if c == nil {
+		return nil
+	}
+
+	return c.links[schemaKey(packageID, handlerKey(typeID, version))]
+}
+
+// Dispatch returns the config schema of a dispatch type, or nil if it does not have one
+func (c *ConfigSchemas) Dispatch(packageID uuid.UUID, id string) *ConfigSchema {
+	if c == nil {
+		return nil
+	}
+
+	return c.dispatches[schemaKey(packageID, id)]
+}
+
+// Settings returns the schema of a package's settings, or nil if it does not have one
+func (c *ConfigSchemas) Settings(packageID uuid.UUID) *ConfigSchema {
+	if c == nil {
+		return nil
+	}
+
+	return c.settings[packageID]
+}
+
+func (c *ConfigSchemas) graphNode(n *GraphNode) *ConfigSchema {
+	if n.TypeID == nil || n.Version == nil {
+		return nil
+	}
+
+	return c.Node(n.PackageID, *n.TypeID, *n.Version)
+}
+
+func (c *ConfigSchemas) graphLink(l *GraphLink) *ConfigSchema {
+	return c.Link(l.PackageID, l.TypeID, l.Version)
+}
+
+// ValidateOperation checks the configs an operation writes against the schemas of the nodes and links it touches
+// Type changes made by updates earlier in the same delta must already be applied to module
+func (c *ConfigSchemas) ValidateOperation(module *GraphModule, op *DeltaOperation) error {
+	switch op.Type {
+	case DOCreateNode:
+		n := GraphNode(*op.CreateNode)
+
+		if schema := c.graphNode(&n); schema != nil && n.ConfigJSON != nil {
+			return schema.ValidateJSON(*n.ConfigJSON)
+		}
+
+	case DOCreateLink:
+		l := GraphLink(*op.CreateLink)
+
+		if schema := c.graphLink(&l); schema != nil {
+			return schema.ValidateJSON(l.ConfigJSON)
+		}
+
+	case DOUpdateNodePackageConfig:
+		n, ok := module.Nodes[op.UpdateNodePackageConfig.ID]
+		if !ok {
+			return nil
+		}
+
+		if schema := c.graphNode(&n); schema != nil {
+			return schema.ValidateJSON(op.UpdateNodePackageConfig.Config)
+		}
+
+	case DOUpdateLinkPackageConfig:
+		l, _ := module.GetLink(op.UpdateLinkPackageConfig.ID)
+		if l == nil {
+			return nil
+		}
+
+		if schema := c.graphLink(l); schema != nil {
+			return schema.ValidateJSON(op.UpdateLinkPackageConfig.Config)
+		}
+
+	case DOUpdateEnvironmentPackageConfig:
+		return c.ValidateEnvironmentPackageConfig(op.UpdateEnvironmentPackageConfig.PackageID, op.UpdateEnvironmentPackageConfig.Data)
+	}
+
+	return nil
+}
+
+// ApplyOperationToModule validates the configs written by operation, then applies it
+func (c *ConfigSchemas) ApplyOperationToModule(module *GraphModule, operation *DeltaOperation) error {
+	if err := c.ValidateOperation(module, operation); err != nil {
+		return err
+	}
+
+	return ApplyOperationToModule(module, operation)
+}
+
+// ApplyDeltaToModule validates and applies every operation of delta in order
+func (c *ConfigSchemas) ApplyDeltaToModule(module *GraphModule, delta *DBDelta) error {
+	for _, op := range delta.Operations {
+		err := c.ApplyOperationToModule(module, &op)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateModule checks every node and link config in module, returning one compilation note per invalid field
+func (c *ConfigSchemas) ValidateModule(module *GraphModule) []CompilationNote {
+	var notes []CompilationNote
+
+	note := func(ref GraphLocationReference, err error) {
+		cvErr, ok := err.(*ConfigValidationError)
+		if !ok {
+			notes = append(notes, CompilationNote{Message: err.Error(), Code: ErrInvalidConfig, GLR: []GraphLocationReference{ref}})
+			return
+		}
+
+		for _, fe := range cvErr.Errors {
+			notes = append(notes, CompilationNote{Message: fe.Error(), Code: ErrInvalidConfig, GLR: []GraphLocationReference{ref}})
+		}
+	}
+
+	// Nodes are visited in a stable order so compiler output does not change between runs
+	nodeIDs := make([]uuid.UUID, 0, len(module.Nodes))
+	for id := range module.Nodes {
+		nodeIDs = append(nodeIDs, id)
+	}
+
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i].String() < nodeIDs[j].String() })
+
+	for _, id := range nodeIDs {
+		n := module.Nodes[id]
+
+		schema := c.graphNode(&n)
+		if schema == nil {
+			continue
+		}
+
+		config := "{}"
+		if n.ConfigJSON != nil {
+			config = *n.ConfigJSON
+		}
+
+		if err := schema.ValidateJSON(config); err != nil {
+			nodeID := id
+			note(GraphLocationReference{ModuleID: module.ID, NodeID: &nodeID, Type: LRTypeConfig}, err)
+		}
+	}
+
+	for _, l := range module.Links {
+		schema := c.graphLink(&l)
+		if schema == nil {
+			continue
+		}
+
+		if err := schema.ValidateJSON(l.ConfigJSON); err != nil {
+			linkID := l.ID
+			note(GraphLocationReference{ModuleID: module.ID, LinkID: &linkID, Type: LRTypeConfig}, err)
+		}
+	}
+
+	return notes
+}
+
+// ValidateModuleList validates every module of a blueprint
+func (c *ConfigSchemas) ValidateModuleList(modules DBModuleList) []CompilationNote {
+	ids := make([]uuid.UUID, 0, len(modules))
+	for id := range modules {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	var notes []CompilationNote
+
+	for _, id := range ids {
+		m := modules[id]
+		notes = append(notes, c.ValidateModule(&m.Graph)...)
+	}
+
+	return notes
+}
+
+// FillDefaults writes schema defaults into the config of every node and link in module
+// It is meant to run on the copy of a module being compiled, before ValidateModule
+func (c *ConfigSchemas) FillDefaults(module *GraphModule) error {
+	fill := func(schema *ConfigSchema, configJSON string) (string, error) {
+		value, err := decodeConfig(configJSON)
+		if err != nil {
+			return "", err
+		}
+
+		jsb, err := json.Marshal(schema.ApplyDefaults(value))
+		if err != nil {
+			return "", err
+		}
+
+		return string(jsb), nil
+	}
+
+	for id, n := range module.Nodes {
+		schema := c.graphNode(&n)
+		if schema == nil {
+			continue
+		}
+
+		config := "{}"
+		if n.ConfigJSON != nil {
+			config = *n.ConfigJSON
+		}
+
+		filled, err := fill(schema, config)
+		if err != nil {
+			return fmt.Errorf("node %s: %w", id, err)
+		}
+
+		n.ConfigJSON = &filled
+		module.Nodes[id] = n
+	}
+
+	for i, l := range module.Links {
+		schema := c.graphLink(&l)
+		if schema == nil {
+			continue
+		}
+
+		filled, err := fill(schema, l.ConfigJSON)
+		if err != nil {
+			return fmt.Errorf("link %s: %w", l.ID, err)
+		}
+
+		module.Links[i].ConfigJSON = filled
+	}
+
+	return nil
+}
+
+// ValidateEnvironmentData checks the package settings of an environment against each package's settings schema
+func (c *ConfigSchemas) ValidateEnvironmentData(data EnvironmentData) error {
+	for packageID, settings := range data {
+		if err := c.ValidateEnvironmentPackageConfig(packageID, settings); err != nil {
+			return fmt.Errorf("package %s: %w", packageID, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateEnvironmentPackageConfig checks the settings of a single package. Secret fields must hold secret references
+func (c *ConfigSchemas) ValidateEnvironmentPackageConfig(packageID uuid.UUID, settings interface{}) error {
+	schema := c.Settings(packageID)
+	if schema == nil {
+		return nil
+	}
+
+	return schema.Validate(normalizeJSONValue(settings))
+}
@@ -3,6 +3,7 @@ package ctypes
 import (
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -104,6 +105,7 @@ type DeltaOperation struct {
 	UpdateEnvironmentPackageConfig *DeltaUpdateEnvironmentPackageConfig `json:"update_environment_package_config,omitempty"`
 
 	CreateModule *DeltaCreateModule `json:"create_module,omitempty"`
+	DeleteModule *DeltaDeleteModule `json:"delete_module,omitempty"`
 	UpdateModule *DeltaUpdateModule `json:"update_module,omitempty"`
 }
 
@@ -202,11 +204,11 @@ func (d *DeltaOperation) Validate() error {
 
 		return d.CreateModule.Validate()
 	case DODeleteModule:
-		// if d.DeleteModule == nil {
-		// 	return errors.New("DeleteModule cannot be null")
-		// }
-		//
-		// return d.DeleteModule.Validate()
+		if d.DeleteModule == nil {
+			return errors.New("DeleteModule cannot be null")
+		}
+
+		return d.DeleteModule.Validate()
 	case DOUpdateModule:
 		if d.UpdateModule == nil {
 			return errors.New("UpdateModule cannot be null")
@@ -394,7 +396,10 @@ func (d *DeltaUpdateNodePackageConfig) Validate() error {
 		return errors.New("invalid id")
 	}
 
-	// TODO validate
+	// The config is checked against the node's schema by ConfigSchemas.ValidateOperation
+	if !emptyConfig(d.Config) && !json.Valid([]byte(d.Config)) {
+		return errors.New("config is not valid json")
+	}
 
 	return nil
 }
@@ -409,7 +414,10 @@ func (d *DeltaUpdateLinkPackageConfig) Validate() error {
 		return errors.New("invalid id")
 	}
 
-	// TODO validate
+	// The config is checked against the link's schema by ConfigSchemas.ValidateOperation
+	if !emptyConfig(d.Config) && !json.Valid([]byte(d.Config)) {
+		return errors.New("config is not valid json")
+	}
 
 	return nil
 }
@@ -429,6 +437,18 @@ func (d *DeltaCreateModule) Validate() error {
 	return nil
 }
 
+type DeltaDeleteModule struct {
+	ID uuid.UUID `json:"id"`
+}
+
+func (d *DeltaDeleteModule) Validate() error {
+	if d.ID == uuid.Nil {
+		return errors.New("invalid id")
+	}
+
+	return nil
+}
+
 type DeltaUpdateModule struct {
 	Name string `json:"name"`
 }
@@ -446,8 +466,15 @@ type DeltaUpdateEnvironmentPackageConfig struct {
 }
 
 func (d *DeltaUpdateEnvironmentPackageConfig) Validate() error {
-	// TODO validate
+	if d.EnvironmentID == uuid.Nil {
+		return errors.New("invalid environment id")
+	}
 
+	if d.PackageID == uuid.Nil {
+		return errors.New("invalid package id")
+	}
+
+	// The data is checked against the package's settings schema by ConfigSchemas.ValidateOperation
 	return nil
 }
 
@@ -477,11 +504,12 @@ func ApplyOperationToModule(module *GraphModule, operation *DeltaOperation) erro
 		}
 
 	case DOMoveLink:
-		link, _ := module.GetLink(operation.MoveLink.ID)
+		link, i := module.GetLink(operation.MoveLink.ID)
 
 		if link != nil {
 			link.A.Position = operation.MoveLink.A
 			link.B.Position = operation.MoveLink.B
+			module.Links[i] = *link
 		} else {
 			return errors.New("could not update link position because link did not exist")
 		}
@@ -509,7 +537,7 @@ func ApplyOperationToModule(module *GraphModule, operation *DeltaOperation) erro
 				updateField := update.Field(i)
 
 				if !updateField.IsNil() {
-					nde.FieldByName(update.Type().Field(i).Name).Set(update.Field(i).Elem())
+					setUpdatedField(nde.FieldByName(update.Type().Field(i).Name), updateField)
 				}
 			}
 
@@ -532,7 +560,7 @@ func ApplyOperationToModule(module *GraphModule, operation *DeltaOperation) erro
 				updateField := update.Field(i)
 
 				if !updateField.IsNil() {
-					lnk.FieldByName(update.Type().Field(i).Name).Set(update.Field(i).Elem())
+					setUpdatedField(lnk.FieldByName(update.Type().Field(i).Name), updateField)
 				}
 			}
 
@@ -543,17 +571,23 @@ func ApplyOperationToModule(module *GraphModule, operation *DeltaOperation) erro
 
 	case DOUpdateNodePackageConfig:
 		if node, ok := module.Nodes[operation.UpdateNodePackageConfig.ID]; ok {
-			node.ConfigJSON = &operation.UpdateNodePackageConfig.Config
+			// An empty config was never set, so the node goes back to having none
+			node.ConfigJSON = nil
+			if !emptyConfig(operation.UpdateNodePackageConfig.Config) {
+				node.ConfigJSON = &operation.UpdateNodePackageConfig.Config
+			}
+
 			module.Nodes[operation.UpdateNodePackageConfig.ID] = node
 		} else {
 			return errors.New("could not update node package config because node did not exist")
 		}
 
 	case DOUpdateLinkPackageConfig:
-		link, _ := module.GetLink(operation.UpdateLinkPackageConfig.ID)
+		link, i := module.GetLink(operation.UpdateLinkPackageConfig.ID)
 
 		if link != nil {
 			link.ConfigJSON = operation.UpdateLinkPackageConfig.Config
+			module.Links[i] = *link
 		} else {
 			return errors.New("could not update link package config because link did not exist")
 		}
@@ -561,3 +595,17 @@ func ApplyOperationToModule(module *GraphModule, operation *DeltaOperation) erro
 
 	return nil
 }
+
+// setUpdatedField copies the value of a non-nil update field into field. Pointer fields get a copy of the value,
+// so the update is never aliased by the graph
+func setUpdatedField(field, update reflect.Value) {
+	if field.Kind() == reflect.Ptr {
+		value := reflect.New(field.Type().Elem())
+		value.Elem().Set(update.Elem())
+		field.Set(value)
+
+		return
+	}
+
+	field.Set(update.Elem())
+}
@@ -9,6 +9,9 @@ type DBDispatch struct {
 	PackageID     uuid.UUID `db:"package_id" json:"package_id"`
 	Name          string    `db:"name" json:"name"`
 	Documentation string    `db:"docs" json:"docs"`
+
+	// ConfigSchema describes the config of the dispatch. Configs are not validated when it is nil
+	ConfigSchema *ConfigSchema `db:"config_schema,omitempty" json:"config_schema,omitempty"`
 }
 
 type DispatchRequest struct {
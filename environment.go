@@ -9,14 +9,18 @@ import (
 )
 
 type DBEnvironment struct {
-	ID               uuid.UUID       `db:"id" json:"id"`
-	Name             string          `db:"name" json:"name"`
-	BotID            uuid.UUID       `db:"bot_id" json:"bot_id"`
-	Data             EnvironmentData `db:"data" json:"data"`
-	BlueprintID      *uuid.UUID      `db:"blueprint_id,omitempty" json:"blueprint_id,omitempty"`
-	BlueprintVersion *Semver         `db:"blueprint_version,omitempty" json:"blueprint_version,omitempty"`
-	PromotedAt       *CustomTime     `db:"promoted_at,omitempty" json:"promoted_at,omitempty"`
-	IsDev            bool            `db:"is_dev" json:"is_dev"`
+	ID               uuid.UUID            `db:"id" json:"id"`
+	Name             string               `db:"name" json:"name"`
+	BotID            uuid.UUID            `db:"bot_id" json:"bot_id"`
+	Data             EnvironmentData      `db:"data" json:"data"`
+	Variables        EnvironmentVariables `db:"variables" json:"variables"`
+	BlueprintID      *uuid.UUID           `db:"blueprint_id,omitempty" json:"blueprint_id,omitempty"`
+	BlueprintVersion *Semver              `db:"blueprint_version,omitempty" json:"blueprint_version,omitempty"`
+	PromotedAt       *CustomTime          `db:"promoted_at,omitempty" json:"promoted_at,omitempty"`
+	IsDev            bool                 `db:"is_dev" json:"is_dev"`
+
+	// schemas are the settings schemas used to redact the environment when it is serialized, see Redacted
+	schemas *ConfigSchemas
 }
 
 // APIEnvironment includes the environment details, as well as the blueprint (if any)
@@ -28,7 +32,15 @@ type APIEnvironment struct {
 type DBEnvironments []DBEnvironment
 
 func (g DBEnvironments) Value() (driver.Value, error) {
-	return postgresql.EncodeJSONB(g)
+	// Stored environments must keep their settings, so they skip the redaction of DBEnvironment.MarshalJSON
+	type dbEnvironment DBEnvironment
+
+	stored := make([]dbEnvironment, len(g))
+	for i := range g {
+		stored[i] = dbEnvironment(g[i])
+	}
+
+	return postgresql.EncodeJSONB(stored)
 }
 
 func (g *DBEnvironments) Scan(src interface{}) error {
@@ -0,0 +1,364 @@
+package ctypes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"upper.io/db.v3/postgresql"
+)
+
+var (
+	ErrEnvironmentNotFound      = errors.New("environment does not exist")
+	ErrPromotionSameEnvironment = errors.New("cannot promote an environment to itself")
+	ErrPromotionNoBlueprint     = errors.New("source environment has no blueprint")
+	ErrPromotionWrongBlueprint  = errors.New("blueprint is not the one deployed to the source environment")
+	ErrPromotionUnlocked        = errors.New("only published blueprint versions can be promoted")
+	ErrPromotionOtherBot        = errors.New("environments belong to different bots")
+	ErrPreflightFailed          = errors.New("promotion preflight checks failed")
+	ErrNothingToRollBack        = errors.New("promotion cannot be rolled back")
+)
+
+// Names of the checks run before a promotion
+const (
+	PreflightCompile           = "compile"
+	PreflightEnvironmentConfig = "environment_config"
+	PreflightVersion           = "version"
+)
+
+// PromoteEnvironmentRequest moves the blueprint version deployed to one environment into another
+type PromoteEnvironmentRequest struct {
+	FromEnvironmentID uuid.UUID `json:"from_environment_id"`
+	ToEnvironmentID   uuid.UUID `json:"to_environment_id"`
+
+	// AllowDowngrade permits promoting a version below the one the target environment is running
+	AllowDowngrade bool `json:"allow_downgrade"`
+}
+
+// PreflightCheck is the outcome of a single check
+type PreflightCheck struct {
+	Name       string            `json:"name"`
+	Passed     bool              `json:"passed"`
+	Overridden bool              `json:"overridden,omitempty"` // Failed, but the request allowed it
+	Message    string            `json:"message,omitempty"`
+	Notes      []CompilationNote `json:"notes,omitempty"`
+}
+
+// PromotionPreflight is the result of every check run before a promotion
+type PromotionPreflight struct {
+	Checks []PreflightCheck `json:"checks"`
+}
+
+func (p PromotionPreflight) Value() (driver.Value, error) {
+	return postgresql.EncodeJSONB(p)
+}
+
+func (p *PromotionPreflight) Scan(src interface{}) error {
+	return postgresql.DecodeJSONB(p, src)
+}
+
+var (
+	_ driver.Valuer = &PromotionPreflight{}
+	_ sql.Scanner   = &PromotionPreflight{}
+)
+
+// Passed is true if no check failed
+func (p *PromotionPreflight) Passed() bool {
+	for _, c := range p.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Overridden is true if a check only passed because the request allowed it
+func (p *PromotionPreflight) Overridden() bool {
+	for _, c := range p.Checks {
+		if c.Overridden {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BlueprintCompiler compiles a blueprint, so preflight checks can run without this package depending on the compiler
+type BlueprintCompiler func(blueprint *DBBlueprint) (*CompilerResult, error)
+
+// DBPromotion records a promotion, so it can be audited and rolled back
+type DBPromotion struct {
+	ID                uuid.UUID `db:"id" json:"id"`
+	BotID             uuid.UUID `db:"bot_id" json:"bot_id"`
+	FromEnvironmentID uuid.UUID `db:"from_environment_id" json:"from_environment_id"`
+	ToEnvironmentID   uuid.UUID `db:"to_environment_id" json:"to_environment_id"`
+
+	BlueprintID      uuid.UUID `db:"blueprint_id" json:"blueprint_id"`
+	BlueprintVersion Semver    `db:"blueprint_version" json:"blueprint_version"`
+
+	// What the target environment was running before, used for rollbacks
+	PreviousBlueprintID      *uuid.UUID `db:"previous_blueprint_id,omitempty" json:"previous_blueprint_id,omitempty"`
+	PreviousBlueprintVersion *Semver    `db:"previous_blueprint_version,omitempty" json:"previous_blueprint_version,omitempty"`
+
+	Preflight  PromotionPreflight `db:"preflight" json:"preflight"`
+	RollbackOf *uuid.UUID         `db:"rollback_of,omitempty" json:"rollback_of,omitempty"` // Set if this promotion undid another one
+	CreatedAt  *CustomTime        `db:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+// PreflightPromotion runs every check for a promotion. Errors are returned for requests that make no sense,
+// failed checks are reported in the preflight instead
+func PreflightPromotion(req *PromoteEnvironmentRequest, bot *APIBot, blueprint *DBBlueprint, compile BlueprintCompiler) (*PromotionPreflight, error) {
+	from, to, err := promotionEnvironments(req, bot)
+	if err != nil {
+		return nil, err
+	}
+
+	if from.BlueprintID == nil || from.BlueprintVersion == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPromotionNoBlueprint, from.Name)
+	}
+
+	if blueprint.ID != *from.BlueprintID || !blueprint.Version.EQ(from.BlueprintVersion.Version) {
+		return nil, ErrPromotionWrongBlueprint
+	}
+
+	if !blueprint.Locked {
+		return nil, fmt.Errorf("%w: %s is not published", ErrPromotionUnlocked, blueprint.Version)
+	}
+
+	preflight := &PromotionPreflight{
+		Checks: []PreflightCheck{
+			preflightCompile(blueprint, compile),
+			preflightEnvironmentConfig(to, bot.Packages),
+			preflightVersion(req, blueprint, to),
+		},
+	}
+
+	return preflight, nil
+}
+
+func promotionEnvironments(req *PromoteEnvironmentRequest, bot *APIBot) (from, to *DBEnvironment, err error) {
+	if req.FromEnvironmentID == req.ToEnvironmentID {
+		return nil, nil, ErrPromotionSameEnvironment
+	}
+
+	from = bot.GetEnvironment(req.FromEnvironmentID)
+	to = bot.GetEnvironment(req.ToEnvironmentID)
+
+	if from == nil || to == nil {
+		return nil, nil, ErrEnvironmentNotFound
+	}
+
+	if from.BotID != bot.ID || to.BotID != bot.ID {
+		return nil, nil, ErrPromotionOtherBot
+	}
+
+	return from, to, nil
+}
+
+func preflightCompile(blueprint *DBBlueprint, compile BlueprintCompiler) PreflightCheck {
+	check := PreflightCheck{Name: PreflightCompile}
+
+	result, err := compile(blueprint)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+
+	if len(result.Errors) > 0 {
+		check.Message = fmt.Sprintf("blueprint has %d compilation errors", len(result.Errors))
+		check.Notes = result.Errors
+
+		return check
+	}
+
+	check.Passed = true
+
+	return check
+}
+
+// preflightEnvironmentConfig checks the target environment has valid settings for every installed package
+// Packages without a settings schema need no settings
+func preflightEnvironmentConfig(env *DBEnvironment, packages []Package) PreflightCheck {
+	check := PreflightCheck{Name: PreflightEnvironmentConfig}
+
+	for _, pkg := range packages {
+		if pkg.SettingsSchema == nil {
+			continue
+		}
+
+		settings, ok := env.Data[pkg.ID]
+		if !ok || settings == nil {
+			settings = map[string]interface{}{}
+		}
+
+		if err := pkg.SettingsSchema.Validate(normalizeJSONValue(settings)); err != nil {
+			check.Notes = append(check.Notes, CompilationNote{
+				Message: fmt.Sprintf("package %s: %s", pkg.Name, err),
+				Code:    ErrInvalidConfig,
+				PLR:     []PackageLocationReference{{PackageID: pkg.ID}},
+			})
+		}
+	}
+
+	if len(check.Notes) > 0 {
+		check.Message = fmt.Sprintf("environment %s has invalid settings for %d packages", env.Name, len(check.Notes))
+		return check
+	}
+
+	check.Passed = true
+
+	return check
+}
+
+// preflightVersion prevents the target environment from going backwards, unless the request allows it
+func preflightVersion(req *PromoteEnvironmentRequest, blueprint *DBBlueprint, to *DBEnvironment) PreflightCheck {
+	check := PreflightCheck{Name: PreflightVersion, Passed: true}
+
+	if to.BlueprintID == nil || to.BlueprintVersion == nil || *to.BlueprintID != blueprint.ID {
+		return check
+	}
+
+	current := *to.BlueprintVersion
+
+	switch {
+	case blueprint.Version.EQ(current.Version):
+		check.Passed = false
+		check.Message = fmt.Sprintf("environment %s is already running %s", to.Name, current)
+	case blueprint.Version.LT(current.Version):
+		check.Message = fmt.Sprintf("environment %s would go from %s back to %s", to.Name, current, blueprint.Version)
+
+		if req.AllowDowngrade {
+			check.Overridden = true
+		} else {
+			check.Passed = false
+		}
+	}
+
+	return check
+}
+
+// PromoteEnvironment runs the preflight checks and, if they pass, returns the promotion record along with the
+// target environment pointing at the promoted blueprint. Both still need to be saved
+func PromoteEnvironment(req *PromoteEnvironmentRequest, bot *APIBot, blueprint *DBBlueprint, compile BlueprintCompiler) (*DBPromotion, *DBEnvironment, error) {
+	preflight, err := PreflightPromotion(req, bot, blueprint, compile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !preflight.Passed() {
+		return nil, nil, &PreflightError{Preflight: preflight}
+	}
+
+	to := bot.GetEnvironment(req.ToEnvironmentID)
+
+	promotion := &DBPromotion{
+		ID:                       uuid.Must(uuid.NewRandom()),
+		BotID:                    bot.ID,
+		FromEnvironmentID:        req.FromEnvironmentID,
+		ToEnvironmentID:          req.ToEnvironmentID,
+		BlueprintID:              blueprint.ID,
+		BlueprintVersion:         blueprint.Version,
+		PreviousBlueprintID:      to.BlueprintID,
+		PreviousBlueprintVersion: to.BlueprintVersion,
+		Preflight:                *preflight,
+		CreatedAt:                TimePtr(time.Now()),
+	}
+
+	return promotion, promotion.apply(to), nil
+}
+
+// RollbackPromotion undoes a promotion, returning the record of the rollback and the restored environment
+// It fails if the environment has been promoted again since, or had no blueprint before
+func RollbackPromotion(promotion *DBPromotion, env *DBEnvironment) (*DBPromotion, *DBEnvironment, error) {
+	if env.ID != promotion.ToEnvironmentID {
+		return nil, nil, fmt.Errorf("%w: promotion was not made to environment %s", ErrNothingToRollBack, env.ID)
+	}
+
+	if promotion.PreviousBlueprintID == nil || promotion.PreviousBlueprintVersion == nil {
+		return nil, nil, fmt.Errorf("%w: environment had no blueprint before", ErrNothingToRollBack)
+	}
+
+	if env.BlueprintID == nil || env.BlueprintVersion == nil || *env.BlueprintID != promotion.BlueprintID ||
+		!env.BlueprintVersion.EQ(promotion.BlueprintVersion.Version) {
+		return nil, nil, fmt.Errorf("%w: environment has changed since", ErrNothingToRollBack)
+	}
+
+	promotionID := promotion.ID
+
+	rollback := &DBPromotion{
+		ID:                       uuid.Must(uuid.NewRandom()),
+		BotID:                    promotion.BotID,
+		FromEnvironmentID:        promotion.ToEnvironmentID,
+		ToEnvironmentID:          promotion.ToEnvironmentID,
+		BlueprintID:              *promotion.PreviousBlueprintID,
+		BlueprintVersion:         *promotion.PreviousBlueprintVersion,
+		PreviousBlueprintID:      env.BlueprintID,
+		PreviousBlueprintVersion: env.BlueprintVersion,
+		Preflight:                PromotionPreflight{Checks: []PreflightCheck{}},
+		RollbackOf:               &promotionID,
+		CreatedAt:                TimePtr(time.Now()),
+	}
+
+	return rollback, rollback.apply(env), nil
+}
+
+// apply returns a copy of env running the promoted blueprint
+func (p *DBPromotion) apply(env *DBEnvironment) *DBEnvironment {
+	updated := *env
+
+	blueprintID, version := p.BlueprintID, p.BlueprintVersion
+
+	updated.BlueprintID = &blueprintID
+	updated.BlueprintVersion = &version
+	updated.PromotedAt = p.CreatedAt
+
+	return &updated
+}
+
+// PreflightError is returned when a promotion is refused because of failed checks
+type PreflightError struct {
+	Preflight *PromotionPreflight
+}
+
+func (e *PreflightError) Error() string {
+	var failed []string
+
+	for _, c := range e.Preflight.Checks {
+		if !c.Passed {
+			failed = append(failed, c.Name)
+		}
+	}
+
+	return fmt.Sprintf("%s: %v", ErrPreflightFailed, failed)
+}
+
+func (e *PreflightError) Unwrap() error {
+	return ErrPreflightFailed
+}
+
+// PromotionError converts a refused promotion into an API error, including the preflight checks if they ran
+func PromotionError(err error) *APIError {
+	apiErr := &APIError{
+		statusCode: http.StatusBadRequest,
+		Code:       ErrPromotionFailed,
+		Message:    err.Error(),
+	}
+
+	var pErr *PreflightError
+	if errors.As(err, &pErr) {
+		apiErr.statusCode = http.StatusConflict
+		apiErr.Data = pErr.Preflight
+	}
+
+	if errors.Is(err, ErrEnvironmentNotFound) {
+		apiErr.statusCode = http.StatusNotFound
+		apiErr.Code = ErrResourceNotFound
+	}
+
+	return apiErr
+}
@@ -0,0 +1,167 @@
+package ctypes
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func compilesCleanly(*DBBlueprint) (*CompilerResult, error) {
+	return &CompilerResult{}, nil
+}
+
+func TestPromoteEnvironment(t *testing.T) {
+	botID := uuid.Must(uuid.NewRandom())
+	pkgID := uuid.Must(uuid.NewRandom())
+	blueprintID := uuid.Must(uuid.NewRandom())
+
+	staging := DBEnvironment{
+		ID:               uuid.Must(uuid.NewRandom()),
+		Name:             "staging",
+		BotID:            botID,
+		BlueprintID:      &blueprintID,
+		BlueprintVersion: svp("0.0.3"),
+	}
+
+	production := DBEnvironment{
+		ID:               uuid.Must(uuid.NewRandom()),
+		Name:             "production",
+		BotID:            botID,
+		Data:             EnvironmentData{pkgID: map[string]interface{}{"token": "abc"}},
+		BlueprintID:      &blueprintID,
+		BlueprintVersion: svp("0.0.2"),
+	}
+
+	bot := &APIBot{
+		DBBot:        &DBBot{ID: botID},
+		Environments: DBEnvironments{staging, production},
+		Packages: []Package{{
+			DBPackage: DBPackage{ID: pkgID, Name: "slack"},
+			SettingsSchema: &ConfigSchema{
+				Type:       SchemaObject,
+				Properties: map[string]*ConfigSchema{"token": {Type: SchemaString}},
+				Required:   []string{"token"},
+			},
+		}},
+	}
+
+	blueprint := &DBBlueprint{ID: blueprintID, BotID: botID, Version: sv("0.0.3"), Locked: true}
+
+	req := &PromoteEnvironmentRequest{FromEnvironmentID: staging.ID, ToEnvironmentID: production.ID}
+
+	promotion, env, err := PromoteEnvironment(req, bot, blueprint, compilesCleanly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env.BlueprintVersion.String() != "0.0.3" || env.PromotedAt == nil || promotion.PreviousBlueprintVersion.String() != "0.0.2" {
+		t.Errorf("unexpected promotion %+v %+v", promotion, env)
+	}
+
+	if bot.Environments[1].BlueprintVersion.String() != "0.0.2" {
+		t.Error("expected the bot's environment to be left alone")
+	}
+
+	rollback, restored, err := RollbackPromotion(promotion, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.BlueprintVersion.String() != "0.0.2" || *rollback.RollbackOf != promotion.ID {
+		t.Errorf("unexpected rollback %+v %+v", rollback, restored)
+	}
+
+	if _, _, err := RollbackPromotion(promotion, restored); !errors.Is(err, ErrNothingToRollBack) {
+		t.Errorf("expected a second rollback to fail, got %v", err)
+	}
+}
+
+func TestPromoteEnvironment_Preflight(t *testing.T) {
+	botID := uuid.Must(uuid.NewRandom())
+	pkgID := uuid.Must(uuid.NewRandom())
+	blueprintID := uuid.Must(uuid.NewRandom())
+
+	staging := DBEnvironment{
+		ID:               uuid.Must(uuid.NewRandom()),
+		Name:             "staging",
+		BotID:            botID,
+		BlueprintID:      &blueprintID,
+		BlueprintVersion: svp("0.0.3"),
+	}
+
+	production := DBEnvironment{
+		ID:               uuid.Must(uuid.NewRandom()),
+		Name:             "production",
+		BotID:            botID,
+		Data:             EnvironmentData{pkgID: map[string]interface{}{"token": "abc"}},
+		BlueprintID:      &blueprintID,
+		BlueprintVersion: svp("0.0.2"),
+	}
+
+	bot := &APIBot{
+		DBBot:        &DBBot{ID: botID},
+		Environments: DBEnvironments{staging, production},
+		Packages: []Package{{
+			DBPackage: DBPackage{ID: pkgID, Name: "slack"},
+			SettingsSchema: &ConfigSchema{
+				Type:       SchemaObject,
+				Properties: map[string]*ConfigSchema{"token": {Type: SchemaString}},
+				Required:   []string{"token"},
+			},
+		}},
+	}
+
+	blueprint := &DBBlueprint{ID: blueprintID, BotID: botID, Version: sv("0.0.3"), Locked: true}
+
+	req := &PromoteEnvironmentRequest{FromEnvironmentID: staging.ID, ToEnvironmentID: production.ID}
+
+	failing := func(*DBBlueprint) (*CompilerResult, error) {
+		return &CompilerResult{Errors: []CompilationNote{{Message: "broken"}}}, nil
+	}
+
+	_, _, err := PromoteEnvironment(req, bot, blueprint, failing)
+
+	apiErr := PromotionError(err)
+	if !errors.Is(err, ErrPreflightFailed) || apiErr.HTTPStatusCode() != http.StatusConflict || apiErr.Code != ErrPromotionFailed {
+		t.Fatalf("expected a failed compile check, got %v", err)
+	}
+
+	// Missing package settings
+	bot.Environments[1].Data = EnvironmentData{}
+
+	preflight, err := PreflightPromotion(req, bot, blueprint, compilesCleanly)
+	if err != nil || preflight.Passed() || preflight.Checks[1].Passed || len(preflight.Checks[1].Notes) != 1 {
+		t.Errorf("expected the environment config check to fail, got %+v %v", preflight, err)
+	}
+
+	// Going backwards needs an override
+	bot.Environments[1].Data = production.Data
+	bot.Environments[1].BlueprintVersion = svp("0.0.4")
+
+	if _, _, err := PromoteEnvironment(req, bot, blueprint, compilesCleanly); !errors.Is(err, ErrPreflightFailed) {
+		t.Errorf("expected a downgrade to fail, got %v", err)
+	}
+
+	req.AllowDowngrade = true
+
+	promotion, _, err := PromoteEnvironment(req, bot, blueprint, compilesCleanly)
+	if err != nil || !promotion.Preflight.Overridden() {
+		t.Errorf("expected an overridden downgrade, got %+v %v", promotion, err)
+	}
+
+	blueprint.Locked = false
+
+	if _, err := PreflightPromotion(req, bot, blueprint, compilesCleanly); !errors.Is(err, ErrPromotionUnlocked) {
+		t.Errorf("expected ErrPromotionUnlocked, got %v", err)
+	}
+
+	req.ToEnvironmentID = uuid.Must(uuid.NewRandom())
+
+	_, err = PreflightPromotion(req, bot, blueprint, compilesCleanly)
+
+	if apiErr := PromotionError(err); apiErr.HTTPStatusCode() != http.StatusNotFound {
+		t.Errorf("expected a missing environment to be not found, got %d", apiErr.HTTPStatusCode())
+	}
+}
@@ -0,0 +1,303 @@
+package ctypes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"upper.io/db.v3/postgresql"
+)
+
+var ErrInvalidVariableName = errors.New("invalid environment variable name")
+
+// variableRefRegex matches "${env.NAME}", "${env.NAME:-default}" and the "$$" escape for a literal "$"
+var variableRefRegex = regexp.MustCompile(`\$\$|\$\{env\.([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+var variableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvironmentVariables are values node and link configs reference as "${env.NAME}", so the same blueprint can
+// point at different URLs or webhook targets in each environment
+type EnvironmentVariables map[string]string
+
+func (v EnvironmentVariables) Value() (driver.Value, error) {
+	return postgresql.EncodeJSONB(v)
+}
+
+func (v *EnvironmentVariables) Scan(src interface{}) error {
+	return postgresql.DecodeJSONB(v, src)
+}
+
+var (
+	_ driver.Valuer = &EnvironmentVariables{}
+	_ sql.Scanner   = &EnvironmentVariables{}
+)
+
+func (v EnvironmentVariables) Validate() error {
+	for name := range v {
+		if !variableNameRegex.MatchString(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidVariableName, name)
+		}
+	}
+
+	return nil
+}
+
+// VariableRefs lists the variables a config references, sorted and without duplicates
+// References with a default are included, as the environment may still override them
+func VariableRefs(configJSON string) []string {
+	seen := map[string]bool{}
+
+	for _, match := range variableRefRegex.FindAllStringSubmatch(configJSON, -1) {
+		if match[1] != "" {
+			seen[match[1]] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// ResolveConfig replaces the variable references in the string values of a JSON config
+// References without a value or default are left in place and returned as missing
+func (v EnvironmentVariables) ResolveConfig(configJSON string) (resolved string, missing []string, err error) {
+	if !variableRefRegex.MatchString(configJSON) {
+		return configJSON, nil, nil
+	}
+
+	var value interface{}
+
+	// Numbers are kept as written, so large integers survive the round trip
+	dec := json.NewDecoder(strings.NewReader(configJSON))
+	dec.UseNumber()
+
+	if err := dec.Decode(&value); err != nil {
+		return "", nil, fmt.Errorf("config is not valid json: %w", err)
+	}
+
+	if dec.More() {
+		return "", nil, errors.New("config is not valid json: unexpected data after the config")
+	}
+
+	value = v.resolveValue(value, &missing)
+
+	jsb, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(jsb), missing, nil
+}
+
+func (v EnvironmentVariables) resolveValue(value interface{}, missing *[]string) interface{} {
+	switch val := value.(type) {
+	case string:
+		return v.resolveString(val, missing)
+	case map[string]interface{}:
+		for k, c := range val {
+			val[k] = v.resolveValue(c, missing)
+		}
+	case []interface{}:
+		for i, c := range val {
+			val[i] = v.resolveValue(c, missing)
+		}
+	}
+
+	return value
+}
+
+func (v EnvironmentVariables) resolveString(s string, missing *[]string) string {
+	return variableRefRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+
+		match := variableRefRegex.FindStringSubmatch(ref)
+
+		if value, ok := v[match[1]]; ok {
+			return value
+		}
+
+		// An empty default is still a default
+		if strings.Contains(ref, ":-") {
+			return match[2]
+		}
+
+		if !StringSliceContains(*missing, match[1]) {
+			*missing = append(*missing, match[1])
+		}
+
+		return ref
+	})
+}
+
+// UnresolvedVariable is a variable referenced by configs that an environment does not define
+type UnresolvedVariable struct {
+	Name string                   `json:"name"`
+	GLR  []GraphLocationReference `json:"glr"`
+}
+
+// VariableReport lists the unresolved variables of a single environment
+type VariableReport struct {
+	EnvironmentID uuid.UUID            `json:"environment_id"`
+	Unresolved    []UnresolvedVariable `json:"unresolved"`
+}
+
+// Resolved is true if every reference could be resolved
+func (r *VariableReport) Resolved() bool {
+	return len(r.Unresolved) == 0
+}
+
+// Notes converts the report into compilation errors, one per unresolved variable
+func (r *VariableReport) Notes() []CompilationNote {
+	notes := make([]CompilationNote, len(r.Unresolved))
+
+	for i, u := range r.Unresolved {
+		notes[i] = CompilationNote{
+			Message: fmt.Sprintf("environment variable %s is not defined", u.Name),
+			Code:    ErrUnresolvedVariable,
+			GLR:     u.GLR,
+		}
+	}
+
+	return notes
+}
+
+func (r *VariableReport) add(name string, ref GraphLocationReference) {
+	for i := range r.Unresolved {
+		if r.Unresolved[i].Name == name {
+			r.Unresolved[i].GLR = append(r.Unresolved[i].GLR, ref)
+			return
+		}
+	}
+
+	r.Unresolved = append(r.Unresolved, UnresolvedVariable{Name: name, GLR: []GraphLocationReference{ref}})
+}
+
+// sort orders variables by name and their references by location, as compiled modules are not ordered
+func (r *VariableReport) sort() {
+	sort.Slice(r.Unresolved, func(i, j int) bool { return r.Unresolved[i].Name < r.Unresolved[j].Name })
+
+	for _, u := range r.Unresolved {
+		sort.Slice(u.GLR, func(i, j int) bool { return glrKey(u.GLR[i]) < glrKey(u.GLR[j]) })
+	}
+}
+
+func glrKey(ref GraphLocationReference) string {
+	key := ref.ModuleID.String()
+
+	if ref.NodeID != nil {
+		key += "n" + ref.NodeID.String()
+	}
+
+	if ref.LinkID != nil {
+		key += "l" + ref.LinkID.String()
+	}
+
+	return key
+}
+
+// ResolveVariables returns a copy of the compiled bot with the variable references in every config replaced by
+// the values of env, along with a report of the references env could not resolve
+func (b *CompiledBot) ResolveVariables(env *DBEnvironment) (*CompiledBot, *VariableReport, error) {
+	report := &VariableReport{EnvironmentID: env.ID, Unresolved: []UnresolvedVariable{}}
+
+	resolved := *b
+	resolved.Modules = make(map[uuid.UUID]CompiledGraphModule, len(b.Modules))
+
+	for moduleID, module := range b.Modules {
+		rm := CompiledGraphModule{
+			Nodes: make(map[uuid.UUID]CompiledGraphNode, len(module.Nodes)),
+			Links: make([]CompiledGraphLink, len(module.Links)),
+		}
+
+		for nodeID, n := range module.Nodes {
+			if n.ConfigJSON != nil {
+				config, missing, err := env.Variables.ResolveConfig(*n.ConfigJSON)
+				if err != nil {
+					return nil, nil, fmt.Errorf("node %s: %w", nodeID, err)
+				}
+
+				id := nodeID
+				for _, name := range missing {
+					report.add(name, GraphLocationReference{ModuleID: moduleID, NodeID: &id, Type: LRTypeConfig})
+				}
+
+				n.ConfigJSON = &config
+			}
+
+			rm.Nodes[nodeID] = n
+		}
+
+		for i, l := range module.Links {
+			config, missing, err := env.Variables.ResolveConfig(l.ConfigJSON)
+			if err != nil {
+				return nil, nil, fmt.Errorf("link %s: %w", l.ID, err)
+			}
+
+			id := l.ID
+			for _, name := range missing {
+				report.add(name, GraphLocationReference{ModuleID: moduleID, LinkID: &id, Type: LRTypeConfig})
+			}
+
+			l.ConfigJSON = config
+			rm.Links[i] = l
+		}
+
+		resolved.Modules[moduleID] = rm
+	}
+
+	report.sort()
+
+	return &resolved, report, nil
+}
+
+// UnresolvedVariables checks the configs of a blueprint's modules against each environment, without compiling
+func UnresolvedVariables(modules DBModuleList, envs []DBEnvironment) []VariableReport {
+	reports := make([]VariableReport, len(envs))
+
+	for i, env := range envs {
+		report := VariableReport{EnvironmentID: env.ID, Unresolved: []UnresolvedVariable{}}
+
+		check := func(configJSON string, ref GraphLocationReference) {
+			// Invalid configs are reported by config validation
+			_, missing, _ := env.Variables.ResolveConfig(configJSON)
+
+			for _, name := range missing {
+				report.add(name, ref)
+			}
+		}
+
+		for _, moduleID := range sortedModuleIDs(modules) {
+			graph := modules[moduleID].Graph
+
+			for _, nodeID := range sortedNodeIDs(graph.Nodes) {
+				if n := graph.Nodes[nodeID]; n.ConfigJSON != nil {
+					id := nodeID
+					check(*n.ConfigJSON, GraphLocationReference{ModuleID: moduleID, NodeID: &id, Type: LRTypeConfig})
+				}
+			}
+
+			for _, l := range sortedLinks(graph.Links) {
+				id := l.ID
+				check(l.ConfigJSON, GraphLocationReference{ModuleID: moduleID, LinkID: &id, Type: LRTypeConfig})
+			}
+		}
+
+		report.sort()
+		reports[i] = report
+	}
+
+	return reports
+}
@@ -0,0 +1,92 @@
+package ctypes
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestEnvironmentVariables_ResolveConfig(t *testing.T) {
+	vars := EnvironmentVariables{"API_URL": "https://prod.example.com", "EMPTY": ""}
+
+	tests := []struct {
+		config  string
+		want    string
+		missing []string
+	}{
+		{`{"url":"${env.API_URL}/hook"}`, `{"url":"https://prod.example.com/hook"}`, nil},
+		{`{"list":["${env.MISSING}", "${env.API_URL}"]}`, `{"list":["${env.MISSING}","https://prod.example.com"]}`, []string{"MISSING"}},
+		{`{"timeout":"${env.TIMEOUT:-30s}","empty":"${env.EMPTY:-x}"}`, `{"empty":"","timeout":"30s"}`, nil},
+		{`{"price":"$${env.API_URL}"}`, `{"price":"${env.API_URL}"}`, nil},
+		{`{"plain":true}`, `{"plain":true}`, nil},
+		{`{"id":9007199254740993,"ratio":0.10,"url":"${env.API_URL}"}`, `{"id":9007199254740993,"ratio":0.10,"url":"https://prod.example.com"}`, nil},
+	}
+
+	for _, tt := range tests {
+		got, missing, err := vars.ResolveConfig(tt.config)
+		if err != nil {
+			t.Errorf("%s: %s", tt.config, err)
+			continue
+		}
+
+		if got != tt.want || !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("%s: expected %s %v, got %s %v", tt.config, tt.want, tt.missing, got, missing)
+		}
+	}
+
+	if _, _, err := vars.ResolveConfig(`{"url":"${env.API_URL}"} {}`); err == nil {
+		t.Error("expected trailing data to be rejected")
+	}
+
+	if refs := VariableRefs(`{"a":"${env.B} ${env.A:-x} $${env.C}","b":"${env.B}"}`); !reflect.DeepEqual(refs, []string{"A", "B"}) {
+		t.Errorf("unexpected refs %v", refs)
+	}
+
+	if err := (EnvironmentVariables{"bad-name": ""}).Validate(); !errors.Is(err, ErrInvalidVariableName) {
+		t.Errorf("expected ErrInvalidVariableName, got %v", err)
+	}
+}
+
+func TestCompiledBot_ResolveVariables(t *testing.T) {
+	moduleID, nodeID, linkID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	config := `{"url":"${env.API_URL}"}`
+
+	bot := &CompiledBot{Modules: map[uuid.UUID]CompiledGraphModule{moduleID: {
+		Nodes: map[uuid.UUID]CompiledGraphNode{nodeID: {ID: nodeID, ConfigJSON: &config}},
+		Links: []CompiledGraphLink{{ID: linkID, ConfigJSON: `{"target":"${env.WEBHOOK}"}`}},
+	}}}
+
+	prod := &DBEnvironment{ID: uuid.Must(uuid.NewRandom()), Variables: EnvironmentVariables{"API_URL": "https://prod"}}
+
+	resolved, report, err := bot.ResolveVariables(prod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *resolved.Modules[moduleID].Nodes[nodeID].ConfigJSON != `{"url":"https://prod"}` || config != `{"url":"${env.API_URL}"}` {
+		t.Errorf("expected a resolved copy, got %s", *resolved.Modules[moduleID].Nodes[nodeID].ConfigJSON)
+	}
+
+	if report.Resolved() || len(report.Unresolved) != 1 || report.Unresolved[0].Name != "WEBHOOK" || *report.Unresolved[0].GLR[0].LinkID != linkID {
+		t.Errorf("expected WEBHOOK to be unresolved, got %+v", report)
+	}
+
+	if notes := report.Notes(); len(notes) != 1 || notes[0].Code != ErrUnresolvedVariable {
+		t.Errorf("unexpected notes %+v", notes)
+	}
+
+	modules := DBModuleList{moduleID: {ModuleID: moduleID, Graph: GraphModule{
+		ID:    moduleID,
+		Nodes: map[uuid.UUID]GraphNode{nodeID: {ID: nodeID, ConfigJSON: &config}},
+		Links: []GraphLink{},
+	}}}
+
+	dev := DBEnvironment{ID: uuid.Must(uuid.NewRandom())}
+
+	reports := UnresolvedVariables(modules, []DBEnvironment{*prod, dev})
+	if !reports[0].Resolved() || reports[1].Resolved() || reports[1].Unresolved[0].Name != "API_URL" {
+		t.Errorf("unexpected reports %+v", reports)
+	}
+}
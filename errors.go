@@ -92,3 +92,12 @@ func GenericError(err error) *APIError {
 		Message: msg,
 	}
 }
+
+// SignatureError converts a signature verification failure into an API error
+func SignatureError(err error) *APIError {
+	return &APIError{
+		statusCode: http.StatusUnauthorized,
+		Code:       ErrInvalidSignature,
+		Message:    err.Error(),
+	}
+}
@@ -0,0 +1,255 @@
+package ctypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// HeaderPackageID identifies the package that signed a request sent to Convai
+const HeaderPackageID = "X-Convai-Package-ID"
+
+// GinKeyPackageID is the gin context key the verified package id is stored under
+const GinKeyPackageID = "convai_package_id"
+
+// DefaultEventBatchSize is the maximum number of events sent in a single AsyncEventRequest
+const DefaultEventBatchSize = 100
+
+var ErrUnknownPackage = errors.New("unknown package")
+
+// EventClient is used by packages to send events to Convai
+type EventClient struct {
+	baseURL    string
+	packageID  uuid.UUID
+	signingKey string
+	client     http.Client
+
+	// MaxBatchSize limits how many events are sent per AsyncEventRequest
+	MaxBatchSize int
+}
+
+func NewEventClient(baseURL string, packageID uuid.UUID, signingKey string) *EventClient {
+	return &EventClient{
+		baseURL:      baseURL,
+		packageID:    packageID,
+		signingKey:   signingKey,
+		MaxBatchSize: DefaultEventBatchSize,
+		client: http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// SendEvent sends a single event and waits for the resulting execution to complete
+func (e *EventClient) SendEvent(event *Event) (*EventResponse, error) {
+	var result EventResponse
+
+	err := e.makeRequestWithBody("POST", "/v1/events", EventRequest{Event: *event}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// SendAsyncEvents queues events for execution, splitting them into batches of MaxBatchSize
+// The indexes in the returned errors always refer to the events slice that was passed in.
+// If a whole batch fails to send, every event in that batch is reported as failed
+func (e *EventClient) SendAsyncEvents(events []Event) (*AsyncEventResponse, error) {
+	batchSize := e.MaxBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultEventBatchSize
+	}
+
+	merged := AsyncEventResponse{
+		Errors: EventResponseErrors{},
+	}
+
+	var lastErr error
+
+	for start := 0; start < len(events); start += batchSize {
+		end := start + batchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		var result AsyncEventResponse
+
+		err := e.makeRequestWithBody("POST", "/v1/events/async", AsyncEventRequest{Events: events[start:end]}, &result)
+		if err != nil {
+			lastErr = err
+
+			for i := start; i < end; i++ {
+				merged.Errors[i] = Error{Code: ErrGenericError, Message: err.Error()}
+			}
+
+			continue
+		}
+
+		merged.QueueCount += result.QueueCount
+
+		for idx, evtErr := range result.Errors {
+			merged.Errors[start+idx] = evtErr
+		}
+	}
+
+	// Only fail outright if nothing at all could be queued
+	if lastErr != nil && merged.QueueCount == 0 {
+		return &merged, lastErr
+	}
+
+	return &merged, nil
+}
+
+func (e *EventClient) makeRequestWithBody(method, url string, body interface{}, out interface{}) error {
+	jsb, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s%s", e.baseURL, url), bytes.NewReader(jsb))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(HeaderPackageID, e.packageID.String())
+	SignRequest(req, jsb, e.signingKey)
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	rsb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var apiErr APIError
+
+		if jsonErr := json.Unmarshal(rsb, &apiErr); jsonErr != nil || apiErr.Message == "" {
+			return &PackageClientError{Status: res.StatusCode, Body: string(rsb)}
+		}
+
+		return apiErr.WithHTTPCode(res.StatusCode)
+	}
+
+	return json.Unmarshal(rsb, out)
+}
+
+// Indexes returns the indexes of all failed events in ascending order
+func (e EventResponseErrors) Indexes() []int {
+	var idxs []int
+
+	for i := range e {
+		idxs = append(idxs, i)
+	}
+
+	sort.Ints(idxs)
+
+	return idxs
+}
+
+// FailedEvents returns the events from the original request that could not be queued, so they can be retried
+func (r *AsyncEventResponse) FailedEvents(events []Event) []Event {
+	var failed []Event
+
+	for _, i := range r.Errors.Indexes() {
+		if i >= 0 && i < len(events) {
+			failed = append(failed, events[i])
+		}
+	}
+
+	return failed
+}
+
+// PackageKeyLookup returns the signing keys (current first, then previous) of a package
+type PackageKeyLookup func(packageID uuid.UUID) ([]string, error)
+
+// PackageRequestVerifier authenticates requests sent by packages to Convai
+type PackageRequestVerifier struct {
+	Lookup    PackageKeyLookup
+	Tolerance time.Duration
+	Replays   ReplayCache
+}
+
+func NewPackageRequestVerifier(lookup PackageKeyLookup) *PackageRequestVerifier {
+	return &PackageRequestVerifier{
+		Lookup:    lookup,
+		Tolerance: DefaultSignatureTolerance,
+		Replays:   NewMemoryReplayCache(),
+	}
+}
+
+// Verify checks the signature of a request made by a package, and returns the id of that package
+func (v *PackageRequestVerifier) Verify(r *http.Request) (uuid.UUID, error) {
+	packageID, err := uuid.Parse(r.Header.Get(HeaderPackageID))
+	if err != nil {
+		return uuid.Nil, ErrUnknownPackage
+	}
+
+	keys, err := v.Lookup(packageID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if len(keys) == 0 {
+		return uuid.Nil, ErrUnknownPackage
+	}
+
+	verifier := RequestVerifier{
+		Keys:      keys,
+		Tolerance: v.Tolerance,
+		Replays:   v.Replays,
+	}
+
+	if err := verifier.Verify(r); err != nil {
+		return uuid.Nil, err
+	}
+
+	return packageID, nil
+}
+
+// GinMiddleware aborts requests that were not signed by a known package
+// The verified package id is available from the gin context under GinKeyPackageID
+func (v *PackageRequestVerifier) GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		packageID, err := v.Verify(c.Request)
+		if err != nil {
+			SignatureError(err).AbortGin(c)
+			return
+		}
+
+		c.Set(GinKeyPackageID, packageID)
+		c.Next()
+	}
+}
+
+// PackageKeysFromList creates a key lookup from a list of packages, useful when all packages are already loaded
+func PackageKeysFromList(packages []DBPackage) PackageKeyLookup {
+	keys := map[uuid.UUID][]string{}
+
+	for _, p := range packages {
+		keys[p.ID] = p.VerificationKeys()
+	}
+
+	return func(packageID uuid.UUID) ([]string, error) {
+		if k, ok := keys[packageID]; ok {
+			return k, nil
+		}
+
+		return nil, ErrUnknownPackage
+	}
+}
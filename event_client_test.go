@@ -0,0 +1,105 @@
+package ctypes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func newEventTestServer(pkg DBPackage, batches *[]int) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(NewPackageRequestVerifier(PackageKeysFromList([]DBPackage{pkg})).GinMiddleware())
+
+	router.POST("/v1/events", func(c *gin.Context) {
+		if c.MustGet(GinKeyPackageID).(uuid.UUID) != pkg.ID {
+			c.Status(http.StatusForbidden)
+			return
+		}
+
+		c.JSON(http.StatusOK, EventResponse{})
+	})
+
+	router.POST("/v1/events/async", func(c *gin.Context) {
+		var req AsyncEventRequest
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+
+		*batches = append(*batches, len(req.Events))
+
+		res := AsyncEventResponse{Errors: EventResponseErrors{}}
+
+		// Reject every event without text
+		for i, e := range req.Events {
+			if e.Text == "" {
+				res.Errors[i] = Error{Code: 1, Message: "missing text"}
+			} else {
+				res.QueueCount++
+			}
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	return httptest.NewServer(router)
+}
+
+func TestEventClient_SendEvent(t *testing.T) {
+	pkg := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+	srv := newEventTestServer(pkg, &[]int{})
+	defer srv.Close()
+
+	if _, err := NewEventClient(srv.URL, pkg.ID, pkg.SigningKey).SendEvent(&Event{ID: "message", Text: "hi"}); err != nil {
+		t.Errorf("expected event to be accepted, got %v", err)
+	}
+
+	_, err := NewEventClient(srv.URL, pkg.ID, "wrong").SendEvent(&Event{ID: "message", Text: "hi"})
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+
+	_, err = NewEventClient(srv.URL, uuid.Must(uuid.NewRandom()), pkg.SigningKey).SendEvent(&Event{ID: "message"})
+	if err == nil {
+		t.Error("expected unknown package to be rejected")
+	}
+}
+
+func TestEventClient_SendAsyncEvents(t *testing.T) {
+	pkg := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	var batches []int
+	srv := newEventTestServer(pkg, &batches)
+	defer srv.Close()
+
+	client := NewEventClient(srv.URL, pkg.ID, pkg.SigningKey)
+	client.MaxBatchSize = 2
+
+	events := []Event{{Text: "a"}, {Text: "b"}, {Text: ""}, {Text: "d"}, {Text: ""}}
+
+	res, err := client.SendAsyncEvents(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 3 || batches[0] != 2 || batches[2] != 1 {
+		t.Errorf("unexpected batches %v", batches)
+	}
+
+	if res.QueueCount != 3 {
+		t.Errorf("expected 3 queued events, got %d", res.QueueCount)
+	}
+
+	idxs := res.Errors.Indexes()
+	if len(idxs) != 2 || idxs[0] != 2 || idxs[1] != 4 {
+		t.Errorf("expected errors at indexes [2 4], got %v", idxs)
+	}
+
+	if failed := res.FailedEvents(events); len(failed) != 2 {
+		t.Errorf("expected 2 failed events, got %d", len(failed))
+	}
+}
@@ -15,6 +15,12 @@ type DBLink struct {
 	Name          string    `db:"name" json:"name"`
 	Documentation string    `db:"docs" json:"docs"`
 	Style         LinkStyle `db:"style" json:"style"`
+
+	// ConfigSchema describes the config of the link. Configs are not validated when it is nil
+	ConfigSchema *ConfigSchema `db:"config_schema,omitempty" json:"config_schema,omitempty"`
+
+	// Migrations upgrade configs from older versions of this link type to this version
+	Migrations ConfigMigrations `db:"migrations,omitempty" json:"migrations,omitempty"`
 }
 
 // CompiledGraphLink is the variant of link that lives in a compiled executable
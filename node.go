@@ -15,6 +15,12 @@ type DBNode struct {
 	Name          string    `db:"name" json:"name"`
 	Documentation string    `db:"docs" json:"docs"`
 	Style         NodeStyle `db:"style" json:"style"`
+
+	// ConfigSchema describes the config of the node. Configs are not validated when it is nil
+	ConfigSchema *ConfigSchema `db:"config_schema,omitempty" json:"config_schema,omitempty"`
+
+	// Migrations upgrade configs from older versions of this node type to this version
+	Migrations ConfigMigrations `db:"migrations,omitempty" json:"migrations,omitempty"`
 }
 
 type CompiledGraphNode struct {
@@ -0,0 +1,443 @@
+package ctypes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ContentTypeNDJSON is the content type of streamed node executions, one JSON event per line
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// MaxNodeStreamLineSize is the largest single event a package may stream (4MB)
+const MaxNodeStreamLineSize = 4 << 20
+
+// Node stream event types
+const (
+	NodeStreamLog            = "log"
+	NodeStreamTransformation = "transformation"
+	NodeStreamResult         = "result"
+	NodeStreamError          = "error"
+)
+
+// NodeStreamEvent is a single line of a streamed node execution
+// Log and transformation events are progressive, the result event is always last and holds the complete result
+// (including every log and transformation that was streamed before it)
+type NodeStreamEvent struct {
+	Type           string          `json:"type"`
+	Log            *LogEntry       `json:"log,omitempty"`
+	Transformation *Transformation `json:"transformation,omitempty"`
+	Result         *NodeCallResult `json:"result,omitempty"`
+	Error          *Error          `json:"error,omitempty"`
+}
+
+// NodeStream is a node execution in progress. Events are read with Next until io.EOF
+type NodeStream struct {
+	call    NodeCall
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+
+	// Events replayed from a non streaming execution, used when the package does not support streaming
+	replay []NodeStreamEvent
+
+	result *NodeCallResult
+	err    error
+}
+
+// Streamed reports whether the package streamed the execution, or whether the stream is replaying a regular execution
+func (s *NodeStream) Streamed() bool {
+	return s.body != nil
+}
+
+// Next returns the next event of the stream. io.EOF is returned once the result has been read
+// Stream level failures (package errors, malformed lines, a missing result) are returned as errors
+func (s *NodeStream) Next() (*NodeStreamEvent, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	event, err := s.next()
+	if err != nil {
+		s.err = err
+		_ = s.Close()
+
+		return nil, err
+	}
+
+	return event, nil
+}
+
+func (s *NodeStream) next() (*NodeStreamEvent, error) {
+	if s.result != nil {
+		return nil, io.EOF
+	}
+
+	if s.body == nil {
+		event := s.replay[0]
+		s.replay = s.replay[1:]
+
+		if event.Type == NodeStreamResult {
+			s.result = event.Result
+		}
+
+		return &event, nil
+	}
+
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event NodeStreamEvent
+
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, &PackageProtocolError{Kind: PPEMalformedResponse, Index: -1, Message: err.Error()}
+		}
+
+		if err := s.validate(&event); err != nil {
+			return nil, err
+		}
+
+		if event.Type == NodeStreamResult {
+			s.result = event.Result
+		}
+
+		return &event, nil
+	}
+
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, &PackageProtocolError{Kind: PPEMalformedResponse, Index: -1, Message: "stream ended without a result"}
+}
+
+func (s *NodeStream) validate(event *NodeStreamEvent) error {
+	switch event.Type {
+	case NodeStreamLog:
+		if event.Log == nil {
+			return &PackageProtocolError{Kind: PPEMalformedResponse, Index: 0, Message: "log event without a log"}
+		}
+
+		return validateLogs(0, []LogEntry{*event.Log})
+	case NodeStreamTransformation:
+		if event.Transformation == nil {
+			return &PackageProtocolError{Kind: PPEMalformedResponse, Index: 0, Message: "transformation event without a transformation"}
+		}
+
+		return ValidateNodeExecutionResponse([]NodeCall{s.call}, []NodeCallResult{{
+			RequestID:       s.call.RequestID,
+			Transformations: []Transformation{*event.Transformation},
+		}})
+	case NodeStreamResult:
+		if event.Result == nil {
+			return &PackageProtocolError{Kind: PPEMalformedResponse, Index: 0, Message: "result event without a result"}
+		}
+
+		return ValidateNodeExecutionResponse([]NodeCall{s.call}, []NodeCallResult{*event.Result})
+	case NodeStreamError:
+		if event.Error == nil {
+			return &PackageProtocolError{Kind: PPEMalformedResponse, Index: 0, Message: "error event without an error"}
+		}
+
+		return &PackageClientError{Status: http.StatusOK, Code: event.Error.Code, Message: event.Error.Message}
+	}
+
+	return &PackageProtocolError{Kind: PPEMalformedResponse, Index: 0, Message: fmt.Sprintf("unknown event type %q", event.Type)}
+}
+
+// Result reads the remaining events and returns the final result of the execution
+func (s *NodeStream) Result() (*NodeCallResult, error) {
+	for {
+		_, err := s.Next()
+		if err == io.EOF {
+			return s.result, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close stops reading the stream. It is safe to call Close more than once
+func (s *NodeStream) Close() error {
+	if s.body == nil {
+		return nil
+	}
+
+	return s.body.Close()
+}
+
+// newReplayStream presents a regular node execution result as a stream
+func newReplayStream(call NodeCall, result *NodeCallResult) *NodeStream {
+	stream := &NodeStream{call: call}
+
+	for i := range result.Logs {
+		stream.replay = append(stream.replay, NodeStreamEvent{Type: NodeStreamLog, Log: &result.Logs[i]})
+	}
+
+	for i := range result.Transformations {
+		stream.replay = append(stream.replay, NodeStreamEvent{Type: NodeStreamTransformation, Transformation: &result.Transformations[i]})
+	}
+
+	stream.replay = append(stream.replay, NodeStreamEvent{Type: NodeStreamResult, Result: result})
+
+	return stream
+}
+
+// streamingUnsupported reports whether a status code means the package does not provide the streaming endpoint
+func streamingUnsupported(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented
+}
+
+// ExecuteNodeStream executes a node, streaming logs and transformations as the package produces them
+// Packages that do not support streaming are called through the regular endpoint, and their result is replayed as a stream
+func (p *PackageClient) ExecuteNodeStream(call *NodeCall, mock bool) (*NodeStream, error) {
+	if !p.capabilities().Streaming {
+		return p.replayNode(call, mock)
+	}
+
+	url := fmt.Sprintf("%s/nodes/execute-stream", p.pkg.BaseURL)
+	if mock {
+		url = fmt.Sprintf("%s/nodes/execute-stream-mock", p.pkg.BaseURL)
+	}
+
+	body, err := json.Marshal(call)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", ContentTypeNDJSON)
+	p.sign(req, body)
+
+	res, err := p.stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if streamingUnsupported(res.StatusCode) {
+		_ = res.Body.Close()
+		return p.replayNode(call, mock)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		rsb, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, newPackageClientError(res.StatusCode, rsb)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), MaxNodeStreamLineSize)
+
+	return &NodeStream{call: *call, body: res.Body, scanner: scanner}, nil
+}
+
+func (p *PackageClient) replayNode(call *NodeCall, mock bool) (*NodeStream, error) {
+	var result *NodeCallResult
+	var err error
+
+	if mock {
+		result, err = p.ExecuteNodeMock(call)
+	} else {
+		result, err = p.ExecuteNode(call)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newReplayStream(*call, result), nil
+}
+
+// StreamingNodeHandler executes a node call, reporting progress through w as it goes
+// Everything written to w is also included in the final result, so the handler only needs to return errors
+type StreamingNodeHandler func(call *NodeCall, w *NodeStreamWriter) error
+
+// NodeStreamWriter sends node stream events to the client, accumulating them into the final result
+type NodeStreamWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	started time.Time
+	result  NodeCallResult
+	err     error
+}
+
+func newNodeStreamWriter(w io.Writer, requestID uuid.UUID) *NodeStreamWriter {
+	sw := &NodeStreamWriter{w: w, started: time.Now()}
+	sw.result.RequestID = requestID
+
+	if f, ok := w.(http.Flusher); ok {
+		sw.flusher = f
+	}
+
+	return sw
+}
+
+// Log streams a log entry
+func (w *NodeStreamWriter) Log(level int, message string) error {
+	return w.writeLog(LogEntry{
+		Message:    message,
+		Level:      level,
+		ExecOffset: time.Since(w.started).Milliseconds(),
+	})
+}
+
+func (w *NodeStreamWriter) writeLog(entry LogEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.result.Logs = append(w.result.Logs, entry)
+
+	return w.write(&NodeStreamEvent{Type: NodeStreamLog, Log: &entry})
+}
+
+// Transform streams a transformation
+func (w *NodeStreamWriter) Transform(t Transformation) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.result.Transformations = append(w.result.Transformations, t)
+
+	return w.write(&NodeStreamEvent{Type: NodeStreamTransformation, Transformation: &t})
+}
+
+// write must be called with mu held. Once a write fails (the client went away) all later writes fail
+func (w *NodeStreamWriter) write(event *NodeStreamEvent) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.w == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		w.err = err
+		return err
+	}
+
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+
+	return nil
+}
+
+// finish sends the result event
+func (w *NodeStreamWriter) finish(errs []Error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.result.Errors = append(w.result.Errors, errs...)
+	result := w.result
+
+	_ = w.write(&NodeStreamEvent{Type: NodeStreamResult, Result: &result})
+}
+
+// streamingNodeHandler adapts a streaming handler for the regular (non streaming) endpoints
+func streamingNodeHandler(handler StreamingNodeHandler) NodeHandler {
+	if handler == nil {
+		return nil
+	}
+
+	return func(call *NodeCall) (*NodeCallResult, error) {
+		w := newNodeStreamWriter(nil, call.RequestID)
+
+		// Like a streamed execution, anything produced before the failure is kept
+		if err := handler(call, w); err != nil {
+			w.result.Errors = append(w.result.Errors, Error{Code: ErrHandlerFailure, Message: err.Error()})
+		}
+
+		return &w.result, nil
+	}
+}
+
+func (s *PackageServer) handleNodeStream(mock bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var call NodeCall
+
+		if err := c.ShouldBindJSON(&call); err != nil {
+			InputValidationError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+			return
+		}
+
+		c.Header("Content-Type", ContentTypeNDJSON)
+		c.Status(http.StatusOK)
+
+		s.streamNode(&call, mock, newNodeStreamWriter(c.Writer, call.RequestID))
+	}
+}
+
+// streamNode runs a node call, streaming its progress to w. Nodes registered without a streaming handler
+// are executed normally, and their result is streamed once it is available
+func (s *PackageServer) streamNode(call *NodeCall, mock bool, w *NodeStreamWriter) {
+	reg, ok := s.nodes[handlerKey(call.TypeID, call.Version)]
+
+	handler := reg.stream
+	if mock && reg.streamMock != nil {
+		handler = reg.streamMock
+	}
+
+	if !ok || handler == nil {
+		result := s.executeNode(call, mock)
+
+		for _, l := range result.Logs {
+			_ = w.writeLog(l)
+		}
+
+		for _, t := range result.Transformations {
+			_ = w.Transform(t)
+		}
+
+		w.finish(result.Errors)
+
+		return
+	}
+
+	var errs []Error
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errs = []Error{handlerPanicError(r)}
+			}
+		}()
+
+		if err := handler(call, w); err != nil {
+			errs = []Error{{Code: ErrHandlerFailure, Message: err.Error()}}
+		}
+	}()
+
+	w.finish(errs)
+}
+
+func streamTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 10 * time.Second
+
+	return t
+}
@@ -0,0 +1,175 @@
+package ctypes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPackageClient_ExecuteNodeStream(t *testing.T) {
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	release := make(chan struct{})
+
+	srv := NewPackageServer(info)
+	srv.RegisterNode(DBNode{TypeID: "slow", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+		return &NodeCallResult{Transformations: []Transformation{{Path: "user.data.seq", Value: call.Sequence}}}, nil
+	}, nil)
+	srv.RegisterStreamingNode(DBNode{TypeID: "progress", Version: "0.0.1"}, func(call *NodeCall, w *NodeStreamWriter) error {
+		_ = w.Log(LogLevelInfo, "started")
+
+		// Block until the client has seen the first log, proving events arrive before the node finishes
+		<-release
+
+		_ = w.Transform(Transformation{Path: "user.data.progress", Value: 100, Operation: OpSet})
+
+		return errors.New("partially failed")
+	}, nil)
+
+	hs := httptest.NewServer(srv.Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	call := &NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "progress", Version: "0.0.1"}
+
+	stream, err := pc.ExecuteNodeStream(call, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stream.Close()
+
+	if !stream.Streamed() {
+		t.Error("expected package to stream")
+	}
+
+	event, err := stream.Next()
+	if err != nil || event.Type != NodeStreamLog || event.Log.Message != "started" {
+		t.Fatalf("expected first log before completion, got %+v %v", event, err)
+	}
+
+	close(release)
+
+	event, err = stream.Next()
+	if err != nil || event.Type != NodeStreamTransformation || event.Transformation.Path != "user.data.progress" {
+		t.Fatalf("expected transformation, got %+v %v", event, err)
+	}
+
+	result, err := stream.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.RequestID != call.RequestID || len(result.Logs) != 1 || len(result.Transformations) != 1 {
+		t.Errorf("expected result to contain streamed events, got %+v", result)
+	}
+
+	if len(result.Errors) != 1 || result.Errors[0].Code != ErrHandlerFailure {
+		t.Errorf("expected handler error in result, got %+v", result.Errors)
+	}
+
+	if _, err := stream.Next(); err != io.EOF {
+		t.Errorf("expected EOF after result, got %v", err)
+	}
+
+	// Regular nodes can be called through the stream endpoint, and streaming nodes through the regular one
+	stream, err = pc.ExecuteNodeStream(&NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "slow", Version: "0.0.1", Sequence: 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := stream.Result(); err != nil || len(result.Transformations) != 1 {
+		t.Errorf("expected regular node result to be streamed, got %+v %v", result, err)
+	}
+
+	plain, err := pc.ExecuteNode(&NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "progress", Version: "0.0.1"})
+	if err != nil || len(plain.Logs) != 1 {
+		t.Errorf("expected streaming node to work without streaming, got %+v %v", plain, err)
+	}
+}
+
+func TestPackageClient_ExecuteNodeStreamFallback(t *testing.T) {
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	router := NewPackageServer(info).
+		RegisterNode(DBNode{TypeID: "slow", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			return &NodeCallResult{}, nil
+		}, func(call *NodeCall) (*NodeCallResult, error) {
+			return &NodeCallResult{Logs: []LogEntry{{Message: "mocked", Level: LogLevelInfo}}}, nil
+		}).
+		Router()
+
+	// A package that predates streaming
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/nodes/execute-stream") {
+			http.NotFound(w, r)
+			return
+		}
+
+		router.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+
+	call := &NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "slow", Version: "0.0.1"}
+
+	stream, err := NewPackageClient(&info).ExecuteNodeStream(call, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stream.Streamed() {
+		t.Error("expected fallback to a replayed stream")
+	}
+
+	event, err := stream.Next()
+	if err != nil || event.Type != NodeStreamLog || event.Log.Message != "mocked" {
+		t.Fatalf("expected replayed mock log, got %+v %v", event, err)
+	}
+
+	result, err := stream.Result()
+	if err != nil || result.RequestID != call.RequestID {
+		t.Errorf("unexpected replayed result %+v %v", result, err)
+	}
+}
+
+func TestNodeStream_Malformed(t *testing.T) {
+	call := NodeCall{RequestID: uuid.Must(uuid.NewRandom())}
+
+	bodies := map[string]string{
+		"truncated": `{"type":"log","log":{"message":"hi","level":30}}` + "\n",
+		"bad level": `{"type":"log","log":{"message":"hi","level":31}}` + "\n",
+		"wrong id":  `{"type":"result","result":{"request_id":"` + uuid.Must(uuid.NewRandom()).String() + `"}}` + "\n",
+		"error":     `{"type":"error","error":{"code":482,"message":"gone"}}` + "\n",
+		"not json":  "nope\n",
+		"unknown":   `{"type":"progress"}` + "\n",
+	}
+
+	for name, body := range bodies {
+		hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ContentTypeNDJSON)
+			_, _ = w.Write([]byte(body))
+		}))
+
+		pc := NewPackageClient(&DBPackage{BaseURL: hs.URL, SigningKey: "secret"})
+
+		stream, err := pc.ExecuteNodeStream(&call, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := stream.Result(); err == nil {
+			t.Errorf("%s: expected stream to fail", name)
+		}
+
+		hs.Close()
+	}
+}
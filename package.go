@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -37,14 +40,19 @@ type BuildManifestRequest struct {
 }
 
 type DBPackage struct {
-	ID             uuid.UUID   `db:"id" json:"id" validate:"required"`
-	Name           string      `db:"name" json:"name" validate:"required"`
-	Description    string      `db:"description" json:"description"`
-	OrganizationID uuid.UUID   `db:"-" json:"organization_id"`
-	BaseURL        string      `db:"base_url" json:"base_url" validate:"required,url"`
-	SigningKey     string      `db:"signing_key" json:"signing_key,omitempty"`
-	CreatedAt      *CustomTime `db:"created_at,omitempty" json:"created_at,omitempty"`
-	UpdatedAt      *CustomTime `db:"updated_at,omitempty" json:"updated_at,omitempty"`
+	ID             uuid.UUID `db:"id" json:"id" validate:"required"`
+	Name           string    `db:"name" json:"name" validate:"required"`
+	Description    string    `db:"description" json:"description"`
+	OrganizationID uuid.UUID `db:"-" json:"organization_id"`
+	BaseURL        string    `db:"base_url" json:"base_url" validate:"required,url"`
+	SigningKey     string    `db:"signing_key" json:"signing_key,omitempty"`
+
+	// PreviousSigningKey is still accepted by packages while a key rotation is in progress
+	PreviousSigningKey string      `db:"previous_signing_key,omitempty" json:"previous_signing_key,omitempty"`
+	KeyRotatedAt       *CustomTime `db:"key_rotated_at,omitempty" json:"key_rotated_at,omitempty"`
+
+	CreatedAt *CustomTime `db:"created_at,omitempty" json:"created_at,omitempty"`
+	UpdatedAt *CustomTime `db:"updated_at,omitempty" json:"updated_at,omitempty"`
 }
 
 type Package struct {
@@ -54,6 +62,12 @@ type Package struct {
 	Links      []DBLink     `json:"links"`
 	Events     []DBEvent    `json:"events"`
 	Dispatches []DBDispatch `json:"dispatches"`
+
+	Modules   []PackageModule  `json:"modules"`
+	Templates PackageTemplates `json:"templates"`
+
+	// SettingsSchema describes the package settings stored on each environment
+	SettingsSchema *ConfigSchema `json:"settings_schema,omitempty"`
 }
 
 type PackageDifferences struct {
@@ -65,6 +79,25 @@ type PackageDifferences struct {
 	NewEvents         []DBEvent    `json:"new_events"`
 	UpdatedDispatches []DBDispatch `json:"updated_dispatches"`
 	NewDispatches     []DBDispatch `json:"new_dispatches"`
+
+	UpdatedModules   []PackageModule    `json:"updated_modules"`
+	NewModules       []PackageModule    `json:"new_modules"`
+	UpdatedTemplates []ResponseTemplate `json:"updated_templates"`
+	NewTemplates     []ResponseTemplate `json:"new_templates"`
+
+	RemovedNodes      []DBNode           `json:"removed_nodes"`
+	RemovedLinks      []DBLink           `json:"removed_links"`
+	RemovedEvents     []DBEvent          `json:"removed_events"`
+	RemovedDispatches []DBDispatch       `json:"removed_dispatches"`
+	RemovedModules    []PackageModule    `json:"removed_modules"`
+	RemovedTemplates  []ResponseTemplate `json:"removed_templates"`
+
+	// SettingsSchemaChanged is set when the settings schema was added, changed or removed. SettingsSchema is the new one
+	SettingsSchemaChanged bool          `json:"settings_schema_changed"`
+	SettingsSchema        *ConfigSchema `json:"settings_schema,omitempty"`
+
+	// Changes classifies every addition, update and removal above
+	Changes []PackageChange `json:"changes"`
 }
 
 func ComputePackageDifferences(old, new *Package) *PackageDifferences {
@@ -80,7 +113,7 @@ func ComputePackageDifferences(old, new *Package) *PackageDifferences {
 				alreadyExisted = true
 
 				// This node already existed. It only needs to be changed if it was updated
-				if oldNode.Name != newNode.Name || oldNode.Documentation != newNode.Documentation || !reflect.DeepEqual(oldNode.Style, newNode.Style) {
+				if oldNode.Name != newNode.Name || oldNode.Documentation != newNode.Documentation || !reflect.DeepEqual(oldNode.Style, newNode.Style) || !reflect.DeepEqual(oldNode.ConfigSchema, newNode.ConfigSchema) || !reflect.DeepEqual(oldNode.Migrations, newNode.Migrations) {
 					diff.UpdatedNodes = append(diff.UpdatedNodes, newNode)
 				}
 
@@ -103,7 +136,7 @@ func ComputePackageDifferences(old, new *Package) *PackageDifferences {
 				alreadyExisted = true
 
 				// This link already existed. It only needs to be changed if it was updated
-				if oldLink.Name != newLink.Name || oldLink.Documentation != newLink.Documentation || !reflect.DeepEqual(oldLink.Style, newLink.Style) {
+				if oldLink.Name != newLink.Name || oldLink.Documentation != newLink.Documentation || !reflect.DeepEqual(oldLink.Style, newLink.Style) || !reflect.DeepEqual(oldLink.ConfigSchema, newLink.ConfigSchema) || !reflect.DeepEqual(oldLink.Migrations, newLink.Migrations) {
 					diff.UpdatedLinks = append(diff.UpdatedLinks, newLink)
 				}
 
@@ -149,7 +182,7 @@ func ComputePackageDifferences(old, new *Package) *PackageDifferences {
 				alreadyExisted = true
 
 				// This dispatch already existed. It only needs to be changed if it was updated
-				if oldDispatch.Name != newDispatch.Name || oldDispatch.Documentation != newDispatch.Documentation {
+				if oldDispatch.Name != newDispatch.Name || oldDispatch.Documentation != newDispatch.Documentation || !reflect.DeepEqual(oldDispatch.ConfigSchema, newDispatch.ConfigSchema) {
 					diff.UpdatedDispatches = append(diff.UpdatedDispatches, newDispatch)
 				}
 
@@ -162,10 +195,218 @@ func ComputePackageDifferences(old, new *Package) *PackageDifferences {
 		}
 	}
 
+	for _, newModule := range new.Modules {
+		alreadyExisted := false
+
+		newModule.PackageID = new.ID
+
+		for _, oldModule := range old.Modules {
+			if oldModule.ID == newModule.ID && oldModule.PackageID == newModule.PackageID && oldModule.Version == newModule.Version {
+				alreadyExisted = true
+
+				// This module already existed. It only needs to be changed if it was updated
+				if oldModule.Name != newModule.Name || oldModule.Documentation != newModule.Documentation || !reflect.DeepEqual(oldModule.Graph, newModule.Graph) {
+					diff.UpdatedModules = append(diff.UpdatedModules, newModule)
+				}
+
+				break
+			}
+		}
+
+		if !alreadyExisted {
+			diff.NewModules = append(diff.NewModules, newModule)
+		}
+	}
+
+	for _, newTemplate := range new.Templates.Responses {
+		alreadyExisted := false
+
+		newTemplate.PackageID = new.ID
+
+		for _, oldTemplate := range old.Templates.Responses {
+			if oldTemplate.ID == newTemplate.ID && oldTemplate.PackageID == newTemplate.PackageID && oldTemplate.Version == newTemplate.Version {
+				alreadyExisted = true
+
+				// This template already existed. It only needs to be changed if it was updated
+				if oldTemplate.Name != newTemplate.Name || oldTemplate.Documentation != newTemplate.Documentation || oldTemplate.Template != newTemplate.Template {
+					diff.UpdatedTemplates = append(diff.UpdatedTemplates, newTemplate)
+				}
+
+				break
+			}
+		}
+
+		if !alreadyExisted {
+			diff.NewTemplates = append(diff.NewTemplates, newTemplate)
+		}
+	}
+
+	if !reflect.DeepEqual(old.SettingsSchema, new.SettingsSchema) {
+		diff.SettingsSchemaChanged = true
+		diff.SettingsSchema = new.SettingsSchema
+	}
+
+	computePackageRemovals(old, new, &diff)
+	classifyChanges(old, &diff)
+
 	return &diff
 }
 
+// computePackageRemovals finds everything in old that is no longer in new
+func computePackageRemovals(old, new *Package, diff *PackageDifferences) {
+	for _, oldNode := range old.Nodes {
+		found := false
+
+		for _, newNode := range new.Nodes {
+			if oldNode.TypeID == newNode.TypeID && oldNode.Version == newNode.Version {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			oldNode.PackageID = new.ID
+			diff.RemovedNodes = append(diff.RemovedNodes, oldNode)
+		}
+	}
+
+	for _, oldLink := range old.Links {
+		found := false
+
+		for _, newLink := range new.Links {
+			if oldLink.TypeID == newLink.TypeID && oldLink.Version == newLink.Version {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			oldLink.PackageID = new.ID
+			diff.RemovedLinks = append(diff.RemovedLinks, oldLink)
+		}
+	}
+
+	for _, oldEvent := range old.Events {
+		found := false
+
+		for _, newEvent := range new.Events {
+			if oldEvent.ID == newEvent.ID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			oldEvent.PackageID = new.ID
+			diff.RemovedEvents = append(diff.RemovedEvents, oldEvent)
+		}
+	}
+
+	for _, oldDispatch := range old.Dispatches {
+		found := false
+
+		for _, newDispatch := range new.Dispatches {
+			if oldDispatch.ID == newDispatch.ID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			oldDispatch.PackageID = new.ID
+			diff.RemovedDispatches = append(diff.RemovedDispatches, oldDispatch)
+		}
+	}
+
+	for _, oldModule := range old.Modules {
+		found := false
+
+		for _, newModule := range new.Modules {
+			if oldModule.ID == newModule.ID && oldModule.Version == newModule.Version {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			oldModule.PackageID = new.ID
+			diff.RemovedModules = append(diff.RemovedModules, oldModule)
+		}
+	}
+
+	for _, oldTemplate := range old.Templates.Responses {
+		found := false
+
+		for _, newTemplate := range new.Templates.Responses {
+			if oldTemplate.ID == newTemplate.ID && oldTemplate.Version == newTemplate.Version {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			oldTemplate.PackageID = new.ID
+			diff.RemovedTemplates = append(diff.RemovedTemplates, oldTemplate)
+		}
+	}
+}
+
+// RotateSigningKey makes newKey the active signing key, keeping the current key as the previous key
+// so that requests signed before the package picks up the new key still verify
+func (p *DBPackage) RotateSigningKey(newKey string) {
+	p.PreviousSigningKey = p.SigningKey
+	p.SigningKey = newKey
+	p.KeyRotatedAt = TimePtr(time.Now())
+}
+
+// FinishKeyRotation drops the previous signing key once the package only uses the new one
+func (p *DBPackage) FinishKeyRotation() {
+	p.PreviousSigningKey = ""
+}
+
+// VerificationKeys returns every key that may currently be used to sign requests for this package
+func (p *DBPackage) VerificationKeys() []string {
+	keys := []string{p.SigningKey}
+
+	if p.PreviousSigningKey != "" {
+		keys = append(keys, p.PreviousSigningKey)
+	}
+
+	return keys
+}
+
+// RequestVerifier creates a verifier that accepts both the current and previous signing keys
+func (p *DBPackage) RequestVerifier() *RequestVerifier {
+	return NewRequestVerifier(p.VerificationKeys()...)
+}
+
+// Cursor is the position of the package in lists sorted by creation, see ParsePackageCursor
 func (p *DBPackage) Cursor() string {
 	s := fmt.Sprintf("%d,%s", p.CreatedAt.UnixNano(), p.ID)
 	return b64.StdEncoding.EncodeToString([]byte(s))
 }
+
+// ParsePackageCursor decodes a cursor created by DBPackage.Cursor
+func ParsePackageCursor(cursor string) (createdAt time.Time, id uuid.UUID, err error) {
+	raw, err := b64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, uuid.Nil, ErrInvalidCursor
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, uuid.Nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+
+	id, err = uuid.Parse(parts[1])
+	if err != nil {
+		return time.Time{}, uuid.Nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+
+	return time.Unix(0, nanos), id, nil
+}
@@ -0,0 +1,289 @@
+package ctypes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAssetSize is the largest asset a PackageClient will download by default (2MB)
+const DefaultMaxAssetSize = 2 << 20
+
+// DefaultAllowedAssetTypes are the content types packages may serve assets as
+var DefaultAllowedAssetTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/svg+xml",
+	"image/x-icon",
+}
+
+var (
+	ErrInvalidAssetName = errors.New("invalid asset file name")
+	ErrAssetTooLarge    = errors.New("asset exceeds maximum size")
+	ErrAssetContentType = errors.New("asset content type is not allowed")
+)
+
+// CachedAsset is an asset downloaded from a package, along with the information needed to revalidate it
+type CachedAsset struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	ETag        string    `json:"etag"`
+	Data        []byte    `json:"data"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// AssetCache stores downloaded package assets
+type AssetCache interface {
+	GetAsset(key string) (*CachedAsset, bool)
+	PutAsset(key string, asset *CachedAsset) error
+}
+
+// MemoryAssetCache keeps assets in memory for the lifetime of the process
+type MemoryAssetCache struct {
+	mu     sync.RWMutex
+	assets map[string]*CachedAsset
+}
+
+func NewMemoryAssetCache() *MemoryAssetCache {
+	return &MemoryAssetCache{
+		assets: map[string]*CachedAsset{},
+	}
+}
+
+func (c *MemoryAssetCache) GetAsset(key string) (*CachedAsset, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	asset, ok := c.assets[key]
+	return asset, ok
+}
+
+func (c *MemoryAssetCache) PutAsset(key string, asset *CachedAsset) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.assets[key] = asset
+	return nil
+}
+
+// DiskAssetCache stores assets as files in a directory, so they survive restarts
+type DiskAssetCache struct {
+	dir string
+}
+
+func NewDiskAssetCache(dir string) (*DiskAssetCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &DiskAssetCache{dir: dir}, nil
+}
+
+// file names are hashed so cache keys can never escape the cache directory
+func (c *DiskAssetCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *DiskAssetCache) GetAsset(key string) (*CachedAsset, bool) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var asset CachedAsset
+
+	if err := json.Unmarshal(b, &asset); err != nil {
+		return nil, false
+	}
+
+	return &asset, true
+}
+
+func (c *DiskAssetCache) PutAsset(key string, asset *CachedAsset) error {
+	b, err := json.Marshal(asset)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a crash never leaves a half written asset behind. Each write gets its own temp
+	// file, so concurrent writes of the same asset cannot interleave
+	tmp, err := ioutil.TempFile(c.dir, "asset-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	// TempFile creates files only the owner can read
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// CleanAssetName validates an asset file name, rejecting anything that could traverse outside of the asset directory
+func CleanAssetName(filename string) (string, error) {
+	if filename == "" || strings.ContainsAny(filename, "\\\x00") || strings.HasPrefix(filename, "/") {
+		return "", ErrInvalidAssetName
+	}
+
+	for _, part := range strings.Split(filename, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", ErrInvalidAssetName
+		}
+	}
+
+	if path.Clean(filename) != filename {
+		return "", ErrInvalidAssetName
+	}
+
+	return filename, nil
+}
+
+func assetURL(baseURL, filename string) string {
+	parts := strings.Split(filename, "/")
+
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+
+	return fmt.Sprintf("%s/assets/%s", baseURL, strings.Join(parts, "/"))
+}
+
+func (p *PackageClient) assetAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return StringSliceContains(p.AllowedAssetTypes, mediaType)
+}
+
+func (p *PackageClient) fetchAsset(filename string) (*CachedAsset, error) {
+	filename, err := CleanAssetName(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := fmt.Sprintf("%s/%s", p.pkg.ID, filename)
+
+	var cached *CachedAsset
+	if p.assets != nil {
+		cached, _ = p.assets.GetAsset(cacheKey)
+	}
+
+	req, err := http.NewRequest("GET", assetURL(p.pkg.BaseURL, filename), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sign(req, []byte{})
+
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, nil
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &PackageClientError{Status: res.StatusCode, Body: string(body)}
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if !p.assetAllowed(contentType) {
+		return nil, fmt.Errorf("%w: %s", ErrAssetContentType, contentType)
+	}
+
+	maxSize := p.MaxAssetSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxAssetSize
+	}
+
+	if res.ContentLength > maxSize {
+		return nil, ErrAssetTooLarge
+	}
+
+	// Read one byte past the limit so an oversize body without a content length is still detected
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, ErrAssetTooLarge
+	}
+
+	asset := &CachedAsset{
+		Filename:    filename,
+		ContentType: contentType,
+		ETag:        res.Header.Get("ETag"),
+		Data:        data,
+		FetchedAt:   time.Now(),
+	}
+
+	if p.assets != nil {
+		if err := p.assets.PutAsset(cacheKey, asset); err != nil {
+			return nil, err
+		}
+	}
+
+	return asset, nil
+}
+
+// assetETag derives a strong ETag from the asset contents
+func assetETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:16]))
+}
+
+func sniffAssetType(filename string, data []byte) string {
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+
+	return http.DetectContentType(bytes.TrimSpace(data))
+}
@@ -0,0 +1,244 @@
+package ctypes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PackageClientResolver returns the client used to call a package
+type PackageClientResolver func(packageID uuid.UUID) (*PackageClient, error)
+
+// PackageClientsFromList creates a resolver from already loaded packages
+func PackageClientsFromList(packages []DBPackage) PackageClientResolver {
+	clients := map[uuid.UUID]*PackageClient{}
+
+	for i := range packages {
+		clients[packages[i].ID] = NewPackageClient(&packages[i])
+	}
+
+	return func(packageID uuid.UUID) (*PackageClient, error) {
+		if c, ok := clients[packageID]; ok {
+			return c, nil
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPackage, packageID)
+	}
+}
+
+// LinkBatchRequest describes the evaluation of all outgoing links of a node
+type LinkBatchRequest struct {
+	Links           []CompiledGraphLink
+	Tree            *Context
+	PackageSettings map[uuid.UUID]string // Package settings (JSON format) keyed by package id
+	Sequence        int
+	Mock            bool
+}
+
+// EvaluateLinks sends one LinkExecutionRequest per package for all links in the request, calling packages concurrently
+// Links that could not be evaluated are returned as impassable, with the failure in their errors
+// Stock links (which are evaluated by the engine itself) should not be passed to this function
+func EvaluateLinks(resolve PackageClientResolver, req *LinkBatchRequest) LinkResultCollection {
+	byPackage := map[uuid.UUID][]CompiledGraphLink{}
+
+	for _, l := range req.Links {
+		byPackage[l.PackageID] = append(byPackage[l.PackageID], l)
+	}
+
+	results := LinkResultCollection{}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for packageID, links := range byPackage {
+		wg.Add(1)
+
+		go func(packageID uuid.UUID, links []CompiledGraphLink) {
+			defer wg.Done()
+
+			packageResults := evaluatePackageLinks(resolve, packageID, links, req)
+
+			mu.Lock()
+			for id, r := range packageResults {
+				results[id] = r
+			}
+			mu.Unlock()
+		}(packageID, links)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func evaluatePackageLinks(resolve PackageClientResolver, packageID uuid.UUID, links []CompiledGraphLink, req *LinkBatchRequest) LinkResultCollection {
+	results := LinkResultCollection{}
+
+	failAll := func(err error) LinkResultCollection {
+		for _, l := range links {
+			results[l.ID] = LinkEvaluationResult{
+				Errors:   []Error{{Code: ErrFailedToCallPackage, Message: err.Error()}},
+				Passable: false,
+				Link:     l,
+			}
+		}
+
+		return results
+	}
+
+	client, err := resolve(packageID)
+	if err != nil {
+		return failAll(err)
+	}
+
+	execReq := LinkExecutionRequest{}
+
+	for _, l := range links {
+		execReq.Calls = append(execReq.Calls, LinkCall{
+			RequestID:       uuid.Must(uuid.NewRandom()),
+			TypeID:          l.TypeID,
+			Version:         l.Version,
+			Config:          l.ConfigJSON,
+			PackageSettings: req.PackageSettings[packageID],
+			Tree:            req.Tree,
+			Sequence:        req.Sequence,
+		})
+	}
+
+	var res *LinkExecutionResponse
+
+	if req.Mock {
+		res, err = client.ExecuteLinkMock(&execReq)
+	} else {
+		res, err = client.ExecuteLink(&execReq)
+	}
+
+	if err != nil {
+		return failAll(err)
+	}
+
+	// Responses have already been validated to be in call order
+	for i, l := range links {
+		r := res.Results[i]
+
+		results[l.ID] = LinkEvaluationResult{
+			Logs:     r.Logs,
+			Errors:   r.Errors,
+			Passable: r.Passable,
+			Link:     l,
+		}
+	}
+
+	return results
+}
+
+type nodeBatchKey struct {
+	packageID uuid.UUID
+	mock      bool
+}
+
+type nodeBatchResult struct {
+	result *NodeCallResult
+	err    error
+}
+
+type pendingNodeBatch struct {
+	calls   []NodeCall
+	waiters []chan nodeBatchResult
+	timer   *time.Timer
+}
+
+// NodeBatcher coalesces node calls made concurrently (for example from different executions) into a single
+// request per package. Calls are held for at most Window before being sent
+type NodeBatcher struct {
+	resolve PackageClientResolver
+
+	// Window is how long the first call of a batch waits for more calls to arrive
+	Window time.Duration
+
+	// MaxBatchSize sends a batch immediately once it holds this many calls
+	MaxBatchSize int
+
+	mu      sync.Mutex
+	pending map[nodeBatchKey]*pendingNodeBatch
+}
+
+func NewNodeBatcher(resolve PackageClientResolver, window time.Duration, maxBatchSize int) *NodeBatcher {
+	return &NodeBatcher{
+		resolve:      resolve,
+		Window:       window,
+		MaxBatchSize: maxBatchSize,
+		pending:      map[nodeBatchKey]*pendingNodeBatch{},
+	}
+}
+
+// Execute queues a node call and blocks until the batch it was placed in has been executed
+func (b *NodeBatcher) Execute(packageID uuid.UUID, call *NodeCall, mock bool) (*NodeCallResult, error) {
+	key := nodeBatchKey{packageID: packageID, mock: mock}
+	done := make(chan nodeBatchResult, 1)
+
+	b.mu.Lock()
+
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &pendingNodeBatch{}
+		b.pending[key] = batch
+		batch.timer = time.AfterFunc(b.Window, func() { b.flush(key, batch) })
+	}
+
+	batch.calls = append(batch.calls, *call)
+	batch.waiters = append(batch.waiters, done)
+
+	full := b.MaxBatchSize > 0 && len(batch.calls) >= b.MaxBatchSize
+
+	b.mu.Unlock()
+
+	if full {
+		b.flush(key, batch)
+	}
+
+	res := <-done
+
+	return res.result, res.err
+}
+
+// flush sends a batch if it has not already been sent
+func (b *NodeBatcher) flush(key nodeBatchKey, batch *pendingNodeBatch) {
+	b.mu.Lock()
+
+	if b.pending[key] != batch {
+		// Already flushed by the timer or by reaching the max batch size
+		b.mu.Unlock()
+		return
+	}
+
+	delete(b.pending, key)
+	batch.timer.Stop()
+
+	b.mu.Unlock()
+
+	results, err := b.send(key, batch.calls)
+
+	for i, w := range batch.waiters {
+		if err != nil {
+			w <- nodeBatchResult{err: err}
+		} else {
+			w <- nodeBatchResult{result: &results[i]}
+		}
+	}
+}
+
+func (b *NodeBatcher) send(key nodeBatchKey, calls []NodeCall) ([]NodeCallResult, error) {
+	client, err := b.resolve(key.packageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.mock {
+		return client.ExecuteNodesMock(calls)
+	}
+
+	return client.ExecuteNodes(calls)
+}
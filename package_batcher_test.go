@@ -0,0 +1,125 @@
+package ctypes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// countRequests wraps a handler, counting requests per path
+func countRequests(h http.Handler, counts map[string]int, mu *sync.Mutex) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestEvaluateLinks(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).
+		RegisterLink(DBLink{TypeID: "always", Version: "0.0.1"}, func(call *LinkCall) (*LinkCallResult, error) {
+			return &LinkCallResult{Passable: call.Config == "true"}, nil
+		}, nil)
+
+	hs := httptest.NewServer(countRequests(srv.Router(), counts, &mu))
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+
+	missingPackage := uuid.Must(uuid.NewRandom())
+
+	links := []CompiledGraphLink{
+		{ID: uuid.Must(uuid.NewRandom()), PackageID: info.ID, TypeID: "always", Version: "0.0.1", ConfigJSON: "true"},
+		{ID: uuid.Must(uuid.NewRandom()), PackageID: info.ID, TypeID: "always", Version: "0.0.1", ConfigJSON: "false"},
+		{ID: uuid.Must(uuid.NewRandom()), PackageID: info.ID, TypeID: "always", Version: "0.0.1", ConfigJSON: "true"},
+		{ID: uuid.Must(uuid.NewRandom()), PackageID: missingPackage, TypeID: "always", Version: "0.0.1"},
+	}
+
+	results := EvaluateLinks(PackageClientsFromList([]DBPackage{info}), &LinkBatchRequest{Links: links})
+
+	if counts["/links/execute"] != 1 {
+		t.Errorf("expected links to be coalesced into one request, got %d", counts["/links/execute"])
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+
+	if !results[links[0].ID].Passable || results[links[1].ID].Passable || !results[links[2].ID].Passable {
+		t.Errorf("unexpected link results %+v", results)
+	}
+
+	if results[links[2].ID].Link.ID != links[2].ID {
+		t.Error("expected result to reference its link")
+	}
+
+	missing := results[links[3].ID]
+	if missing.Passable || len(missing.Errors) != 1 || missing.Errors[0].Code != ErrFailedToCallPackage {
+		t.Errorf("expected unknown package to fail, got %+v", missing)
+	}
+}
+
+func TestNodeBatcher_Execute(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).
+		RegisterNode(DBNode{TypeID: "slow", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			// Later calls finish first, so results have to be matched back by request id
+			time.Sleep(time.Duration(10-call.Sequence) * time.Millisecond)
+			return &NodeCallResult{}, nil
+		}, nil)
+
+	hs := httptest.NewServer(countRequests(srv.Router(), counts, &mu))
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+
+	batcher := NewNodeBatcher(PackageClientsFromList([]DBPackage{info}), 50*time.Millisecond, 4)
+
+	var wg sync.WaitGroup
+	results := make([]*NodeCallResult, 8)
+	calls := make([]NodeCall, 8)
+
+	for i := range calls {
+		calls[i] = NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "slow", Version: "0.0.1", Sequence: i}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := batcher.Execute(info.ID, &calls[i], false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			results[i] = res
+		}(i)
+	}
+
+	wg.Wait()
+
+	if counts["/nodes/execute"] != 2 {
+		t.Errorf("expected 8 calls to be sent as 2 batches, got %d requests", counts["/nodes/execute"])
+	}
+
+	for i, r := range results {
+		if r == nil || r.RequestID != calls[i].RequestID {
+			t.Errorf("result %d was not split back to its caller: %+v", i, r)
+		}
+	}
+}
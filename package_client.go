@@ -2,48 +2,107 @@ package ctypes
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha512"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+// PackageClientError is returned when a package responds with a non 2xx status
+// If the package sent a structured error body, Code, Message and Data are filled from it
 type PackageClientError struct {
-	Status int
-	Body   string
+	Status  int
+	Body    string
+	Code    int
+	Message string
+	Data    interface{}
 }
 
 func (p *PackageClientError) Error() string {
+	if p.Message != "" {
+		return fmt.Sprintf("%d: %s (code %d)", p.Status, p.Message, p.Code)
+	}
+
 	return fmt.Sprintf("%d: %s", p.Status, p.Body)
 }
 
+// newPackageClientError decodes a package error body. Packages may respond with an APIError or an Error
+func newPackageClientError(status int, body []byte) *PackageClientError {
+	pcErr := &PackageClientError{Status: status, Body: string(body)}
+
+	var structured struct {
+		Code    *int        `json:"code"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &structured); err == nil && structured.Message != "" {
+		pcErr.Message = structured.Message
+		pcErr.Data = structured.Data
+
+		if structured.Code != nil {
+			pcErr.Code = *structured.Code
+		}
+	}
+
+	return pcErr
+}
+
 // PackageClient is used to make requests to packages
 type PackageClient struct {
 	client http.Client
+	stream http.Client
 	pkg    *DBPackage
+	assets AssetCache
+
+	manifestMu sync.Mutex
+	manifest   *Package
+
+	protocolMu sync.RWMutex
+	protocol   *NegotiatedProtocol
+
+	// MaxAssetSize is the largest asset (in bytes) that will be downloaded from the package
+	MaxAssetSize int64
+
+	// AllowedAssetTypes lists the content types a package may serve assets as
+	AllowedAssetTypes []string
 }
 
 func NewPackageClient(pkg *DBPackage) *PackageClient {
 	return &PackageClient{
-		pkg: pkg,
+		pkg:               pkg,
+		assets:            NewMemoryAssetCache(),
+		MaxAssetSize:      DefaultMaxAssetSize,
+		AllowedAssetTypes: DefaultAllowedAssetTypes,
 		client: http.Client{
 			Timeout: 10 * time.Second,
 		},
+		// Streamed executions may run for a long time, so only the wait for the response headers is limited
+		stream: http.Client{
+			Transport: streamTransport(),
+		},
 	}
 }
 
+var _ IPackageProvider = &PackageClient{}
+
+// WithAssetCache replaces the default in memory asset cache
+func (p *PackageClient) WithAssetCache(cache AssetCache) *PackageClient {
+	p.assets = cache
+	return p
+}
+
 func (p *PackageClient) DoJSONPost(url string, body interface{}, result interface{}) error {
-	return p.makeRequestWithBody("POST", fmt.Sprintf("%s%s", p.pkg.BaseURL, url), p.pkg.SigningKey, body, result)
+	return p.makeRequestWithBody("POST", fmt.Sprintf("%s%s", p.pkg.BaseURL, url), body, result)
 }
 
 func (p *PackageClient) DoJSONGet(url string, result interface{}) error {
-	return p.makeRequestWithBody("GET", fmt.Sprintf("%s%s", p.pkg.BaseURL, url), p.pkg.SigningKey, nil, result)
+	return p.makeRequestWithBody("GET", fmt.Sprintf("%s%s", p.pkg.BaseURL, url), nil, result)
 }
 
 func (p *PackageClient) FetchManifest() (*Package, error) {
@@ -57,52 +116,118 @@ func (p *PackageClient) FetchManifest() (*Package, error) {
 	return &result, nil
 }
 
-func (p *PackageClient) ExecuteNode(input *NodeCall) (*NodeCallResult, error) {
-	var result NodeExecutionResponse
+// GetManifest returns the package manifest, fetching it on first use. Returns nil if the manifest cannot be fetched
+// A failed fetch is retried on the next call
+func (p *PackageClient) GetManifest() *Package {
+	p.manifestMu.Lock()
+	defer p.manifestMu.Unlock()
+
+	if p.manifest == nil {
+		manifest, err := p.FetchManifest()
+		if err != nil {
+			return nil
+		}
+
+		p.manifest = manifest
+	}
+
+	return p.manifest
+}
 
-	err := p.DoJSONPost("/nodes/execute", NodeExecutionRequest{
-		Calls: []NodeCall{*input},
-	}, &result)
+func (p *PackageClient) ExecuteNode(input *NodeCall) (*NodeCallResult, error) {
+	results, err := p.ExecuteNodes([]NodeCall{*input})
 	if err != nil {
 		return nil, err
 	}
 
-	return &result.Results[0], nil
+	return &results[0], nil
 }
 
 func (p *PackageClient) ExecuteNodeMock(input *NodeCall) (*NodeCallResult, error) {
-	var result NodeExecutionResponse
-
-	err := p.DoJSONPost("/nodes/execute-mock", NodeExecutionRequest{
-		Calls: []NodeCall{*input},
-	}, &result)
+	results, err := p.ExecuteNodesMock([]NodeCall{*input})
 	if err != nil {
 		return nil, err
 	}
 
-	return &result.Results[0], nil
+	return &results[0], nil
 }
 
-func (p *PackageClient) ExecuteLink(request *LinkExecutionRequest) (*LinkExecutionResponse, error) {
-	var result LinkExecutionResponse
+// ExecuteNodes sends several node calls in a single request. Results are returned in the same order as calls
+func (p *PackageClient) ExecuteNodes(calls []NodeCall) ([]NodeCallResult, error) {
+	return p.executeNodes("/nodes/execute", calls)
+}
 
-	err := p.DoJSONPost("/links/execute", request, &result)
-	if err != nil {
+// ExecuteNodesMock is the mock variant of ExecuteNodes
+func (p *PackageClient) ExecuteNodesMock(calls []NodeCall) ([]NodeCallResult, error) {
+	if err := p.requireMock(); err != nil {
 		return nil, err
 	}
 
-	return &result, nil
+	return p.executeNodes("/nodes/execute-mock", calls)
 }
 
-func (p *PackageClient) ExecuteLinkMock(request *LinkExecutionRequest) (*LinkExecutionResponse, error) {
-	var result LinkExecutionResponse
+// executeNodes sends calls in as many requests as the negotiated batch size requires
+func (p *PackageClient) executeNodes(url string, calls []NodeCall) ([]NodeCallResult, error) {
+	results := make([]NodeCallResult, 0, len(calls))
 
-	err := p.DoJSONPost("/links/execute-mock", request, &result)
-	if err != nil {
+	for _, r := range batchRanges(len(calls), p.capabilities().MaxNodeBatchSize) {
+		var result NodeExecutionResponse
+
+		batch := calls[r[0]:r[1]]
+
+		err := p.DoJSONPost(url, NodeExecutionRequest{
+			Calls: batch,
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ValidateNodeExecutionResponse(batch, result.Results)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result.Results...)
+	}
+
+	return results, nil
+}
+
+func (p *PackageClient) ExecuteLink(request *LinkExecutionRequest) (*LinkExecutionResponse, error) {
+	return p.executeLinks("/links/execute", request)
+}
+
+func (p *PackageClient) ExecuteLinkMock(request *LinkExecutionRequest) (*LinkExecutionResponse, error) {
+	if err := p.requireMock(); err != nil {
 		return nil, err
 	}
 
-	return &result, nil
+	return p.executeLinks("/links/execute-mock", request)
+}
+
+// executeLinks sends link calls in as many requests as the negotiated batch size requires
+func (p *PackageClient) executeLinks(url string, request *LinkExecutionRequest) (*LinkExecutionResponse, error) {
+	results := LinkExecutionResponse{Results: make([]LinkCallResult, 0, len(request.Calls))}
+
+	for _, r := range batchRanges(len(request.Calls), p.capabilities().MaxLinkBatchSize) {
+		var result LinkExecutionResponse
+
+		batch := request.Calls[r[0]:r[1]]
+
+		err := p.DoJSONPost(url, LinkExecutionRequest{Calls: batch}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ValidateLinkExecutionResponse(batch, result.Results)
+		if err != nil {
+			return nil, err
+		}
+
+		results.Results = append(results.Results, result.Results...)
+	}
+
+	return &results, nil
 }
 
 func (p *PackageClient) Dispatch(request *DispatchRequest) (*DispatchResponse, error) {
@@ -113,10 +238,19 @@ func (p *PackageClient) Dispatch(request *DispatchRequest) (*DispatchResponse, e
 		return nil, err
 	}
 
+	err = ValidateDispatchResponse(request.Dispatches, result.Results)
+	if err != nil {
+		return nil, err
+	}
+
 	return &result, nil
 }
 
 func (p *PackageClient) DispatchMock(request *DispatchRequest) (*DispatchResponse, error) {
+	if err := p.requireMock(); err != nil {
+		return nil, err
+	}
+
 	var result DispatchResponse
 
 	err := p.DoJSONPost("/dispatch/execute-mock", request, &result)
@@ -124,68 +258,146 @@ func (p *PackageClient) DispatchMock(request *DispatchRequest) (*DispatchRespons
 		return nil, err
 	}
 
+	err = ValidateDispatchResponse(request.Dispatches, result.Results)
+	if err != nil {
+		return nil, err
+	}
+
 	return &result, nil
 }
 
-// TODO
+// MigrateConfigs asks the package to run config migrations it declared as remote
+func (p *PackageClient) MigrateConfigs(calls []ConfigMigrationCall) ([]ConfigMigrationResult, error) {
+	if !p.capabilities().Migrations {
+		return nil, fmt.Errorf("%w: migrations", ErrCapabilityUnsupported)
+	}
+
+	var result ConfigMigrationResponse
+
+	err := p.DoJSONPost("/migrate", ConfigMigrationRequest{Calls: calls}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ValidateConfigMigrationResponse(calls, result.Results)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Results, nil
+}
+
+// GetAsset downloads an asset (such as an icon listed in NodeStyle.Icons) from the package
 func (p *PackageClient) GetAsset(filename string) (io.Reader, error) {
-	return nil, nil
+	data, err := p.GetAssetBytes(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
 }
 
-// TODO
+// GetAssetBytes downloads an asset from the package, revalidating any cached copy using its ETag
 func (p *PackageClient) GetAssetBytes(filename string) ([]byte, error) {
-	return nil, nil
+	if !p.capabilities().Assets {
+		return nil, fmt.Errorf("%w: assets", ErrCapabilityUnsupported)
+	}
+
+	asset, err := p.fetchAsset(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return asset.Data, nil
 }
 
-func (p *PackageClient) makeRequestWithBody(method, url, signingToken string, body interface{}, out interface{}) error {
+// MiscRequest sends a package specific request to POST /misc/:key and returns the decoded JSON response
+func (p *PackageClient) MiscRequest(key string, jsonBody []byte) (interface{}, error) {
+	if !validFieldName(key) || strings.Contains(key, ".") {
+		return nil, fmt.Errorf("invalid misc request key %q", key)
+	}
+
+	if len(jsonBody) == 0 {
+		jsonBody = []byte("null")
+	} else if !json.Valid(jsonBody) {
+		return nil, errors.New("misc request body must be valid json")
+	}
+
+	res, rsb, err := p.doSignedRequest("POST", fmt.Sprintf("%s/misc/%s", p.pkg.BaseURL, key), jsonBody, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, newPackageClientError(res.StatusCode, rsb)
+	}
+
+	var result interface{}
+
+	if err := json.Unmarshal(rsb, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (p *PackageClient) makeRequestWithBody(method, url string, body interface{}, out interface{}) error {
 	jsb, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest(method, url, bytes.NewReader(jsb))
+	res, rsb, err := p.doSignedRequest(method, url, jsb, nil)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Convai-Signature", getSignature(jsb, signingToken))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return newPackageClientError(res.StatusCode, rsb)
+	}
 
-	res, err := p.client.Do(req)
+	err = json.Unmarshal(rsb, out)
 	if err != nil {
-		return err
+		return &PackageProtocolError{Kind: PPEMalformedResponse, Index: -1, Message: err.Error()}
 	}
 
-	defer res.Body.Close()
+	return nil
+}
 
-	rsb, err := ioutil.ReadAll(res.Body)
+// doSignedRequest sends a signed request and reads the whole response body
+func (p *PackageClient) doSignedRequest(method, url string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		var pkgErr error
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
-		pkgErr = json.Unmarshal(rsb, &pkgErr)
-		if pkgErr != nil {
-			return &PackageClientError{Status: res.StatusCode, Body: string(rsb)}
-		} else {
-			return errors.New(pkgErr.Error())
-		}
-	} else {
-		err = json.Unmarshal(rsb, out)
-		if err != nil {
-			return err
-		}
+	req.Header.Set("Content-Type", "application/json")
+	p.sign(req, body)
 
-		return nil
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	defer res.Body.Close()
+
+	rsb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res, rsb, nil
 }
 
-func getSignature(body []byte, key string) string {
-	mac := hmac.New(sha512.New, []byte(key))
-	mac.Write(body)
-	hash := mac.Sum(nil)
+// sign signs a request, and tells the package which protocol version was negotiated
+func (p *PackageClient) sign(req *http.Request, body []byte) {
+	if protocol := p.Protocol(); protocol != nil && !protocol.Legacy {
+		req.Header.Set(HeaderProtocolVersion, protocol.Version)
+	}
 
-	return base64.StdEncoding.EncodeToString(hash)
+	SignRequest(req, body, p.pkg.SigningKey)
 }
@@ -1,7 +1,17 @@
 package ctypes
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/uuid"
@@ -152,10 +162,198 @@ func TestPackageClient_FetchManifest(t *testing.T) {
 	fmt.Printf("%+v\n", res)
 }
 
+type countingAssetCache struct {
+	*MemoryAssetCache
+	puts int
+}
+
+func (c *countingAssetCache) PutAsset(key string, asset *CachedAsset) error {
+	c.puts++
+	return c.MemoryAssetCache.PutAsset(key, asset)
+}
+
+func newAssetTestClient(t *testing.T) (*PackageClient, *countingAssetCache, func()) {
+	dir, err := ioutil.TempDir("", "convai-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "icon.svg"), []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "big.png"), bytes.Repeat([]byte{0x89}, 2048), 0644)
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	hs := httptest.NewServer(NewPackageServer(info).ServeAssets(http.Dir(dir)).Router())
+	info.BaseURL = hs.URL
+
+	cache := &countingAssetCache{MemoryAssetCache: NewMemoryAssetCache()}
+
+	return NewPackageClient(&info).WithAssetCache(cache), cache, func() {
+		hs.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
 func TestPackageClient_GetAsset(t *testing.T) {
-	// TODO
+	pc, _, cleanup := newAssetTestClient(t)
+	defer cleanup()
+
+	r, err := pc.GetAsset("icon.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(r)
+	if !strings.HasPrefix(string(b), "<svg") {
+		t.Errorf("unexpected asset contents %q", b)
+	}
+
+	for _, name := range []string{"../secret.png", "/etc/passwd", "a/../../b.png", "a\\b.png", ""} {
+		if _, err := pc.GetAsset(name); err != ErrInvalidAssetName {
+			t.Errorf("expected %q to be rejected, got %v", name, err)
+		}
+	}
 }
 
 func TestPackageClient_GetAssetBytes(t *testing.T) {
-	// TODO
+	pc, cache, cleanup := newAssetTestClient(t)
+	defer cleanup()
+
+	first, err := pc.GetAssetBytes("icon.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := pc.GetAssetBytes("icon.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(first) != string(second) {
+		t.Error("expected revalidated asset to match")
+	}
+
+	if cache.puts != 1 {
+		t.Errorf("expected unchanged asset to be revalidated rather than downloaded again, got %d cache writes", cache.puts)
+	}
+
+	if _, err := pc.GetAssetBytes("notes.txt"); !errors.Is(err, ErrAssetContentType) {
+		t.Errorf("expected content type error, got %v", err)
+	}
+
+	pc.MaxAssetSize = 1024
+
+	if _, err := pc.GetAssetBytes("big.png"); err != ErrAssetTooLarge {
+		t.Errorf("expected size error, got %v", err)
+	}
+
+	if _, err := pc.GetAssetBytes("missing.png"); err == nil {
+		t.Error("expected missing asset to fail")
+	}
+}
+
+func TestPackageClient_MiscRequest(t *testing.T) {
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).RegisterMisc("echo", func(jsonBody []byte) (interface{}, error) {
+		var body map[string]interface{}
+		err := json.Unmarshal(jsonBody, &body)
+		return body, err
+	})
+
+	hs := httptest.NewServer(srv.Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	res, err := pc.MiscRequest("echo", []byte(`{"hello":"world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.(map[string]interface{})["hello"] != "world" {
+		t.Errorf("unexpected misc response %v", res)
+	}
+
+	if _, err := pc.MiscRequest("../manifest", nil); err == nil {
+		t.Error("expected invalid key to be rejected")
+	}
+
+	if _, err := pc.MiscRequest("unknown", nil); err == nil {
+		t.Error("expected unknown misc key to fail")
+	}
+}
+
+func TestPackageClient_GetManifest(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	hs := httptest.NewServer(countRequests(NewPackageServer(info).Router(), counts, &mu))
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if pc.GetManifest() == nil {
+				t.Error("expected manifest")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if counts["/manifest"] != 1 {
+		t.Errorf("expected the manifest to be fetched once, got %d requests", counts["/manifest"])
+	}
+}
+
+func TestDiskAssetCache_PutAsset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convai-asset-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskAssetCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			data := bytes.Repeat([]byte{byte('a' + i)}, 64*1024)
+			if err := cache.PutAsset("icon.svg", &CachedAsset{Filename: "icon.svg", Data: data}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	asset, ok := cache.GetAsset("icon.svg")
+	if !ok || len(asset.Data) != 64*1024 || !bytes.Equal(asset.Data, bytes.Repeat(asset.Data[:1], 64*1024)) {
+		t.Fatal("expected one complete asset to win")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected temp files to be renamed away, got %d files", len(files))
+	}
 }
@@ -0,0 +1,419 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/blang/semver"
+	"github.com/google/uuid"
+)
+
+// ChangeLevel classifies a package change the way a semver bump would
+type ChangeLevel int
+
+const (
+	ChangeNone ChangeLevel = iota
+	ChangePatch
+	ChangeMinor
+	ChangeMajor
+)
+
+func (c ChangeLevel) String() string {
+	switch c {
+	case ChangePatch:
+		return "patch"
+	case ChangeMinor:
+		return "minor"
+	case ChangeMajor:
+		return "major"
+	}
+
+	return "none"
+}
+
+func (c ChangeLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *ChangeLevel) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	switch s {
+	case "none":
+		*c = ChangeNone
+	case "patch":
+		*c = ChangePatch
+	case "minor":
+		*c = ChangeMinor
+	case "major":
+		*c = ChangeMajor
+	default:
+		return fmt.Errorf("invalid change level %q", s)
+	}
+
+	return nil
+}
+
+// Kinds of package items
+const (
+	PackageItemNode     = "node"
+	PackageItemLink     = "link"
+	PackageItemEvent    = "event"
+	PackageItemDispatch = "dispatch"
+	PackageItemModule   = "module"
+	PackageItemTemplate = "template"
+	PackageItemSettings = "settings"
+)
+
+// Kinds of package changes
+const (
+	PackageChangeAdded   = "added"
+	PackageChangeUpdated = "updated"
+	PackageChangeRemoved = "removed"
+)
+
+// PackageChange is a single classified change between two package manifests
+type PackageChange struct {
+	Item    string      `json:"item"`   // One of the PackageItem constants
+	Change  string      `json:"change"` // One of the PackageChange constants
+	ID      string      `json:"id"`     // Type id of nodes and links, id of everything else
+	Version string      `json:"version,omitempty"`
+	Level   ChangeLevel `json:"level"`
+}
+
+// Level is the highest level of all changes, which is the smallest version bump the package should make
+func (d *PackageDifferences) Level() ChangeLevel {
+	level := ChangeNone
+
+	for _, c := range d.Changes {
+		if c.Level > level {
+			level = c.Level
+		}
+	}
+
+	return level
+}
+
+// Breaking returns the changes that break existing bots
+func (d *PackageDifferences) Breaking() []PackageChange {
+	var breaking []PackageChange
+
+	for _, c := range d.Changes {
+		if c.Level == ChangeMajor {
+			breaking = append(breaking, c)
+		}
+	}
+
+	return breaking
+}
+
+// classifyVersion classifies a new version of an item against the closest existing version below it
+// A brand new item is a minor change, since it only adds functionality
+func classifyVersion(existing []string, version string) ChangeLevel {
+	v, err := semver.Parse(version)
+	if err != nil {
+		return ChangeMajor
+	}
+
+	var base *semver.Version
+
+	for _, e := range existing {
+		ev, err := semver.Parse(e)
+		if err != nil || ev.GT(v) {
+			continue
+		}
+
+		if base == nil || ev.GT(*base) {
+			evCopy := ev
+			base = &evCopy
+		}
+	}
+
+	switch {
+	case base == nil:
+		return ChangeMinor
+	case v.Major != base.Major:
+		return ChangeMajor
+	case v.Minor != base.Minor:
+		return ChangeMinor
+	}
+
+	return ChangePatch
+}
+
+// classifyChanges fills diff.Changes from the item lists
+func classifyChanges(old *Package, diff *PackageDifferences) {
+	versions := func(item, id string) []string {
+		var vs []string
+
+		switch item {
+		case PackageItemNode:
+			for _, n := range old.Nodes {
+				if n.TypeID == id {
+					vs = append(vs, n.Version)
+				}
+			}
+		case PackageItemLink:
+			for _, l := range old.Links {
+				if l.TypeID == id {
+					vs = append(vs, l.Version)
+				}
+			}
+		case PackageItemModule:
+			for _, m := range old.Modules {
+				if m.ID == id {
+					vs = append(vs, m.Version)
+				}
+			}
+		case PackageItemTemplate:
+			for _, t := range old.Templates.Responses {
+				if t.ID == id {
+					vs = append(vs, t.Version)
+				}
+			}
+		}
+
+		return vs
+	}
+
+	add := func(item, change, id, version string, level ChangeLevel) {
+		diff.Changes = append(diff.Changes, PackageChange{Item: item, Change: change, ID: id, Version: version, Level: level})
+	}
+
+	for _, n := range diff.NewNodes {
+		add(PackageItemNode, PackageChangeAdded, n.TypeID, n.Version, classifyVersion(versions(PackageItemNode, n.TypeID), n.Version))
+	}
+	for _, n := range diff.UpdatedNodes {
+		level := ChangePatch
+
+		for _, o := range old.Nodes {
+			if o.TypeID == n.TypeID && o.Version == n.Version {
+				level = classifySchemaChange(o.ConfigSchema, n.ConfigSchema)
+			}
+		}
+
+		add(PackageItemNode, PackageChangeUpdated, n.TypeID, n.Version, level)
+	}
+	for _, n := range diff.RemovedNodes {
+		add(PackageItemNode, PackageChangeRemoved, n.TypeID, n.Version, ChangeMajor)
+	}
+
+	for _, l := range diff.NewLinks {
+		add(PackageItemLink, PackageChangeAdded, l.TypeID, l.Version, classifyVersion(versions(PackageItemLink, l.TypeID), l.Version))
+	}
+	for _, l := range diff.UpdatedLinks {
+		level := ChangePatch
+
+		for _, o := range old.Links {
+			if o.TypeID == l.TypeID && o.Version == l.Version {
+				level = classifySchemaChange(o.ConfigSchema, l.ConfigSchema)
+			}
+		}
+
+		add(PackageItemLink, PackageChangeUpdated, l.TypeID, l.Version, level)
+	}
+	for _, l := range diff.RemovedLinks {
+		add(PackageItemLink, PackageChangeRemoved, l.TypeID, l.Version, ChangeMajor)
+	}
+
+	// Events and dispatches are not versioned
+	for _, e := range diff.NewEvents {
+		add(PackageItemEvent, PackageChangeAdded, e.ID, "", ChangeMinor)
+	}
+	for _, e := range diff.UpdatedEvents {
+		add(PackageItemEvent, PackageChangeUpdated, e.ID, "", ChangePatch)
+	}
+	for _, e := range diff.RemovedEvents {
+		add(PackageItemEvent, PackageChangeRemoved, e.ID, "", ChangeMajor)
+	}
+
+	for _, d := range diff.NewDispatches {
+		add(PackageItemDispatch, PackageChangeAdded, d.ID, "", ChangeMinor)
+	}
+	for _, d := range diff.UpdatedDispatches {
+		level := ChangePatch
+
+		for _, o := range old.Dispatches {
+			if o.ID == d.ID {
+				level = classifySchemaChange(o.ConfigSchema, d.ConfigSchema)
+			}
+		}
+
+		add(PackageItemDispatch, PackageChangeUpdated, d.ID, "", level)
+	}
+	for _, d := range diff.RemovedDispatches {
+		add(PackageItemDispatch, PackageChangeRemoved, d.ID, "", ChangeMajor)
+	}
+
+	// Modules and templates are copied when they are used, so removing them does not break existing bots
+	for _, m := range diff.NewModules {
+		add(PackageItemModule, PackageChangeAdded, m.ID, m.Version, classifyVersion(versions(PackageItemModule, m.ID), m.Version))
+	}
+	for _, m := range diff.UpdatedModules {
+		add(PackageItemModule, PackageChangeUpdated, m.ID, m.Version, ChangePatch)
+	}
+	for _, m := range diff.RemovedModules {
+		add(PackageItemModule, PackageChangeRemoved, m.ID, m.Version, ChangeMinor)
+	}
+
+	for _, t := range diff.NewTemplates {
+		add(PackageItemTemplate, PackageChangeAdded, t.ID, t.Version, classifyVersion(versions(PackageItemTemplate, t.ID), t.Version))
+	}
+	for _, t := range diff.UpdatedTemplates {
+		add(PackageItemTemplate, PackageChangeUpdated, t.ID, t.Version, ChangePatch)
+	}
+	for _, t := range diff.RemovedTemplates {
+		add(PackageItemTemplate, PackageChangeRemoved, t.ID, t.Version, ChangeMinor)
+	}
+
+	if diff.SettingsSchemaChanged {
+		add(PackageItemSettings, PackageChangeUpdated, "", "", classifySchemaChange(old.SettingsSchema, diff.SettingsSchema))
+	}
+}
+
+// classifySchemaChange classifies an update of an item whose config schema went from old to new
+// Configs that were valid before must stay valid, so new required properties, narrowed types and removed properties
+// that can no longer be set are major. New optional properties are minor, anything else (names, docs, styles) is a patch
+func classifySchemaChange(old, new *ConfigSchema) ChangeLevel {
+	// Without a schema nothing is validated, so removing one cannot break configs
+	if new == nil {
+		return ChangePatch
+	}
+
+	if old == nil {
+		old = &ConfigSchema{}
+	}
+
+	oldType := old.Type
+	if oldType == "" && old.Properties != nil {
+		oldType = SchemaObject
+	}
+
+	if new.Type != "" && new.Type != oldType && !(oldType == SchemaInteger && new.Type == SchemaNumber) {
+		return ChangeMajor
+	}
+
+	for _, name := range new.Required {
+		if !StringSliceContains(old.Required, name) {
+			return ChangeMajor
+		}
+	}
+
+	level := ChangePatch
+
+	raise := func(l ChangeLevel) {
+		if l > level {
+			level = l
+		}
+	}
+
+	for name, prop := range new.Properties {
+		oldProp, ok := old.Properties[name]
+		if !ok {
+			raise(ChangeMinor)
+			continue
+		}
+
+		raise(classifySchemaChange(oldProp, prop))
+	}
+
+	if new.AdditionalProperties != nil && !*new.AdditionalProperties {
+		if old.AdditionalProperties == nil || *old.AdditionalProperties {
+			return ChangeMajor
+		}
+
+		for name := range old.Properties {
+			if _, ok := new.Properties[name]; !ok {
+				return ChangeMajor
+			}
+		}
+	}
+
+	if new.Items != nil {
+		raise(classifySchemaChange(old.Items, new.Items))
+	}
+
+	return level
+}
+
+// BrokenReference is a graph node or link that references something a new package manifest removes
+type BrokenReference struct {
+	BlueprintID      uuid.UUID  `json:"blueprint_id"`
+	BlueprintVersion Semver     `json:"blueprint_version"`
+	BotID            uuid.UUID  `json:"bot_id"`
+	ModuleID         uuid.UUID  `json:"module_id"`
+	NodeID           *uuid.UUID `json:"node_id,omitempty"`
+	LinkID           *uuid.UUID `json:"link_id,omitempty"`
+	Item             string     `json:"item"` // One of the PackageItem constants
+	ID               string     `json:"id"`
+	Version          string     `json:"version,omitempty"`
+}
+
+// BreakingReferences lists every node and link in blueprints that would break if the new manifest were published
+func (d *PackageDifferences) BreakingReferences(packageID uuid.UUID, blueprints []DBBlueprint) []BrokenReference {
+	removedNodes := map[string]bool{}
+	removedLinks := map[string]bool{}
+	removedEvents := map[string]bool{}
+
+	for _, n := range d.RemovedNodes {
+		removedNodes[handlerKey(n.TypeID, n.Version)] = true
+	}
+
+	for _, l := range d.RemovedLinks {
+		removedLinks[handlerKey(l.TypeID, l.Version)] = true
+	}
+
+	for _, e := range d.RemovedEvents {
+		removedEvents[e.ID] = true
+	}
+
+	var broken []BrokenReference
+
+	for _, bp := range blueprints {
+		ref := BrokenReference{BlueprintID: bp.ID, BlueprintVersion: bp.Version, BotID: bp.BotID}
+
+		// Modules and nodes are visited in order, so the result is the same on every run
+		for _, moduleID := range sortedModuleIDs(bp.Modules) {
+			module := bp.Modules[moduleID]
+			ref.ModuleID = moduleID
+
+			for _, nodeID := range sortedNodeIDs(module.Graph.Nodes) {
+				n := module.Graph.Nodes[nodeID]
+				if n.PackageID != packageID {
+					continue
+				}
+
+				nodeID := nodeID
+
+				switch {
+				case n.TypeID != nil && n.Version != nil && removedNodes[handlerKey(*n.TypeID, *n.Version)]:
+					r := ref
+					r.NodeID, r.Item, r.ID, r.Version = &nodeID, PackageItemNode, *n.TypeID, *n.Version
+					broken = append(broken, r)
+				case n.EventTypeID != nil && removedEvents[*n.EventTypeID]:
+					r := ref
+					r.NodeID, r.Item, r.ID = &nodeID, PackageItemEvent, *n.EventTypeID
+					broken = append(broken, r)
+				}
+			}
+
+			for _, l := range module.Graph.Links {
+				if l.PackageID != packageID || !removedLinks[handlerKey(l.TypeID, l.Version)] {
+					continue
+				}
+
+				linkID := l.ID
+
+				r := ref
+				r.LinkID, r.Item, r.ID, r.Version = &linkID, PackageItemLink, l.TypeID, l.Version
+				broken = append(broken, r)
+			}
+		}
+	}
+
+	return broken
+}
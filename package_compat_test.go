@@ -0,0 +1,248 @@
+package ctypes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/google/uuid"
+)
+
+func TestClassifyVersion(t *testing.T) {
+	tests := []struct {
+		existing []string
+		version  string
+		want     ChangeLevel
+	}{
+		{nil, "1.0.0", ChangeMinor},
+		{[]string{"1.0.0"}, "1.0.1", ChangePatch},
+		{[]string{"1.0.0"}, "1.1.0", ChangeMinor},
+		{[]string{"1.0.0"}, "2.0.0", ChangeMajor},
+		{[]string{"1.0.0", "2.0.0"}, "1.0.1", ChangePatch}, // Backported fixes compare against their own line
+		{[]string{"2.0.0"}, "1.0.0", ChangeMinor},
+		{[]string{"1.0.0"}, "not a version", ChangeMajor},
+	}
+
+	for _, tt := range tests {
+		if got := classifyVersion(tt.existing, tt.version); got != tt.want {
+			t.Errorf("classifyVersion(%v, %s) = %s, want %s", tt.existing, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestClassifySchemaChange(t *testing.T) {
+	no := false
+	str := func() *ConfigSchema { return &ConfigSchema{Type: SchemaString} }
+
+	base := &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str()}}
+
+	tests := []struct {
+		name string
+		new  *ConfigSchema
+		want ChangeLevel
+	}{
+		{"unchanged", &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str()}}, ChangePatch},
+		{"docs", &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": {Type: SchemaString, Description: "Where to send it"}, "method": str()}}, ChangePatch},
+		{"new optional property", &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str(), "body": str()}}, ChangeMinor},
+		{"new required property", &ConfigSchema{Type: SchemaObject, Required: []string{"url", "body"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str(), "body": str()}}, ChangeMajor},
+		{"optional property made required", &ConfigSchema{Type: SchemaObject, Required: []string{"url", "method"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str()}}, ChangeMajor},
+		{"changed property type", &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str(), "method": {Type: SchemaInteger}}}, ChangeMajor},
+		{"removed property", &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str()}}, ChangePatch},
+		{"additional properties disallowed", &ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str()}, AdditionalProperties: &no}, ChangeMajor},
+		{"schema removed", nil, ChangePatch},
+	}
+
+	for _, tt := range tests {
+		if got := classifySchemaChange(base, tt.new); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	// Widening a number is fine, narrowing it is not
+	if got := classifySchemaChange(&ConfigSchema{Type: SchemaInteger}, &ConfigSchema{Type: SchemaNumber}); got != ChangePatch {
+		t.Errorf("expected integer to number to be a patch, got %s", got)
+	}
+
+	if got := classifySchemaChange(&ConfigSchema{Type: SchemaNumber}, &ConfigSchema{Type: SchemaInteger}); got != ChangeMajor {
+		t.Errorf("expected number to integer to be major, got %s", got)
+	}
+
+	// Nested schemas are compared too
+	list := func(item *ConfigSchema) *ConfigSchema { return &ConfigSchema{Type: SchemaArray, Items: item} }
+	if got := classifySchemaChange(list(base), list(&ConfigSchema{Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": str(), "method": str(), "body": str()}})); got != ChangeMinor {
+		t.Errorf("expected a new optional item property to be minor, got %s", got)
+	}
+
+	// Adding a schema to an item that had none can reject existing configs
+	if got := classifySchemaChange(nil, &ConfigSchema{Type: SchemaObject}); got != ChangeMajor {
+		t.Errorf("expected a new schema to be major, got %s", got)
+	}
+}
+
+func TestComputePackageDifferences_Schemas(t *testing.T) {
+	packageID := uuid.Must(uuid.NewRandom())
+	url := &ConfigSchema{Type: SchemaObject, Properties: map[string]*ConfigSchema{"url": {Type: SchemaString}}}
+
+	old := &Package{
+		DBPackage:      DBPackage{ID: packageID},
+		Nodes:          []DBNode{{TypeID: "send", Version: "1.0.0", PackageID: packageID, ConfigSchema: url}},
+		Links:          []DBLink{{TypeID: "when", Version: "1.0.0", PackageID: packageID, ConfigSchema: url}},
+		Dispatches:     []DBDispatch{{ID: "reply", PackageID: packageID, ConfigSchema: url}},
+		SettingsSchema: url,
+	}
+
+	new := &Package{
+		DBPackage: DBPackage{ID: packageID},
+		Nodes: []DBNode{{TypeID: "send", Version: "1.0.0", ConfigSchema: &ConfigSchema{
+			Type: SchemaObject, Required: []string{"url"}, Properties: map[string]*ConfigSchema{"url": {Type: SchemaString}},
+		}}},
+		Links: []DBLink{{TypeID: "when", Version: "1.0.0", ConfigSchema: &ConfigSchema{
+			Type: SchemaObject, Properties: map[string]*ConfigSchema{"url": {Type: SchemaString}, "method": {Type: SchemaString}},
+		}}},
+		Dispatches: []DBDispatch{{ID: "reply", ConfigSchema: &ConfigSchema{
+			Type: SchemaObject, Properties: map[string]*ConfigSchema{"url": {Type: SchemaString, Description: "Where to reply"}},
+		}}},
+		SettingsSchema: &ConfigSchema{Type: SchemaObject, Properties: map[string]*ConfigSchema{"url": {Type: SchemaBoolean}}},
+	}
+
+	diff := ComputePackageDifferences(old, new)
+
+	levels := map[string]ChangeLevel{}
+	for _, c := range diff.Changes {
+		levels[c.Item+":"+c.Change+":"+c.ID+"@"+c.Version] = c.Level
+	}
+
+	want := map[string]ChangeLevel{
+		"node:updated:send@1.0.0": ChangeMajor,
+		"link:updated:when@1.0.0": ChangeMinor,
+		"dispatch:updated:reply@": ChangePatch,
+		"settings:updated:@":      ChangeMajor,
+	}
+
+	if !reflect.DeepEqual(levels, want) {
+		t.Errorf("expected %v, got %v", want, levels)
+	}
+
+	if !diff.SettingsSchemaChanged || diff.SettingsSchema != new.SettingsSchema {
+		t.Errorf("expected the settings schema change to be detected, got %+v", diff)
+	}
+
+	if diff = ComputePackageDifferences(old, old); diff.SettingsSchemaChanged || len(diff.Changes) != 0 {
+		t.Errorf("expected no changes, got %+v", diff.Changes)
+	}
+}
+
+func TestComputePackageDifferences_Breaking(t *testing.T) {
+	packageID := uuid.Must(uuid.NewRandom())
+
+	old := &Package{
+		DBPackage:  DBPackage{ID: packageID},
+		Nodes:      []DBNode{{TypeID: "send", Version: "1.0.0", PackageID: packageID}, {TypeID: "wait", Version: "1.0.0", PackageID: packageID}},
+		Links:      []DBLink{{TypeID: "always", Version: "1.0.0", PackageID: packageID}},
+		Events:     []DBEvent{{ID: "message", PackageID: packageID}},
+		Dispatches: []DBDispatch{{ID: "reply", PackageID: packageID}},
+	}
+
+	new := &Package{
+		DBPackage:  DBPackage{ID: packageID},
+		Nodes:      []DBNode{{TypeID: "send", Version: "1.0.0", Name: "Send Message"}, {TypeID: "send", Version: "1.1.0"}},
+		Links:      []DBLink{{TypeID: "always", Version: "1.0.0"}, {TypeID: "always", Version: "2.0.0"}},
+		Events:     []DBEvent{},
+		Dispatches: []DBDispatch{{ID: "reply"}, {ID: "typing"}},
+	}
+
+	diff := ComputePackageDifferences(old, new)
+
+	if len(diff.RemovedNodes) != 1 || diff.RemovedNodes[0].TypeID != "wait" || diff.RemovedNodes[0].PackageID != packageID {
+		t.Errorf("expected wait node to be removed, got %+v", diff.RemovedNodes)
+	}
+
+	if len(diff.RemovedEvents) != 1 || len(diff.RemovedLinks) != 0 || len(diff.RemovedDispatches) != 0 {
+		t.Errorf("unexpected removals %+v", diff)
+	}
+
+	levels := map[string]ChangeLevel{}
+	for _, c := range diff.Changes {
+		levels[c.Item+":"+c.Change+":"+c.ID+"@"+c.Version] = c.Level
+	}
+
+	want := map[string]ChangeLevel{
+		"node:updated:send@1.0.0": ChangePatch,
+		"node:added:send@1.1.0":   ChangeMinor,
+		"node:removed:wait@1.0.0": ChangeMajor,
+		"link:added:always@2.0.0": ChangeMajor,
+		"event:removed:message@":  ChangeMajor,
+		"dispatch:added:typing@":  ChangeMinor,
+	}
+
+	for k, level := range want {
+		if levels[k] != level {
+			t.Errorf("expected %s to be %s, got %s", k, level, levels[k])
+		}
+	}
+
+	if len(diff.Changes) != len(want) {
+		t.Errorf("expected %d changes, got %+v", len(want), diff.Changes)
+	}
+
+	if diff.Level() != ChangeMajor || len(diff.Breaking()) != 3 {
+		t.Errorf("expected 3 breaking changes, got %+v", diff.Breaking())
+	}
+
+	// A blueprint using the removed node and event, and the kept link
+	send, wait, entry := "send", "wait", "message"
+	version := "1.0.0"
+	sendID, waitID, entryID := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	moduleID := uuid.Must(uuid.NewRandom())
+
+	blueprint := DBBlueprint{
+		ID:      uuid.Must(uuid.NewRandom()),
+		Version: Semver{semver.MustParse("0.0.3")},
+		Modules: DBModuleList{
+			moduleID: {ModuleID: moduleID, Graph: GraphModule{
+				ID: moduleID,
+				Nodes: map[uuid.UUID]GraphNode{
+					sendID:  {ID: sendID, PackageID: packageID, TypeID: &send, Version: &version},
+					waitID:  {ID: waitID, PackageID: packageID, TypeID: &wait, Version: &version},
+					entryID: {ID: entryID, PackageID: packageID, EventTypeID: &entry},
+				},
+				Links: []GraphLink{{ID: uuid.Must(uuid.NewRandom()), PackageID: packageID, TypeID: "always", Version: "1.0.0"}},
+			}},
+		},
+	}
+
+	// Another package with identical type ids is unaffected
+	other := blueprint
+	other.ID = uuid.Must(uuid.NewRandom())
+	other.Modules = DBModuleList{moduleID: {ModuleID: moduleID, Graph: GraphModule{
+		ID:    moduleID,
+		Nodes: map[uuid.UUID]GraphNode{waitID: {ID: waitID, PackageID: uuid.Must(uuid.NewRandom()), TypeID: &wait, Version: &version}},
+	}}}
+
+	broken := diff.BreakingReferences(packageID, []DBBlueprint{blueprint, other})
+
+	if len(broken) != 2 {
+		t.Fatalf("expected 2 broken references, got %+v", broken)
+	}
+
+	for _, b := range broken {
+		if b.BlueprintID != blueprint.ID || b.ModuleID != moduleID || b.NodeID == nil {
+			t.Errorf("unexpected broken reference %+v", b)
+			continue
+		}
+
+		if !(*b.NodeID == waitID && b.Item == PackageItemNode) && !(*b.NodeID == entryID && b.Item == PackageItemEvent) {
+			t.Errorf("unexpected broken reference %+v", b)
+		}
+	}
+
+	if broken[0].NodeID.String() > broken[1].NodeID.String() {
+		t.Errorf("expected broken references to be sorted by node id, got %+v", broken)
+	}
+
+	for i := 0; i < 10; i++ {
+		if again := diff.BreakingReferences(packageID, []DBBlueprint{blueprint, other}); !reflect.DeepEqual(again, broken) {
+			t.Fatalf("expected the same order on every run, got %+v and %+v", broken, again)
+		}
+	}
+}
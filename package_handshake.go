@@ -1,5 +1,11 @@
 package ctypes
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
 type RunnableEvent struct {
 	Name          string    `json:"name"`
 	ID            string    `json:"id"`
@@ -12,8 +18,158 @@ type DispatchStyle struct {
 	Icon  string `json:"icon"`  // File name (files will be served in a special format by the plugin)
 }
 
-type PackageModule struct {
+// Package protocol versions
+const (
+	PackageProtocolV1 = "1" // Request/response endpoints only, packages without a handshake endpoint speak this version
+	PackageProtocolV2 = "2" // Adds the handshake and streaming node execution
+)
+
+// HeaderProtocolVersion is sent with every request once a protocol version has been negotiated
+const HeaderProtocolVersion = "X-Convai-Protocol-Version"
+
+// SupportedProtocolVersions are the protocol versions Convai speaks, most preferred first
+var SupportedProtocolVersions = []string{PackageProtocolV2, PackageProtocolV1}
+
+var (
+	ErrNoCompatibleProtocol  = errors.New("package does not support a compatible protocol version")
+	ErrCapabilityUnsupported = errors.New("package does not support this capability")
+)
+
+// PackageCapabilities describes the optional parts of the protocol a package implements
+type PackageCapabilities struct {
+	MockEndpoints    bool `json:"mock_endpoints"`      // The package provides the -mock variants of the execute endpoints
+	Streaming        bool `json:"streaming"`           // The package provides streaming node execution
+	MaxNodeBatchSize int  `json:"max_node_batch_size"` // Maximum node calls per request (0 is unlimited)
+	MaxLinkBatchSize int  `json:"max_link_batch_size"` // Maximum link calls per request (0 is unlimited)
+	Assets           bool `json:"assets"`              // The package serves assets
+	Migrations       bool `json:"migrations"`          // The package migrates configs through POST /migrate
+}
+
+// LegacyPackageCapabilities are assumed for packages that predate the handshake
+var LegacyPackageCapabilities = PackageCapabilities{
+	MockEndpoints: true,
+	Assets:        true,
+}
+
+// HandshakeRequest is sent by Convai to POST /handshake
+type HandshakeRequest struct {
+	ProtocolVersions []string `json:"protocol_versions"` // Versions Convai supports, most preferred first
+}
+
+// HandshakeResponse is how a package describes itself during the handshake
+type HandshakeResponse struct {
+	ProtocolVersions []string            `json:"protocol_versions"` // Versions the package supports
+	Capabilities     PackageCapabilities `json:"capabilities"`
+	Modules          []PackageModule     `json:"modules"`
+	Templates        PackageTemplates    `json:"templates"`
+}
+
+// NegotiatedProtocol is the outcome of a handshake
+type NegotiatedProtocol struct {
+	Version      string              `json:"version"`
+	Capabilities PackageCapabilities `json:"capabilities"`
+	Modules      []PackageModule     `json:"modules"`
+	Templates    PackageTemplates    `json:"templates"`
+	Legacy       bool                `json:"legacy"` // The package has no handshake endpoint
+}
+
+// NegotiateProtocolVersion picks the first of ours (in order of preference) that is also in theirs
+func NegotiateProtocolVersion(ours, theirs []string) (string, error) {
+	for _, v := range ours {
+		if StringSliceContains(theirs, v) {
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: package supports %v, convai supports %v", ErrNoCompatibleProtocol, theirs, ours)
 }
 
-type PackageTemplates struct {
+// Handshake negotiates a protocol version with the package. Once it succeeds, the client adapts requests to the
+// capabilities of the package. Packages without a handshake endpoint are treated as speaking PackageProtocolV1
+func (p *PackageClient) Handshake() (*NegotiatedProtocol, error) {
+	var res HandshakeResponse
+
+	err := p.DoJSONPost("/handshake", HandshakeRequest{ProtocolVersions: SupportedProtocolVersions}, &res)
+
+	var pcErr *PackageClientError
+	legacy := errors.As(err, &pcErr) && (pcErr.Status == http.StatusNotFound || pcErr.Status == http.StatusMethodNotAllowed)
+
+	switch {
+	case legacy:
+		res = HandshakeResponse{
+			ProtocolVersions: []string{PackageProtocolV1},
+			Capabilities:     LegacyPackageCapabilities,
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	version, err := NegotiateProtocolVersion(SupportedProtocolVersions, res.ProtocolVersions)
+	if err != nil {
+		return nil, err
+	}
+
+	negotiated := &NegotiatedProtocol{
+		Version:      version,
+		Capabilities: res.Capabilities,
+		Modules:      res.Modules,
+		Templates:    res.Templates,
+		Legacy:       legacy,
+	}
+
+	// Streaming only exists from v2, even if a package claims otherwise
+	if version == PackageProtocolV1 {
+		negotiated.Capabilities.Streaming = false
+	}
+
+	p.protocolMu.Lock()
+	p.protocol = negotiated
+	p.protocolMu.Unlock()
+
+	return negotiated, nil
+}
+
+// Protocol returns the negotiated protocol, or nil if Handshake has not been called
+func (p *PackageClient) Protocol() *NegotiatedProtocol {
+	p.protocolMu.RLock()
+	defer p.protocolMu.RUnlock()
+
+	return p.protocol
+}
+
+// capabilities returns the negotiated capabilities. Without a handshake nothing is assumed to be unsupported
+func (p *PackageClient) capabilities() PackageCapabilities {
+	if protocol := p.Protocol(); protocol != nil {
+		return protocol.Capabilities
+	}
+
+	return PackageCapabilities{MockEndpoints: true, Streaming: true, Assets: true, Migrations: true}
+}
+
+func (p *PackageClient) requireMock() error {
+	if !p.capabilities().MockEndpoints {
+		return fmt.Errorf("%w: mock endpoints", ErrCapabilityUnsupported)
+	}
+
+	return nil
+}
+
+// batchRanges splits n calls into [start, end) ranges of at most size calls
+func batchRanges(n, size int) [][2]int {
+	if size <= 0 || n <= size {
+		return [][2]int{{0, n}}
+	}
+
+	var ranges [][2]int
+
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+
+		ranges = append(ranges, [2]int{start, end})
+	}
+
+	return ranges
 }
@@ -0,0 +1,188 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		ours, theirs []string
+		want         string
+		wantErr      bool
+	}{
+		{ours: []string{"2", "1"}, theirs: []string{"1", "2"}, want: "2"},
+		{ours: []string{"2", "1"}, theirs: []string{"1"}, want: "1"},
+		{ours: []string{"1", "2"}, theirs: []string{"2", "1"}, want: "1"},
+		{ours: []string{"2", "1"}, theirs: []string{"3"}, wantErr: true},
+		{ours: []string{"2", "1"}, theirs: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := NegotiateProtocolVersion(tt.ours, tt.theirs)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("NegotiateProtocolVersion(%v, %v) = %q, %v", tt.ours, tt.theirs, got, err)
+		}
+
+		if tt.wantErr && !errors.Is(err, ErrNoCompatibleProtocol) {
+			t.Errorf("expected ErrNoCompatibleProtocol, got %v", err)
+		}
+	}
+}
+
+func TestPackageClient_Handshake(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+	versions := map[string]bool{}
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).
+		RegisterNode(DBNode{TypeID: "slow", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			return &NodeCallResult{}, nil
+		}, nil)
+	srv.MaxNodeBatchSize = 3
+
+	router := srv.Router()
+
+	hs := httptest.NewServer(countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		versions[r.Header.Get(HeaderProtocolVersion)] = true
+		mu.Unlock()
+
+		router.ServeHTTP(w, r)
+	}), counts, &mu))
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	if pc.Protocol() != nil {
+		t.Error("expected no protocol before the handshake")
+	}
+
+	calls := make([]NodeCall, 7)
+	for i := range calls {
+		calls[i] = NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "slow", Version: "0.0.1", Sequence: i}
+	}
+
+	// Without a handshake the client does not know the limit, and the server rejects the batch
+	var pcErr *PackageClientError
+	if _, err := pc.ExecuteNodes(calls); !errors.As(err, &pcErr) || pcErr.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected oversize batch to be rejected, got %v", err)
+	}
+
+	protocol, err := pc.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if protocol.Version != PackageProtocolV2 || protocol.Legacy || !protocol.Capabilities.Streaming || protocol.Capabilities.MaxNodeBatchSize != 3 {
+		t.Errorf("unexpected protocol %+v", protocol)
+	}
+
+	mu.Lock()
+	counts["/nodes/execute"] = 0
+	mu.Unlock()
+
+	results, err := pc.ExecuteNodes(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts["/nodes/execute"] != 3 {
+		t.Errorf("expected 7 calls to be split into 3 requests, got %d", counts["/nodes/execute"])
+	}
+
+	for i, r := range results {
+		if r.RequestID != calls[i].RequestID {
+			t.Errorf("result %d out of order", i)
+		}
+	}
+
+	if !versions[PackageProtocolV2] {
+		t.Error("expected negotiated version to be sent with requests")
+	}
+
+	if _, err := pc.GetAssetBytes("icon.svg"); !errors.Is(err, ErrCapabilityUnsupported) {
+		t.Errorf("expected assets to be unsupported, got %v", err)
+	}
+}
+
+func TestPackageClient_HandshakeLegacy(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+	router := NewPackageServer(info).Router()
+
+	hs := httptest.NewServer(countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/handshake" {
+			http.NotFound(w, r)
+			return
+		}
+
+		router.ServeHTTP(w, r)
+	}), counts, &mu))
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	protocol, err := pc.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if protocol.Version != PackageProtocolV1 || !protocol.Legacy || protocol.Capabilities.Streaming {
+		t.Errorf("unexpected legacy protocol %+v", protocol)
+	}
+
+	stream, err := pc.ExecuteNodeStream(&NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "slow", Version: "0.0.1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stream.Result(); err != nil {
+		t.Fatal(err)
+	}
+
+	if counts["/nodes/execute-stream"] != 0 || counts["/nodes/execute"] != 1 {
+		t.Errorf("expected streaming to be skipped for legacy packages, got %v", counts)
+	}
+}
+
+func TestPackageClient_HandshakeCapabilities(t *testing.T) {
+	handshake := HandshakeResponse{ProtocolVersions: []string{PackageProtocolV2}}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(handshake)
+	}))
+	defer hs.Close()
+
+	pc := NewPackageClient(&DBPackage{BaseURL: hs.URL, SigningKey: "secret"})
+
+	if _, err := pc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pc.ExecuteNodeMock(&NodeCall{RequestID: uuid.Must(uuid.NewRandom())}); !errors.Is(err, ErrCapabilityUnsupported) {
+		t.Errorf("expected mock endpoints to be unsupported, got %v", err)
+	}
+
+	if _, err := pc.DispatchMock(&DispatchRequest{}); !errors.Is(err, ErrCapabilityUnsupported) {
+		t.Errorf("expected mock dispatch to be unsupported, got %v", err)
+	}
+
+	handshake.ProtocolVersions = []string{"99"}
+
+	if _, err := pc.Handshake(); !errors.Is(err, ErrNoCompatibleProtocol) {
+		t.Errorf("expected no compatible protocol, got %v", err)
+	}
+}
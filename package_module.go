@@ -0,0 +1,313 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/blang/semver"
+	"github.com/google/uuid"
+)
+
+// PackageModule is a prebuilt module (such as a flow that collects an email address) shipped by a package
+// Modules are versioned alongside nodes and links, and are copied into a blueprint when imported
+type PackageModule struct {
+	ID            string      `json:"id" validate:"required"` // Identifies the module within the package, like a node type id
+	PackageID     uuid.UUID   `json:"package_id"`
+	Version       string      `json:"version"`
+	Name          string      `json:"name"`
+	Documentation string      `json:"docs"`  // Markdown format
+	Graph         GraphModule `json:"graph"` // Nodes and links name the package providing them, uuid.Nil being the stock package
+}
+
+// PackageTemplates are the reusable templates shipped by a package
+type PackageTemplates struct {
+	Responses []ResponseTemplate `json:"responses"`
+}
+
+// ResponseTemplate is a reusable bot response
+type ResponseTemplate struct {
+	ID            string    `json:"id"`
+	PackageID     uuid.UUID `json:"package_id"`
+	Version       string    `json:"version"`
+	Name          string    `json:"name"`
+	Documentation string    `json:"docs"`     // Markdown format
+	Template      string    `json:"template"` // An XMLResponse document, which may contain template tags
+}
+
+// ModuleSource records which package module a blueprint module was imported from
+type ModuleSource struct {
+	PackageID uuid.UUID `json:"package_id"`
+	ModuleID  string    `json:"module_id"`
+	Version   string    `json:"version"`
+
+	// IDMap maps ids in the package module graph (the module, its nodes and its links) to ids in the imported copy
+	IDMap map[uuid.UUID]uuid.UUID `json:"id_map"`
+}
+
+func (m *PackageModule) Validate() error {
+	if m.ID == "" {
+		return errors.New("package module id missing")
+	}
+
+	if _, err := semver.Parse(m.Version); err != nil {
+		return fmt.Errorf("invalid version: %v", err)
+	}
+
+	return m.Graph.Validate()
+}
+
+// copyGraph returns a deep copy of the module graph, so importing never modifies the package module
+func (m *PackageModule) copyGraph() (GraphModule, error) {
+	var graph GraphModule
+
+	jsb, err := json.Marshal(m.Graph)
+	if err != nil {
+		return graph, err
+	}
+
+	err = json.Unmarshal(jsb, &graph)
+
+	return graph, err
+}
+
+// ImportPackageModule copies a package module into the module list, giving the module, its nodes and its links new ids
+// References to other modules are kept as they are. Returns the id of the imported module
+func (l *DBModuleList) ImportPackageModule(m *PackageModule) (uuid.UUID, error) {
+	if err := m.Validate(); err != nil {
+		return uuid.Nil, err
+	}
+
+	graph, err := m.copyGraph()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	idMap := map[uuid.UUID]uuid.UUID{}
+
+	newID := func(old uuid.UUID) uuid.UUID {
+		id := uuid.Must(uuid.NewRandom())
+		idMap[old] = id
+
+		return id
+	}
+
+	imported := GraphModule{
+		ID:    newID(graph.ID),
+		Label: graph.Label,
+		Nodes: map[uuid.UUID]GraphNode{},
+		Links: []GraphLink{},
+	}
+
+	for oldID, n := range graph.Nodes {
+		n.ID = newID(oldID)
+		imported.Nodes[n.ID] = n
+	}
+
+	for _, link := range graph.Links {
+		link.ID = newID(link.ID)
+		link.A.NodeID = remapNodeID(link.A.NodeID, idMap)
+		link.B.NodeID = remapNodeID(link.B.NodeID, idMap)
+
+		imported.Links = append(imported.Links, link)
+	}
+
+	if *l == nil {
+		*l = DBModuleList{}
+	}
+
+	(*l)[imported.ID] = DBModuleListItem{
+		ModuleID: imported.ID,
+		Name:     m.Name,
+		Graph:    imported,
+		Source: &ModuleSource{
+			PackageID: m.PackageID,
+			ModuleID:  m.ID,
+			Version:   m.Version,
+			IDMap:     idMap,
+		},
+	}
+
+	return imported.ID, nil
+}
+
+func remapNodeID(id *uuid.UUID, idMap map[uuid.UUID]uuid.UUID) *uuid.UUID {
+	if id == nil {
+		return nil
+	}
+
+	if mapped, ok := idMap[*id]; ok {
+		return &mapped
+	}
+
+	return id
+}
+
+// ModuleNodeChange is a node that differs between an imported module and the package module it came from
+type ModuleNodeChange struct {
+	ImportedID uuid.UUID `json:"imported_id"`
+	Imported   GraphNode `json:"imported"`
+	Upgraded   GraphNode `json:"upgraded"` // Ids are in the package module graph
+}
+
+// ModuleLinkChange is a link that differs between an imported module and the package module it came from
+type ModuleLinkChange struct {
+	ImportedID uuid.UUID `json:"imported_id"`
+	Imported   GraphLink `json:"imported"`
+	Upgraded   GraphLink `json:"upgraded"` // Ids are in the package module graph
+}
+
+// ModuleUpgradeDiff describes how an imported module differs from a (usually newer) version of its package module
+// Layout changes are ignored
+type ModuleUpgradeDiff struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+
+	AddedNodes   []GraphNode        `json:"added_nodes"`   // Nodes in the package module that were never imported
+	RemovedNodes []uuid.UUID        `json:"removed_nodes"` // Imported nodes the package module no longer has
+	ChangedNodes []ModuleNodeChange `json:"changed_nodes"`
+	LocalNodes   []uuid.UUID        `json:"local_nodes"`   // Nodes added to the imported copy by the bot builder
+	DeletedNodes []uuid.UUID        `json:"deleted_nodes"` // Package module nodes deleted from the imported copy (package module ids)
+
+	AddedLinks   []GraphLink        `json:"added_links"`
+	RemovedLinks []uuid.UUID        `json:"removed_links"`
+	ChangedLinks []ModuleLinkChange `json:"changed_links"`
+	LocalLinks   []uuid.UUID        `json:"local_links"`
+	DeletedLinks []uuid.UUID        `json:"deleted_links"`
+}
+
+// Empty is true if the imported module matches the package module
+func (d *ModuleUpgradeDiff) Empty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.ChangedNodes) == 0 &&
+		len(d.LocalNodes) == 0 && len(d.DeletedNodes) == 0 &&
+		len(d.AddedLinks) == 0 && len(d.RemovedLinks) == 0 && len(d.ChangedLinks) == 0 &&
+		len(d.LocalLinks) == 0 && len(d.DeletedLinks) == 0
+}
+
+var ErrModuleNotImported = errors.New("module was not imported from this package module")
+
+// DiffModuleUpgrade compares an imported module with a version of the package module it was imported from
+func DiffModuleUpgrade(imported *DBModuleListItem, upgraded *PackageModule) (*ModuleUpgradeDiff, error) {
+	src := imported.Source
+	if src == nil || src.PackageID != upgraded.PackageID || src.ModuleID != upgraded.ID {
+		return nil, ErrModuleNotImported
+	}
+
+	graph, err := upgraded.copyGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := ModuleUpgradeDiff{
+		FromVersion: src.Version,
+		ToVersion:   upgraded.Version,
+	}
+
+	// Ids in the imported copy that still correspond to something in the package module
+	matched := map[uuid.UUID]bool{}
+
+	for oldID, n := range graph.Nodes {
+		importedID, ok := src.IDMap[oldID]
+		if !ok {
+			diff.AddedNodes = append(diff.AddedNodes, n)
+			continue
+		}
+
+		current, ok := imported.Graph.Nodes[importedID]
+		if !ok {
+			diff.DeletedNodes = append(diff.DeletedNodes, oldID)
+			continue
+		}
+
+		matched[importedID] = true
+
+		if !nodesEquivalent(&current, &n) {
+			diff.ChangedNodes = append(diff.ChangedNodes, ModuleNodeChange{ImportedID: importedID, Imported: current, Upgraded: n})
+		}
+	}
+
+	for id := range imported.Graph.Nodes {
+		if matched[id] {
+			continue
+		}
+
+		if importedFromPackage(src.IDMap, id) {
+			diff.RemovedNodes = append(diff.RemovedNodes, id)
+		} else {
+			diff.LocalNodes = append(diff.LocalNodes, id)
+		}
+	}
+
+	importedLinks := map[uuid.UUID]GraphLink{}
+	for _, link := range imported.Graph.Links {
+		importedLinks[link.ID] = link
+	}
+
+	for _, link := range graph.Links {
+		importedID, ok := src.IDMap[link.ID]
+		if !ok {
+			diff.AddedLinks = append(diff.AddedLinks, link)
+			continue
+		}
+
+		current, ok := importedLinks[importedID]
+		if !ok {
+			diff.DeletedLinks = append(diff.DeletedLinks, link.ID)
+			continue
+		}
+
+		matched[importedID] = true
+
+		if !linksEquivalent(&current, &link, src.IDMap) {
+			diff.ChangedLinks = append(diff.ChangedLinks, ModuleLinkChange{ImportedID: importedID, Imported: current, Upgraded: link})
+		}
+	}
+
+	for _, link := range imported.Graph.Links {
+		if matched[link.ID] {
+			continue
+		}
+
+		if importedFromPackage(src.IDMap, link.ID) {
+			diff.RemovedLinks = append(diff.RemovedLinks, link.ID)
+		} else {
+			diff.LocalLinks = append(diff.LocalLinks, link.ID)
+		}
+	}
+
+	return &diff, nil
+}
+
+func importedFromPackage(idMap map[uuid.UUID]uuid.UUID, importedID uuid.UUID) bool {
+	for _, id := range idMap {
+		if id == importedID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nodesEquivalent(a, b *GraphNode) bool {
+	return a.Label == b.Label &&
+		a.PackageID == b.PackageID &&
+		reflect.DeepEqual(a.TypeID, b.TypeID) &&
+		reflect.DeepEqual(a.Version, b.Version) &&
+		reflect.DeepEqual(a.ConfigJSON, b.ConfigJSON) &&
+		reflect.DeepEqual(a.ModuleID, b.ModuleID) &&
+		reflect.DeepEqual(a.ModuleVersion, b.ModuleVersion) &&
+		reflect.DeepEqual(a.EventTypeID, b.EventTypeID)
+}
+
+// linksEquivalent compares an imported link with a package module link, mapping the endpoints of the latter
+func linksEquivalent(imported, upgraded *GraphLink, idMap map[uuid.UUID]uuid.UUID) bool {
+	return imported.Label == upgraded.Label &&
+		imported.PackageID == upgraded.PackageID &&
+		imported.TypeID == upgraded.TypeID &&
+		imported.Version == upgraded.Version &&
+		imported.Priority == upgraded.Priority &&
+		imported.ConfigJSON == upgraded.ConfigJSON &&
+		reflect.DeepEqual(imported.A.NodeID, remapNodeID(upgraded.A.NodeID, idMap)) &&
+		reflect.DeepEqual(imported.B.NodeID, remapNodeID(upgraded.B.NodeID, idMap))
+}
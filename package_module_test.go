@@ -0,0 +1,222 @@
+package ctypes
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDBModuleList_ImportPackageModule(t *testing.T) {
+	packageID := uuid.Must(uuid.NewRandom())
+	ask, branch := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	send, stockBranch, version := "send", "branch", "0.0.1"
+	askConfig, branchConfig := `{"text":"What is your email?"}`, `{}`
+
+	// The branch node and the link between the nodes come from the stock package
+	module := &PackageModule{
+		ID:        "collect-email",
+		PackageID: packageID,
+		Version:   "1.0.0",
+		Name:      "Collect Email",
+		Graph: GraphModule{
+			ID:    uuid.Must(uuid.NewRandom()),
+			Label: "Collect Email",
+			Nodes: map[uuid.UUID]GraphNode{
+				ask:    {ID: ask, Label: "Ask", PackageID: packageID, TypeID: &send, Version: &version, ConfigJSON: &askConfig},
+				branch: {ID: branch, Label: "Branch", PackageID: uuid.Nil, TypeID: &stockBranch, Version: &version, ConfigJSON: &branchConfig},
+			},
+			Links: []GraphLink{{
+				ID:         uuid.Must(uuid.NewRandom()),
+				PackageID:  uuid.Nil,
+				TypeID:     "basic",
+				Version:    "0.0.1",
+				ConfigJSON: "{}",
+				A:          LinkPoint{NodeID: &ask, IsOutput: true},
+				B:          LinkPoint{NodeID: &branch, Position: Point{X: 10}},
+			}},
+		},
+	}
+
+	var list DBModuleList
+
+	id, err := list.ImportPackageModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, ok := list[id]
+	if !ok || item.ModuleID != id || item.Graph.ID != id || item.Name != "Collect Email" {
+		t.Fatalf("expected module to be imported under its new id, got %+v", item)
+	}
+
+	if id == module.Graph.ID || item.Source == nil || item.Source.IDMap[module.Graph.ID] != id || item.Source.Version != "1.0.0" {
+		t.Errorf("unexpected source %+v", item.Source)
+	}
+
+	for oldID := range module.Graph.Nodes {
+		newID := item.Source.IDMap[oldID]
+
+		node, ok := item.Graph.Nodes[newID]
+		if !ok || newID == oldID || node.ID != newID {
+			t.Errorf("node %s was not remapped", oldID)
+		}
+
+		if node.PackageID != module.Graph.Nodes[oldID].PackageID {
+			t.Errorf("expected %s node to keep its package, got %s", node.Label, node.PackageID)
+		}
+	}
+
+	link := item.Graph.Links[0]
+	original := module.Graph.Links[0]
+
+	if link.PackageID != uuid.Nil {
+		t.Errorf("expected stock link to stay in the stock package, got %s", link.PackageID)
+	}
+
+	if link.ID == original.ID || *link.A.NodeID != item.Source.IDMap[*original.A.NodeID] || *link.B.NodeID != item.Source.IDMap[*original.B.NodeID] {
+		t.Errorf("link was not remapped %+v", link)
+	}
+
+	if *original.A.NodeID == *link.A.NodeID {
+		t.Error("import modified the package module")
+	}
+
+	if err := item.Graph.Validate(); err != nil {
+		t.Errorf("imported graph is invalid: %s", err)
+	}
+}
+
+func TestDiffModuleUpgrade(t *testing.T) {
+	packageID := uuid.Must(uuid.NewRandom())
+	ask, wait := uuid.Must(uuid.NewRandom()), uuid.Must(uuid.NewRandom())
+	typeID, version := "send", "0.0.1"
+	askConfig, waitConfig := `{"text":"What is your email?"}`, `{}`
+
+	module := &PackageModule{
+		ID:        "collect-email",
+		PackageID: packageID,
+		Version:   "1.0.0",
+		Graph: GraphModule{
+			ID: uuid.Must(uuid.NewRandom()),
+			Nodes: map[uuid.UUID]GraphNode{
+				ask:  {ID: ask, Label: "Ask", PackageID: packageID, TypeID: &typeID, Version: &version, ConfigJSON: &askConfig},
+				wait: {ID: wait, Label: "Wait", PackageID: packageID, TypeID: &typeID, Version: &version, ConfigJSON: &waitConfig},
+			},
+			Links: []GraphLink{{
+				ID:         uuid.Must(uuid.NewRandom()),
+				TypeID:     "basic",
+				Version:    "0.0.1",
+				ConfigJSON: "{}",
+				A:          LinkPoint{NodeID: &ask, IsOutput: true},
+				B:          LinkPoint{NodeID: &wait, Position: Point{X: 10}},
+			}},
+		},
+	}
+
+	list := DBModuleList{}
+
+	id, err := list.ImportPackageModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := list[id]
+
+	diff, err := DiffModuleUpgrade(&item, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !diff.Empty() {
+		t.Errorf("expected no differences right after import, got %+v", diff)
+	}
+
+	// The package changes the question, drops the wait node (and its link) and adds a validation node
+	upgraded := *module
+	upgraded.Version = "1.1.0"
+	upgraded.Graph.Nodes = map[uuid.UUID]GraphNode{}
+	upgraded.Graph.Links = []GraphLink{}
+
+	askNode := module.Graph.Nodes[ask]
+	question := `{"text":"Email please"}`
+	askNode.ConfigJSON = &question
+	upgraded.Graph.Nodes[ask] = askNode
+
+	validate := uuid.Must(uuid.NewRandom())
+	upgraded.Graph.Nodes[validate] = GraphNode{ID: validate, Label: "Validate"}
+
+	// Meanwhile the bot builder adds their own node
+	local := uuid.Must(uuid.NewRandom())
+	item.Graph.Nodes[local] = GraphNode{ID: local, Label: "Local"}
+
+	diff, err = DiffModuleUpgrade(&item, &upgraded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff.FromVersion != "1.0.0" || diff.ToVersion != "1.1.0" {
+		t.Errorf("unexpected versions %s -> %s", diff.FromVersion, diff.ToVersion)
+	}
+
+	if len(diff.ChangedNodes) != 1 || diff.ChangedNodes[0].ImportedID != item.Source.IDMap[ask] {
+		t.Errorf("expected ask node to change, got %+v", diff.ChangedNodes)
+	}
+
+	if len(diff.RemovedNodes) != 1 || diff.RemovedNodes[0] != item.Source.IDMap[wait] {
+		t.Errorf("expected wait node to be removed, got %+v", diff.RemovedNodes)
+	}
+
+	if len(diff.AddedNodes) != 1 || diff.AddedNodes[0].ID != validate {
+		t.Errorf("expected validate node to be added, got %+v", diff.AddedNodes)
+	}
+
+	if len(diff.LocalNodes) != 1 || diff.LocalNodes[0] != local {
+		t.Errorf("expected local node, got %+v", diff.LocalNodes)
+	}
+
+	if len(diff.RemovedLinks) != 1 {
+		t.Errorf("expected link to be removed, got %+v", diff.RemovedLinks)
+	}
+
+	other := *module
+	other.ID = "something-else"
+
+	if _, err := DiffModuleUpgrade(&item, &other); err != ErrModuleNotImported {
+		t.Errorf("expected ErrModuleNotImported, got %v", err)
+	}
+}
+
+func TestComputePackageDifferences_Modules(t *testing.T) {
+	module := &PackageModule{ID: "collect-email", PackageID: uuid.Must(uuid.NewRandom()), Version: "1.0.0"}
+	template := ResponseTemplate{ID: "greeting", Version: "1.0.0", Template: "<response><message><text>Hi</text></message></response>"}
+
+	old := &Package{Modules: []PackageModule{*module}, Templates: PackageTemplates{Responses: []ResponseTemplate{template}}}
+	old.ID = module.PackageID
+	old.Templates.Responses[0].PackageID = module.PackageID
+
+	updated := *module
+	updated.Documentation = "Collects and validates an email address"
+
+	newer := *module
+	newer.Version = "1.1.0"
+
+	changedTemplate := template
+	changedTemplate.Template = "<response><message><text>Hello</text></message></response>"
+
+	new := &Package{Modules: []PackageModule{updated, newer}, Templates: PackageTemplates{Responses: []ResponseTemplate{changedTemplate}}}
+	new.ID = module.PackageID
+
+	diff := ComputePackageDifferences(old, new)
+
+	if len(diff.UpdatedModules) != 1 || diff.UpdatedModules[0].Version != "1.0.0" {
+		t.Errorf("expected updated module, got %+v", diff.UpdatedModules)
+	}
+
+	if len(diff.NewModules) != 1 || diff.NewModules[0].Version != "1.1.0" {
+		t.Errorf("expected new module version, got %+v", diff.NewModules)
+	}
+
+	if len(diff.UpdatedTemplates) != 1 || len(diff.NewTemplates) != 0 {
+		t.Errorf("expected updated template, got %+v %+v", diff.UpdatedTemplates, diff.NewTemplates)
+	}
+}
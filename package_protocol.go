@@ -0,0 +1,214 @@
+package ctypes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Package protocol error kinds
+const (
+	PPEMalformedResponse = "malformed_response"
+	PPEResultCount       = "result_count"
+	PPERequestID         = "request_id"
+	PPELogLevel          = "log_level"
+	PPETransformation    = "transformation"
+)
+
+var (
+	ErrResultCountMismatch = errors.New("package returned a different number of results than calls")
+	ErrRequestIDMismatch   = errors.New("package returned a result with an unexpected request id")
+	ErrInvalidLogLevel     = errors.New("package returned a log entry with an invalid level")
+	ErrInvalidTransform    = errors.New("package returned an invalid transformation")
+)
+
+var validLogLevels = []int{LogLevelTrace, LogLevelDebug, LogLevelInfo, LogLevelWarning, LogLevelError}
+
+// PackageProtocolError is returned when a package replies with a response that does not conform to the protocol
+type PackageProtocolError struct {
+	Kind    string `json:"kind"`
+	Index   int    `json:"index"` // Index of the offending result, -1 if the error is not about a single result
+	Message string `json:"message"`
+}
+
+func (e *PackageProtocolError) Error() string {
+	if e.Index >= 0 {
+		return fmt.Sprintf("package protocol violation (%s) in result %d: %s", e.Kind, e.Index, e.Message)
+	}
+
+	return fmt.Sprintf("package protocol violation (%s): %s", e.Kind, e.Message)
+}
+
+func (e *PackageProtocolError) Unwrap() error {
+	switch e.Kind {
+	case PPEResultCount:
+		return ErrResultCountMismatch
+	case PPERequestID:
+		return ErrRequestIDMismatch
+	case PPELogLevel:
+		return ErrInvalidLogLevel
+	case PPETransformation:
+		return ErrInvalidTransform
+	}
+
+	return nil
+}
+
+// ValidateNodeExecutionResponse checks that node results match the calls that were sent
+func ValidateNodeExecutionResponse(calls []NodeCall, results []NodeCallResult) error {
+	if len(calls) != len(results) {
+		return resultCountError(len(calls), len(results))
+	}
+
+	for i := range calls {
+		if calls[i].RequestID != results[i].RequestID {
+			return requestIDError(i, results[i].RequestID.String(), calls[i].RequestID.String())
+		}
+
+		if err := validateLogs(i, results[i].Logs); err != nil {
+			return err
+		}
+
+		for _, t := range results[i].Transformations {
+			if !t.PathValid() {
+				return &PackageProtocolError{Kind: PPETransformation, Index: i, Message: fmt.Sprintf("invalid path %q", t.Path)}
+			}
+
+			if t.Operation != OpSet && t.Operation != OpDelete {
+				return &PackageProtocolError{Kind: PPETransformation, Index: i, Message: fmt.Sprintf("unknown operation %d", t.Operation)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateLinkExecutionResponse checks that link results match the calls that were sent
+func ValidateLinkExecutionResponse(calls []LinkCall, results []LinkCallResult) error {
+	if len(calls) != len(results) {
+		return resultCountError(len(calls), len(results))
+	}
+
+	for i := range calls {
+		if calls[i].RequestID != results[i].RequestID {
+			return requestIDError(i, results[i].RequestID.String(), calls[i].RequestID.String())
+		}
+
+		if err := validateLogs(i, results[i].Logs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateDispatchResponse checks that dispatch results match the dispatches that were sent
+func ValidateDispatchResponse(calls []DispatchCall, results []DispatchCallResult) error {
+	if len(calls) != len(results) {
+		return resultCountError(len(calls), len(results))
+	}
+
+	for i := range calls {
+		if calls[i].RequestID != results[i].RequestID {
+			return requestIDError(i, results[i].RequestID.String(), calls[i].RequestID.String())
+		}
+
+		if err := validateLogs(i, results[i].Logs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resultCountError(sent, received int) error {
+	return &PackageProtocolError{
+		Kind:    PPEResultCount,
+		Index:   -1,
+		Message: fmt.Sprintf("sent %d calls, received %d results", sent, received),
+	}
+}
+
+func requestIDError(index int, got, want string) error {
+	return &PackageProtocolError{
+		Kind:    PPERequestID,
+		Index:   index,
+		Message: fmt.Sprintf("got request id %s, expected %s", got, want),
+	}
+}
+
+func validateLogs(index int, logs []LogEntry) error {
+	for _, l := range logs {
+		valid := false
+
+		for _, lvl := range validLogLevels {
+			if l.Level == lvl {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return &PackageProtocolError{Kind: PPELogLevel, Index: index, Message: fmt.Sprintf("invalid log level %d", l.Level)}
+		}
+	}
+
+	return nil
+}
+
+// PackageCallError converts an error from a PackageClient into an API error
+// Missing links are reported with ErrPackageMissingLink, everything else with ErrFailedToCallPackage
+func PackageCallError(err error) *APIError {
+	apiErr := &APIError{
+		statusCode: http.StatusBadGateway,
+		Code:       ErrFailedToCallPackage,
+		Message:    fmt.Sprintf("failed to call package: %s", err.Error()),
+	}
+
+	var pcErr *PackageClientError
+	var protoErr *PackageProtocolError
+
+	switch {
+	case errors.As(err, &pcErr):
+		if pcErr.Code == ErrPackageMissingLink {
+			return apiErr.
+				WithCode(ErrPackageMissingLink).
+				WithHTTPCode(http.StatusNotFound).
+				WithMessage(fmt.Sprintf("package is missing link: %s", pcErr.Message)).
+				WithData(pcErr.Data)
+		}
+
+		apiErr = apiErr.WithData(pcErr)
+	case errors.As(err, &protoErr):
+		apiErr = apiErr.WithData(protoErr)
+	}
+
+	return apiErr
+}
+
+// MissingLinkResult reports whether a link result failed because the package does not provide the link
+func MissingLinkResult(result *LinkCallResult) bool {
+	for _, e := range result.Errors {
+		if e.Code == ErrPackageMissingLink {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewPackageError converts a package call failure into a PackageError that can be stored as a DBPMError
+func NewPackageError(errType string, err error) PackageError {
+	pmErr := PackageError{
+		Type: errType,
+		Body: err.Error(),
+	}
+
+	var pcErr *PackageClientError
+	if errors.As(err, &pcErr) {
+		pmErr.StatusCode = pcErr.Status
+		pmErr.Body = pcErr.Body
+	}
+
+	return pmErr
+}
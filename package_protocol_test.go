@@ -0,0 +1,122 @@
+package ctypes
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateNodeExecutionResponse(t *testing.T) {
+	calls := []NodeCall{
+		{RequestID: uuid.Must(uuid.NewRandom())},
+		{RequestID: uuid.Must(uuid.NewRandom())},
+	}
+
+	valid := func() []NodeCallResult {
+		return []NodeCallResult{
+			{RequestID: calls[0].RequestID, Logs: []LogEntry{{Message: "ok", Level: LogLevelInfo}}},
+			{RequestID: calls[1].RequestID, Transformations: []Transformation{{Path: "user.data.name", Operation: OpSet}}},
+		}
+	}
+
+	if err := ValidateNodeExecutionResponse(calls, valid()); err != nil {
+		t.Errorf("expected valid response, got %s", err)
+	}
+
+	if err := ValidateNodeExecutionResponse(calls, nil); !errors.Is(err, ErrResultCountMismatch) {
+		t.Errorf("expected result count mismatch, got %v", err)
+	}
+
+	swapped := valid()
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+
+	if err := ValidateNodeExecutionResponse(calls, swapped); !errors.Is(err, ErrRequestIDMismatch) {
+		t.Errorf("expected request id mismatch, got %v", err)
+	}
+
+	badLevel := valid()
+	badLevel[0].Logs[0].Level = 35
+
+	err := ValidateNodeExecutionResponse(calls, badLevel)
+	if !errors.Is(err, ErrInvalidLogLevel) {
+		t.Errorf("expected invalid log level, got %v", err)
+	}
+
+	var protoErr *PackageProtocolError
+	if !errors.As(err, &protoErr) || protoErr.Index != 0 {
+		t.Errorf("expected protocol error for result 0, got %v", err)
+	}
+
+	badPath := valid()
+	badPath[1].Transformations[0].Path = "name"
+
+	if err := ValidateNodeExecutionResponse(calls, badPath); !errors.Is(err, ErrInvalidTransform) {
+		t.Errorf("expected invalid transformation, got %v", err)
+	}
+
+	badOp := valid()
+	badOp[1].Transformations[0].Operation = 7
+
+	if err := ValidateNodeExecutionResponse(calls, badOp); !errors.Is(err, ErrInvalidTransform) {
+		t.Errorf("expected invalid transformation operation, got %v", err)
+	}
+}
+
+func TestPackageClient_InvalidResponses(t *testing.T) {
+	responses := map[string]string{
+		"/nodes/execute":    `{"results": []}`,
+		"/links/execute":    `not json`,
+		"/dispatch/execute": `{"code": 482, "message": "no such dispatch", "data": {"type_id": "missing"}}`,
+	}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dispatch/execute" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		_, _ = w.Write([]byte(responses[r.URL.Path]))
+	}))
+	defer hs.Close()
+
+	pc := NewPackageClient(&DBPackage{ID: uuid.Must(uuid.NewRandom()), BaseURL: hs.URL, SigningKey: "secret"})
+
+	_, err := pc.ExecuteNode(&NodeCall{RequestID: uuid.Must(uuid.NewRandom())})
+	if !errors.Is(err, ErrResultCountMismatch) {
+		t.Errorf("expected empty results to be rejected, got %v", err)
+	}
+
+	if apiErr := PackageCallError(err); apiErr.Code != ErrFailedToCallPackage {
+		t.Errorf("expected failed to call package, got %d", apiErr.Code)
+	}
+
+	_, err = pc.ExecuteLink(&LinkExecutionRequest{Calls: []LinkCall{{RequestID: uuid.Must(uuid.NewRandom())}}})
+
+	var protoErr *PackageProtocolError
+	if !errors.As(err, &protoErr) || protoErr.Kind != PPEMalformedResponse {
+		t.Errorf("expected malformed response error, got %v", err)
+	}
+
+	_, err = pc.Dispatch(&DispatchRequest{Dispatches: []DispatchCall{{RequestID: uuid.Must(uuid.NewRandom())}}})
+
+	var pcErr *PackageClientError
+	if !errors.As(err, &pcErr) {
+		t.Fatalf("expected package client error, got %v", err)
+	}
+
+	if pcErr.Status != http.StatusNotFound || pcErr.Code != ErrPackageMissingLink || pcErr.Message != "no such dispatch" {
+		t.Errorf("expected structured error body to be decoded, got %+v", pcErr)
+	}
+
+	apiErr := PackageCallError(err)
+	if apiErr.Code != ErrPackageMissingLink || apiErr.HTTPStatusCode() != http.StatusNotFound {
+		t.Errorf("expected missing link api error, got %+v", apiErr)
+	}
+
+	pmErr := NewPackageError(PMErrDispatch, err)
+	if pmErr.StatusCode != http.StatusNotFound || pmErr.Body != responses["/dispatch/execute"] {
+		t.Errorf("unexpected package error %+v", pmErr)
+	}
+}
@@ -0,0 +1,678 @@
+package ctypes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NodeHandler executes a single node call on behalf of a package
+type NodeHandler func(call *NodeCall) (*NodeCallResult, error)
+
+// LinkHandler evaluates a single link call on behalf of a package
+type LinkHandler func(call *LinkCall) (*LinkCallResult, error)
+
+// DispatchHandler performs a single dispatch on behalf of a package
+type DispatchHandler func(call *DispatchCall) (*DispatchCallResult, error)
+
+// MigrationHandler migrates a single config by one version step, returning the migrated config
+type MigrationHandler func(call *ConfigMigrationCall) (string, error)
+
+// MiscHandler answers a package specific misc request. The returned value is sent back as JSON
+type MiscHandler func(jsonBody []byte) (interface{}, error)
+
+type registeredNode struct {
+	node       DBNode
+	handler    NodeHandler
+	mock       NodeHandler
+	stream     StreamingNodeHandler
+	streamMock StreamingNodeHandler
+}
+
+type registeredLink struct {
+	link    DBLink
+	handler LinkHandler
+	mock    LinkHandler
+}
+
+type registeredDispatch struct {
+	dispatch DBDispatch
+	handler  DispatchHandler
+	mock     DispatchHandler
+}
+
+// PackageServer implements the server side of the package protocol, so package authors only need to write handlers
+type PackageServer struct {
+	info     DBPackage
+	verifier *RequestVerifier
+
+	nodes      map[string]registeredNode
+	links      map[string]registeredLink
+	dispatches map[string]registeredDispatch
+	events     []DBEvent
+	misc       map[string]MiscHandler
+	assets     http.FileSystem
+	modules    []PackageModule
+	templates  PackageTemplates
+	settings   *ConfigSchema
+	migrations map[string]MigrationHandler
+
+	// Registration order is kept so the manifest is stable
+	nodeKeys     []string
+	linkKeys     []string
+	dispatchKeys []string
+
+	// MaxConcurrency limits how many calls from a single batch are executed at once (0 is unlimited)
+	MaxConcurrency int
+
+	// MaxNodeBatchSize and MaxLinkBatchSize are advertised during the handshake, larger batches are rejected (0 is unlimited)
+	MaxNodeBatchSize int
+	MaxLinkBatchSize int
+}
+
+// NewPackageServer creates a package server. Requests are verified with the signing key(s) of info
+func NewPackageServer(info DBPackage) *PackageServer {
+	return &PackageServer{
+		info:       info,
+		verifier:   info.RequestVerifier(),
+		nodes:      map[string]registeredNode{},
+		links:      map[string]registeredLink{},
+		dispatches: map[string]registeredDispatch{},
+		misc:       map[string]MiscHandler{},
+		migrations: map[string]MigrationHandler{},
+	}
+}
+
+func handlerKey(typeID, version string) string {
+	return fmt.Sprintf("%s@%s", typeID, version)
+}
+
+// RegisterNode adds a node type to the package. If mock is nil, handler is also used for mock executions
+func (s *PackageServer) RegisterNode(node DBNode, handler NodeHandler, mock NodeHandler) *PackageServer {
+	key := handlerKey(node.TypeID, node.Version)
+
+	if _, exists := s.nodes[key]; !exists {
+		s.nodeKeys = append(s.nodeKeys, key)
+	}
+
+	s.nodes[key] = registeredNode{node: node, handler: handler, mock: mock}
+
+	return s
+}
+
+// RegisterStreamingNode adds a node type that streams its logs and transformations while it executes
+// The node can still be called through the regular endpoints. If mock is nil, handler is also used for mock executions
+func (s *PackageServer) RegisterStreamingNode(node DBNode, handler StreamingNodeHandler, mock StreamingNodeHandler) *PackageServer {
+	s.RegisterNode(node, streamingNodeHandler(handler), streamingNodeHandler(mock))
+
+	key := handlerKey(node.TypeID, node.Version)
+	reg := s.nodes[key]
+	reg.stream = handler
+	reg.streamMock = mock
+	s.nodes[key] = reg
+
+	return s
+}
+
+// RegisterLink adds a link type to the package. If mock is nil, handler is also used for mock executions
+func (s *PackageServer) RegisterLink(link DBLink, handler LinkHandler, mock LinkHandler) *PackageServer {
+	key := handlerKey(link.TypeID, link.Version)
+
+	if _, exists := s.links[key]; !exists {
+		s.linkKeys = append(s.linkKeys, key)
+	}
+
+	s.links[key] = registeredLink{link: link, handler: handler, mock: mock}
+
+	return s
+}
+
+// RegisterDispatch adds a dispatch type to the package. If mock is nil, handler is also used for mock dispatches
+func (s *PackageServer) RegisterDispatch(dispatch DBDispatch, handler DispatchHandler, mock DispatchHandler) *PackageServer {
+	if _, exists := s.dispatches[dispatch.ID]; !exists {
+		s.dispatchKeys = append(s.dispatchKeys, dispatch.ID)
+	}
+
+	s.dispatches[dispatch.ID] = registeredDispatch{dispatch: dispatch, handler: handler, mock: mock}
+
+	return s
+}
+
+// RegisterEvent adds an event the package can send to Convai to the manifest
+func (s *PackageServer) RegisterEvent(event DBEvent) *PackageServer {
+	s.events = append(s.events, event)
+	return s
+}
+
+// RegisterMisc adds a handler for POST /misc/:key
+func (s *PackageServer) RegisterMisc(key string, handler MiscHandler) *PackageServer {
+	s.misc[key] = handler
+	return s
+}
+
+// RegisterModule adds a prebuilt module to the package
+func (s *PackageServer) RegisterModule(module PackageModule) *PackageServer {
+	s.modules = append(s.modules, module)
+	return s
+}
+
+// RegisterTemplate adds a response template to the package
+func (s *PackageServer) RegisterTemplate(template ResponseTemplate) *PackageServer {
+	s.templates.Responses = append(s.templates.Responses, template)
+	return s
+}
+
+func migrationKey(item, typeID, from, to string) string {
+	return fmt.Sprintf("%s/%s/%s->%s", item, typeID, from, to)
+}
+
+// RegisterNodeMigration adds a handler that migrates node configs from one version to another
+// The migration is listed in the manifest on the node with version to
+func (s *PackageServer) RegisterNodeMigration(typeID, from, to string, handler MigrationHandler) *PackageServer {
+	s.migrations[migrationKey(PackageItemNode, typeID, from, to)] = handler
+	return s
+}
+
+// RegisterLinkMigration adds a handler that migrates link configs from one version to another
+// The migration is listed in the manifest on the link with version to
+func (s *PackageServer) RegisterLinkMigration(typeID, from, to string, handler MigrationHandler) *PackageServer {
+	s.migrations[migrationKey(PackageItemLink, typeID, from, to)] = handler
+	return s
+}
+
+// remoteMigrations lists the registered migrations into a version of a node or link type
+func (s *PackageServer) remoteMigrations(item, typeID, to string) []ConfigMigration {
+	var migrations []ConfigMigration
+
+	prefix := fmt.Sprintf("%s/%s/", item, typeID)
+	suffix := "->" + to
+
+	for key := range s.migrations {
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) {
+			from := strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)
+			migrations = append(migrations, ConfigMigration{From: from, To: to, Remote: true})
+		}
+	}
+
+	// Map iteration order is random, the manifest should not be
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].From < migrations[j].From })
+
+	return migrations
+}
+
+// SetSettingsSchema describes the package settings bot builders configure on each environment
+func (s *PackageServer) SetSettingsSchema(schema *ConfigSchema) *PackageServer {
+	s.settings = schema
+	return s
+}
+
+// ServeAssets serves style icons and other assets from fs under /assets
+func (s *PackageServer) ServeAssets(fs http.FileSystem) *PackageServer {
+	s.assets = fs
+	return s
+}
+
+// Manifest builds the package manifest from all registrations
+func (s *PackageServer) Manifest() *Package {
+	pkg := Package{
+		DBPackage:  s.info,
+		Nodes:      []DBNode{},
+		Links:      []DBLink{},
+		Events:     []DBEvent{},
+		Dispatches: []DBDispatch{},
+		Modules:    []PackageModule{},
+		Templates:  PackageTemplates{Responses: []ResponseTemplate{}},
+
+		SettingsSchema: s.settings,
+	}
+
+	// Never leak signing keys through the manifest
+	pkg.SigningKey = ""
+	pkg.PreviousSigningKey = ""
+
+	for _, key := range s.nodeKeys {
+		node := s.nodes[key].node
+		node.PackageID = s.info.ID
+		if remote := s.remoteMigrations(PackageItemNode, node.TypeID, node.Version); len(remote) > 0 {
+			node.Migrations = append(append(ConfigMigrations{}, node.Migrations...), remote...)
+		}
+		pkg.Nodes = append(pkg.Nodes, node)
+	}
+
+	for _, key := range s.linkKeys {
+		link := s.links[key].link
+		link.PackageID = s.info.ID
+		if remote := s.remoteMigrations(PackageItemLink, link.TypeID, link.Version); len(remote) > 0 {
+			link.Migrations = append(append(ConfigMigrations{}, link.Migrations...), remote...)
+		}
+		pkg.Links = append(pkg.Links, link)
+	}
+
+	for _, event := range s.events {
+		event.PackageID = s.info.ID
+		pkg.Events = append(pkg.Events, event)
+	}
+
+	for _, key := range s.dispatchKeys {
+		dispatch := s.dispatches[key].dispatch
+		dispatch.PackageID = s.info.ID
+		pkg.Dispatches = append(pkg.Dispatches, dispatch)
+	}
+
+	for _, module := range s.modules {
+		module.PackageID = s.info.ID
+		pkg.Modules = append(pkg.Modules, module)
+	}
+
+	for _, template := range s.templates.Responses {
+		template.PackageID = s.info.ID
+		pkg.Templates.Responses = append(pkg.Templates.Responses, template)
+	}
+
+	return &pkg
+}
+
+// Router returns a gin engine serving the package protocol
+func (s *PackageServer) Router() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	s.Mount(router)
+
+	return router
+}
+
+// Mount adds the package protocol routes to an existing gin router
+func (s *PackageServer) Mount(router gin.IRouter) {
+	group := router.Group("/", s.verifier.GinMiddleware())
+
+	group.GET("/manifest", s.handleManifest)
+	group.POST("/handshake", s.handleHandshake)
+	group.POST("/nodes/execute", s.handleNodes(false))
+	group.POST("/nodes/execute-mock", s.handleNodes(true))
+	group.POST("/nodes/execute-stream", s.handleNodeStream(false))
+	group.POST("/nodes/execute-stream-mock", s.handleNodeStream(true))
+	group.POST("/links/execute", s.handleLinks(false))
+	group.POST("/links/execute-mock", s.handleLinks(true))
+	group.POST("/dispatch/execute", s.handleDispatches(false))
+	group.POST("/dispatch/execute-mock", s.handleDispatches(true))
+	group.POST("/migrate", s.handleMigrate)
+	group.POST("/misc/:key", s.handleMisc)
+	group.GET("/assets/*filename", s.handleAsset)
+}
+
+// Run starts serving the package protocol on addr
+func (s *PackageServer) Run(addr string) error {
+	return http.ListenAndServe(addr, s.Router())
+}
+
+func (s *PackageServer) handleManifest(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Manifest())
+}
+
+// Handshake describes the protocol versions and capabilities of the server
+func (s *PackageServer) Handshake() *HandshakeResponse {
+	manifest := s.Manifest()
+
+	return &HandshakeResponse{
+		ProtocolVersions: []string{PackageProtocolV2, PackageProtocolV1},
+		Capabilities: PackageCapabilities{
+			MockEndpoints:    true,
+			Streaming:        true,
+			MaxNodeBatchSize: s.MaxNodeBatchSize,
+			MaxLinkBatchSize: s.MaxLinkBatchSize,
+			Assets:           s.assets != nil,
+			Migrations:       len(s.migrations) > 0,
+		},
+		Modules:   manifest.Modules,
+		Templates: manifest.Templates,
+	}
+}
+
+func (s *PackageServer) handleHandshake(c *gin.Context) {
+	var req HandshakeRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		InputValidationError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+		return
+	}
+
+	res := s.Handshake()
+
+	if _, err := NegotiateProtocolVersion(req.ProtocolVersions, res.ProtocolVersions); err != nil {
+		GenericError(err).WithHTTPCode(http.StatusConflict).AbortGin(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// batchTooLarge rejects batches over the advertised limit
+func batchTooLarge(c *gin.Context, size, max int) bool {
+	if max <= 0 || size <= max {
+		return false
+	}
+
+	GenericError(fmt.Errorf("batch of %d calls exceeds the maximum of %d", size, max)).
+		WithHTTPCode(http.StatusRequestEntityTooLarge).
+		AbortGin(c)
+
+	return true
+}
+
+func (s *PackageServer) handleMisc(c *gin.Context) {
+	handler, ok := s.misc[c.Param("key")]
+	if !ok {
+		NotFoundError.AbortGin(c)
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		GenericError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+		return
+	}
+
+	res, err := handler(body)
+	if err != nil {
+		(&APIError{Code: ErrHandlerFailure, Message: err.Error()}).WithHTTPCode(http.StatusInternalServerError).AbortGin(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *PackageServer) handleAsset(c *gin.Context) {
+	filename, err := CleanAssetName(strings.TrimPrefix(c.Param("filename"), "/"))
+	if err != nil || s.assets == nil {
+		NotFoundError.AbortGin(c)
+		return
+	}
+
+	f, err := s.assets.Open("/" + filename)
+	if err != nil {
+		NotFoundError.AbortGin(c)
+		return
+	}
+
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		NotFoundError.AbortGin(c)
+		return
+	}
+
+	etag := assetETag(data)
+	c.Header("ETag", etag)
+
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, sniffAssetType(filename, data), data)
+}
+
+func (s *PackageServer) handleNodes(mock bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req NodeExecutionRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			InputValidationError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+			return
+		}
+
+		if batchTooLarge(c, len(req.Calls), s.MaxNodeBatchSize) {
+			return
+		}
+
+		c.JSON(http.StatusOK, NodeExecutionResponse{Results: s.ExecuteNodes(req.Calls, mock)})
+	}
+}
+
+func (s *PackageServer) handleLinks(mock bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LinkExecutionRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			InputValidationError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+			return
+		}
+
+		if batchTooLarge(c, len(req.Calls), s.MaxLinkBatchSize) {
+			return
+		}
+
+		c.JSON(http.StatusOK, LinkExecutionResponse{Results: s.ExecuteLinks(req.Calls, mock)})
+	}
+}
+
+func (s *PackageServer) handleMigrate(c *gin.Context) {
+	var req ConfigMigrationRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		InputValidationError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+		return
+	}
+
+	results := make([]ConfigMigrationResult, len(req.Calls))
+
+	for i := range req.Calls {
+		results[i] = s.migrateConfig(&req.Calls[i])
+	}
+
+	c.JSON(http.StatusOK, ConfigMigrationResponse{Results: results})
+}
+
+func (s *PackageServer) handleDispatches(mock bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DispatchRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			InputValidationError(err).WithHTTPCode(http.StatusBadRequest).AbortGin(c)
+			return
+		}
+
+		c.JSON(http.StatusOK, DispatchResponse{Results: s.ExecuteDispatches(req.Dispatches, mock)})
+	}
+}
+
+// ExecuteNodes runs all calls concurrently and returns the results in the same order as the calls
+func (s *PackageServer) ExecuteNodes(calls []NodeCall, mock bool) []NodeCallResult {
+	results := make([]NodeCallResult, len(calls))
+
+	s.fanOut(len(calls), func(i int) {
+		results[i] = s.executeNode(&calls[i], mock)
+	})
+
+	return results
+}
+
+// ExecuteLinks evaluates all calls concurrently and returns the results in the same order as the calls
+func (s *PackageServer) ExecuteLinks(calls []LinkCall, mock bool) []LinkCallResult {
+	results := make([]LinkCallResult, len(calls))
+
+	s.fanOut(len(calls), func(i int) {
+		results[i] = s.executeLink(&calls[i], mock)
+	})
+
+	return results
+}
+
+// ExecuteDispatches performs dispatches one at a time, because messages must be delivered in order
+func (s *PackageServer) ExecuteDispatches(calls []DispatchCall, mock bool) []DispatchCallResult {
+	results := make([]DispatchCallResult, len(calls))
+
+	for i := range calls {
+		results[i] = s.executeDispatch(&calls[i], mock)
+	}
+
+	return results
+}
+
+func (s *PackageServer) fanOut(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	var sem chan struct{}
+
+	if s.MaxConcurrency > 0 {
+		sem = make(chan struct{}, s.MaxConcurrency)
+	}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		if sem != nil {
+			sem <- struct{}{}
+		}
+
+		go func(i int) {
+			defer wg.Done()
+
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func (s *PackageServer) executeNode(call *NodeCall, mock bool) (result NodeCallResult) {
+	// Whatever happens, the request id must be echoed back
+	defer func() {
+		if r := recover(); r != nil {
+			result = NodeCallResult{Errors: []Error{handlerPanicError(r)}}
+		}
+
+		result.RequestID = call.RequestID
+	}()
+
+	reg, ok := s.nodes[handlerKey(call.TypeID, call.Version)]
+	if !ok {
+		return NodeCallResult{Errors: []Error{{
+			Code:    ErrPackageMissingNode,
+			Message: fmt.Sprintf("node %s version %s is not provided by this package", call.TypeID, call.Version),
+		}}}
+	}
+
+	handler := reg.handler
+	if mock && reg.mock != nil {
+		handler = reg.mock
+	}
+
+	res, err := handler(call)
+	if err != nil {
+		return NodeCallResult{Errors: []Error{{Code: ErrHandlerFailure, Message: err.Error()}}}
+	}
+
+	if res == nil {
+		return NodeCallResult{}
+	}
+
+	return *res
+}
+
+func (s *PackageServer) executeLink(call *LinkCall, mock bool) (result LinkCallResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = LinkCallResult{Errors: []Error{handlerPanicError(r)}}
+		}
+
+		result.RequestID = call.RequestID
+	}()
+
+	reg, ok := s.links[handlerKey(call.TypeID, call.Version)]
+	if !ok {
+		return LinkCallResult{Errors: []Error{{
+			Code:    ErrPackageMissingLink,
+			Message: fmt.Sprintf("link %s version %s is not provided by this package", call.TypeID, call.Version),
+		}}}
+	}
+
+	handler := reg.handler
+	if mock && reg.mock != nil {
+		handler = reg.mock
+	}
+
+	res, err := handler(call)
+	if err != nil {
+		return LinkCallResult{Errors: []Error{{Code: ErrHandlerFailure, Message: err.Error()}}}
+	}
+
+	if res == nil {
+		return LinkCallResult{}
+	}
+
+	return *res
+}
+
+func (s *PackageServer) migrateConfig(call *ConfigMigrationCall) (result ConfigMigrationResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = ConfigMigrationResult{Errors: []Error{handlerPanicError(r)}}
+		}
+
+		result.RequestID = call.RequestID
+	}()
+
+	handler, ok := s.migrations[migrationKey(call.Item, call.TypeID, call.From, call.To)]
+	if !ok {
+		return ConfigMigrationResult{Errors: []Error{{
+			Code:    ErrInvalidConfig,
+			Message: fmt.Sprintf("%s %s has no migration from %s to %s", call.Item, call.TypeID, call.From, call.To),
+		}}}
+	}
+
+	config, err := handler(call)
+	if err != nil {
+		return ConfigMigrationResult{Errors: []Error{{Code: ErrHandlerFailure, Message: err.Error()}}}
+	}
+
+	return ConfigMigrationResult{Config: config}
+}
+
+func (s *PackageServer) executeDispatch(call *DispatchCall, mock bool) (result DispatchCallResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			e := handlerPanicError(r)
+			result = DispatchCallResult{Error: &e}
+		}
+
+		result.RequestID = call.RequestID
+	}()
+
+	reg, ok := s.dispatches[call.ID]
+	if !ok {
+		return DispatchCallResult{Error: &Error{
+			Code:    ErrDispatchNotFound,
+			Message: fmt.Sprintf("dispatch %s is not provided by this package", call.ID),
+		}}
+	}
+
+	handler := reg.handler
+	if mock && reg.mock != nil {
+		handler = reg.mock
+	}
+
+	res, err := handler(call)
+	if err != nil {
+		return DispatchCallResult{Error: &Error{Code: ErrHandlerFailure, Message: err.Error()}}
+	}
+
+	if res == nil {
+		return DispatchCallResult{Successful: true}
+	}
+
+	return *res
+}
+
+func handlerPanicError(r interface{}) Error {
+	return Error{Code: ErrHandlerFailure, Message: fmt.Sprintf("handler panicked: %v", r)}
+}
@@ -0,0 +1,192 @@
+package ctypes
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestPackageServer_Manifest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), Name: "Test Package", SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).
+		RegisterNode(DBNode{TypeID: "send", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			return &NodeCallResult{}, nil
+		}, nil).
+		RegisterNode(DBNode{TypeID: "wait", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			return &NodeCallResult{}, nil
+		}, nil).
+		RegisterLink(DBLink{TypeID: "always", Version: "0.0.1"}, func(call *LinkCall) (*LinkCallResult, error) {
+			return &LinkCallResult{Passable: true}, nil
+		}, nil).
+		RegisterDispatch(DBDispatch{ID: "echo"}, func(call *DispatchCall) (*DispatchCallResult, error) {
+			return &DispatchCallResult{Successful: true}, nil
+		}, nil).
+		RegisterEvent(DBEvent{ID: "message"})
+
+	hs := httptest.NewServer(srv.Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+
+	manifest, err := NewPackageClient(&info).FetchManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Nodes) != 2 || manifest.Nodes[0].TypeID != "send" || manifest.Nodes[0].PackageID != info.ID {
+		t.Errorf("unexpected manifest nodes %+v", manifest.Nodes)
+	}
+
+	if len(manifest.Links) != 1 || len(manifest.Dispatches) != 1 || len(manifest.Events) != 1 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	if manifest.SigningKey != "" {
+		t.Error("manifest must not contain the signing key")
+	}
+}
+
+func TestPackageServer_ExecuteNodes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).
+		RegisterNode(DBNode{TypeID: "slow", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			// Later calls finish first, so result ordering is exercised
+			time.Sleep(time.Duration(10-call.Sequence) * time.Millisecond)
+
+			return &NodeCallResult{
+				Transformations: []Transformation{{Path: "user.data.seq", Value: call.Sequence}},
+			}, nil
+		}, func(call *NodeCall) (*NodeCallResult, error) {
+			return &NodeCallResult{Logs: []LogEntry{{Message: "mocked", Level: LogLevelInfo}}}, nil
+		}).
+		RegisterNode(DBNode{TypeID: "broken", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			return nil, errors.New("it broke")
+		}, nil).
+		RegisterNode(DBNode{TypeID: "panics", Version: "0.0.1"}, func(call *NodeCall) (*NodeCallResult, error) {
+			panic("oh no")
+		}, nil)
+
+	hs := httptest.NewServer(srv.Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	var calls []NodeCall
+	for i := 0; i < 5; i++ {
+		calls = append(calls, NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "slow", Version: "0.0.1", Sequence: i})
+	}
+
+	calls = append(calls,
+		NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "broken", Version: "0.0.1"},
+		NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "panics", Version: "0.0.1"},
+		NodeCall{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "missing", Version: "0.0.1"},
+	)
+
+	var res NodeExecutionResponse
+	if err := pc.DoJSONPost("/nodes/execute", NodeExecutionRequest{Calls: calls}, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Results) != len(calls) {
+		t.Fatalf("expected %d results, got %d", len(calls), len(res.Results))
+	}
+
+	for i, r := range res.Results {
+		if r.RequestID != calls[i].RequestID {
+			t.Errorf("result %d has request id %s, want %s", i, r.RequestID, calls[i].RequestID)
+		}
+
+		if i < 5 && (len(r.Transformations) != 1 || r.Transformations[0].Value != float64(i)) {
+			t.Errorf("result %d out of order: %+v", i, r.Transformations)
+		}
+	}
+
+	if res.Results[5].Errors[0].Code != ErrHandlerFailure || res.Results[6].Errors[0].Code != ErrHandlerFailure {
+		t.Errorf("expected handler failures, got %+v %+v", res.Results[5].Errors, res.Results[6].Errors)
+	}
+
+	if res.Results[7].Errors[0].Code != ErrPackageMissingNode {
+		t.Errorf("expected missing node error, got %+v", res.Results[7].Errors)
+	}
+
+	mocked, err := pc.ExecuteNodeMock(&calls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mocked.Logs) != 1 || mocked.Logs[0].Message != "mocked" {
+		t.Errorf("expected mock handler to be used, got %+v", mocked)
+	}
+}
+
+func TestPackageServer_LinksAndDispatches(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	srv := NewPackageServer(info).
+		RegisterLink(DBLink{TypeID: "always", Version: "0.0.1"}, func(call *LinkCall) (*LinkCallResult, error) {
+			return &LinkCallResult{Passable: call.Config == "true"}, nil
+		}, nil).
+		RegisterDispatch(DBDispatch{ID: "echo"}, func(call *DispatchCall) (*DispatchCallResult, error) {
+			return &DispatchCallResult{Successful: true}, nil
+		}, nil)
+
+	hs := httptest.NewServer(srv.Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	pc := NewPackageClient(&info)
+
+	links, err := pc.ExecuteLink(&LinkExecutionRequest{Calls: []LinkCall{
+		{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "always", Version: "0.0.1", Config: "true"},
+		{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "always", Version: "0.0.1", Config: "false"},
+		{RequestID: uuid.Must(uuid.NewRandom()), TypeID: "never", Version: "0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !links.Results[0].Passable || links.Results[1].Passable || links.Results[2].Errors[0].Code != ErrPackageMissingLink {
+		t.Errorf("unexpected link results %+v", links.Results)
+	}
+
+	dispatchID := uuid.Must(uuid.NewRandom())
+
+	dispatches, err := pc.Dispatch(&DispatchRequest{Dispatches: []DispatchCall{{RequestID: dispatchID, ID: "echo"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dispatches.Results) != 1 || !dispatches.Results[0].Successful || dispatches.Results[0].RequestID != dispatchID {
+		t.Errorf("unexpected dispatch results %+v", dispatches.Results)
+	}
+}
+
+func TestPackageServer_RejectsUnsignedRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	info := DBPackage{ID: uuid.Must(uuid.NewRandom()), SigningKey: "bubbles"}
+
+	hs := httptest.NewServer(NewPackageServer(info).Router())
+	defer hs.Close()
+
+	info.BaseURL = hs.URL
+	info.SigningKey = "wrong"
+
+	_, err := NewPackageClient(&info).FetchManifest()
+	if pcErr, ok := err.(*PackageClientError); !ok || pcErr.Status != 401 {
+		t.Errorf("expected 401 package client error, got %v", err)
+	}
+}
@@ -1,12 +1,15 @@
 package ctypes
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -28,15 +31,92 @@ const (
 	RQLessThan
 	RQLessThanOrEqual
 	RQRegex
+	RQIn           // The field equals one of Values
+	RQBetween      // The field is between Values[0] and Values[1], inclusive
+	RQContainsAny  // The array field contains at least one of Values
+	RQContainsAll  // The array field contains all of Values
+	RQEqualsFold   // The field equals Value, ignoring case
+	RQContainsFold // The field contains Value, ignoring case
+	RQNull         // The field exists and is null
+)
+
+// Explicit value types of a RQQ. Without one, the type is guessed by ValueAsTyped
+const (
+	RQTypeString = "string"
+	RQTypeNumber = "number"
+	RQTypeBool   = "bool"
+	RQTypeUUID   = "uuid"
+	RQTypeTime   = "time" // RFC 3339 timestamps or dates formatted as 2006-01-02
 )
 
 // ResourceQuery is the format used to perform custom resource queries against memory and execution logs
 type ResourceQuery struct {
-	Mode    int      `json:"mode"`
-	Limit   uint64   `json:"limit"`
-	Offset  uint64   `json:"offset"`
-	Queries []RQQ    `json:"queries"`
-	Sort    []RQSort `json:"sort"`
+	Mode    int       `json:"mode"`
+	Limit   uint64    `json:"limit"`
+	Offset  uint64    `json:"offset"`
+	Queries []RQQ     `json:"queries"`
+	Groups  []RQGroup `json:"groups,omitempty"` // Nested groups, combined with Queries using Mode
+	Sort    []RQSort  `json:"sort"`
+
+	// Keyset position to continue from, replaces Offset. It is never read from json, where its signature could not
+	// be checked, see ResourceQueryFromURLWithCursor and DecodeCursor
+	Cursor *Cursor `json:"-"`
+
+	Aggregation *RQAggregation `json:"aggregation,omitempty"` // Summarises the matched rows into groups
+}
+
+// RQGroup is a nested group of queries, combined with its own mode
+type RQGroup struct {
+	Mode    int       `json:"mode"`
+	Queries []RQQ     `json:"queries"`
+	Groups  []RQGroup `json:"groups,omitempty"`
+}
+
+// UnmarshalJSON rejects unknown modes and groups nested deeper than MaxRQGroupDepth
+func (q *ResourceQuery) UnmarshalJSON(data []byte) error {
+	type plain ResourceQuery
+
+	if err := json.Unmarshal(data, (*plain)(q)); err != nil {
+		return err
+	}
+
+	g := q.group()
+
+	return g.validate(0)
+}
+
+func (g *RQGroup) validate(depth int) error {
+	if depth > MaxRQGroupDepth {
+		return fmt.Errorf("%w: groups nested deeper than %d", ErrInvalidQuery, MaxRQGroupDepth)
+	}
+
+	if g.Mode != RQAll && g.Mode != RQAny && g.Mode != RQNor {
+		return fmt.Errorf("%w: unknown mode %d", ErrInvalidQuery, g.Mode)
+	}
+
+	for i := range g.Groups {
+		if err := g.Groups[i].validate(depth + 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// group is the top level of the query as a group
+func (q *ResourceQuery) group() RQGroup {
+	return RQGroup{Mode: q.Mode, Queries: q.Queries, Groups: q.Groups}
+}
+
+// Group adds a nested group with its own mode, filled in by build using the usual builder methods
+// Limits, offsets and sorts set by build are ignored
+func (q *ResourceQuery) Group(mode int, build func(g *ResourceQuery)) *ResourceQuery {
+	g := NewResourceQuery(mode)
+	build(g)
+
+	q.Groups = append(q.Groups, g.group())
+
+	return q
 }
 
 func NewResourceQuery(mode int) *ResourceQuery {
@@ -46,16 +126,53 @@ func NewResourceQuery(mode int) *ResourceQuery {
 	}
 }
 
+// MaxRQGroupDepth is how deeply query groups can be nested
+const MaxRQGroupDepth = 8
+
+// rqGroupNameRegex matches the group names of url keys, as in "g1.eq.field=value"
+var rqGroupNameRegex = regexp.MustCompile(`^g[0-9]+$`)
+
+// ResourceQueryFromURL parses a resource query from url query parameters
+// Keys prefixed with group names belong to nested groups, so "g1.eq.a=1&g1.eq.b=2&eq.c=3&mode=any" is
+// "(a=1 AND b=2) OR c=3". Groups can be nested, as in "g1.g2.eq.a=1", and "g1.mode=any" sets a group's mode
+// Cursors are ignored, see ResourceQueryFromURLWithCursor
 func ResourceQueryFromURL(url *url.URL, fieldPrefix string) (*ResourceQuery, error) {
+	return ResourceQueryFromURLWithCursor(url, fieldPrefix, "")
+}
+
+// ResourceQueryFromURLWithCursor is ResourceQueryFromURL that also continues from the "cursor" parameter, which
+// must have been signed with cursorKey. Cursors are ignored if cursorKey is empty
+func ResourceQueryFromURLWithCursor(url *url.URL, fieldPrefix, cursorKey string) (*ResourceQuery, error) {
 	queryParams := url.Query()
 
 	resourceQuery := NewResourceQuery(RQAll)
 
-	for key, queryStr := range queryParams {
+	// Groups by their path of group names, "" being the top level
+	groups := map[string]*ResourceQuery{"": resourceQuery}
+
+	// Go through the keys in order, so sorts and groups keep a stable order
+	keys := make([]string, 0, len(queryParams))
+	for key := range queryParams {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, rawKey := range keys {
+		queryStr := queryParams[rawKey]
+
 		if len(queryStr) == 0 {
 			continue
 		}
 
+		path, key := splitURLGroups(rawKey)
+
+		if len(path) > MaxRQGroupDepth {
+			return nil, fmt.Errorf("%w: groups nested deeper than %d", ErrInvalidQuery, MaxRQGroupDepth)
+		}
+
+		group := urlGroup(groups, path)
+
 		switch strings.TrimSpace(strings.ToLower(key)) {
 
 		// Parse the limit from the query parameter. Even if the limit is not valid, the rq builder will take care of it
@@ -88,14 +205,26 @@ func ResourceQueryFromURL(url *url.URL, fieldPrefix string) (*ResourceQuery, err
 				resourceQuery.SortDesc(fieldPrefix + field)
 			}
 
+		case "cursor":
+			if cursorKey == "" || len(path) > 0 {
+				continue
+			}
+
+			c, err := DecodeCursor(queryStr[0], cursorKey)
+			if err != nil {
+				return nil, err
+			}
+
+			resourceQuery.Cursor = c
+
 		case "mode":
 			switch queryStr[0] {
 			case "all":
-				resourceQuery.ModeAll()
+				group.ModeAll()
 			case "any":
-				resourceQuery.ModeAny()
+				group.ModeAny()
 			case "nor":
-				resourceQuery.ModeNor()
+				group.ModeNor()
 			}
 
 		// All other query parameters might be other operators
@@ -109,57 +238,189 @@ func ResourceQueryFromURL(url *url.URL, fieldPrefix string) (*ResourceQuery, err
 					return nil, errors.New("invalid field name " + field)
 				}
 
-				for _, val := range queryStr {
-					switch strings.TrimSpace(strings.ToLower(prefix)) {
-					case "eq":
-						resourceQuery.Equals(field, val)
-					case "!eq":
-						resourceQuery.DoesNotEqual(field, val)
-					case "ex":
-						resourceQuery.Exists(field)
-					case "!ex":
-						resourceQuery.DoesNotExist(field)
-					case "cont":
-						resourceQuery.Contains(field, val)
-					case "!cont":
-						resourceQuery.DoesNotContain(field, val)
-					case "sw":
-						resourceQuery.StartsWith(field, val)
-					case "!sw":
-						resourceQuery.DoesNotStartWith(field, val)
-					case "ew":
-						resourceQuery.EndsWith(field, val)
-					case "!ew":
-						resourceQuery.DoesNotEndWith(field, val)
-					case "gt":
-						resourceQuery.GreaterThan(field, val)
-					case "!gt":
-						resourceQuery.LessThanOrEqualTo(field, val)
-					case "gte":
-						resourceQuery.GreaterThanOrEqualTo(field, val)
-					case "!gte":
-						resourceQuery.LessThan(field, val)
-					case "lt":
-						resourceQuery.LessThan(field, val)
-					case "!lt":
-						resourceQuery.GreaterThanOrEqualTo(field, val)
-					case "lte":
-						resourceQuery.LessThanOrEqualTo(field, val)
-					case "!lte":
-						resourceQuery.GreaterThan(field, val)
-					case "rx":
-						resourceQuery.MatchesRegEx(field, val)
-					case "!rx":
-						resourceQuery.DoesNotMatchRegEx(field, val)
-					}
-				}
+				group.addURLQuery(strings.TrimSpace(strings.ToLower(prefix)), field, queryStr)
 			}
 		}
 	}
 
+	resourceQuery.Groups = assembleURLGroups(groups, "")
+
+	if resourceQuery.Cursor != nil {
+		resourceQuery.After(resourceQuery.Cursor)
+	}
+
 	return resourceQuery.sortQueriesByField(), nil
 }
 
+// splitURLGroups splits the group names off the front of a url key
+func splitURLGroups(key string) (path []string, rest string) {
+	parts := strings.Split(key, ".")
+
+	for len(parts) > 1 && rqGroupNameRegex.MatchString(parts[0]) {
+		path = append(path, parts[0])
+		parts = parts[1:]
+	}
+
+	return path, strings.Join(parts, ".")
+}
+
+// urlGroup returns the group at path, creating it and its parents if needed
+func urlGroup(groups map[string]*ResourceQuery, path []string) *ResourceQuery {
+	for i := range path {
+		name := strings.Join(path[:i+1], ".")
+
+		if _, ok := groups[name]; !ok {
+			groups[name] = NewResourceQuery(RQAll)
+		}
+	}
+
+	return groups[strings.Join(path, ".")]
+}
+
+// assembleURLGroups builds the groups directly below parent, ordered by their number
+func assembleURLGroups(groups map[string]*ResourceQuery, parent string) []RQGroup {
+	var names []string
+
+	for name := range groups {
+		if name == "" {
+			continue
+		}
+
+		rest := name
+		if parent != "" {
+			if !strings.HasPrefix(name, parent+".") {
+				continue
+			}
+
+			rest = strings.TrimPrefix(name, parent+".")
+		}
+
+		if !strings.Contains(rest, ".") {
+			names = append(names, name)
+		}
+	}
+
+	groupNumber := func(name string) int {
+		n, _ := strconv.Atoi(strings.TrimPrefix(name[strings.LastIndex(name, ".")+1:], "g"))
+		return n
+	}
+
+	sort.Slice(names, func(i, j int) bool { return groupNumber(names[i]) < groupNumber(names[j]) })
+
+	var out []RQGroup
+
+	for _, name := range names {
+		g := groups[name].sortQueriesByField().group()
+		g.Groups = assembleURLGroups(groups, name)
+
+		out = append(out, g)
+	}
+
+	return out
+}
+
+// addURLQuery adds queries from a url operator prefix such as "eq" or "!sw"
+// A type can follow the operator, as in "gt:time.created_at=2020-01-01". Each value of single value operators
+// is a separate query, while multi value operators such as "in" take all of the values of the key
+func (q *ResourceQuery) addURLQuery(prefix, field string, vals []string) {
+	var valueType string
+
+	if i := strings.Index(prefix, ":"); i >= 0 {
+		prefix, valueType = prefix[:i], prefix[i+1:]
+	}
+
+	before := len(q.Queries)
+
+	switch prefix {
+	case "in":
+		q.In(field, vals...)
+	case "!in":
+		q.NotIn(field, vals...)
+	case "btw":
+		if len(vals) == 2 {
+			q.Between(field, vals[0], vals[1])
+		}
+	case "!btw":
+		if len(vals) == 2 {
+			q.NotBetween(field, vals[0], vals[1])
+		}
+	case "any":
+		q.ContainsAny(field, vals...)
+	case "all":
+		q.ContainsAll(field, vals...)
+	case "null":
+		q.IsNull(field)
+	case "!null":
+		q.IsNotNull(field)
+	default:
+		for _, val := range vals {
+			q.addURLValueQuery(prefix, field, val)
+		}
+	}
+
+	for i := before; i < len(q.Queries); i++ {
+		q.Queries[i].Type = valueType
+	}
+}
+
+func (q *ResourceQuery) addURLValueQuery(prefix, field, val string) {
+	switch prefix {
+	case "eq":
+		q.Equals(field, val)
+	case "!eq":
+		q.DoesNotEqual(field, val)
+	case "ieq":
+		q.EqualsIgnoreCase(field, val)
+	case "!ieq":
+		q.EqualsIgnoreCase(field, val).negateLast()
+	case "ex":
+		q.Exists(field)
+	case "!ex":
+		q.DoesNotExist(field)
+	case "cont":
+		q.Contains(field, val)
+	case "!cont":
+		q.DoesNotContain(field, val)
+	case "icont":
+		q.ContainsIgnoreCase(field, val)
+	case "!icont":
+		q.ContainsIgnoreCase(field, val).negateLast()
+	case "sw":
+		q.StartsWith(field, val)
+	case "!sw":
+		q.DoesNotStartWith(field, val)
+	case "ew":
+		q.EndsWith(field, val)
+	case "!ew":
+		q.DoesNotEndWith(field, val)
+	case "gt":
+		q.GreaterThan(field, val)
+	case "!gt":
+		q.LessThanOrEqualTo(field, val)
+	case "gte":
+		q.GreaterThanOrEqualTo(field, val)
+	case "!gte":
+		q.LessThan(field, val)
+	case "lt":
+		q.LessThan(field, val)
+	case "!lt":
+		q.GreaterThanOrEqualTo(field, val)
+	case "lte":
+		q.LessThanOrEqualTo(field, val)
+	case "!lte":
+		q.GreaterThan(field, val)
+	case "rx":
+		q.MatchesRegEx(field, val)
+	case "!rx":
+		q.DoesNotMatchRegEx(field, val)
+	}
+}
+
+func (q *ResourceQuery) negateLast() *ResourceQuery {
+	q.Queries[len(q.Queries)-1].Negate = true
+	return q
+}
+
 func (q *ResourceQuery) ResourceLimit(limit uint64) *ResourceQuery {
 	if limit <= 0 {
 		limit = 10
@@ -379,8 +640,118 @@ func (q *ResourceQuery) DoesNotMatchRegEx(field, value string) *ResourceQuery {
 	return q
 }
 
+func (q *ResourceQuery) In(field string, values ...string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQIn,
+		Values:   values,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) NotIn(field string, values ...string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQIn,
+		Values:   values,
+		Negate:   true,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) Between(field, from, to string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQBetween,
+		Values:   []string{from, to},
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) NotBetween(field, from, to string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQBetween,
+		Values:   []string{from, to},
+		Negate:   true,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) ContainsAny(field string, values ...string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQContainsAny,
+		Values:   values,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) ContainsAll(field string, values ...string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQContainsAll,
+		Values:   values,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) EqualsIgnoreCase(field, value string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQEqualsFold,
+		Value:    &value,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) ContainsIgnoreCase(field, value string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQContainsFold,
+		Value:    &value,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) IsNull(field string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQNull,
+	})
+
+	return q
+}
+
+func (q *ResourceQuery) IsNotNull(field string) *ResourceQuery {
+	q.Queries = append(q.Queries, RQQ{
+		Field:    field,
+		Operator: RQNull,
+		Negate:   true,
+	})
+
+	return q
+}
+
+// OfType sets the explicit value type of the last query added
+func (q *ResourceQuery) OfType(valueType string) *ResourceQuery {
+	if len(q.Queries) > 0 {
+		q.Queries[len(q.Queries)-1].Type = valueType
+	}
+
+	return q
+}
+
 func (q *ResourceQuery) sortQueriesByField() *ResourceQuery {
-	sort.Slice(q.Queries, func(i, j int) bool {
+	sort.SliceStable(q.Queries, func(i, j int) bool {
 		a, b := q.Queries[i], q.Queries[j]
 		return a.Field > b.Field
 	})
@@ -389,16 +760,12 @@ func (q *ResourceQuery) sortQueriesByField() *ResourceQuery {
 }
 
 // FilterFields will remove all sort and query fields from the resource query that are not in allowedFields
+// Groups are filtered the same way, and groups left without any queries are removed
 func (q *ResourceQuery) FilterFields(allowedFields ...string) *ResourceQuery {
-	var allowedQueries []RQQ
+	g := q.group()
+	g.filterFields(allowedFields)
 
-	for _, query := range q.Queries {
-		if StringSliceContains(allowedFields, query.Field) {
-			allowedQueries = append(allowedQueries, query)
-		}
-	}
-
-	q.Queries = allowedQueries
+	q.Queries, q.Groups = g.Queries, g.Groups
 
 	var allowedSorts []RQSort
 
@@ -413,15 +780,39 @@ func (q *ResourceQuery) FilterFields(allowedFields ...string) *ResourceQuery {
 	return q
 }
 
-// SelectivePrefix will add a prefix to any field names that match fieldName
-func (q *ResourceQuery) SelectivePrefix(fieldName, prefix string) *ResourceQuery {
-	for i, query := range q.Queries {
-		if query.Field == fieldName {
-			query.Field = prefix + query.Field
-			q.Queries[i] = query
+func (g *RQGroup) filterFields(allowedFields []string) {
+	var allowedQueries []RQQ
+
+	for _, query := range g.Queries {
+		if StringSliceContains(allowedFields, query.Field) {
+			allowedQueries = append(allowedQueries, query)
 		}
 	}
 
+	g.Queries = allowedQueries
+
+	var allowedGroups []RQGroup
+
+	for _, group := range g.Groups {
+		group.filterFields(allowedFields)
+
+		if !group.empty() {
+			allowedGroups = append(allowedGroups, group)
+		}
+	}
+
+	g.Groups = allowedGroups
+}
+
+func (g *RQGroup) empty() bool {
+	return len(g.Queries) == 0 && len(g.Groups) == 0
+}
+
+// SelectivePrefix will add a prefix to any field names that match fieldName
+func (q *ResourceQuery) SelectivePrefix(fieldName, prefix string) *ResourceQuery {
+	g := q.group()
+	g.selectivePrefix(fieldName, prefix)
+
 	for i, srt := range q.Sort {
 		if srt.Field == fieldName {
 			srt.Field = prefix + srt.Field
@@ -432,12 +823,27 @@ func (q *ResourceQuery) SelectivePrefix(fieldName, prefix string) *ResourceQuery
 	return q
 }
 
+func (g *RQGroup) selectivePrefix(fieldName, prefix string) {
+	for i, query := range g.Queries {
+		if query.Field == fieldName {
+			query.Field = prefix + query.Field
+			g.Queries[i] = query
+		}
+	}
+
+	for i := range g.Groups {
+		g.Groups[i].selectivePrefix(fieldName, prefix)
+	}
+}
+
 // RQQ is one single query operation
 type RQQ struct {
-	Field    string  `json:"field"`
-	Operator int     `json:"operator"`
-	Value    *string `json:"value"`
-	Negate   bool    `json:"negate"`
+	Field    string   `json:"field"`
+	Operator int      `json:"operator"`
+	Value    *string  `json:"value"`
+	Values   []string `json:"values,omitempty"` // Values of RQIn, RQBetween, RQContainsAny and RQContainsAll
+	Type     string   `json:"type,omitempty"`   // Explicit type of the values, guessed if empty
+	Negate   bool     `json:"negate"`
 }
 
 // RQSort is a single sort operation
@@ -456,25 +862,147 @@ func (r *RQQ) ValueAsTyped() interface{} {
 		return nil
 	}
 
+	return guessValueType(*r.Value)
+}
+
+func guessValueType(value string) interface{} {
 	// First, try parsing as an int
-	if i, err := strconv.ParseInt(*r.Value, 10, 64); err == nil {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
 		return i
 	}
 
 	// Then, try parsing as a float.
 	// and make sure the string has a decimal in it. An overflow size integer will be parsed as a float in some cases
-	if f, err := strconv.ParseFloat(*r.Value, 64); err == nil && strings.Contains(*r.Value, ".") {
+	if f, err := strconv.ParseFloat(value, 64); err == nil && strings.Contains(value, ".") {
 		return f
 	}
 
 	// Try parsing the value as a uuid
-	if id, err := uuid.Parse(*r.Value); err != nil {
+	if id, err := uuid.Parse(value); err == nil {
 		return id
 	}
 
-	// TODO add more parse checks
+	// Try parsing the value as a timestamp
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t
+	}
+
+	return value
+}
+
+// TypedValue converts one of the values of the query to its Type, or guesses the type if there is none
+// Numbers are int64 or float64, and times are time.Time
+func (r *RQQ) TypedValue(value string) (interface{}, error) {
+	switch r.Type {
+	case "":
+		return guessValueType(value), nil
+	case RQTypeString:
+		return value, nil
+	case RQTypeNumber:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i, nil
+		}
+
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f, nil
+		}
+	case RQTypeBool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, nil
+		}
+	case RQTypeUUID:
+		if id, err := uuid.Parse(value); err == nil {
+			return id, nil
+		}
+	case RQTypeTime:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, nil
+		}
+
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return t, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidQuery, r.Type)
+	}
+
+	return nil, fmt.Errorf("%w: %s is not a valid %s", ErrInvalidQuery, value, r.Type)
+}
+
+// TypedValues converts Value or Values, depending on the operator, with TypedValue
+func (r *RQQ) TypedValues() ([]interface{}, error) {
+	var typed []interface{}
+
+	for _, v := range r.values() {
+		tv, err := r.TypedValue(v)
+		if err != nil {
+			return nil, err
+		}
+
+		typed = append(typed, tv)
+	}
+
+	return typed, nil
+}
+
+// storedValues converts the values with TypedValues into the form they have in json documents, where uuids and
+// times are strings. Times are formatted in UTC with timeLayout
+func (r *RQQ) storedValues(timeLayout string) ([]interface{}, error) {
+	typed, err := r.TypedValues()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range typed {
+		switch tv := v.(type) {
+		case uuid.UUID:
+			typed[i] = tv.String()
+		case time.Time:
+			typed[i] = tv.UTC().Format(timeLayout)
+		}
+	}
+
+	return typed, nil
+}
+
+// values are the raw values used by the operator
+func (r *RQQ) values() []string {
+	switch r.Operator {
+	case RQExists, RQNull:
+		return nil
+	case RQIn, RQBetween, RQContainsAny, RQContainsAll:
+		return r.Values
+	}
+
+	if r.Value == nil {
+		return nil
+	}
+
+	return []string{*r.Value}
+}
+
+// checkValues makes sure the query has the values its operator needs, and that they are of its type
+func (r *RQQ) checkValues() error {
+	switch r.Operator {
+	case RQExists, RQNull:
+		return nil
+	case RQIn, RQContainsAny, RQContainsAll:
+		if len(r.Values) == 0 {
+			return fmt.Errorf("%w: %s needs at least one value", ErrInvalidQuery, r.Field)
+		}
+	case RQBetween:
+		if len(r.Values) != 2 {
+			return fmt.Errorf("%w: %s needs two values", ErrInvalidQuery, r.Field)
+		}
+	default:
+		if r.Value == nil {
+			return fmt.Errorf("%w: %s needs a value", ErrInvalidQuery, r.Field)
+		}
+	}
+
+	_, err := r.TypedValues()
 
-	return *r.Value
+	return err
 }
 
 func (r *RQQ) FieldNameValid() bool {
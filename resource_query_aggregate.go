@@ -0,0 +1,437 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Aggregate functions
+const (
+	AggCount = "count"
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+)
+
+// Time buckets group keys can be truncated to. Buckets are formatted as strings in UTC, such as "2020-05-01" for
+// days and "2020-W18" for ISO weeks, so every backend produces the same keys
+const (
+	BucketMinute = "minute"
+	BucketHour   = "hour"
+	BucketDay    = "day"
+	BucketWeek   = "week"
+	BucketMonth  = "month"
+)
+
+var aggregateNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RQGroupBy groups rows by the value of a field
+type RQGroupBy struct {
+	Field  string `json:"field"`
+	Bucket string `json:"bucket,omitempty"` // Truncates a time field to the start of a bucket
+	As     string `json:"as,omitempty"`     // Name of the key in results, Field with dots replaced by _ if empty
+}
+
+// RQAggregate is a single value computed for each group
+// Sums, averages, minimums and maximums only consider numbers, other values are ignored
+type RQAggregate struct {
+	Function string `json:"function"`
+	Field    string `json:"field,omitempty"` // Not used by count, which counts rows
+	As       string `json:"as"`
+}
+
+// RQAggregation summarises the rows matched by a query into groups
+// The query's sort, limit and offset then apply to the groups, and sort by the names of keys and aggregates
+type RQAggregation struct {
+	Unwind     string        `json:"unwind,omitempty"` // Array field whose elements are aggregated instead of the rows
+	GroupBy    []RQGroupBy   `json:"group_by"`
+	Aggregates []RQAggregate `json:"aggregates"`
+}
+
+// AggregateRow is a group of an aggregation, keyed by the names of its group keys and aggregates
+type AggregateRow map[string]interface{}
+
+func (g *RQGroupBy) name() string {
+	if g.As != "" {
+		return g.As
+	}
+
+	return strings.NewReplacer(".", "_", "$", "_", "@", "_", "-", "_").Replace(g.Field)
+}
+
+// names are the names of the keys and aggregates in each row
+func (a *RQAggregation) names() []string {
+	var names []string
+
+	for i := range a.GroupBy {
+		names = append(names, a.GroupBy[i].name())
+	}
+
+	for _, agg := range a.Aggregates {
+		names = append(names, agg.As)
+	}
+
+	return names
+}
+
+func (a *RQAggregation) validate(q *ResourceQuery) error {
+	if len(a.GroupBy) == 0 && len(a.Aggregates) == 0 {
+		return fmt.Errorf("%w: aggregation without groups or aggregates", ErrInvalidQuery)
+	}
+
+	if q.Cursor != nil {
+		return fmt.Errorf("%w: aggregations cannot be paginated with cursors", ErrInvalidQuery)
+	}
+
+	for _, g := range a.GroupBy {
+		switch g.Bucket {
+		case "", BucketMinute, BucketHour, BucketDay, BucketWeek, BucketMonth:
+		default:
+			return fmt.Errorf("%w: unknown bucket %q", ErrInvalidQuery, g.Bucket)
+		}
+	}
+
+	for _, agg := range a.Aggregates {
+		switch agg.Function {
+		case AggCount:
+		case AggSum, AggAvg, AggMin, AggMax:
+			if agg.Field == "" {
+				return fmt.Errorf("%w: %s of %s needs a field", ErrInvalidQuery, agg.Function, agg.As)
+			}
+		default:
+			return fmt.Errorf("%w: unknown aggregate function %q", ErrInvalidQuery, agg.Function)
+		}
+	}
+
+	names := a.names()
+
+	for i, name := range names {
+		if !aggregateNameRegex.MatchString(name) || StringSliceContains(names[:i], name) {
+			return fmt.Errorf("%w: invalid or duplicate name %q", ErrInvalidQuery, name)
+		}
+	}
+
+	for _, srt := range q.Sort {
+		if !StringSliceContains(names, srt.Field) {
+			return fmt.Errorf("%w: %s is not a group key or aggregate", ErrFieldNotAllowed, srt.Field)
+		}
+	}
+
+	return nil
+}
+
+func (q *ResourceQuery) aggregation() *RQAggregation {
+	if q.Aggregation == nil {
+		q.Aggregation = &RQAggregation{}
+	}
+
+	return q.Aggregation
+}
+
+// GroupBy groups the results by the value of a field
+func (q *ResourceQuery) GroupBy(field string) *ResourceQuery {
+	a := q.aggregation()
+	a.GroupBy = append(a.GroupBy, RQGroupBy{Field: field})
+
+	return q
+}
+
+// GroupByTime groups the results by the bucket a time field falls into
+func (q *ResourceQuery) GroupByTime(field, bucket string) *ResourceQuery {
+	a := q.aggregation()
+	a.GroupBy = append(a.GroupBy, RQGroupBy{Field: field, Bucket: bucket})
+
+	return q
+}
+
+// Unwind aggregates the elements of an array field instead of the rows holding them
+func (q *ResourceQuery) Unwind(field string) *ResourceQuery {
+	q.aggregation().Unwind = field
+	return q
+}
+
+func (q *ResourceQuery) addAggregate(function, field, as string) *ResourceQuery {
+	a := q.aggregation()
+	a.Aggregates = append(a.Aggregates, RQAggregate{Function: function, Field: field, As: as})
+
+	return q
+}
+
+func (q *ResourceQuery) Count(as string) *ResourceQuery {
+	return q.addAggregate(AggCount, "", as)
+}
+
+func (q *ResourceQuery) Sum(field, as string) *ResourceQuery {
+	return q.addAggregate(AggSum, field, as)
+}
+
+func (q *ResourceQuery) Avg(field, as string) *ResourceQuery {
+	return q.addAggregate(AggAvg, field, as)
+}
+
+func (q *ResourceQuery) Min(field, as string) *ResourceQuery {
+	return q.addAggregate(AggMin, field, as)
+}
+
+func (q *ResourceQuery) Max(field, as string) *ResourceQuery {
+	return q.addAggregate(AggMax, field, as)
+}
+
+func formatBucket(t time.Time, bucket string) string {
+	switch bucket {
+	case BucketMinute:
+		return t.Format("2006-01-02T15:04:00Z")
+	case BucketHour:
+		return t.Format("2006-01-02T15:00:00Z")
+	case BucketWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case BucketMonth:
+		return t.Format("2006-01")
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// unwindDocument returns a copy of the document for each element of the array at field, like mongo's $unwind
+// Documents where the field is missing or an empty array are dropped
+func unwindDocument(doc map[string]interface{}, field string) []map[string]interface{} {
+	parts := strings.Split(field, ".")
+
+	var unwind func(m map[string]interface{}, depth int) []map[string]interface{}
+
+	unwind = func(m map[string]interface{}, depth int) []map[string]interface{} {
+		value, ok := m[parts[depth]]
+		if !ok {
+			return nil
+		}
+
+		var elements []interface{}
+
+		if depth < len(parts)-1 {
+			child, isMap := value.(map[string]interface{})
+			if !isMap {
+				return nil
+			}
+
+			for _, c := range unwind(child, depth+1) {
+				elements = append(elements, c)
+			}
+		} else if arr, isArr := value.([]interface{}); isArr {
+			elements = arr
+		} else if value != nil {
+			elements = []interface{}{value}
+		}
+
+		out := make([]map[string]interface{}, len(elements))
+
+		for i, el := range elements {
+			cp := make(map[string]interface{}, len(m))
+			for k, v := range m {
+				cp[k] = v
+			}
+
+			cp[parts[depth]] = el
+			out[i] = cp
+		}
+
+		return out
+	}
+
+	return unwind(doc, 0)
+}
+
+// aggregateState accumulates a single aggregate of a group
+type aggregateState struct {
+	count    int64
+	sum      float64
+	numbers  int64
+	min, max *float64
+}
+
+func (s *aggregateState) add(value interface{}) {
+	s.count++
+
+	f, ok := value.(float64)
+	if !ok {
+		return
+	}
+
+	s.numbers++
+	s.sum += f
+
+	if s.min == nil || f < *s.min {
+		s.min = &f
+	}
+
+	if s.max == nil || f > *s.max {
+		s.max = &f
+	}
+}
+
+func (s *aggregateState) result(function string) interface{} {
+	switch function {
+	case AggCount:
+		return s.count
+	case AggSum:
+		return s.sum
+	case AggAvg:
+		if s.numbers == 0 {
+			return nil
+		}
+
+		return s.sum / float64(s.numbers)
+	case AggMin:
+		if s.min == nil {
+			return nil
+		}
+
+		return *s.min
+	default:
+		if s.max == nil {
+			return nil
+		}
+
+		return *s.max
+	}
+}
+
+// Aggregate computes the query's aggregation over documents in memory, the same way ToSQLAggregate and
+// ToMongoPipeline do in the database. Without a sort, groups are ordered by their keys
+func (q *ResourceQuery) Aggregate(docs []interface{}) ([]AggregateRow, error) {
+	a := q.Aggregation
+	if a == nil {
+		return nil, fmt.Errorf("%w: query has no aggregation", ErrInvalidQuery)
+	}
+
+	if err := a.validate(q); err != nil {
+		return nil, err
+	}
+
+	g := q.group()
+
+	type group struct {
+		keys   []interface{}
+		states []aggregateState
+	}
+
+	groups := map[string]*group{}
+
+	for _, doc := range docs {
+		d, err := queryDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		match, err := g.matches(d)
+		if err != nil {
+			return nil, err
+		}
+
+		if !match {
+			continue
+		}
+
+		rows := []map[string]interface{}{d}
+		if a.Unwind != "" {
+			rows = unwindDocument(d, a.Unwind)
+		}
+
+		for _, row := range rows {
+			keys := make([]interface{}, len(a.GroupBy))
+
+			for i, gb := range a.GroupBy {
+				values := lookupField(row, gb.Field)
+				if len(values) == 0 {
+					continue
+				}
+
+				keys[i] = values[0]
+
+				if gb.Bucket != "" {
+					keys[i] = nil
+
+					if t, ok := parseJSONTime(values[0]); ok {
+						keys[i] = formatBucket(t, gb.Bucket)
+					}
+				}
+			}
+
+			jsb, err := json.Marshal(keys)
+			if err != nil {
+				return nil, err
+			}
+
+			grp, ok := groups[string(jsb)]
+			if !ok {
+				grp = &group{keys: keys, states: make([]aggregateState, len(a.Aggregates))}
+				groups[string(jsb)] = grp
+			}
+
+			for i, agg := range a.Aggregates {
+				var value interface{}
+
+				if agg.Field != "" {
+					if values := lookupField(row, agg.Field); len(values) > 0 {
+						value = values[0]
+					}
+				}
+
+				grp.states[i].add(value)
+			}
+		}
+	}
+
+	rows := make([]AggregateRow, 0, len(groups))
+
+	for _, grp := range groups {
+		row := AggregateRow{}
+
+		for i := range a.GroupBy {
+			row[a.GroupBy[i].name()] = grp.keys[i]
+		}
+
+		for i, agg := range a.Aggregates {
+			row[agg.As] = grp.states[i].result(agg.Function)
+		}
+
+		rows = append(rows, row)
+	}
+
+	sorts := q.Sort
+	if len(sorts) == 0 {
+		for i := range a.GroupBy {
+			sorts = append(sorts, RQSort{Field: a.GroupBy[i].name(), Ascending: true})
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, srt := range sorts {
+			cmp := compareSortValues(queryJSONValue(rows[i][srt.Field]), queryJSONValue(rows[j][srt.Field]))
+			if cmp == 0 {
+				continue
+			}
+
+			return (cmp < 0) == srt.Ascending
+		}
+
+		return false
+	})
+
+	out := []AggregateRow{}
+
+	for i := q.Offset; i < uint64(len(rows)); i++ {
+		if q.Limit > 0 && uint64(len(out)) >= q.Limit {
+			break
+		}
+
+		out = append(out, rows[i])
+	}
+
+	return out, nil
+}
@@ -0,0 +1,152 @@
+package ctypes
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestResourceQuery_Aggregate(t *testing.T) {
+	botA, botB := uuid.MustParse("00000000-0000-0000-0000-00000000000a"), uuid.MustParse("00000000-0000-0000-0000-00000000000b")
+	nodeA, nodeB := uuid.MustParse("00000000-0000-0000-0000-0000000000a1"), uuid.MustParse("00000000-0000-0000-0000-0000000000b1")
+
+	execution := func(bot uuid.UUID, start string, durations ...time.Duration) *ExecutionResult {
+		st, _ := time.Parse(time.RFC3339, start)
+		ex := &ExecutionResult{ID: uuid.Must(uuid.NewRandom()), BotID: bot, StartTime: CustomTime{st}}
+
+		for i, d := range durations {
+			node := nodeA
+			if i%2 == 1 {
+				node = nodeB
+			}
+
+			ex.Steps = append(ex.Steps, Step{Node: &NodeExecutionResult{NodeID: &node}, Duration: d})
+		}
+
+		return ex
+	}
+
+	docs := []interface{}{
+		execution(botA, "2020-05-01T10:00:00Z", 100, 10),
+		execution(botA, "2020-05-01T23:59:00Z", 300),
+		execution(botA, "2020-05-02T01:00:00Z", 200, 30),
+		execution(botB, "2020-05-01T12:00:00Z"),
+	}
+
+	perDay := NewResourceQuery(RQAll).GroupBy("bot_id").GroupByTime("start_time", BucketDay).Count("executions")
+
+	rows, err := perDay.Aggregate(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AggregateRow{
+		{"bot_id": botA.String(), "start_time": "2020-05-01", "executions": int64(2)},
+		{"bot_id": botA.String(), "start_time": "2020-05-02", "executions": int64(1)},
+		{"bot_id": botB.String(), "start_time": "2020-05-01", "executions": int64(1)},
+	}
+
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected %v, got %v", want, rows)
+	}
+
+	perNode := NewResourceQuery(RQAll).Equals("bot_id", botA.String()).
+		Unwind("steps").GroupBy("steps.node.node_id").
+		Avg("steps.duration", "avg_duration").Max("steps.duration", "max_duration").Count("steps").
+		SortDesc("avg_duration")
+
+	rows, err = perNode.Aggregate(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = []AggregateRow{
+		{"steps_node_node_id": nodeA.String(), "avg_duration": float64(200), "max_duration": float64(300), "steps": int64(3)},
+		{"steps_node_node_id": nodeB.String(), "avg_duration": float64(20), "max_duration": float64(30), "steps": int64(2)},
+	}
+
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected %v, got %v", want, rows)
+	}
+
+	fields := SQLFields{"bot_id": {Column: "bot_id"}, "start_time": {Column: "start_time"}, "steps": {Column: "data", JSONB: true}}
+
+	s, err := perNode.ToSQLAggregate(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := s.Statement("executions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStmt := `SELECT "unwound"."value" #> '{node,node_id}' AS "steps_node_node_id", ` +
+		`AVG(CASE WHEN jsonb_typeof("unwound"."value" #> '{duration}') = 'number' THEN ("unwound"."value" #>> '{duration}')::numeric END) AS "avg_duration", ` +
+		`MAX(CASE WHEN jsonb_typeof("unwound"."value" #> '{duration}') = 'number' THEN ("unwound"."value" #>> '{duration}')::numeric END) AS "max_duration", ` +
+		`COUNT(*) AS "steps" FROM "executions" ` +
+		`CROSS JOIN LATERAL jsonb_array_elements(CASE WHEN jsonb_typeof("data") = 'array' THEN "data" END) AS "unwound"("value") ` +
+		`WHERE ("bot_id" = ?) GROUP BY 1 ORDER BY "avg_duration" DESC LIMIT 10`
+
+	if stmt != wantStmt || !reflect.DeepEqual(s.Args, []interface{}{botA.String()}) {
+		t.Errorf("unexpected statement %s %v", stmt, s.Args)
+	}
+
+	s, err = perDay.ToSQLAggregate(fields)
+	if err != nil || !strings.HasPrefix(s.Columns[1], `to_char("start_time" AT TIME ZONE 'UTC', 'YYYY-MM-DD')`) {
+		t.Errorf("unexpected bucket column %v %v", s, err)
+	}
+
+	// JSONB keys keep their type, and JSONB times without a zone are bucketed as UTC
+	s, err = NewResourceQuery(RQAll).GroupBy("steps.priority").GroupByTime("steps.at", BucketDay).Count("n").ToSQLAggregate(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantColumns := []string{
+		`"data" #> '{priority}' AS "steps_priority"`,
+		`to_char((` + sqlTimestamp(`("data" #>> '{at}')`) + `) AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS "steps_at"`,
+		`COUNT(*) AS "n"`,
+	}
+
+	if !reflect.DeepEqual(s.Columns, wantColumns) || !strings.Contains(wantColumns[1], `::timestamp AT TIME ZONE 'UTC'`) {
+		t.Errorf("unexpected columns %v", s.Columns)
+	}
+
+	pipeline, err := perNode.ToMongoPipeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stages []string
+	for _, stage := range pipeline {
+		stages = append(stages, stage[0].Key)
+	}
+
+	if !reflect.DeepEqual(stages, []string{"$match", "$unwind", "$group", "$project", "$sort", "$limit"}) || pipeline[1][0].Value != "$steps" {
+		t.Errorf("unexpected pipeline %v", pipeline)
+	}
+
+	group := pipeline[2][0].Value.(bson.M)
+	if !reflect.DeepEqual(group["_id"], bson.M{"steps_node_node_id": bson.M{"$ifNull": bson.A{"$steps.node.node_id", nil}}}) || !reflect.DeepEqual(group["steps"], bson.M{"$sum": 1}) {
+		t.Errorf("unexpected group %v", group)
+	}
+
+	invalid := []*ResourceQuery{
+		NewResourceQuery(RQAll).GroupBy("bot_id").SortAsc("start_time"),
+		NewResourceQuery(RQAll).Sum("", "total"),
+		NewResourceQuery(RQAll).GroupByTime("start_time", "year"),
+		NewResourceQuery(RQAll).Count("n").Count("n"),
+	}
+
+	for _, q := range invalid {
+		if _, err := q.Aggregate(docs); err == nil || !(errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrFieldNotAllowed)) {
+			t.Errorf("expected %+v to be invalid, got %v", q.Aggregation, err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package ctypes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a keyset pagination position, the sort values of the row a page continues from
+// Unlike offsets, cursors stay correct when rows are added or removed between pages. The sort should end with a
+// unique field, such as an id, so no two rows share a position
+type Cursor struct {
+	Fields   []string      `json:"f"`           // Sort fields, prefixed with - when descending
+	Values   []interface{} `json:"v"`           // Sort values of the row, as they are stored in json
+	Previous bool          `json:"p,omitempty"` // The page before the row rather than the one after it
+}
+
+// NewCursor creates a cursor for a row with the given values of the sort fields
+func NewCursor(sort []RQSort, values []interface{}, previous bool) (*Cursor, error) {
+	if len(sort) == 0 || len(values) != len(sort) {
+		return nil, fmt.Errorf("%w: expected %d sort values, got %d", ErrInvalidCursor, len(sort), len(values))
+	}
+
+	c := &Cursor{Fields: cursorFields(sort), Values: make([]interface{}, len(values)), Previous: previous}
+
+	for i, v := range values {
+		switch nv := queryJSONValue(v).(type) {
+		case string, float64, bool:
+			c.Values[i] = nv
+		default:
+			return nil, fmt.Errorf("%w: %s cannot be paginated on a %T value", ErrInvalidCursor, sort[i].Field, v)
+		}
+	}
+
+	return c, nil
+}
+
+func cursorFields(sort []RQSort) []string {
+	fields := make([]string, len(sort))
+
+	for i, srt := range sort {
+		fields[i] = srt.Field
+		if !srt.Ascending {
+			fields[i] = "-" + srt.Field
+		}
+	}
+
+	return fields
+}
+
+func cursorMAC(payload []byte, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// Encode signs the cursor with key, so clients cannot forge positions
+func (c *Cursor) Encode(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("%w: no signing key", ErrInvalidCursor)
+	}
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(cursorMAC(payload, key)), nil
+}
+
+// DecodeCursor verifies and decodes a cursor created by Encode with the same key
+func DecodeCursor(encoded, key string) (*Cursor, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%w: no signing key", ErrInvalidCursor)
+	}
+
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, cursorMAC(payload, key)) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidCursor)
+	}
+
+	var c Cursor
+
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// After makes the query continue from a cursor instead of an offset
+func (q *ResourceQuery) After(c *Cursor) *ResourceQuery {
+	q.Cursor = c
+	q.Offset = 0
+
+	return q
+}
+
+// PagingBackward is true if the query fetches the page before its cursor. Such pages are sorted in reverse by
+// ToSQL and ToMongo, so their rows need to be reversed before they are shown. Filter already does this
+func (q *ResourceQuery) PagingBackward() bool {
+	return q.Cursor != nil && q.Cursor.Previous
+}
+
+// sorts is the order rows are fetched in, which is reversed when paging backward
+func (q *ResourceQuery) sorts() []RQSort {
+	if !q.PagingBackward() {
+		return q.Sort
+	}
+
+	sorts := make([]RQSort, len(q.Sort))
+
+	for i, srt := range q.Sort {
+		sorts[i] = RQSort{Field: srt.Field, Ascending: !srt.Ascending}
+	}
+
+	return sorts
+}
+
+// offset is ignored when paging with a cursor
+func (q *ResourceQuery) offset() uint64 {
+	if q.Cursor != nil {
+		return 0
+	}
+
+	return q.Offset
+}
+
+// filterGroup is the group compilers match rows against, which continues from the cursor if there is one
+func (q *ResourceQuery) filterGroup() (RQGroup, error) {
+	g := q.group()
+
+	if q.Cursor == nil {
+		return g, nil
+	}
+
+	keyset, err := q.keysetGroup()
+	if err != nil {
+		return RQGroup{}, err
+	}
+
+	return RQGroup{Mode: RQAll, Groups: []RQGroup{g, keyset}}, nil
+}
+
+// keysetGroup matches the rows after the cursor, in the order rows are fetched in:
+// (a > va) OR (a = va AND b > vb) OR ...
+func (q *ResourceQuery) keysetGroup() (RQGroup, error) {
+	c := q.Cursor
+
+	if len(c.Fields) == 0 || len(c.Values) != len(c.Fields) || !reflect.DeepEqual(c.Fields, cursorFields(q.Sort)) {
+		return RQGroup{}, fmt.Errorf("%w: cursor does not match the sort of the query", ErrInvalidCursor)
+	}
+
+	keyset := RQGroup{Mode: RQAny}
+
+	for i, srt := range q.sorts() {
+		step := RQGroup{Mode: RQAll}
+
+		for j := 0; j < i; j++ {
+			eq, err := cursorQuery(q.Sort[j].Field, RQEquals, c.Values[j])
+			if err != nil {
+				return RQGroup{}, err
+			}
+
+			step.Queries = append(step.Queries, eq)
+		}
+
+		op := RQLessThan
+		if srt.Ascending {
+			op = RQGreaterThan
+		}
+
+		next, err := cursorQuery(srt.Field, op, c.Values[i])
+		if err != nil {
+			return RQGroup{}, err
+		}
+
+		step.Queries = append(step.Queries, next)
+		keyset.Groups = append(keyset.Groups, step)
+	}
+
+	return keyset, nil
+}
+
+// cursorQuery compares a field against a cursor value, with the type of the value made explicit
+func cursorQuery(field string, operator int, value interface{}) (RQQ, error) {
+	var s, valueType string
+
+	switch v := value.(type) {
+	case string:
+		s, valueType = v, RQTypeString
+	case float64:
+		s, valueType = strconv.FormatFloat(v, 'f', -1, 64), RQTypeNumber
+	case bool:
+		s, valueType = strconv.FormatBool(v), RQTypeBool
+	default:
+		return RQQ{}, fmt.Errorf("%w: unsupported value %v", ErrInvalidCursor, value)
+	}
+
+	return RQQ{Field: field, Operator: operator, Value: &s, Type: valueType}, nil
+}
+
+// SortValues returns the values of the query's sort fields in a document, for creating cursors
+func (q *ResourceQuery) SortValues(doc interface{}) ([]interface{}, error) {
+	d, err := queryDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(q.Sort))
+
+	for i, srt := range q.Sort {
+		found := lookupField(d, srt.Field)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("%w: %s is missing", ErrInvalidCursor, srt.Field)
+		}
+
+		values[i] = found[0]
+	}
+
+	return values, nil
+}
+
+// NewPageInfo builds the page info of count rows fetched with q, in the order they are shown
+// sortValues returns the sort values of row i, see SortValues. Cursors are signed with key
+// A next page is assumed whenever a page is full, so the last page can be empty
+func NewPageInfo(q *ResourceQuery, count int, key string, sortValues func(i int) ([]interface{}, error)) (PageInfo, error) {
+	info := PageInfo{Count: count}
+
+	full := q.Limit > 0 && uint64(count) >= q.Limit
+	backward := q.PagingBackward()
+
+	hasNext, hasPrevious := full, q.Cursor != nil
+	if backward {
+		hasNext, hasPrevious = true, full
+	}
+
+	// An empty page can only be left the way it was entered
+	if count == 0 {
+		if q.Cursor != nil {
+			back := *q.Cursor
+			back.Previous = !back.Previous
+
+			encoded, err := back.Encode(key)
+			if err != nil {
+				return PageInfo{}, err
+			}
+
+			if backward {
+				info.NextCursor = encoded
+			} else {
+				info.PreviousCursor = encoded
+			}
+		}
+
+		return info, nil
+	}
+
+	cursorAt := func(i int, previous bool) (string, error) {
+		values, err := sortValues(i)
+		if err != nil {
+			return "", err
+		}
+
+		c, err := NewCursor(q.Sort, values, previous)
+		if err != nil {
+			return "", err
+		}
+
+		return c.Encode(key)
+	}
+
+	var err error
+
+	if hasNext {
+		if info.NextCursor, err = cursorAt(count-1, false); err != nil {
+			return PageInfo{}, err
+		}
+	}
+
+	if hasPrevious {
+		if info.PreviousCursor, err = cursorAt(0, true); err != nil {
+			return PageInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+// NewDocumentPageInfo builds the page info of documents returned by Filter, or any documents that marshal into
+// json with the query's sort fields
+func NewDocumentPageInfo(q *ResourceQuery, docs []interface{}, key string) (PageInfo, error) {
+	return NewPageInfo(q, len(docs), key, func(i int) ([]interface{}, error) {
+		return q.SortValues(docs[i])
+	})
+}
@@ -0,0 +1,120 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestResourceQuery_Cursor(t *testing.T) {
+	const key = "cursor-key"
+
+	var docs []interface{}
+	for i := 0; i < 7; i++ {
+		docs = append(docs, Mem{"id": fmt.Sprintf("m%d", i), "score": i % 3})
+	}
+
+	newQuery := func(cursor string) *ResourceQuery {
+		u, _ := url.Parse("https://test.url?limit=3&sortdesc=score&sortdesc=id&cursor=" + url.QueryEscape(cursor))
+
+		q, err := ResourceQueryFromURLWithCursor(u, "", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return q
+	}
+
+	page := func(q *ResourceQuery) ([]string, PageInfo) {
+		got, err := q.Filter(docs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := NewDocumentPageInfo(q, got, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, d := range got {
+			ids = append(ids, d.(Mem)["id"].(string))
+		}
+
+		return ids, info
+	}
+
+	u, _ := url.Parse("https://test.url?limit=3&sortdesc=score&sortdesc=id")
+	first, _ := ResourceQueryFromURL(u, "")
+
+	ids, info := page(first)
+	if !reflect.DeepEqual(ids, []string{"m5", "m2", "m4"}) || info.PreviousCursor != "" || info.NextCursor == "" {
+		t.Fatalf("unexpected first page %v %+v", ids, info)
+	}
+
+	ids, info = page(newQuery(info.NextCursor))
+	if !reflect.DeepEqual(ids, []string{"m1", "m6", "m3"}) || info.PreviousCursor == "" {
+		t.Fatalf("unexpected second page %v %+v", ids, info)
+	}
+
+	second := info
+
+	ids, info = page(newQuery(second.NextCursor))
+	if !reflect.DeepEqual(ids, []string{"m0"}) || info.NextCursor != "" {
+		t.Fatalf("unexpected last page %v %+v", ids, info)
+	}
+
+	ids, info = page(newQuery(second.PreviousCursor))
+	if !reflect.DeepEqual(ids, []string{"m5", "m2", "m4"}) || info.NextCursor == "" {
+		t.Fatalf("expected to go back to the first page, got %v %+v", ids, info)
+	}
+
+	// Cursors cannot be tampered with, or used with another key or sort
+	parts := strings.Split(second.NextCursor, ".")
+	forged, _ := (&Cursor{Fields: []string{"-score", "-id"}, Values: []interface{}{float64(0), "m0"}}).Encode("other-key")
+
+	for _, cursor := range []string{parts[0] + "x." + parts[1], forged, "garbage"} {
+		if _, err := DecodeCursor(cursor, key); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("expected %s to be rejected, got %v", cursor, err)
+		}
+	}
+
+	var fromJSON ResourceQuery
+	if err := json.Unmarshal([]byte(`{"sort":[{"field":"id"}],"cursor":{"f":["-id"],"v":["m0"]}}`), &fromJSON); err != nil || fromJSON.Cursor != nil {
+		t.Errorf("expected an unsigned cursor in json to be ignored, got %+v %v", fromJSON.Cursor, err)
+	}
+
+	c, _ := DecodeCursor(second.NextCursor, key)
+	if _, err := NewResourceQuery(RQAll).SortAsc("id").After(c).Filter(docs); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected a cursor of another sort to be rejected, got %v", err)
+	}
+
+	s, err := NewResourceQuery(RQAll).Equals("id", "x").SortDesc("score").SortDesc("id").After(c).ToSQL(SQLFields{"id": {Column: "id"}, "score": {Column: "score"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Where != `(("id" = ?) AND (("score" < ?) OR ("score" = ? AND "id" < ?)))` || !reflect.DeepEqual(s.Args, []interface{}{"x", int64(0), int64(0), "m3"}) {
+		t.Errorf("unexpected sql %s %v", s.Where, s.Args)
+	}
+}
+
+func TestParsePackageCursor(t *testing.T) {
+	p := &DBPackage{ID: uuid.Must(uuid.NewRandom()), CreatedAt: &CustomTime{time.Unix(0, 1600000000123456789)}}
+
+	createdAt, id, err := ParsePackageCursor(p.Cursor())
+	if err != nil || !createdAt.Equal(p.CreatedAt.Time) || id != p.ID {
+		t.Errorf("expected %s %s, got %s %s %v", p.CreatedAt, p.ID, createdAt, id, err)
+	}
+
+	if _, _, err := ParsePackageCursor("bm90IGEgY3Vyc29y"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
@@ -0,0 +1,528 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxCachedRegexes bounds the regex cache, which is cleared when it fills up
+const maxCachedRegexes = 256
+
+var regexCache = struct {
+	mu      sync.Mutex
+	regexes map[string]*regexp.Regexp
+}{regexes: map[string]*regexp.Regexp{}}
+
+// cachedRegex compiles a pattern once, as the same query is usually matched against many documents
+func cachedRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.mu.Lock()
+	defer regexCache.mu.Unlock()
+
+	if rx, ok := regexCache.regexes[pattern]; ok {
+		return rx, nil
+	}
+
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+	}
+
+	if len(regexCache.regexes) >= maxCachedRegexes {
+		regexCache.regexes = map[string]*regexp.Regexp{}
+	}
+
+	regexCache.regexes[pattern] = rx
+
+	return rx, nil
+}
+
+// queryDocument converts a document into the json form queries are matched against
+// Contexts are matched using the same "context.container.key" paths as templates
+func queryDocument(doc interface{}) (map[string]interface{}, error) {
+	if ctx, ok := doc.(*Context); ok {
+		doc = ctx.GetTemplateData()
+	}
+
+	jsb, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var out map[string]interface{}
+
+	if err := json.Unmarshal(jsb, &out); err != nil {
+		return nil, fmt.Errorf("%w: document is not an object", ErrInvalidQuery)
+	}
+
+	return out, nil
+}
+
+// queryJSONValue converts a value to what it would decode to in a query document, where numbers are float64
+func queryJSONValue(value interface{}) interface{} {
+	jsb, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(jsb, &normalized); err != nil {
+		return value
+	}
+
+	return normalized
+}
+
+// lookupField returns the values at a dotted path. Like mongo, paths continue through every element of an array,
+// numeric parts index arrays, and a field holding an array also yields each of its elements
+func lookupField(doc interface{}, field string) []interface{} {
+	values := []interface{}{doc}
+
+	for _, part := range strings.Split(field, ".") {
+		var next []interface{}
+
+		for _, v := range values {
+			switch val := v.(type) {
+			case map[string]interface{}:
+				if c, ok := val[part]; ok {
+					next = append(next, c)
+				}
+			case []interface{}:
+				if i, err := strconv.Atoi(part); err == nil {
+					if i >= 0 && i < len(val) {
+						next = append(next, val[i])
+					}
+
+					continue
+				}
+
+				for _, el := range val {
+					if m, ok := el.(map[string]interface{}); ok {
+						if c, ok := m[part]; ok {
+							next = append(next, c)
+						}
+					}
+				}
+			}
+		}
+
+		values = next
+	}
+
+	var expanded []interface{}
+
+	for _, v := range values {
+		expanded = append(expanded, v)
+
+		if arr, ok := v.([]interface{}); ok {
+			expanded = append(expanded, arr...)
+		}
+	}
+
+	return expanded
+}
+
+// jsonValues are the typed values of the query as they would be stored in json. Times are kept, as they are
+// compared by parsing the stored strings
+func (r *RQQ) jsonValues() ([]interface{}, error) {
+	typed, err := r.TypedValues()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range typed {
+		switch tv := v.(type) {
+		case int64:
+			typed[i] = float64(tv)
+		case uuid.UUID:
+			typed[i] = tv.String()
+		}
+	}
+
+	return typed, nil
+}
+
+// jsonTimeLayouts are the time formats found in json documents, including CustomTime's
+var jsonTimeLayouts = []string{time.RFC3339Nano, ctLayout, "2006-01-02"}
+
+// parseJSONTime parses a time stored in a json document. Times without a zone are UTC, like CustomTime's
+func parseJSONTime(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	for _, layout := range jsonTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// compareJSON compares two json values of the same type, ok is false if they cannot be compared
+// A time b is compared against a, which must be a string holding a time
+func compareJSON(a, b interface{}) (cmp int, ok bool) {
+	if bt, isTime := b.(time.Time); isTime {
+		at, isTime := parseJSONTime(a)
+		if !isTime {
+			return 0, false
+		}
+
+		switch {
+		case at.Before(bt):
+			return -1, true
+		case at.After(bt):
+			return 1, true
+		}
+
+		return 0, true
+	}
+
+	switch av := a.(type) {
+	case float64:
+		if bv, isNum := b.(float64); isNum {
+			switch {
+			case av < bv:
+				return -1, true
+			case av > bv:
+				return 1, true
+			}
+
+			return 0, true
+		}
+	case string:
+		if bv, isStr := b.(string); isStr {
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, isBool := b.(bool); isBool {
+			switch {
+			case av == bv:
+				return 0, true
+			case !av:
+				return -1, true
+			}
+
+			return 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// Matches reports whether a document matches the query. Documents can be a Mem, a *Context, a map or anything
+// else that marshals into a json object. Comparisons are typed like mongo's, so "5" only matches the number 5
+func (q *ResourceQuery) Matches(doc interface{}) (bool, error) {
+	d, err := queryDocument(doc)
+	if err != nil {
+		return false, err
+	}
+
+	return q.matches(d)
+}
+
+func (q *ResourceQuery) matches(doc map[string]interface{}) (bool, error) {
+	g, err := q.filterGroup()
+	if err != nil {
+		return false, err
+	}
+
+	return g.matches(doc)
+}
+
+func (g *RQGroup) matches(doc map[string]interface{}) (bool, error) {
+	results := make([]bool, 0, len(g.Queries)+len(g.Groups))
+
+	for _, rqq := range g.Queries {
+		match, err := rqq.matches(doc)
+		if err != nil {
+			return false, err
+		}
+
+		results = append(results, match)
+	}
+
+	for i := range g.Groups {
+		match, err := g.Groups[i].matches(doc)
+		if err != nil {
+			return false, err
+		}
+
+		results = append(results, match)
+	}
+
+	if len(results) == 0 {
+		return true, nil
+	}
+
+	switch g.Mode {
+	case RQAll:
+		return !boolSliceContains(results, false), nil
+	case RQAny:
+		return boolSliceContains(results, true), nil
+	case RQNor:
+		return !boolSliceContains(results, true), nil
+	default:
+		return false, fmt.Errorf("%w: unknown mode %d", ErrInvalidQuery, g.Mode)
+	}
+}
+
+func boolSliceContains(s []bool, v bool) bool {
+	for _, b := range s {
+		if b == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *RQQ) matches(doc map[string]interface{}) (bool, error) {
+	if err := r.checkValues(); err != nil {
+		return false, err
+	}
+
+	typed, err := r.jsonValues()
+	if err != nil {
+		return false, err
+	}
+
+	values := lookupField(doc, r.Field)
+
+	var test func(v interface{}) bool
+
+	compare := func(accept func(cmp int) bool) func(v interface{}) bool {
+		return func(v interface{}) bool {
+			cmp, ok := compareJSON(v, typed[0])
+			return ok && accept(cmp)
+		}
+	}
+
+	str := func(accept func(s string) bool) func(v interface{}) bool {
+		return func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && accept(s)
+		}
+	}
+
+	equalsAny := func(v interface{}) bool {
+		for _, t := range typed {
+			if cmp, ok := compareJSON(v, t); ok && cmp == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	switch r.Operator {
+	case RQEquals:
+		test = compare(func(cmp int) bool { return cmp == 0 })
+	case RQExists:
+		test = func(v interface{}) bool { return true }
+	case RQContains:
+		test = str(func(s string) bool { return strings.Contains(s, *r.Value) })
+	case RQStartsWith:
+		test = str(func(s string) bool { return strings.HasPrefix(s, *r.Value) })
+	case RQEndsWith:
+		test = str(func(s string) bool { return strings.HasSuffix(s, *r.Value) })
+	case RQGreaterThan:
+		test = compare(func(cmp int) bool { return cmp > 0 })
+	case RQGreaterThanOrEqual:
+		test = compare(func(cmp int) bool { return cmp >= 0 })
+	case RQLessThan:
+		test = compare(func(cmp int) bool { return cmp < 0 })
+	case RQLessThanOrEqual:
+		test = compare(func(cmp int) bool { return cmp <= 0 })
+	case RQRegex:
+		rx, err := cachedRegex(*r.Value)
+		if err != nil {
+			return false, err
+		}
+
+		test = str(rx.MatchString)
+	case RQIn, RQContainsAny:
+		// Fields holding arrays also yield their elements, so in and contains any are the same test
+		test = equalsAny
+	case RQBetween:
+		test = func(v interface{}) bool {
+			lower, lok := compareJSON(v, typed[0])
+			upper, uok := compareJSON(v, typed[1])
+
+			return lok && uok && lower >= 0 && upper <= 0
+		}
+	case RQContainsAll:
+		for _, t := range typed {
+			found := false
+
+			for _, v := range values {
+				if cmp, ok := compareJSON(v, t); ok && cmp == 0 {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return r.Negate, nil
+			}
+		}
+
+		return !r.Negate, nil
+	case RQEqualsFold:
+		test = str(func(s string) bool { return strings.EqualFold(s, *r.Value) })
+	case RQContainsFold:
+		test = str(func(s string) bool { return strings.Contains(strings.ToLower(s), strings.ToLower(*r.Value)) })
+	case RQNull:
+		test = func(v interface{}) bool { return v == nil }
+	default:
+		return false, fmt.Errorf("%w: unknown operator %d", ErrInvalidQuery, r.Operator)
+	}
+
+	match := false
+
+	for _, v := range values {
+		if test(v) {
+			match = true
+			break
+		}
+	}
+
+	return match != r.Negate, nil
+}
+
+// sortRank orders values of different types the way mongo does
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case float64:
+		return 1
+	case string:
+		return 2
+	case map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bool:
+		return 5
+	default:
+		return 6
+	}
+}
+
+func compareSortValues(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+
+	cmp, _ := compareJSON(a, b)
+
+	return cmp
+}
+
+// Filter returns the documents that match the query, sorted and paginated like the query, from its cursor if set
+// The returned documents are the ones passed in, not their json form
+func (q *ResourceQuery) Filter(docs []interface{}) ([]interface{}, error) {
+	type entry struct {
+		doc  interface{}
+		keys []interface{}
+	}
+
+	sorts := q.sorts()
+
+	g, err := q.filterGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []entry
+
+	for _, doc := range docs {
+		d, err := queryDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		match, err := g.matches(d)
+		if err != nil {
+			return nil, err
+		}
+
+		if !match {
+			continue
+		}
+
+		e := entry{doc: doc, keys: make([]interface{}, len(sorts))}
+
+		for i, srt := range sorts {
+			// Missing fields sort like null
+			if values := lookupField(d, srt.Field); len(values) > 0 {
+				e.keys[i] = values[0]
+			}
+		}
+
+		matched = append(matched, e)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		for k, srt := range sorts {
+			cmp := compareSortValues(matched[i].keys[k], matched[j].keys[k])
+			if cmp == 0 {
+				continue
+			}
+
+			return (cmp < 0) == srt.Ascending
+		}
+
+		return false
+	})
+
+	out := []interface{}{}
+
+	for i := q.offset(); i < uint64(len(matched)); i++ {
+		if q.Limit > 0 && uint64(len(out)) >= q.Limit {
+			break
+		}
+
+		out = append(out, matched[i].doc)
+	}
+
+	// Pages before a cursor were collected in reverse
+	if q.PagingBackward() {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+
+	return out, nil
+}
+
+// FilterMem is Filter for a slice of memory
+func (q *ResourceQuery) FilterMem(mems []Mem) ([]Mem, error) {
+	docs := make([]interface{}, len(mems))
+	for i, m := range mems {
+		docs[i] = m
+	}
+
+	filtered, err := q.Filter(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Mem, len(filtered))
+	for i, doc := range filtered {
+		out[i] = doc.(Mem)
+	}
+
+	return out, nil
+}
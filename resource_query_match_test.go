@@ -0,0 +1,89 @@
+package ctypes
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestResourceQuery_Matches(t *testing.T) {
+	id := uuid.Must(uuid.NewRandom())
+
+	doc := Mem{
+		"id":    id,
+		"name":  "Jane (admin)",
+		"age":   31,
+		"tags":  []string{"vip", "beta"},
+		"steps": []map[string]interface{}{{"duration": 1.5}, {"duration": 4}},
+	}
+
+	tests := []struct {
+		query *ResourceQuery
+		want  bool
+	}{
+		{NewResourceQuery(RQAll), true},
+		{NewResourceQuery(RQAny), true},
+		{NewResourceQuery(RQAll).Equals("id", id.String()).Equals("age", "31"), true},
+		{NewResourceQuery(RQAll).Equals("name", "31").Equals("age", "31"), false},
+		{NewResourceQuery(RQAll).GreaterThan("age", "30.5").LessThanOrEqualTo("age", "31"), true},
+		{NewResourceQuery(RQAll).GreaterThan("name", "10"), false},
+		{NewResourceQuery(RQAll).Contains("name", "(admin)").StartsWith("name", "Ja").EndsWith("name", ")"), true},
+		{NewResourceQuery(RQAll).Equals("tags", "beta").Equals("tags.0", "vip"), true},
+		{NewResourceQuery(RQAll).GreaterThan("steps.duration", "3"), true},
+		{NewResourceQuery(RQAll).DoesNotExist("missing").DoesNotEqual("missing", "x"), true},
+		{NewResourceQuery(RQAny).Exists("missing").MatchesRegEx("name", `^J\w+`), true},
+		{NewResourceQuery(RQNor).Exists("missing").DoesNotMatchRegEx("name", `^J\w+`), true},
+		{NewResourceQuery(RQNor).Exists("age"), false},
+	}
+
+	for i, tt := range tests {
+		got, err := tt.query.Matches(doc)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("%d: expected %v for %+v", i, tt.want, tt.query.Queries)
+		}
+	}
+
+	if _, err := NewResourceQuery(RQAll).MatchesRegEx("name", "(").Matches(doc); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected an invalid regex to be rejected, got %v", err)
+	}
+
+	ctx := &Context{Name: "user", Memory: []MemoryContainer{{Name: "profile", Data: Mem{"plan": "pro"}}}}
+
+	if match, err := NewResourceQuery(RQAll).Equals("user.profile.plan", "pro").Matches(ctx); err != nil || !match {
+		t.Errorf("expected context to match, got %v %v", match, err)
+	}
+}
+
+func TestResourceQuery_Filter(t *testing.T) {
+	mems := []Mem{
+		{"name": "a", "score": 3},
+		{"name": "b", "score": 1},
+		{"name": "c"},
+		{"name": "d", "score": 3},
+		{"name": "e", "score": "high"},
+	}
+
+	q := NewResourceQuery(RQAll).DoesNotEqual("name", "b").SortDesc("score").SortAsc("name").ResourceLimit(3).ResourceOffset(1)
+
+	got, err := q.FilterMem(mems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range got {
+		names = append(names, m["name"].(string))
+	}
+
+	// Strings sort above numbers, and missing fields below everything
+	if !reflect.DeepEqual(names, []string{"a", "d", "c"}) {
+		t.Errorf("unexpected order %v", names)
+	}
+}
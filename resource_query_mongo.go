@@ -0,0 +1,313 @@
+package ctypes
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ToMongo compiles the query into a filter and find options for a collection of mongoified documents
+// Documents of a page before a cursor are sorted in reverse, see PagingBackward
+func (q *ResourceQuery) ToMongo() (bson.M, *options.FindOptions, error) {
+	g, err := q.filterGroup()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filter, err := g.toMongo()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := options.Find().SetSkip(int64(q.offset()))
+
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+
+	if len(q.Sort) > 0 {
+		// Sort documents must keep their order, so this is a bson.D rather than a bson.M
+		sort := bson.D{}
+
+		for _, srt := range q.sorts() {
+			if err := validMongoField(srt.Field); err != nil {
+				return nil, nil, err
+			}
+
+			dir := -1
+			if srt.Ascending {
+				dir = 1
+			}
+
+			sort = append(sort, bson.E{Key: srt.Field, Value: dir})
+		}
+
+		opts.SetSort(sort)
+	}
+
+	return filter, opts, nil
+}
+
+func (g *RQGroup) toMongo() (bson.M, error) {
+	clauses := bson.A{}
+
+	for _, rqq := range g.Queries {
+		clause, err := rqq.toMongo()
+		if err != nil {
+			return nil, err
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	for i := range g.Groups {
+		clause, err := g.Groups[i].toMongo()
+		if err != nil {
+			return nil, err
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	filter := bson.M{}
+
+	// Mongo rejects empty $and, $or and $nor arrays
+	if len(clauses) == 0 {
+		return filter, nil
+	}
+
+	switch g.Mode {
+	case RQAll:
+		filter["$and"] = clauses
+	case RQAny:
+		filter["$or"] = clauses
+	case RQNor:
+		filter["$nor"] = clauses
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %d", ErrInvalidQuery, g.Mode)
+	}
+
+	return filter, nil
+}
+
+// validMongoField rejects fields that mongo would read as operators or positional paths
+func validMongoField(field string) error {
+	if field == "" {
+		return fmt.Errorf("%w: empty field", ErrFieldNotAllowed)
+	}
+
+	for _, part := range strings.Split(field, ".") {
+		if part == "" || strings.HasPrefix(part, "$") {
+			return fmt.Errorf("%w: %s", ErrFieldNotAllowed, field)
+		}
+	}
+
+	return nil
+}
+
+func (r *RQQ) toMongo() (bson.M, error) {
+	if err := validMongoField(r.Field); err != nil {
+		return nil, err
+	}
+
+	if err := r.checkValues(); err != nil {
+		return nil, err
+	}
+
+	// Mongo compares time strings as text, so they must be written the way CustomTime stores them in documents
+	stored, err := r.storedValues(ctLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	values := bson.A(stored)
+
+	var cond bson.M
+
+	switch r.Operator {
+	case RQEquals:
+		cond = bson.M{"$eq": values[0]}
+	case RQExists:
+		cond = bson.M{"$exists": true}
+	case RQContains:
+		cond = bson.M{"$regex": regexp.QuoteMeta(*r.Value)}
+	case RQStartsWith:
+		cond = bson.M{"$regex": "^" + regexp.QuoteMeta(*r.Value)}
+	case RQEndsWith:
+		cond = bson.M{"$regex": regexp.QuoteMeta(*r.Value) + "$"}
+	case RQGreaterThan:
+		cond = bson.M{"$gt": values[0]}
+	case RQGreaterThanOrEqual:
+		cond = bson.M{"$gte": values[0]}
+	case RQLessThan:
+		cond = bson.M{"$lt": values[0]}
+	case RQLessThanOrEqual:
+		cond = bson.M{"$lte": values[0]}
+	case RQRegex:
+		if _, err := regexp.Compile(*r.Value); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+		}
+
+		cond = bson.M{"$regex": *r.Value}
+	case RQIn, RQContainsAny:
+		// $in matches arrays holding any of the values, so it covers both operators
+		cond = bson.M{"$in": values}
+	case RQBetween:
+		cond = bson.M{"$gte": values[0], "$lte": values[1]}
+	case RQContainsAll:
+		cond = bson.M{"$all": values}
+	case RQEqualsFold:
+		cond = bson.M{"$regex": "^" + regexp.QuoteMeta(*r.Value) + "$", "$options": "i"}
+	case RQContainsFold:
+		cond = bson.M{"$regex": regexp.QuoteMeta(*r.Value), "$options": "i"}
+	case RQNull:
+		cond = bson.M{"$type": "null"}
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %d", ErrInvalidQuery, r.Operator)
+	}
+
+	clause := bson.M{r.Field: cond}
+
+	// $nor rather than $not, so documents without the field match negated queries, as they do in sql
+	if r.Negate {
+		return bson.M{"$nor": bson.A{clause}}, nil
+	}
+
+	return clause, nil
+}
+
+// mongoBucketFormats format dates like formatBucket
+var mongoBucketFormats = map[string]string{
+	BucketMinute: "%Y-%m-%dT%H:%M:00Z",
+	BucketHour:   "%Y-%m-%dT%H:00:00Z",
+	BucketDay:    "%Y-%m-%d",
+	BucketWeek:   "%G-W%V",
+	BucketMonth:  "%Y-%m",
+}
+
+// mongoNumber is the field if it holds a number, and null otherwise
+func mongoNumber(field string) bson.M {
+	ref := "$" + field
+
+	return bson.M{"$cond": bson.A{
+		bson.M{"$in": bson.A{bson.M{"$type": ref}, bson.A{"double", "int", "long", "decimal"}}},
+		ref,
+		nil,
+	}}
+}
+
+// ToMongoPipeline compiles the query's aggregation into an aggregation pipeline for mongoified documents
+// The stages can be used as a mongo.Pipeline
+func (q *ResourceQuery) ToMongoPipeline() ([]bson.D, error) {
+	a := q.Aggregation
+	if a == nil {
+		return nil, fmt.Errorf("%w: query has no aggregation", ErrInvalidQuery)
+	}
+
+	if err := a.validate(q); err != nil {
+		return nil, err
+	}
+
+	g := q.group()
+
+	filter, err := g.toMongo()
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := []bson.D{{{Key: "$match", Value: filter}}}
+
+	if a.Unwind != "" {
+		if err := validMongoField(a.Unwind); err != nil {
+			return nil, err
+		}
+
+		pipeline = append(pipeline, bson.D{{Key: "$unwind", Value: "$" + a.Unwind}})
+	}
+
+	var id interface{}
+
+	project := bson.M{"_id": 0}
+
+	if len(a.GroupBy) > 0 {
+		keys := bson.M{}
+
+		for i := range a.GroupBy {
+			gb := a.GroupBy[i]
+
+			if err := validMongoField(gb.Field); err != nil {
+				return nil, err
+			}
+
+			var key interface{} = bson.M{"$ifNull": bson.A{"$" + gb.Field, nil}}
+
+			if gb.Bucket != "" {
+				key = bson.M{"$dateToString": bson.M{
+					"format": mongoBucketFormats[gb.Bucket],
+					"date": bson.M{"$dateFromString": bson.M{
+						"dateString": "$" + gb.Field,
+						"onError":    nil,
+						"onNull":     nil,
+					}},
+				}}
+			}
+
+			keys[gb.name()] = key
+			project[gb.name()] = "$_id." + gb.name()
+		}
+
+		id = keys
+	}
+
+	group := bson.M{"_id": id}
+
+	for _, agg := range a.Aggregates {
+		if agg.Function == AggCount {
+			group[agg.As] = bson.M{"$sum": 1}
+		} else {
+			if err := validMongoField(agg.Field); err != nil {
+				return nil, err
+			}
+
+			group[agg.As] = bson.M{"$" + agg.Function: mongoNumber(agg.Field)}
+		}
+
+		project[agg.As] = 1
+	}
+
+	pipeline = append(pipeline, bson.D{{Key: "$group", Value: group}}, bson.D{{Key: "$project", Value: project}})
+
+	sort := bson.D{}
+
+	for _, srt := range q.Sort {
+		dir := -1
+		if srt.Ascending {
+			dir = 1
+		}
+
+		sort = append(sort, bson.E{Key: srt.Field, Value: dir})
+	}
+
+	if len(q.Sort) == 0 {
+		for i := range a.GroupBy {
+			sort = append(sort, bson.E{Key: a.GroupBy[i].name(), Value: 1})
+		}
+	}
+
+	if len(sort) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sort}})
+	}
+
+	if q.Offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: int64(q.Offset)}})
+	}
+
+	if q.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: int64(q.Limit)}})
+	}
+
+	return pipeline, nil
+}
@@ -0,0 +1,97 @@
+package ctypes
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestResourceQuery_ToMongo(t *testing.T) {
+	id := uuid.Must(uuid.NewRandom())
+
+	q := NewResourceQuery(RQAny).
+		Equals("id", id.String()).
+		GreaterThanOrEqualTo("steps.duration", "1.5").
+		DoesNotStartWith("event.name", "a.b*").
+		Exists("error").
+		SortDesc("start_time").
+		SortAsc("id").
+		ResourceOffset(20)
+
+	filter, opts, err := q.ToMongo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bson.M{"$or": bson.A{
+		bson.M{"id": bson.M{"$eq": id.String()}},
+		bson.M{"steps.duration": bson.M{"$gte": 1.5}},
+		bson.M{"$nor": bson.A{bson.M{"event.name": bson.M{"$regex": `^a\.b\*`}}}},
+		bson.M{"error": bson.M{"$exists": true}},
+	}}
+
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("expected %v, got %v", want, filter)
+	}
+
+	if *opts.Limit != 10 || *opts.Skip != 20 || !reflect.DeepEqual(opts.Sort, bson.D{{Key: "start_time", Value: -1}, {Key: "id", Value: 1}}) {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	if filter, _, _ := NewResourceQuery(RQNor).ToMongo(); len(filter) != 0 {
+		t.Errorf("expected an empty filter, got %v", filter)
+	}
+
+	if _, _, err := NewResourceQuery(RQAll).Equals("$where", "1").ToMongo(); !errors.Is(err, ErrFieldNotAllowed) {
+		t.Errorf("expected operator fields to be rejected, got %v", err)
+	}
+
+	if _, _, err := NewResourceQuery(RQAll).MatchesRegEx("id", "[").ToMongo(); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected an invalid regex to be rejected, got %v", err)
+	}
+}
+
+func TestResourceQuery_ToMongoTimes(t *testing.T) {
+	// Equivalent to 2020-01-01T00:00:00Z
+	q := NewResourceQuery(RQAll).GreaterThanOrEqualTo("start_time", "2020-01-01T02:00:00+02:00").OfType(RQTypeTime)
+
+	filter, _, err := q.ToMongo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter compares against the string mongo holds, like {"$gte": "2020-01-01T00:00:00.000000"}
+	clause := filter["$and"].(bson.A)[0].(bson.M)["start_time"].(bson.M)
+	bound, ok := clause["$gte"].(string)
+	if !ok || len(clause) != 1 {
+		t.Fatalf("unexpected filter %v", filter)
+	}
+
+	tests := []struct {
+		start time.Time
+		match bool
+	}{
+		{time.Date(2019, 12, 31, 23, 59, 59, 500000000, time.UTC), false},
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2020, 1, 1, 0, 0, 0, 1000, time.UTC), true},
+		{time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		result := ExecutionResult{ID: uuid.Must(uuid.NewRandom()), StartTime: CustomTime{tt.start}}
+		doc := result.Mongoify()
+
+		if match, err := q.Matches(doc); err != nil || match != tt.match {
+			t.Errorf("%s: expected Matches to be %v, got %v %v", tt.start, tt.match, match, err)
+		}
+
+		// Mongo compares two strings by their bytes
+		if match := doc["start_time"].(string) >= bound; match != tt.match {
+			t.Errorf("%s: expected mongo to match %v, %s >= %s is %v", tt.start, tt.match, doc["start_time"], bound, match)
+		}
+	}
+}
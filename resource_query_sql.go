@@ -0,0 +1,656 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"upper.io/db.v3"
+)
+
+var (
+	ErrFieldNotAllowed = errors.New("field cannot be queried")
+	ErrInvalidQuery    = errors.New("invalid resource query")
+)
+
+var (
+	sqlColumnRegex    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+	jsonPathPartRegex = regexp.MustCompile(`^[A-Za-z0-9_$@\-]+$`)
+)
+
+// SQLField maps a resource query field to a column
+type SQLField struct {
+	Column string `json:"column"` // Column name, optionally prefixed with a table name
+	JSONB  bool   `json:"jsonb"`  // Sub-fields of the field, "field.a.b", are paths into the JSONB column
+}
+
+// SQLFields is the whitelist of fields a resource query can use, keyed by field name
+// Fields that are not listed cause ErrFieldNotAllowed, so queries cannot reach arbitrary columns
+type SQLFields map[string]SQLField
+
+// SQLQuery is a resource query compiled for upper.io/db, with every value bound as a parameter
+type SQLQuery struct {
+	Where   string        `json:"where"`
+	Args    []interface{} `json:"args"`
+	OrderBy []interface{} `json:"order_by"` // Column names, prefixed with - when descending, or db.Raw for JSONB paths
+	Limit   uint64        `json:"limit"`
+	Offset  uint64        `json:"offset"`
+}
+
+// Cond returns the where clause as a condition for db.Result.Where or a sqlbuilder selector
+func (s *SQLQuery) Cond() db.Compound {
+	return db.Raw(s.Where, s.Args...)
+}
+
+// Apply sets the conditions, order, limit and offset of the query on res
+func (s *SQLQuery) Apply(res db.Result) db.Result {
+	res = res.Where(s.Cond())
+
+	if len(s.OrderBy) > 0 {
+		res = res.OrderBy(s.OrderBy...)
+	}
+
+	if s.Limit > 0 {
+		res = res.Limit(int(s.Limit))
+	}
+
+	return res.Offset(int(s.Offset))
+}
+
+// sqlExpr is a resolved field
+type sqlExpr struct {
+	name    string // Unquoted column
+	path    []string
+	element bool // The column is a JSONB array element, see RQAggregation.Unwind
+}
+
+func (e sqlExpr) column() string {
+	parts := strings.Split(e.name, ".")
+
+	for i, p := range parts {
+		parts[i] = `"` + p + `"`
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func (e sqlExpr) jsonb() bool {
+	return len(e.path) > 0 || e.element
+}
+
+// text is the field as text, JSONB paths are extracted with #>>
+func (e sqlExpr) text() string {
+	if !e.jsonb() {
+		return e.column()
+	}
+
+	return fmt.Sprintf("(%s #>> ?::text[])", e.column())
+}
+
+// pathArg is the bound argument of the JSONB path, if any
+func (e sqlExpr) pathArg() []interface{} {
+	if !e.jsonb() {
+		return nil
+	}
+
+	return []interface{}{"{" + strings.Join(e.path, ",") + "}"}
+}
+
+// orderBy is the field as an ORDER BY term. Path parts are validated, so they can be inlined safely
+func (e sqlExpr) orderBy(asc bool) interface{} {
+	if !e.jsonb() {
+		if asc {
+			return e.name
+		}
+
+		return "-" + e.name
+	}
+
+	dir := "DESC"
+	if asc {
+		dir = "ASC"
+	}
+
+	return db.Raw(fmt.Sprintf("%s #>> '{%s}' %s", e.column(), strings.Join(e.path, ","), dir))
+}
+
+// resolve maps a query field to its column, using the longest JSONB field the field is a path into
+func (f SQLFields) resolve(field string) (sqlExpr, error) {
+	if sf, ok := f[field]; ok {
+		if !sqlColumnRegex.MatchString(sf.Column) {
+			return sqlExpr{}, fmt.Errorf("%w: invalid column %q", ErrFieldNotAllowed, sf.Column)
+		}
+
+		return sqlExpr{name: sf.Column}, nil
+	}
+
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+
+	// Longest first, so "data.user" wins over "data"
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	for _, k := range keys {
+		sf := f[k]
+
+		if !sf.JSONB || !strings.HasPrefix(field, k+".") {
+			continue
+		}
+
+		if !sqlColumnRegex.MatchString(sf.Column) {
+			return sqlExpr{}, fmt.Errorf("%w: invalid column %q", ErrFieldNotAllowed, sf.Column)
+		}
+
+		path := strings.Split(strings.TrimPrefix(field, k+"."), ".")
+
+		for _, p := range path {
+			if !jsonPathPartRegex.MatchString(p) {
+				return sqlExpr{}, fmt.Errorf("%w: invalid path %q", ErrFieldNotAllowed, field)
+			}
+		}
+
+		return sqlExpr{name: sf.Column, path: path}, nil
+	}
+
+	return sqlExpr{}, fmt.Errorf("%w: %s", ErrFieldNotAllowed, field)
+}
+
+// ToSQL compiles the query into a where clause with bound parameters, using fields as the whitelist of fields
+// Rows of a page before a cursor are sorted in reverse, see PagingBackward
+func (q *ResourceQuery) ToSQL(fields SQLFields) (*SQLQuery, error) {
+	s := &SQLQuery{Limit: q.Limit, Offset: q.offset(), OrderBy: []interface{}{}}
+
+	g, err := q.filterGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	where, args, err := g.toSQL(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Where, s.Args = where, args
+
+	for _, srt := range q.sorts() {
+		expr, err := fields.resolve(srt.Field)
+		if err != nil {
+			return nil, err
+		}
+
+		s.OrderBy = append(s.OrderBy, expr.orderBy(srt.Ascending))
+	}
+
+	return s, nil
+}
+
+func (g *RQGroup) toSQL(fields SQLFields) (string, []interface{}, error) {
+	var (
+		clauses []string
+		args    []interface{}
+	)
+
+	for _, rqq := range g.Queries {
+		clause, a, err := rqq.toSQL(fields)
+		if err != nil {
+			return "", nil, err
+		}
+
+		clauses = append(clauses, clause)
+		args = append(args, a...)
+	}
+
+	for i := range g.Groups {
+		clause, a, err := g.Groups[i].toSQL(fields)
+		if err != nil {
+			return "", nil, err
+		}
+
+		clauses = append(clauses, clause)
+		args = append(args, a...)
+	}
+
+	switch {
+	case len(clauses) == 0:
+		return "TRUE", args, nil
+	case g.Mode == RQAll:
+		return "(" + strings.Join(clauses, " AND ") + ")", args, nil
+	case g.Mode == RQAny:
+		return "(" + strings.Join(clauses, " OR ") + ")", args, nil
+	case g.Mode == RQNor:
+		return "(" + strings.Join(clauses, " OR ") + ") IS NOT TRUE", args, nil
+	default:
+		return "", nil, fmt.Errorf("%w: unknown mode %d", ErrInvalidQuery, g.Mode)
+	}
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// pgTextArray formats values as a postgres text array literal
+func pgTextArray(values []string) string {
+	quoted := make([]string, len(values))
+
+	for i, v := range values {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	}
+
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// sqlTimestamp casts JSON text that looks like a date to a timestamp, and to NULL otherwise. CASE, unlike AND,
+// guarantees the cast only happens to such text. Times without a zone are UTC, like CustomTime's
+func sqlTimestamp(text string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s ~ '^\d{4}-\d{2}-\d{2}' THEN (CASE WHEN %[1]s ~ '(Z|[+-]\d{2}(:?\d{2})?)$' THEN %[1]s::timestamptz ELSE %[1]s::timestamp AT TIME ZONE 'UTC' END) END`, text)
+}
+
+// sqlCompare compares the field against a single value. JSONB values are compared by type like Matches and mongo
+// do, so "5" only matches the number 5
+func (r *RQQ) sqlCompare(expr sqlExpr, op, value string) (string, []interface{}, error) {
+	typed, err := r.TypedValue(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if expr.jsonb() {
+		// Comparing JSONB values rather than casting the text cannot fail on values of other types
+		jsonbCompare := func(jsonType, cast string, arg interface{}) (string, []interface{}, error) {
+			return fmt.Sprintf("(jsonb_typeof(%[1]s #> ?::text[]) = '%[2]s' AND %[1]s #> ?::text[] %[3]s to_jsonb(?::%[4]s))", expr.column(), jsonType, op, cast),
+				[]interface{}{expr.pathArg()[0], expr.pathArg()[0], arg}, nil
+		}
+
+		switch v := typed.(type) {
+		case int64, float64:
+			return jsonbCompare("number", "numeric", v)
+		case bool:
+			return jsonbCompare("boolean", "boolean", v)
+		case uuid.UUID:
+			return jsonbCompare("string", "text", v.String())
+		case time.Time:
+			return fmt.Sprintf("%s %s ?", sqlTimestamp(expr.inlineText()), op), []interface{}{v}, nil
+		default:
+			return jsonbCompare("string", "text", value)
+		}
+	}
+
+	switch r.Type {
+	case RQTypeNumber, RQTypeBool, RQTypeTime:
+		return fmt.Sprintf("%s %s ?", expr.column(), op), []interface{}{typed}, nil
+	case RQTypeUUID:
+		value = typed.(uuid.UUID).String()
+	}
+
+	return fmt.Sprintf("%s %s ?", expr.column(), op), []interface{}{value}, nil
+}
+
+func (r *RQQ) toSQL(fields SQLFields) (string, []interface{}, error) {
+	expr, err := fields.resolve(r.Field)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := r.checkValues(); err != nil {
+		return "", nil, err
+	}
+
+	var (
+		clause string
+		args   []interface{}
+	)
+
+	compare := func(op string) {
+		clause, args, err = r.sqlCompare(expr, op, *r.Value)
+	}
+
+	// combine joins comparisons against each of the values
+	combine := func(sep string, ops ...string) {
+		var clauses []string
+
+		for i, v := range r.Values {
+			op := ops[0]
+			if len(ops) > 1 {
+				op = ops[i]
+			}
+
+			c, a, cerr := r.sqlCompare(expr, op, v)
+			if cerr != nil {
+				err = cerr
+				return
+			}
+
+			clauses = append(clauses, c)
+			args = append(args, a...)
+		}
+
+		clause = "(" + strings.Join(clauses, sep) + ")"
+	}
+
+	like := func(op, pattern string) {
+		clause = fmt.Sprintf(`%s %s ? ESCAPE '\'`, expr.text(), op)
+		args = append(expr.pathArg(), pattern)
+	}
+
+	// contains checks arrays, JSONB arrays with @> so numbers work too and columns as postgres text arrays
+	contains := func(sep, op string) error {
+		if !expr.jsonb() {
+			clause = fmt.Sprintf("%s %s ?::text[]", expr.column(), op)
+			args = []interface{}{pgTextArray(r.Values)}
+
+			return nil
+		}
+
+		stored, err := r.storedValues(time.RFC3339Nano)
+		if err != nil {
+			return err
+		}
+
+		var clauses []string
+
+		for _, v := range stored {
+			jsb, err := json.Marshal([]interface{}{v})
+			if err != nil {
+				return err
+			}
+
+			clauses = append(clauses, fmt.Sprintf("%s #> ?::text[] @> ?::jsonb", expr.column()))
+			args = append(args, expr.pathArg()[0], string(jsb))
+		}
+
+		clause = "(" + strings.Join(clauses, sep) + ")"
+
+		return nil
+	}
+
+	switch r.Operator {
+	case RQEquals:
+		compare("=")
+	case RQExists:
+		if expr.jsonb() {
+			clause = fmt.Sprintf("%s #> ?::text[] IS NOT NULL", expr.column())
+			args = expr.pathArg()
+		} else {
+			clause = fmt.Sprintf("%s IS NOT NULL", expr.column())
+		}
+	case RQContains:
+		like("LIKE", "%"+escapeLike(*r.Value)+"%")
+	case RQStartsWith:
+		like("LIKE", escapeLike(*r.Value)+"%")
+	case RQEndsWith:
+		like("LIKE", "%"+escapeLike(*r.Value))
+	case RQGreaterThan:
+		compare(">")
+	case RQGreaterThanOrEqual:
+		compare(">=")
+	case RQLessThan:
+		compare("<")
+	case RQLessThanOrEqual:
+		compare("<=")
+	case RQRegex:
+		if _, err := regexp.Compile(*r.Value); err != nil {
+			return "", nil, fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+		}
+
+		clause = fmt.Sprintf("%s ~ ?", expr.text())
+		args = append(expr.pathArg(), *r.Value)
+	case RQIn:
+		combine(" OR ", "=")
+	case RQBetween:
+		combine(" AND ", ">=", "<=")
+	case RQContainsAny:
+		err = contains(" OR ", "&&")
+	case RQContainsAll:
+		err = contains(" AND ", "@>")
+	case RQEqualsFold:
+		clause = fmt.Sprintf("lower(%s) = lower(?)", expr.text())
+		args = append(expr.pathArg(), *r.Value)
+	case RQContainsFold:
+		like("ILIKE", "%"+escapeLike(*r.Value)+"%")
+	case RQNull:
+		if expr.jsonb() {
+			clause = fmt.Sprintf("jsonb_typeof(%s #> ?::text[]) = 'null'", expr.column())
+			args = expr.pathArg()
+		} else {
+			clause = fmt.Sprintf("%s IS NULL", expr.column())
+		}
+	default:
+		return "", nil, fmt.Errorf("%w: unknown operator %d", ErrInvalidQuery, r.Operator)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	// IS NOT TRUE rather than NOT, so rows where the field is missing match negated queries
+	if r.Negate {
+		clause = "(" + clause + ") IS NOT TRUE"
+	}
+
+	return clause, args, nil
+}
+
+// sqlBucketFormats format timestamps like formatBucket
+var sqlBucketFormats = map[string]string{
+	BucketMinute: `YYYY-MM-DD"T"HH24:MI:00"Z"`,
+	BucketHour:   `YYYY-MM-DD"T"HH24:00:00"Z"`,
+	BucketDay:    `YYYY-MM-DD`,
+	BucketWeek:   `IYYY-"W"IW`,
+	BucketMonth:  `YYYY-MM`,
+}
+
+// inlineJSON is the JSONB value of the field with its path inlined, for select lists. Path parts are validated,
+// so they can be inlined safely
+func (e sqlExpr) inlineJSON() string {
+	if len(e.path) == 0 {
+		return e.column()
+	}
+
+	return fmt.Sprintf("%s #> '{%s}'", e.column(), strings.Join(e.path, ","))
+}
+
+// inlineText is the field as text with its path inlined
+func (e sqlExpr) inlineText() string {
+	if !e.jsonb() {
+		return e.column()
+	}
+
+	return fmt.Sprintf("(%s #>> '{%s}')", e.column(), strings.Join(e.path, ","))
+}
+
+// inlineNumber is the field as a number, or NULL for JSONB values that are not numbers
+func (e sqlExpr) inlineNumber() string {
+	if !e.jsonb() {
+		return e.column()
+	}
+
+	return fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'number' THEN %s::numeric END", e.inlineJSON(), e.inlineText())
+}
+
+// inlineBucket is the time bucket of the field, formatted in UTC
+func (e sqlExpr) inlineBucket(bucket string) string {
+	ts := e.column() + " AT TIME ZONE 'UTC'"
+
+	if e.jsonb() {
+		ts = fmt.Sprintf("(%s) AT TIME ZONE 'UTC'", sqlTimestamp(e.inlineText()))
+	}
+
+	return fmt.Sprintf("to_char(%s, '%s')", ts, sqlBucketFormats[bucket])
+}
+
+// resolveAggregate resolves fields of an aggregation, where fields under the unwound array refer to its elements
+func (f SQLFields) resolveAggregate(field, unwind string) (sqlExpr, error) {
+	if unwind == "" || (field != unwind && !strings.HasPrefix(field, unwind+".")) {
+		return f.resolve(field)
+	}
+
+	var path []string
+
+	if field != unwind {
+		path = strings.Split(strings.TrimPrefix(field, unwind+"."), ".")
+	}
+
+	for _, p := range path {
+		if !jsonPathPartRegex.MatchString(p) {
+			return sqlExpr{}, fmt.Errorf("%w: invalid path %q", ErrFieldNotAllowed, field)
+		}
+	}
+
+	return sqlExpr{name: "unwound.value", path: path, element: true}, nil
+}
+
+// SQLAggregate is an aggregation compiled to the parts of a SELECT statement, see Statement
+// Keys of JSONB fields are selected as JSONB, so they have to be decoded as json to match the rows of Aggregate
+type SQLAggregate struct {
+	Columns []string      `json:"columns"` // Select expressions, aliased with the names of the keys and aggregates
+	Join    string        `json:"join"`    // Lateral join unwinding an array, if any
+	Where   string        `json:"where"`
+	Args    []interface{} `json:"args"`
+	GroupBy []string      `json:"group_by"` // Positions of the group keys in Columns
+	Having  string        `json:"having"`
+	OrderBy []string      `json:"order_by"`
+	Limit   uint64        `json:"limit"`
+	Offset  uint64        `json:"offset"`
+}
+
+// Statement builds the SELECT statement over table, with ? placeholders for Args
+func (a *SQLAggregate) Statement(table string) (string, error) {
+	if !sqlColumnRegex.MatchString(table) {
+		return "", fmt.Errorf("%w: invalid table %q", ErrInvalidQuery, table)
+	}
+
+	stmt := fmt.Sprintf("SELECT %s FROM %s", strings.Join(a.Columns, ", "), sqlExpr{name: table}.column())
+
+	if a.Join != "" {
+		stmt += " " + a.Join
+	}
+
+	stmt += " WHERE " + a.Where
+
+	if len(a.GroupBy) > 0 {
+		stmt += " GROUP BY " + strings.Join(a.GroupBy, ", ")
+	}
+
+	if a.Having != "" {
+		stmt += " HAVING " + a.Having
+	}
+
+	if len(a.OrderBy) > 0 {
+		stmt += " ORDER BY " + strings.Join(a.OrderBy, ", ")
+	}
+
+	if a.Limit > 0 {
+		stmt += fmt.Sprintf(" LIMIT %d", a.Limit)
+	}
+
+	if a.Offset > 0 {
+		stmt += fmt.Sprintf(" OFFSET %d", a.Offset)
+	}
+
+	return stmt, nil
+}
+
+// ToSQLAggregate compiles the query's aggregation, using fields as the whitelist of fields
+func (q *ResourceQuery) ToSQLAggregate(fields SQLFields) (*SQLAggregate, error) {
+	a := q.Aggregation
+	if a == nil {
+		return nil, fmt.Errorf("%w: query has no aggregation", ErrInvalidQuery)
+	}
+
+	if err := a.validate(q); err != nil {
+		return nil, err
+	}
+
+	g := q.group()
+
+	where, args, err := g.toSQL(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLAggregate{Where: where, Args: args, Limit: q.Limit, Offset: q.Offset}
+
+	if a.Unwind != "" {
+		expr, err := fields.resolve(a.Unwind)
+		if err != nil {
+			return nil, err
+		}
+
+		array := expr.column()
+		if expr.jsonb() {
+			array = expr.inlineJSON()
+		}
+
+		s.Join = fmt.Sprintf(`CROSS JOIN LATERAL jsonb_array_elements(CASE WHEN jsonb_typeof(%[1]s) = 'array' THEN %[1]s END) AS "unwound"("value")`, array)
+	}
+
+	for i, gb := range a.GroupBy {
+		expr, err := fields.resolveAggregate(gb.Field, a.Unwind)
+		if err != nil {
+			return nil, err
+		}
+
+		// JSONB keys stay JSONB, so numbers come back and sort as numbers like they do in Aggregate
+		column := expr.inlineJSON()
+		if gb.Bucket != "" {
+			column = expr.inlineBucket(gb.Bucket)
+		}
+
+		s.Columns = append(s.Columns, fmt.Sprintf(`%s AS "%s"`, column, gb.name()))
+		s.GroupBy = append(s.GroupBy, strconv.Itoa(i+1))
+	}
+
+	for _, agg := range a.Aggregates {
+		var column string
+
+		if agg.Function == AggCount {
+			column = "COUNT(*)"
+		} else {
+			expr, err := fields.resolveAggregate(agg.Field, a.Unwind)
+			if err != nil {
+				return nil, err
+			}
+
+			switch agg.Function {
+			case AggSum:
+				column = fmt.Sprintf("COALESCE(SUM(%s), 0)", expr.inlineNumber())
+			case AggAvg:
+				column = fmt.Sprintf("AVG(%s)", expr.inlineNumber())
+			case AggMin:
+				column = fmt.Sprintf("MIN(%s)", expr.inlineNumber())
+			case AggMax:
+				column = fmt.Sprintf("MAX(%s)", expr.inlineNumber())
+			}
+		}
+
+		s.Columns = append(s.Columns, fmt.Sprintf(`%s AS "%s"`, column, agg.As))
+	}
+
+	// Without groups, SQL would return a single row even if nothing matched
+	if len(a.GroupBy) == 0 {
+		s.Having = "COUNT(*) > 0"
+	}
+
+	for _, srt := range q.Sort {
+		dir := "DESC"
+		if srt.Ascending {
+			dir = "ASC"
+		}
+
+		s.OrderBy = append(s.OrderBy, fmt.Sprintf(`"%s" %s`, srt.Field, dir))
+	}
+
+	if len(q.Sort) == 0 {
+		s.OrderBy = s.GroupBy
+	}
+
+	return s, nil
+}
@@ -0,0 +1,95 @@
+package ctypes
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testSQLFields = SQLFields{
+	"id":         {Column: "id"},
+	"created_at": {Column: "logs.created_at"},
+	"data":       {Column: "data", JSONB: true},
+}
+
+func TestResourceQuery_ToSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *ResourceQuery
+		where string
+		args  []interface{}
+	}{
+		{
+			name:  "empty",
+			query: NewResourceQuery(RQAll),
+			where: "TRUE",
+		},
+		{
+			name:  "columns",
+			query: NewResourceQuery(RQAll).Equals("id", "abc").GreaterThan("created_at", "2020-01-01"),
+			where: `("id" = ? AND "logs"."created_at" > ?)`,
+			args:  []interface{}{"abc", "2020-01-01"},
+		},
+		{
+			name:  "jsonb paths",
+			query: NewResourceQuery(RQAny).DoesNotEqual("data.user.name", "bob").Exists("data.age"),
+			where: `(((jsonb_typeof("data" #> ?::text[]) = 'string' AND "data" #> ?::text[] = to_jsonb(?::text))) IS NOT TRUE OR "data" #> ?::text[] IS NOT NULL)`,
+			args:  []interface{}{"{user,name}", "{user,name}", "bob", "{age}"},
+		},
+		{
+			name:  "jsonb numbers",
+			query: NewResourceQuery(RQAll).LessThan("data.age", "18"),
+			where: `((jsonb_typeof("data" #> ?::text[]) = 'number' AND "data" #> ?::text[] < to_jsonb(?::numeric)))`,
+			args:  []interface{}{"{age}", "{age}", int64(18)},
+		},
+		{
+			name:  "like escaping",
+			query: NewResourceQuery(RQNor).Contains("data.text", "50%_off").StartsWith("id", `a\b`),
+			where: `(("data" #>> ?::text[]) LIKE ? ESCAPE '\' OR "id" LIKE ? ESCAPE '\') IS NOT TRUE`,
+			args:  []interface{}{"{text}", `%50\%\_off%`, `a\\b%`},
+		},
+		{
+			name:  "regex",
+			query: NewResourceQuery(RQAll).MatchesRegEx("id", "^a.*"),
+			where: `("id" ~ ?)`,
+			args:  []interface{}{"^a.*"},
+		},
+	}
+
+	for _, tt := range tests {
+		s, err := tt.query.ToSQL(testSQLFields)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		if s.Where != tt.where || !reflect.DeepEqual(s.Args, tt.args) {
+			t.Errorf("%s: expected %s %v, got %s %v", tt.name, tt.where, tt.args, s.Where, s.Args)
+		}
+	}
+
+	s, err := NewResourceQuery(RQAll).SortDesc("created_at").SortAsc("data.user.name").ToSQL(testSQLFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.OrderBy) != 2 || s.OrderBy[0] != "-logs.created_at" || s.OrderBy[1].(interface{ Raw() string }).Raw() != `"data" #>> '{user,name}' ASC` {
+		t.Errorf("unexpected order %v", s.OrderBy)
+	}
+
+	invalid := []*ResourceQuery{
+		NewResourceQuery(RQAll).Equals("password", "x"),
+		NewResourceQuery(RQAll).Equals("data.a'b", "x"),
+		NewResourceQuery(RQAll).SortAsc("secret"),
+	}
+
+	for _, q := range invalid {
+		if _, err := q.ToSQL(testSQLFields); !errors.Is(err, ErrFieldNotAllowed) {
+			t.Errorf("expected %+v to be rejected, got %v", q.Queries, err)
+		}
+	}
+
+	if _, err := NewResourceQuery(RQAll).MatchesRegEx("id", "(").ToSQL(testSQLFields); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected an invalid regex to be rejected, got %v", err)
+	}
+}
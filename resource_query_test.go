@@ -1,9 +1,15 @@
 package ctypes
 
 import (
+	"encoding/json"
+	"errors"
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestResourceQueryFromURL(t *testing.T) {
@@ -140,6 +146,27 @@ func TestRQQ_ValueAsTyped(t *testing.T) {
 			},
 			want: float64(-5068.5566),
 		},
+		{
+			name: "UUID",
+			fields: fields{
+				Value: StrPtr("8c0d4fa6-4a0b-4a5e-9a6e-2a4c1b1f6d10"),
+			},
+			want: uuid.MustParse("8c0d4fa6-4a0b-4a5e-9a6e-2a4c1b1f6d10"),
+		},
+		{
+			name: "Time",
+			fields: fields{
+				Value: StrPtr("2020-05-01T10:00:00Z"),
+			},
+			want: time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "String",
+			fields: fields{
+				Value: StrPtr("floobs"),
+			},
+			want: "floobs",
+		},
 		{
 			name: "Overflow Integer",
 			fields: fields{
@@ -162,3 +189,314 @@ func TestRQQ_ValueAsTyped(t *testing.T) {
 		})
 	}
 }
+
+func TestResourceQuery_Groups(t *testing.T) {
+	u, _ := url.Parse("https://test.url?mode=any&eq.c1=3&g1.eq.a1=1&g1.eq.b1=2&g2.mode=nor&g2.g1.ex.d1&sort=c1")
+
+	q, err := ResourceQueryFromURL(u, "fp.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.FilterFields("fp.a1", "fp.b1", "fp.c1").SelectivePrefix("fp.a1", "x.")
+
+	want := &ResourceQuery{
+		Mode:    RQAny,
+		Limit:   10,
+		Queries: []RQQ{{Field: "fp.c1", Operator: RQEquals, Value: StrPtr("3")}},
+		Groups: []RQGroup{{
+			Mode: RQAll,
+			Queries: []RQQ{
+				{Field: "fp.b1", Operator: RQEquals, Value: StrPtr("2")},
+				{Field: "x.fp.a1", Operator: RQEquals, Value: StrPtr("1")},
+			},
+		}},
+		Sort: []RQSort{{Field: "fp.c1", Ascending: true}},
+	}
+
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("expected %+v, got %+v", want, q)
+	}
+
+	jsb, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ResourceQuery
+	if err := json.Unmarshal(jsb, &decoded); err != nil || !reflect.DeepEqual(&decoded, q) {
+		t.Errorf("expected the tree to survive json, got %+v %v", decoded, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"groups":[{"mode":7}]}`), &decoded); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected an unknown group mode to be rejected, got %v", err)
+	}
+
+	// (a=1 AND b=2) OR c=3
+	q = NewResourceQuery(RQAny).Equals("c", "3").Group(RQAll, func(g *ResourceQuery) {
+		g.Equals("a", "1").Equals("b", "2")
+	})
+
+	for doc, want := range map[string]bool{`{"a":1,"b":2}`: true, `{"a":1}`: false, `{"c":3}`: true} {
+		var m map[string]interface{}
+		_ = json.Unmarshal([]byte(doc), &m)
+
+		if match, err := q.Matches(m); err != nil || match != want {
+			t.Errorf("%s: expected %v, got %v %v", doc, want, match, err)
+		}
+	}
+
+	s, err := q.ToSQL(SQLFields{"a": {Column: "a"}, "b": {Column: "b"}, "c": {Column: "c"}})
+	if err != nil || s.Where != `("c" = ? OR ("a" = ? AND "b" = ?))` {
+		t.Errorf("unexpected sql %+v %v", s, err)
+	}
+}
+
+func TestRQQ_Operators(t *testing.T) {
+	u, _ := url.Parse("https://test.url?in.status=open&in.status=closed&btw:time.created=2020-01-01&btw:time.created=2020-02-01&all.tags=vip&all.tags=beta&!ieq.name=JANE&!null.deleted")
+
+	q, err := ResourceQueryFromURL(u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []RQQ{
+		{Field: "tags", Operator: RQContainsAll, Values: []string{"vip", "beta"}},
+		{Field: "status", Operator: RQIn, Values: []string{"open", "closed"}},
+		{Field: "name", Operator: RQEqualsFold, Value: StrPtr("JANE"), Negate: true},
+		{Field: "deleted", Operator: RQNull, Negate: true},
+		{Field: "created", Operator: RQBetween, Values: []string{"2020-01-01", "2020-02-01"}, Type: RQTypeTime},
+	}
+
+	if !reflect.DeepEqual(q.Queries, want) {
+		t.Errorf("expected %+v, got %+v", want, q.Queries)
+	}
+
+	docs := map[string]bool{
+		`{"tags":["vip","beta","x"],"status":"open","name":"Joe","deleted":null,"created":"2020-01-15T00:00:00Z"}`:  false,
+		`{"tags":["vip","beta","x"],"status":"open","name":"Joe","deleted":false,"created":"2020-01-15T00:00:00Z"}`: true,
+		`{"tags":["vip","beta"],"status":"open","name":"jane","deleted":false,"created":"2020-01-15T00:00:00Z"}`:    false,
+		`{"tags":["vip"],"status":"open","name":"Joe","deleted":false,"created":"2020-01-15T00:00:00Z"}`:            false,
+		`{"tags":["vip","beta"],"status":"draft","name":"Joe","deleted":false,"created":"2020-01-15T00:00:00Z"}`:    false,
+		`{"tags":["vip","beta"],"status":"closed","name":"Joe","created":"2020-03-15T00:00:00Z"}`:                   false,
+		`{"tags":["vip","beta"],"status":"closed","name":"Joe"}`:                                                    false,
+	}
+
+	for doc, want := range docs {
+		var m map[string]interface{}
+		_ = json.Unmarshal([]byte(doc), &m)
+
+		if match, err := q.Matches(m); err != nil || match != want {
+			t.Errorf("%s: expected %v, got %v %v", doc, want, match, err)
+		}
+	}
+
+	filter, _, err := NewResourceQuery(RQAll).In("n", "1", "x").ContainsAll("tags", "a").EqualsIgnoreCase("name", "a.b").IsNull("d").ToMongo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFilter := bson.M{"$and": bson.A{
+		bson.M{"n": bson.M{"$in": bson.A{int64(1), "x"}}},
+		bson.M{"tags": bson.M{"$all": bson.A{"a"}}},
+		bson.M{"name": bson.M{"$regex": `^a\.b$`, "$options": "i"}},
+		bson.M{"d": bson.M{"$type": "null"}},
+	}}
+
+	if !reflect.DeepEqual(filter, wantFilter) {
+		t.Errorf("expected %v, got %v", wantFilter, filter)
+	}
+
+	fields := SQLFields{"tags": {Column: "tags"}, "data": {Column: "data", JSONB: true}}
+
+	s, err := NewResourceQuery(RQAll).ContainsAny("tags", `a"b`, "c").ContainsAll("data.tags", "1").GreaterThan("data.at", "2020-01-01").OfType(RQTypeTime).ToSQL(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantWhere := `("tags" && ?::text[] AND ("data" #> ?::text[] @> ?::jsonb) AND CASE WHEN ("data" #>> '{at}') ~ '^\d{4}-\d{2}-\d{2}' THEN (CASE WHEN ("data" #>> '{at}') ~ '(Z|[+-]\d{2}(:?\d{2})?)$' THEN ("data" #>> '{at}')::timestamptz ELSE ("data" #>> '{at}')::timestamp AT TIME ZONE 'UTC' END) END > ?)`
+	wantArgs := []interface{}{`{"a\"b","c"}`, "{tags}", "[1]", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	if s.Where != wantWhere || !reflect.DeepEqual(s.Args, wantArgs) {
+		t.Errorf("unexpected sql %s %v", s.Where, s.Args)
+	}
+
+	invalid := []*ResourceQuery{
+		{Queries: []RQQ{{Field: "a", Operator: RQBetween, Values: []string{"1"}}}},
+		NewResourceQuery(RQAll).In("a"),
+		NewResourceQuery(RQAll).Equals("a", "x").OfType(RQTypeNumber),
+		NewResourceQuery(RQAll).Equals("a", "x").OfType("date"),
+	}
+
+	for _, q := range invalid {
+		if _, err := q.Matches(map[string]interface{}{}); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("expected %+v to be invalid, got %v", q.Queries, err)
+		}
+	}
+}
+
+func TestRQQ_OperatorsAcrossBackends(t *testing.T) {
+	var doc map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"data":{"name":"Jane","age":31,"tags":["vip","beta"],"at":"2020-01-15T00:00:00.000000","note":null}}`), &doc)
+
+	fields := SQLFields{"data": {Column: "data", JSONB: true}}
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := `CASE WHEN ("data" #>> '{at}') ~ '^\d{4}-\d{2}-\d{2}' THEN (CASE WHEN ("data" #>> '{at}') ~ '(Z|[+-]\d{2}(:?\d{2})?)$' THEN ("data" #>> '{at}')::timestamptz ELSE ("data" #>> '{at}')::timestamp AT TIME ZONE 'UTC' END) END`
+
+	tests := []struct {
+		query *ResourceQuery
+		match bool
+		where string
+		args  []interface{}
+		mongo bson.M
+	}{
+		{
+			query: NewResourceQuery(RQAll).Equals("data.age", "31"),
+			match: true,
+			where: `(jsonb_typeof("data" #> ?::text[]) = 'number' AND "data" #> ?::text[] = to_jsonb(?::numeric))`,
+			args:  []interface{}{"{age}", "{age}", int64(31)},
+			mongo: bson.M{"data.age": bson.M{"$eq": int64(31)}},
+		},
+		{
+			query: NewResourceQuery(RQAll).Equals("data.age", "31").OfType(RQTypeString),
+			match: false,
+			where: `(jsonb_typeof("data" #> ?::text[]) = 'string' AND "data" #> ?::text[] = to_jsonb(?::text))`,
+			args:  []interface{}{"{age}", "{age}", "31"},
+			mongo: bson.M{"data.age": bson.M{"$eq": "31"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).Exists("data.note"),
+			match: true,
+			where: `"data" #> ?::text[] IS NOT NULL`,
+			args:  []interface{}{"{note}"},
+			mongo: bson.M{"data.note": bson.M{"$exists": true}},
+		},
+		{
+			query: NewResourceQuery(RQAll).Contains("data.name", "an"),
+			match: true,
+			where: `("data" #>> ?::text[]) LIKE ? ESCAPE '\'`,
+			args:  []interface{}{"{name}", "%an%"},
+			mongo: bson.M{"data.name": bson.M{"$regex": "an"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).StartsWith("data.name", "Ja"),
+			match: true,
+			where: `("data" #>> ?::text[]) LIKE ? ESCAPE '\'`,
+			args:  []interface{}{"{name}", "Ja%"},
+			mongo: bson.M{"data.name": bson.M{"$regex": "^Ja"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).EndsWith("data.name", "an"),
+			match: false,
+			where: `("data" #>> ?::text[]) LIKE ? ESCAPE '\'`,
+			args:  []interface{}{"{name}", "%an"},
+			mongo: bson.M{"data.name": bson.M{"$regex": "an$"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).GreaterThan("data.at", "2020-01-01T00:00:00Z"),
+			match: true,
+			where: ts + ` > ?`,
+			args:  []interface{}{at},
+			mongo: bson.M{"data.at": bson.M{"$gt": "2020-01-01T00:00:00.000000"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).GreaterThanOrEqualTo("data.age", "31"),
+			match: true,
+			where: `(jsonb_typeof("data" #> ?::text[]) = 'number' AND "data" #> ?::text[] >= to_jsonb(?::numeric))`,
+			args:  []interface{}{"{age}", "{age}", int64(31)},
+			mongo: bson.M{"data.age": bson.M{"$gte": int64(31)}},
+		},
+		{
+			query: NewResourceQuery(RQAll).LessThan("data.age", "30.5"),
+			match: false,
+			where: `(jsonb_typeof("data" #> ?::text[]) = 'number' AND "data" #> ?::text[] < to_jsonb(?::numeric))`,
+			args:  []interface{}{"{age}", "{age}", 30.5},
+			mongo: bson.M{"data.age": bson.M{"$lt": 30.5}},
+		},
+		{
+			query: NewResourceQuery(RQAll).LessThanOrEqualTo("data.name", "K"),
+			match: true,
+			where: `(jsonb_typeof("data" #> ?::text[]) = 'string' AND "data" #> ?::text[] <= to_jsonb(?::text))`,
+			args:  []interface{}{"{name}", "{name}", "K"},
+			mongo: bson.M{"data.name": bson.M{"$lte": "K"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).MatchesRegEx("data.name", `^J\w+`),
+			match: true,
+			where: `("data" #>> ?::text[]) ~ ?`,
+			args:  []interface{}{"{name}", `^J\w+`},
+			mongo: bson.M{"data.name": bson.M{"$regex": `^J\w+`}},
+		},
+		{
+			query: NewResourceQuery(RQAll).In("data.name", "Joe", "Jane"),
+			match: true,
+			where: `((jsonb_typeof("data" #> ?::text[]) = 'string' AND "data" #> ?::text[] = to_jsonb(?::text)) OR (jsonb_typeof("data" #> ?::text[]) = 'string' AND "data" #> ?::text[] = to_jsonb(?::text)))`,
+			args:  []interface{}{"{name}", "{name}", "Joe", "{name}", "{name}", "Jane"},
+			mongo: bson.M{"data.name": bson.M{"$in": bson.A{"Joe", "Jane"}}},
+		},
+		{
+			query: NewResourceQuery(RQAll).Between("data.at", "2020-01-01", "2020-01-31").OfType(RQTypeTime),
+			match: true,
+			where: `(` + ts + ` >= ? AND ` + ts + ` <= ?)`,
+			args:  []interface{}{at, time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)},
+			mongo: bson.M{"data.at": bson.M{"$gte": "2020-01-01T00:00:00.000000", "$lte": "2020-01-31T00:00:00.000000"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).ContainsAny("data.tags", "x", "vip"),
+			match: true,
+			where: `("data" #> ?::text[] @> ?::jsonb OR "data" #> ?::text[] @> ?::jsonb)`,
+			args:  []interface{}{"{tags}", `["x"]`, "{tags}", `["vip"]`},
+			mongo: bson.M{"data.tags": bson.M{"$in": bson.A{"x", "vip"}}},
+		},
+		{
+			query: NewResourceQuery(RQAll).ContainsAll("data.tags", "x", "vip"),
+			match: false,
+			where: `("data" #> ?::text[] @> ?::jsonb AND "data" #> ?::text[] @> ?::jsonb)`,
+			args:  []interface{}{"{tags}", `["x"]`, "{tags}", `["vip"]`},
+			mongo: bson.M{"data.tags": bson.M{"$all": bson.A{"x", "vip"}}},
+		},
+		{
+			query: NewResourceQuery(RQAll).EqualsIgnoreCase("data.name", "JANE"),
+			match: true,
+			where: `lower(("data" #>> ?::text[])) = lower(?)`,
+			args:  []interface{}{"{name}", "JANE"},
+			mongo: bson.M{"data.name": bson.M{"$regex": "^JANE$", "$options": "i"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).ContainsIgnoreCase("data.name", "AN"),
+			match: true,
+			where: `("data" #>> ?::text[]) ILIKE ? ESCAPE '\'`,
+			args:  []interface{}{"{name}", "%AN%"},
+			mongo: bson.M{"data.name": bson.M{"$regex": "AN", "$options": "i"}},
+		},
+		{
+			query: NewResourceQuery(RQAll).IsNull("data.note"),
+			match: true,
+			where: `jsonb_typeof("data" #> ?::text[]) = 'null'`,
+			args:  []interface{}{"{note}"},
+			mongo: bson.M{"data.note": bson.M{"$type": "null"}},
+		},
+	}
+
+	for _, tt := range tests {
+		rqq := tt.query.Queries[0]
+
+		if match, err := tt.query.Matches(doc); err != nil || match != tt.match {
+			t.Errorf("%+v: expected match %v, got %v %v", rqq, tt.match, match, err)
+		}
+
+		s, err := tt.query.ToSQL(fields)
+		if err != nil {
+			t.Errorf("%+v: %s", rqq, err)
+		} else if s.Where != "("+tt.where+")" || !reflect.DeepEqual(s.Args, tt.args) {
+			t.Errorf("%+v: expected sql %s %v, got %s %v", rqq, tt.where, tt.args, s.Where, s.Args)
+		}
+
+		filter, _, err := tt.query.ToMongo()
+		if err != nil {
+			t.Errorf("%+v: %s", rqq, err)
+		} else if want := (bson.M{"$and": bson.A{tt.mongo}}); !reflect.DeepEqual(filter, want) {
+			t.Errorf("%+v: expected mongo %v, got %v", rqq, want, filter)
+		}
+	}
+}
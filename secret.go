@@ -0,0 +1,361 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// SecretRefKey is the only key of a secret reference, {"$secret": "name"}
+const SecretRefKey = "$secret"
+
+// RedactedSecret replaces secret values in serialized output
+const RedactedSecret = "********"
+
+var ErrSecretNotFound = errors.New("secret does not exist")
+
+// SecretRef points to a value held by a SecretStore, so the value itself never has to be stored in an environment
+type SecretRef struct {
+	Name string `json:"$secret"`
+}
+
+// SecretRefName returns the name of the secret value refers to, if it is a secret reference
+func SecretRefName(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case SecretRef:
+		return v.Name, true
+	case *SecretRef:
+		if v == nil {
+			return "", false
+		}
+
+		return v.Name, true
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return "", false
+		}
+
+		name, ok := v[SecretRefKey].(string)
+
+		return name, ok
+	}
+
+	return "", false
+}
+
+// SecretStore holds the secret values of environments
+type SecretStore interface {
+	Secret(environmentID uuid.UUID, name string) (string, error)
+}
+
+// MapSecretStore is a SecretStore kept in memory, keyed by environment id and secret name
+type MapSecretStore map[uuid.UUID]map[string]string
+
+func (m MapSecretStore) Secret(environmentID uuid.UUID, name string) (string, error) {
+	value, ok := m[environmentID][name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+
+	return value, nil
+}
+
+// SecretValue is a resolved secret. It is redacted when serialized or printed, Reveal returns the actual value
+// Resolved values are never written back to the database, as encoding them only writes RedactedSecret
+type SecretValue string
+
+func (s SecretValue) Reveal() string {
+	return string(s)
+}
+
+func (s SecretValue) String() string {
+	return RedactedSecret
+}
+
+func (s SecretValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(RedactedSecret)
+}
+
+// SecretRefs lists the names of every secret referenced in value, sorted and without duplicates
+func SecretRefs(value interface{}) []string {
+	seen := map[string]bool{}
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		if name, ok := SecretRefName(v); ok {
+			seen[name] = true
+			return
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		}
+	}
+
+	walk(normalizeJSONValue(value))
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// resolveSecretRefs returns a copy of value with every secret reference replaced by a SecretValue
+func resolveSecretRefs(value interface{}, resolve func(name string) (string, error)) (interface{}, error) {
+	if name, ok := SecretRefName(value); ok {
+		secret, err := resolve(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return SecretValue(secret), nil
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(v))
+
+		for k, c := range v {
+			r, err := resolveSecretRefs(c, resolve)
+			if err != nil {
+				return nil, err
+			}
+
+			resolved[k] = r
+		}
+
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+
+		for i, c := range v {
+			r, err := resolveSecretRefs(c, resolve)
+			if err != nil {
+				return nil, err
+			}
+
+			resolved[i] = r
+		}
+
+		return resolved, nil
+	}
+
+	return value, nil
+}
+
+// RevealSecrets returns a copy of value with every SecretValue replaced by the actual secret
+// It is meant for the config sent to a package, which needs the real values
+func RevealSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case SecretValue:
+		return v.Reveal()
+	case map[string]interface{}:
+		revealed := make(map[string]interface{}, len(v))
+
+		for k, c := range v {
+			revealed[k] = RevealSecrets(c)
+		}
+
+		return revealed
+	case []interface{}:
+		revealed := make([]interface{}, len(v))
+
+		for i, c := range v {
+			revealed[i] = RevealSecrets(c)
+		}
+
+		return revealed
+	}
+
+	return value
+}
+
+// ResolveSecrets returns the package settings of the environment with secret references resolved from store
+// The resolved settings hold SecretValues, use RevealSecrets before sending them to a package
+func (e *DBEnvironment) ResolveSecrets(store SecretStore) (EnvironmentData, error) {
+	resolved := make(EnvironmentData, len(e.Data))
+
+	for packageID, settings := range e.Data {
+		r, err := resolveSecretRefs(normalizeJSONValue(settings), func(name string) (string, error) {
+			return store.Secret(e.ID, name)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", packageID, err)
+		}
+
+		resolved[packageID] = r
+	}
+
+	return resolved, nil
+}
+
+// MissingSecrets lists the secrets the environment references that store does not have
+func (e *DBEnvironment) MissingSecrets(store SecretStore) []string {
+	var missing []string
+
+	for _, settings := range e.Data {
+		for _, name := range SecretRefs(settings) {
+			if _, err := store.Secret(e.ID, name); err != nil && !StringSliceContains(missing, name) {
+				missing = append(missing, name)
+			}
+		}
+	}
+
+	sort.Strings(missing)
+
+	return missing
+}
+
+// Redacted returns a copy of the environment where values of secret fields that were stored in plain text are
+// replaced with RedactedSecret. Secret references are kept, as they only hold names
+// Without schemas there is no telling which settings are secret, so every plain setting value is redacted
+func (e *DBEnvironment) Redacted(schemas *ConfigSchemas) *DBEnvironment {
+	redacted := *e
+	redacted.schemas = schemas
+
+	if e.Data == nil {
+		return &redacted
+	}
+
+	redacted.Data = make(EnvironmentData, len(e.Data))
+
+	for packageID, settings := range e.Data {
+		if schemas == nil {
+			redacted.Data[packageID] = redactPlain(normalizeJSONValue(settings))
+			continue
+		}
+
+		schema := schemas.Settings(packageID)
+		if schema == nil {
+			redacted.Data[packageID] = settings
+			continue
+		}
+
+		redacted.Data[packageID] = schema.redact(normalizeJSONValue(settings))
+	}
+
+	return &redacted
+}
+
+// MarshalJSON redacts the secret settings of the environment, using the schemas it was redacted with if any
+func (e DBEnvironment) MarshalJSON() ([]byte, error) {
+	type dbEnvironment DBEnvironment
+
+	return json.Marshal(dbEnvironment(*e.Redacted(e.schemas)))
+}
+
+// MarshalJSON redacts the secret settings of the environment, see DBEnvironment.MarshalJSON
+func (e APIEnvironment) MarshalJSON() ([]byte, error) {
+	type dbEnvironment DBEnvironment
+
+	var env *dbEnvironment
+	if e.DBEnvironment != nil {
+		redacted := dbEnvironment(*e.Redacted(e.schemas))
+		env = &redacted
+	}
+
+	return json.Marshal(struct {
+		*dbEnvironment
+		Blueprint *DBBlueprint `json:"blueprint"`
+	}{env, e.Blueprint})
+}
+
+// redactPlain replaces every value that is not a secret reference with RedactedSecret
+func redactPlain(value interface{}) interface{} {
+	if _, ok := SecretRefName(value); ok || value == nil {
+		return value
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+
+		for k, c := range v {
+			redacted[k] = redactPlain(c)
+		}
+
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+
+		for i, c := range v {
+			redacted[i] = redactPlain(c)
+		}
+
+		return redacted
+	}
+
+	return RedactedSecret
+}
+
+func (s *ConfigSchema) redact(value interface{}) interface{} {
+	if _, ok := SecretRefName(value); ok || value == nil {
+		return value
+	}
+
+	if s.Secret {
+		return RedactedSecret
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+
+		for k, c := range v {
+			if prop, ok := s.Properties[k]; ok {
+				redacted[k] = prop.redact(c)
+			} else {
+				redacted[k] = c
+			}
+		}
+
+		return redacted
+	case []interface{}:
+		if s.Items == nil {
+			return v
+		}
+
+		redacted := make([]interface{}, len(v))
+
+		for i, c := range v {
+			redacted[i] = s.Items.redact(c)
+		}
+
+		return redacted
+	}
+
+	return value
+}
+
+// MarshalJSON redacts the secret settings of every environment, using the settings schemas of the bot's packages
+func (b APIBot) MarshalJSON() ([]byte, error) {
+	type apiBot APIBot
+
+	schemas := NewConfigSchemas(b.Packages)
+
+	redacted := apiBot(b)
+
+	if b.Environments != nil {
+		redacted.Environments = make(DBEnvironments, len(b.Environments))
+
+		for i := range b.Environments {
+			redacted.Environments[i] = *b.Environments[i].Redacted(schemas)
+		}
+	}
+
+	return json.Marshal(redacted)
+}
@@ -0,0 +1,193 @@
+package ctypes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestConfigSchema_ValidateSecrets(t *testing.T) {
+	pkgID := uuid.Must(uuid.NewRandom())
+
+	env := DBEnvironment{
+		ID: uuid.Must(uuid.NewRandom()),
+		Data: EnvironmentData{pkgID: map[string]interface{}{
+			"workspace": "acme",
+			"token":     map[string]interface{}{SecretRefKey: "slack_token"},
+		}},
+	}
+
+	bot := &APIBot{
+		DBBot:        &DBBot{ID: uuid.Must(uuid.NewRandom())},
+		Environments: DBEnvironments{env},
+		Packages: []Package{{
+			DBPackage: DBPackage{ID: pkgID},
+			SettingsSchema: &ConfigSchema{
+				Type: SchemaObject,
+				Properties: map[string]*ConfigSchema{
+					"workspace": {Type: SchemaString},
+					"token":     {Type: SchemaString, Secret: true},
+				},
+			},
+		}},
+	}
+
+	schemas := NewConfigSchemas(bot.Packages)
+
+	if err := schemas.ValidateEnvironmentData(env.Data); err != nil {
+		t.Errorf("expected secret references to be valid, got %v", err)
+	}
+
+	plain := map[string]interface{}{"token": "xoxb-123"}
+	if err := schemas.ValidateEnvironmentPackageConfig(pkgID, plain); err == nil || !strings.Contains(err.Error(), "secret reference") {
+		t.Errorf("expected plain secret to be rejected, got %v", err)
+	}
+
+	stringRef := map[string]interface{}{"workspace": SecretRef{Name: "ws"}}
+	if err := schemas.ValidateEnvironmentPackageConfig(pkgID, stringRef); err != nil {
+		t.Errorf("expected a secret reference in a string field to be valid, got %v", err)
+	}
+
+	if form := bot.Packages[0].SettingsSchema.Form(); form.Fields[0].Widget != WidgetSecret {
+		t.Errorf("expected a secret widget, got %+v", form.Fields[0])
+	}
+}
+
+func TestDBEnvironment_ResolveSecrets(t *testing.T) {
+	pkgID := uuid.Must(uuid.NewRandom())
+
+	env := DBEnvironment{
+		ID: uuid.Must(uuid.NewRandom()),
+		Data: EnvironmentData{pkgID: map[string]interface{}{
+			"workspace": "acme",
+			"token":     map[string]interface{}{SecretRefKey: "slack_token"},
+		}},
+	}
+
+	store := MapSecretStore{env.ID: {"slack_token": "xoxb-123"}}
+
+	resolved, err := env.ResolveSecrets(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := resolved[pkgID].(map[string]interface{})
+	if settings["token"] != SecretValue("xoxb-123") {
+		t.Fatalf("expected resolved secret, got %#v", settings["token"])
+	}
+
+	jsb, _ := json.Marshal(resolved)
+	if strings.Contains(string(jsb), "xoxb") || fmt.Sprint(settings["token"]) != RedactedSecret {
+		t.Errorf("expected resolved secret to be redacted, got %s", jsb)
+	}
+
+	revealed := RevealSecrets(settings).(map[string]interface{})
+	if revealed["token"] != "xoxb-123" {
+		t.Errorf("expected revealed secret, got %#v", revealed["token"])
+	}
+
+	if _, err := env.ResolveSecrets(MapSecretStore{}); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("expected ErrSecretNotFound, got %v", err)
+	}
+
+	if missing := env.MissingSecrets(MapSecretStore{}); !reflect.DeepEqual(missing, []string{"slack_token"}) {
+		t.Errorf("expected slack_token to be missing, got %v", missing)
+	}
+}
+
+func TestAPIBot_MarshalJSON(t *testing.T) {
+	pkgID := uuid.Must(uuid.NewRandom())
+
+	env := DBEnvironment{
+		ID:   uuid.Must(uuid.NewRandom()),
+		Data: EnvironmentData{pkgID: map[string]interface{}{"workspace": "acme", "token": "xoxb-123"}},
+	}
+
+	bot := &APIBot{
+		DBBot:        &DBBot{ID: uuid.Must(uuid.NewRandom())},
+		Environments: DBEnvironments{env},
+		Packages: []Package{{
+			DBPackage: DBPackage{ID: pkgID},
+			SettingsSchema: &ConfigSchema{
+				Type: SchemaObject,
+				Properties: map[string]*ConfigSchema{
+					"workspace": {Type: SchemaString},
+					"token":     {Type: SchemaString, Secret: true},
+				},
+			},
+		}},
+	}
+
+	jsb, err := json.Marshal(bot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(jsb), "xoxb") || !strings.Contains(string(jsb), "acme") || !strings.Contains(string(jsb), RedactedSecret) {
+		t.Errorf("expected only the token to be redacted, got %s", jsb)
+	}
+
+	if bot.Environments[0].Data[pkgID].(map[string]interface{})["token"] != "xoxb-123" {
+		t.Error("expected marshalling not to modify the bot")
+	}
+}
+
+func TestDBEnvironment_MarshalJSON(t *testing.T) {
+	pkgID := uuid.Must(uuid.NewRandom())
+
+	env := DBEnvironment{
+		ID: uuid.Must(uuid.NewRandom()),
+		Data: EnvironmentData{pkgID: map[string]interface{}{
+			"workspace": "acme",
+			"token":     "xoxb-123",
+			"signing":   map[string]interface{}{SecretRefKey: "slack_signing"},
+		}},
+	}
+
+	// Without schemas every plain setting is redacted, secret references are kept
+	for _, v := range []interface{}{env, &env, APIEnvironment{DBEnvironment: &env}} {
+		jsb, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(jsb), "xoxb") || strings.Contains(string(jsb), "acme") || !strings.Contains(string(jsb), "slack_signing") {
+			t.Errorf("expected plain settings to be redacted, got %s", jsb)
+		}
+	}
+
+	schemas := NewConfigSchemas([]Package{{
+		DBPackage: DBPackage{ID: pkgID},
+		SettingsSchema: &ConfigSchema{
+			Type: SchemaObject,
+			Properties: map[string]*ConfigSchema{
+				"workspace": {Type: SchemaString},
+				"token":     {Type: SchemaString, Secret: true},
+			},
+		},
+	}})
+
+	jsb, err := json.Marshal(APIEnvironment{DBEnvironment: env.Redacted(schemas), Blueprint: &DBBlueprint{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(jsb), "xoxb") || !strings.Contains(string(jsb), "acme") || !strings.Contains(string(jsb), `"blueprint":{`) {
+		t.Errorf("expected only the token to be redacted, got %s", jsb)
+	}
+
+	// Stored environments keep their settings
+	stored, err := DBEnvironments{env}.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(fmt.Sprint(stored), "xoxb-123") {
+		t.Errorf("expected stored environments not to be redacted, got %s", stored)
+	}
+}
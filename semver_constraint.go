@@ -0,0 +1,473 @@
+package ctypes
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+var (
+	ErrInvalidConstraint = errors.New("invalid version constraint")
+	ErrNoMatchingVersion = errors.New("no version matches constraint")
+)
+
+// SemverConstraint is a version range such as "^1.2", "~0.3.1", ">=1.0 <2.0", "1.x" or "^1.0 || ^2.0"
+// Terms separated by spaces must all match, groups separated by || are alternatives
+type SemverConstraint struct {
+	raw    string
+	groups [][]semverComparator
+}
+
+type semverComparator struct {
+	op      string // One of = > >= < <=
+	version semver.Version
+}
+
+func (c semverComparator) check(v semver.Version) bool {
+	switch c.op {
+	case ">":
+		return v.GT(c.version)
+	case ">=":
+		return v.GTE(c.version)
+	case "<":
+		return v.LT(c.version)
+	case "<=":
+		return v.LTE(c.version)
+	}
+
+	return v.EQ(c.version)
+}
+
+// ParseSemverConstraint parses a constraint. An empty constraint or "*" matches every release version
+func ParseSemverConstraint(s string) (*SemverConstraint, error) {
+	c := &SemverConstraint{raw: strings.TrimSpace(s)}
+
+	for _, group := range strings.Split(c.raw, "||") {
+		var comparators []semverComparator
+
+		terms := joinOperators(strings.Fields(group))
+
+		for i := 0; i < len(terms); i++ {
+			// Hyphen ranges, "1.0 - 2.0"
+			if i+2 < len(terms) && terms[i+1] == "-" {
+				lower, err := expandTerm(">=" + terms[i])
+				if err != nil {
+					return nil, err
+				}
+
+				upper, err := expandTerm("<=" + terms[i+2])
+				if err != nil {
+					return nil, err
+				}
+
+				comparators = append(comparators, lower...)
+				comparators = append(comparators, upper...)
+				i += 2
+
+				continue
+			}
+
+			expanded, err := expandTerm(terms[i])
+			if err != nil {
+				return nil, err
+			}
+
+			comparators = append(comparators, expanded...)
+		}
+
+		c.groups = append(c.groups, comparators)
+	}
+
+	return c, nil
+}
+
+// joinOperators attaches operators written with a space, as in ">= 1.0", to their version
+func joinOperators(terms []string) []string {
+	var joined []string
+
+	for i := 0; i < len(terms); i++ {
+		switch terms[i] {
+		case ">=", "<=", ">", "<", "=", "^", "~":
+			if i+1 < len(terms) {
+				joined = append(joined, terms[i]+terms[i+1])
+				i++
+
+				continue
+			}
+		}
+
+		joined = append(joined, terms[i])
+	}
+
+	return joined
+}
+
+// MustParseSemverConstraint is like ParseSemverConstraint but panics if the constraint is invalid
+func MustParseSemverConstraint(s string) *SemverConstraint {
+	c, err := ParseSemverConstraint(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// partialVersion is a version where trailing parts may be missing or wildcards, such as "1", "1.2" or "1.x"
+type partialVersion struct {
+	parts   int // Number of parts that were given
+	version semver.Version
+}
+
+func parsePartialVersion(s string) (partialVersion, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "=")
+
+	if s == "" || s == "*" || s == "x" || s == "X" {
+		return partialVersion{}, nil
+	}
+
+	// Anything with a prerelease or build must be a full version
+	if strings.ContainsAny(s, "-+") {
+		v, err := semver.Parse(s)
+		if err != nil {
+			return partialVersion{}, fmt.Errorf("%w: %s", ErrInvalidConstraint, err)
+		}
+
+		return partialVersion{parts: 3, version: v}, nil
+	}
+
+	var p partialVersion
+	nums := make([]uint64, 3)
+
+	for i, part := range strings.Split(s, ".") {
+		if i > 2 {
+			return p, fmt.Errorf("%w: too many parts in %q", ErrInvalidConstraint, s)
+		}
+
+		if part == "*" || part == "x" || part == "X" {
+			break
+		}
+
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("%w: %q", ErrInvalidConstraint, s)
+		}
+
+		nums[i] = n
+		p.parts++
+	}
+
+	p.version = semver.Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}
+
+	return p, nil
+}
+
+// next returns the smallest version above every version the partial version covers
+func (p partialVersion) next() semver.Version {
+	switch p.parts {
+	case 1:
+		return semver.Version{Major: p.version.Major + 1}
+	case 2:
+		return semver.Version{Major: p.version.Major, Minor: p.version.Minor + 1}
+	}
+
+	return semver.Version{Major: p.version.Major, Minor: p.version.Minor, Patch: p.version.Patch + 1}
+}
+
+// expandTerm turns a single term into the comparators it stands for
+func expandTerm(term string) ([]semverComparator, error) {
+	op := ""
+
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, prefix) {
+			op = prefix
+			term = strings.TrimPrefix(term, prefix)
+			break
+		}
+	}
+
+	p, err := parsePartialVersion(term)
+	if err != nil {
+		return nil, err
+	}
+
+	lower := semverComparator{op: ">=", version: p.version}
+
+	// Wildcards match everything
+	if p.parts == 0 {
+		switch op {
+		case "<", ">":
+			return nil, fmt.Errorf("%w: %s*", ErrInvalidConstraint, op)
+		}
+
+		return []semverComparator{{op: ">=", version: semver.Version{}}}, nil
+	}
+
+	switch op {
+	case "^":
+		// Changes that do not modify the left-most non-zero part
+		upper := semver.Version{Major: p.version.Major + 1}
+
+		switch {
+		case p.version.Major == 0 && (p.parts == 1 || p.version.Minor == 0 && p.parts == 2):
+			upper = p.next()
+		case p.version.Major == 0 && p.version.Minor == 0:
+			upper = semver.Version{Patch: p.version.Patch + 1}
+		case p.version.Major == 0:
+			upper = semver.Version{Minor: p.version.Minor + 1}
+		}
+
+		return []semverComparator{lower, {op: "<", version: upper}}, nil
+	case "~":
+		// Patch level changes if a minor version is given, minor level changes otherwise
+		upper := semver.Version{Major: p.version.Major, Minor: p.version.Minor + 1}
+		if p.parts == 1 {
+			upper = semver.Version{Major: p.version.Major + 1}
+		}
+
+		return []semverComparator{lower, {op: "<", version: upper}}, nil
+	case ">":
+		if p.parts < 3 {
+			return []semverComparator{{op: ">=", version: p.next()}}, nil
+		}
+	case "<=":
+		if p.parts < 3 {
+			return []semverComparator{{op: "<", version: p.next()}}, nil
+		}
+	case "", "=":
+		if p.parts < 3 {
+			return []semverComparator{lower, {op: "<", version: p.next()}}, nil
+		}
+
+		op = "="
+	}
+
+	return []semverComparator{{op: op, version: p.version}}, nil
+}
+
+// Check reports whether v satisfies the constraint
+// Prerelease versions only match if a term of the same group names a prerelease of the same major.minor.patch
+func (c *SemverConstraint) Check(v semver.Version) bool {
+	for _, group := range c.groups {
+		if checkGroup(group, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkGroup(group []semverComparator, v semver.Version) bool {
+	for _, comp := range group {
+		if !comp.check(v) {
+			return false
+		}
+	}
+
+	if len(v.Pre) == 0 {
+		return true
+	}
+
+	for _, comp := range group {
+		cv := comp.version
+		if len(cv.Pre) > 0 && cv.Major == v.Major && cv.Minor == v.Minor && cv.Patch == v.Patch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckString is like Check but takes an unparsed version. Invalid versions never match
+func (c *SemverConstraint) CheckString(version string) bool {
+	v, err := semver.Parse(version)
+	if err != nil {
+		return false
+	}
+
+	return c.Check(v)
+}
+
+// Best returns the highest of versions that satisfies the constraint
+func (c *SemverConstraint) Best(versions []string) (string, error) {
+	best := ""
+	var bestVersion semver.Version
+
+	for _, version := range versions {
+		v, err := semver.Parse(version)
+		if err != nil || !c.Check(v) {
+			continue
+		}
+
+		if best == "" || v.GT(bestVersion) {
+			best, bestVersion = version, v
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("%w: %s", ErrNoMatchingVersion, c)
+	}
+
+	return best, nil
+}
+
+func (c *SemverConstraint) String() string {
+	if c.raw == "" {
+		return "*"
+	}
+
+	return c.raw
+}
+
+func (c *SemverConstraint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *SemverConstraint) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseSemverConstraint(s)
+	if err != nil {
+		return err
+	}
+
+	*c = *parsed
+
+	return nil
+}
+
+func (c SemverConstraint) Value() (driver.Value, error) {
+	return c.String(), nil
+}
+
+func (c *SemverConstraint) Scan(src interface{}) error {
+	var s string
+
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a version constraint", src)
+	}
+
+	parsed, err := ParseSemverConstraint(s)
+	if err != nil {
+		return err
+	}
+
+	*c = *parsed
+
+	return nil
+}
+
+var (
+	_ driver.Valuer = &SemverConstraint{}
+	_ sql.Scanner   = &SemverConstraint{}
+)
+
+// ResolveNode picks the highest version of a node type that satisfies constraint
+func (p *Package) ResolveNode(typeID, constraint string) (*DBNode, error) {
+	c, err := ParseSemverConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+
+	for _, n := range p.Nodes {
+		if n.TypeID == typeID {
+			versions = append(versions, n.Version)
+		}
+	}
+
+	version, err := c.Best(versions)
+	if err != nil {
+		return nil, fmt.Errorf("node %s: %w", typeID, err)
+	}
+
+	for i := range p.Nodes {
+		if p.Nodes[i].TypeID == typeID && p.Nodes[i].Version == version {
+			node := p.Nodes[i]
+			node.PackageID = p.ID
+
+			return &node, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ResolveLink picks the highest version of a link type that satisfies constraint
+func (p *Package) ResolveLink(typeID, constraint string) (*DBLink, error) {
+	c, err := ParseSemverConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+
+	for _, l := range p.Links {
+		if l.TypeID == typeID {
+			versions = append(versions, l.Version)
+		}
+	}
+
+	version, err := c.Best(versions)
+	if err != nil {
+		return nil, fmt.Errorf("link %s: %w", typeID, err)
+	}
+
+	for i := range p.Links {
+		if p.Links[i].TypeID == typeID && p.Links[i].Version == version {
+			link := p.Links[i]
+			link.PackageID = p.ID
+
+			return &link, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ResolveModule picks the highest version of a package module that satisfies constraint
+func (p *Package) ResolveModule(id, constraint string) (*PackageModule, error) {
+	c, err := ParseSemverConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+
+	for _, m := range p.Modules {
+		if m.ID == id {
+			versions = append(versions, m.Version)
+		}
+	}
+
+	version, err := c.Best(versions)
+	if err != nil {
+		return nil, fmt.Errorf("module %s: %w", id, err)
+	}
+
+	for i := range p.Modules {
+		if p.Modules[i].ID == id && p.Modules[i].Version == version {
+			module := p.Modules[i]
+			module.PackageID = p.ID
+
+			return &module, nil
+		}
+	}
+
+	return nil, nil
+}
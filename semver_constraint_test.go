@@ -0,0 +1,168 @@
+package ctypes
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/google/uuid"
+)
+
+func TestSemverConstraint_Check(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		rejects    []string
+	}{
+		{"^1.2", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0", "1.3.0-beta"}},
+		{"^1.2.3", []string{"1.2.3", "1.4.0"}, []string{"1.2.2", "2.0.0"}},
+		{"^0.3.1", []string{"0.3.1", "0.3.9"}, []string{"0.4.0", "0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~0.3.1", []string{"0.3.1", "0.3.5"}, []string{"0.4.0", "0.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{">=1.0 <2.0", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{">= 1.0, < 2.0", nil, nil},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", []string{"1.2.9"}, []string{"1.3.0"}},
+		{"1.x", []string{"1.0.0", "1.5.2"}, []string{"2.0.0", "0.9.0"}},
+		{"1.2.*", []string{"1.2.7"}, []string{"1.3.0"}},
+		{"*", []string{"0.0.1", "9.9.9"}, []string{"1.0.0-alpha"}},
+		{"", []string{"0.0.1"}, nil},
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{"^1.0 || ^3.0", []string{"1.1.0", "3.2.0"}, []string{"2.0.0"}},
+		{"1.0 - 2.0", []string{"1.0.0", "2.0.9"}, []string{"2.1.0"}},
+		{">=1.0.0-beta <1.0.1", []string{"1.0.0-beta.2", "1.0.0"}, []string{"1.0.1-beta"}},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseSemverConstraint(tt.constraint)
+		if tt.matches == nil && tt.rejects == nil {
+			if err == nil {
+				t.Errorf("expected %q to be invalid", tt.constraint)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", tt.constraint, err)
+			continue
+		}
+
+		for _, v := range tt.matches {
+			if !c.Check(semver.MustParse(v)) {
+				t.Errorf("expected %q to match %s", tt.constraint, v)
+			}
+		}
+
+		for _, v := range tt.rejects {
+			if c.Check(semver.MustParse(v)) {
+				t.Errorf("expected %q not to match %s", tt.constraint, v)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"^a.b", "1.2.3.4", ">*", "~1.2.3-"} {
+		if _, err := ParseSemverConstraint(invalid); !errors.Is(err, ErrInvalidConstraint) {
+			t.Errorf("expected %q to be invalid, got %v", invalid, err)
+		}
+	}
+}
+
+func TestPackage_Resolve(t *testing.T) {
+	pkg := &Package{
+		DBPackage: DBPackage{ID: uuid.Must(uuid.NewRandom())},
+		Nodes: []DBNode{
+			{TypeID: "send", Version: "1.0.0"},
+			{TypeID: "send", Version: "1.4.2"},
+			{TypeID: "send", Version: "2.0.0"},
+			{TypeID: "other", Version: "1.9.0"},
+		},
+		Links:   []DBLink{{TypeID: "always", Version: "0.1.0"}, {TypeID: "always", Version: "0.2.0"}},
+		Modules: []PackageModule{{ID: "faq", Version: "1.0.0"}, {ID: "faq", Version: "1.1.0"}},
+	}
+
+	node, err := pkg.ResolveNode("send", "^1.0")
+	if err != nil || node.Version != "1.4.2" || node.PackageID != pkg.ID {
+		t.Errorf("expected send@1.4.2, got %+v %v", node, err)
+	}
+
+	link, err := pkg.ResolveLink("always", "~0.1")
+	if err != nil || link.Version != "0.1.0" {
+		t.Errorf("expected always@0.1.0, got %+v %v", link, err)
+	}
+
+	if _, err := pkg.ResolveNode("send", ">=3"); !errors.Is(err, ErrNoMatchingVersion) {
+		t.Errorf("expected ErrNoMatchingVersion, got %v", err)
+	}
+
+	// A lockfile pins the first resolution until the constraint or the package rules it out
+	sendConstraint, alwaysVersion := "^1.0", "0.2.0"
+	send, always, branch, stockVersion := "send", "always", "branch", "0.0.1"
+	moduleID := uuid.Must(uuid.NewRandom())
+
+	blueprint := &DBBlueprint{
+		ID:      uuid.Must(uuid.NewRandom()),
+		Version: INITIAL_VERSION,
+		Modules: DBModuleList{moduleID: {
+			ModuleID: moduleID,
+			Source:   &ModuleSource{PackageID: pkg.ID, ModuleID: "faq", Version: "1.0.0"},
+			Graph: GraphModule{
+				ID: moduleID,
+				Nodes: map[uuid.UUID]GraphNode{
+					uuid.Must(uuid.NewRandom()): {PackageID: pkg.ID, TypeID: &send, Version: &sendConstraint},
+					uuid.Must(uuid.NewRandom()): {PackageID: uuid.Nil, TypeID: &branch, Version: &stockVersion},
+				},
+				Links: []GraphLink{
+					{PackageID: pkg.ID, TypeID: always, Version: alwaysVersion},
+					{PackageID: uuid.Nil, TypeID: "basic", Version: stockVersion},
+				},
+			},
+		}},
+	}
+
+	lockfile, err := NewBotLockfile(blueprint, []Package{*pkg}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := lockfile.NodeVersion(pkg.ID, "send", "^1.0"); !ok || v != "1.4.2" {
+		t.Errorf("expected send to be locked to 1.4.2, got %s", v)
+	}
+
+	if v, ok := lockfile.LinkVersion(pkg.ID, "always", "0.2.0"); !ok || v != "0.2.0" {
+		t.Errorf("expected always to be locked to 0.2.0, got %s", v)
+	}
+
+	if v, ok := lockfile.ModuleVersion(moduleID); !ok || v != "1.0.0" {
+		t.Errorf("expected module to be locked to 1.0.0, got %s", v)
+	}
+
+	if _, ok := lockfile.NodeVersion(uuid.Nil, "branch", "0.0.1"); ok || len(lockfile.Packages) != 1 {
+		t.Errorf("expected stock nodes to be left out of the lockfile, got %+v", lockfile.Packages)
+	}
+
+	pkg.Nodes = append(pkg.Nodes, DBNode{TypeID: "send", Version: "1.5.0"})
+
+	relocked, err := NewBotLockfile(blueprint, []Package{*pkg}, lockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := relocked.NodeVersion(pkg.ID, "send", "^1.0"); v != "1.4.2" {
+		t.Errorf("expected lockfile to keep 1.4.2, got %s", v)
+	}
+
+	if v, _ := (*BotLockfile)(nil).NodeVersion(pkg.ID, "send", "^1.0"); v != "" {
+		t.Error("expected nil lockfile to have no versions")
+	}
+
+	fresh, err := NewBotLockfile(blueprint, []Package{*pkg}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := fresh.NodeVersion(pkg.ID, "send", "^1.0"); v != "1.5.0" {
+		t.Errorf("expected a fresh lockfile to pick 1.5.0, got %s", v)
+	}
+}
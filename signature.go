@@ -0,0 +1,307 @@
+package ctypes
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Signature headers sent with every request made to a package
+const (
+	HeaderSignature        = "X-Convai-Signature"         // Legacy (v1) signature, HMAC-SHA512 of the body only
+	HeaderSignatureV2      = "X-Convai-Signature-V2"      // HMAC-SHA512 of the v2 signing payload, see signingPayloadV2
+	HeaderSignatureVersion = "X-Convai-Signature-Version" // The highest signature version present on the request
+	HeaderTimestamp        = "X-Convai-Timestamp"         // Unix timestamp (seconds) of when the request was signed
+	HeaderRequestID        = "X-Convai-Request-ID"        // Unique id of the request, used to prevent replays
+)
+
+const (
+	SignatureV1 = 1
+	SignatureV2 = 2
+)
+
+// DefaultSignatureTolerance is how far a v2 timestamp may drift from the verifier's clock
+const DefaultSignatureTolerance = 5 * time.Minute
+
+var (
+	ErrSignatureMissing = errors.New("request signature missing")
+	ErrSignatureInvalid = errors.New("request signature invalid")
+	ErrSignatureExpired = errors.New("request timestamp outside of tolerance window")
+	ErrRequestReplayed  = errors.New("request id has already been used")
+	ErrNoSigningKeys    = errors.New("no signing keys available to verify request")
+)
+
+// SignRequest adds both the legacy and v2 signature headers to a request
+// Packages that have not yet been upgraded will continue to verify the v1 signature
+func SignRequest(req *http.Request, body []byte, key string) {
+	timestamp := time.Now().Unix()
+	requestID := uuid.Must(uuid.NewRandom())
+
+	req.Header.Set(HeaderSignature, getSignature(body, key))
+	req.Header.Set(HeaderSignatureV2, getSignatureV2(req.Method, req.URL.RequestURI(), body, key, timestamp, requestID))
+	req.Header.Set(HeaderSignatureVersion, strconv.Itoa(SignatureV2))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderRequestID, requestID.String())
+}
+
+// signingPayloadV2 binds the timestamp, request id, method and path to the body so none of them can be swapped out
+// A signed body can therefore not be replayed against a different endpoint of the package
+func signingPayloadV2(method, requestURI string, body []byte, timestamp int64, requestID uuid.UUID) []byte {
+	prefix := fmt.Sprintf("v2:%d:%s:%s:%s:", timestamp, requestID, method, requestURI)
+	return append([]byte(prefix), body...)
+}
+
+func getSignature(body []byte, key string) string {
+	mac := hmac.New(sha512.New, []byte(key))
+	mac.Write(body)
+	hash := mac.Sum(nil)
+
+	return base64.StdEncoding.EncodeToString(hash)
+}
+
+func getSignatureV2(method, requestURI string, body []byte, key string, timestamp int64, requestID uuid.UUID) string {
+	return getSignature(signingPayloadV2(method, requestURI, body, timestamp, requestID), key)
+}
+
+// signatureMatches compares the provided base64 signature against the expected one in constant time
+func signatureMatches(provided, expected string) bool {
+	return hmac.Equal([]byte(provided), []byte(expected))
+}
+
+// GenerateSigningKey returns a random key suitable for DBPackage.SigningKey
+func GenerateSigningKey() (string, error) {
+	key := make([]byte, 48)
+
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// ReplayCache remembers request ids until they expire, so a captured request cannot be sent twice
+type ReplayCache interface {
+	// Seen records the request id and reports whether it had already been recorded
+	Seen(requestID string, expiresAt time.Time) bool
+}
+
+// MemoryReplayCache is a ReplayCache for a single process
+type MemoryReplayCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	lastGC  time.Time
+}
+
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		entries: map[string]time.Time{},
+	}
+}
+
+func (c *MemoryReplayCache) Seen(requestID string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	// Periodically drop expired entries so the cache does not grow forever
+	if now.Sub(c.lastGC) > time.Minute {
+		for id, exp := range c.entries {
+			if now.After(exp) {
+				delete(c.entries, id)
+			}
+		}
+
+		c.lastGC = now
+	}
+
+	if exp, ok := c.entries[requestID]; ok && now.Before(exp) {
+		return true
+	}
+
+	c.entries[requestID] = expiresAt
+
+	return false
+}
+
+// RequestVerifier verifies signatures on requests made by Convai
+type RequestVerifier struct {
+	// Keys that may have signed the request. During a key rotation both the new and previous key should be present
+	Keys []string
+
+	// Tolerance is the maximum allowed difference between the request timestamp and the current time
+	Tolerance time.Duration
+
+	// Replays tracks request ids that have already been verified. If nil, replay protection is disabled
+	Replays ReplayCache
+
+	// AllowLegacy accepts v1 (body only) signatures from requests that have no v2 signature
+	AllowLegacy bool
+
+	now func() time.Time
+}
+
+// NewRequestVerifier creates a verifier with the default tolerance and an in memory replay cache
+func NewRequestVerifier(keys ...string) *RequestVerifier {
+	return &RequestVerifier{
+		Keys:      keys,
+		Tolerance: DefaultSignatureTolerance,
+		Replays:   NewMemoryReplayCache(),
+	}
+}
+
+// sharedReplays is the replay cache used by VerifyRequest. Request ids are random uuids, so requests for different
+// keys can share it
+var sharedReplays = NewMemoryReplayCache()
+
+// VerifyRequest checks the signature of a request made by Convai using any of the provided keys
+// Request ids are remembered for the process, so a captured request is rejected the second time it is seen
+// The request body is read and replaced, so it can still be consumed by the handler
+func VerifyRequest(r *http.Request, keys ...string) error {
+	return (&RequestVerifier{Keys: keys, Tolerance: DefaultSignatureTolerance, Replays: sharedReplays}).Verify(r)
+}
+
+// Verify checks the signature of a request, restoring the body afterwards
+func (v *RequestVerifier) Verify(r *http.Request) error {
+	body, err := readAndRestoreBody(r)
+	if err != nil {
+		return err
+	}
+
+	return v.VerifyBody(r.Method, r.URL.RequestURI(), r.Header, body)
+}
+
+// VerifyBody checks the signature headers against an already read body
+// requestURI is the path and query the request was sent to, as returned by url.URL.RequestURI
+func (v *RequestVerifier) VerifyBody(method, requestURI string, header http.Header, body []byte) error {
+	if len(v.Keys) == 0 {
+		return ErrNoSigningKeys
+	}
+
+	if header.Get(HeaderSignatureV2) == "" {
+		if v.AllowLegacy && header.Get(HeaderSignature) != "" {
+			return v.verifyV1(header, body)
+		}
+
+		return ErrSignatureMissing
+	}
+
+	return v.verifyV2(method, requestURI, header, body)
+}
+
+func (v *RequestVerifier) verifyV1(header http.Header, body []byte) error {
+	provided := header.Get(HeaderSignature)
+
+	for _, key := range v.Keys {
+		if key != "" && signatureMatches(provided, getSignature(body, key)) {
+			return nil
+		}
+	}
+
+	return ErrSignatureInvalid
+}
+
+func (v *RequestVerifier) verifyV2(method, requestURI string, header http.Header, body []byte) error {
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return ErrSignatureMissing
+	}
+
+	requestID, err := uuid.Parse(header.Get(HeaderRequestID))
+	if err != nil {
+		return ErrSignatureMissing
+	}
+
+	tolerance := v.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultSignatureTolerance
+	}
+
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-tolerance)) || signedAt.After(now.Add(tolerance)) {
+		return ErrSignatureExpired
+	}
+
+	provided := header.Get(HeaderSignatureV2)
+	valid := false
+
+	for _, key := range v.Keys {
+		if key != "" && signatureMatches(provided, getSignatureV2(method, requestURI, body, key, timestamp, requestID)) {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return ErrSignatureInvalid
+	}
+
+	// Only record the request id once the signature is known to be good, otherwise anyone could burn ids
+	// The id has to be remembered for as long as the timestamp would still be accepted
+	if v.Replays != nil && v.Replays.Seen(requestID.String(), signedAt.Add(tolerance)) {
+		return ErrRequestReplayed
+	}
+
+	return nil
+}
+
+// Middleware wraps a net/http handler, rejecting any request without a valid signature
+func (v *RequestVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			apiErr := SignatureError(err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(apiErr.HTTPStatusCode())
+			_ = json.NewEncoder(w).Encode(apiErr)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GinMiddleware returns a gin handler that aborts any request without a valid signature
+func (v *RequestVerifier) GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := v.Verify(c.Request); err != nil {
+			SignatureError(err).AbortGin(c)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func readAndRestoreBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
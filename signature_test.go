@@ -0,0 +1,176 @@
+package ctypes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newSignedRequest(t *testing.T, body, key string) *http.Request {
+	req, err := http.NewRequest("POST", "http://package.test/nodes/execute", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SignRequest(req, []byte(body), key)
+
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := `{"calls":[]}`
+	req := newSignedRequest(t, body, "bubbles")
+
+	if err := VerifyRequest(req, "bubbles"); err != nil {
+		t.Errorf("expected valid signature, got %v", err)
+	}
+
+	// The body must still be readable by the handler
+	rb, _ := ioutil.ReadAll(req.Body)
+	if string(rb) != body {
+		t.Errorf("expected body to be restored, got %q", rb)
+	}
+
+	replay, _ := http.NewRequest("POST", "http://package.test/nodes/execute", bytes.NewReader([]byte(body)))
+	replay.Header = req.Header.Clone()
+
+	if err := VerifyRequest(replay, "bubbles"); err != ErrRequestReplayed {
+		t.Errorf("expected ErrRequestReplayed, got %v", err)
+	}
+
+	if err := VerifyRequest(newSignedRequest(t, body, "bubbles"), "not-bubbles"); err != ErrSignatureInvalid {
+		t.Errorf("expected ErrSignatureInvalid, got %v", err)
+	}
+
+	tampered := newSignedRequest(t, body, "bubbles")
+	tampered.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"calls":[{}]}`)))
+	if err := VerifyRequest(tampered, "bubbles"); err != ErrSignatureInvalid {
+		t.Errorf("expected tampered body to fail, got %v", err)
+	}
+}
+
+func TestRequestVerifier_KeyRotation(t *testing.T) {
+	pkg := DBPackage{SigningKey: "old"}
+	req := newSignedRequest(t, "{}", pkg.SigningKey)
+
+	pkg.RotateSigningKey("new")
+
+	if err := pkg.RequestVerifier().Verify(req); err != nil {
+		t.Errorf("expected request signed with previous key to verify, got %v", err)
+	}
+
+	pkg.FinishKeyRotation()
+
+	if err := pkg.RequestVerifier().Verify(newSignedRequest(t, "{}", "old")); err != ErrSignatureInvalid {
+		t.Errorf("expected previous key to be rejected after rotation finished, got %v", err)
+	}
+}
+
+func TestRequestVerifier_Tolerance(t *testing.T) {
+	v := NewRequestVerifier("bubbles")
+	v.Tolerance = time.Minute
+	v.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	if err := v.Verify(newSignedRequest(t, "{}", "bubbles")); err != ErrSignatureExpired {
+		t.Errorf("expected ErrSignatureExpired, got %v", err)
+	}
+
+	// Moving the timestamp forward invalidates the signature
+	req := newSignedRequest(t, "{}", "bubbles")
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10))
+	if err := v.Verify(req); err != ErrSignatureInvalid {
+		t.Errorf("expected ErrSignatureInvalid, got %v", err)
+	}
+}
+
+func TestRequestVerifier_Replay(t *testing.T) {
+	v := NewRequestVerifier("bubbles")
+	req := newSignedRequest(t, "{}", "bubbles")
+
+	if err := v.Verify(req); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, _ := http.NewRequest("POST", "http://package.test/nodes/execute", bytes.NewReader([]byte("{}")))
+	replay.Header = req.Header.Clone()
+
+	if err := v.Verify(replay); err != ErrRequestReplayed {
+		t.Errorf("expected ErrRequestReplayed, got %v", err)
+	}
+}
+
+func TestRequestVerifier_Endpoint(t *testing.T) {
+	v := NewRequestVerifier("bubbles")
+
+	for _, target := range []string{"http://package.test/links/execute", "http://package.test/nodes/execute?mock=1"} {
+		req := newSignedRequest(t, "{}", "bubbles")
+
+		moved, _ := http.NewRequest("POST", target, bytes.NewReader([]byte("{}")))
+		moved.Header = req.Header.Clone()
+
+		if err := v.Verify(moved); err != ErrSignatureInvalid {
+			t.Errorf("expected request sent to %s to fail, got %v", target, err)
+		}
+	}
+
+	req := newSignedRequest(t, "{}", "bubbles")
+	req.Method = "PUT"
+
+	if err := v.Verify(req); err != ErrSignatureInvalid {
+		t.Errorf("expected request with another method to fail, got %v", err)
+	}
+}
+
+func TestRequestVerifier_Legacy(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://package.test/", bytes.NewReader([]byte("{}")))
+	req.Header.Set(HeaderSignature, getSignature([]byte("{}"), "bubbles"))
+
+	v := NewRequestVerifier("bubbles")
+
+	if err := v.Verify(req); err != ErrSignatureMissing {
+		t.Errorf("expected legacy signature to be rejected by default, got %v", err)
+	}
+
+	v.AllowLegacy = true
+
+	if err := v.Verify(req); err != nil {
+		t.Errorf("expected legacy signature to be accepted, got %v", err)
+	}
+}
+
+func TestRequestVerifier_Middleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	v := NewRequestVerifier("bubbles")
+
+	router := gin.New()
+	router.Use(v.GinMiddleware())
+	router.POST("/nodes/execute", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	handlers := map[string]http.Handler{
+		"gin":      router,
+		"net/http": v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+	}
+
+	for name, h := range handlers {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newSignedRequest(t, "{}", "bubbles"))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", name, rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, newSignedRequest(t, "{}", "wrong"))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, rec.Code)
+		}
+	}
+}